@@ -0,0 +1,57 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command hidden_features turns a data file into a file of the hidden
+// features P(h|X) of a model, dense or sparse, for training other models.
+package main
+
+import (
+	"flag"
+	"log"
+	"rbm"
+)
+
+func main() {
+	model_file := flag.String("model", "", "file of the model")
+	data_file := flag.String("data", "", "input data")
+	vocabulary_file := flag.String("vocab", "", "vocabulary of the feature values, if they are not integers")
+	hasher_file := flag.String("hasher", "", "feature hasher of the feature values, if they are not integers")
+	output_file := flag.String("output", "", "file to write the hidden features to")
+	given_label := flag.Bool("given_label", false, "condition the features on the labels of the instances instead of summing them out")
+	min_activation := flag.Float64("min_activation", 0, "only write the features of at least this activation, 0 for dense features")
+	flag.Parse()
+	if *vocabulary_file != "" && *hasher_file != "" {
+		log.Fatalf("Only one of -vocab and -hasher can be given.")
+	}
+
+	model, err := rbm.LoadModelFromFile(*model_file)
+	if err != nil {
+		log.Fatalf("Failed to load model: %s", err)
+	}
+	var encoder rbm.FeatureEncoder
+	if *vocabulary_file != "" {
+		vocabulary, err := rbm.LoadVocabularyFromFile(*vocabulary_file)
+		if err != nil {
+			log.Fatalf("Failed to load vocabulary: %s", err)
+		}
+		encoder = vocabulary
+	}
+	if *hasher_file != "" {
+		hasher, err := rbm.LoadFeatureHasherFromFile(*hasher_file)
+		if err != nil {
+			log.Fatalf("Failed to load feature hasher: %s", err)
+		}
+		encoder = hasher
+	}
+	data := rbm.NewModelInstanceLoader(*data_file, model, encoder)
+	if data == nil {
+		log.Fatalf("Failed to open %s.", *data_file)
+	}
+	defer data.Close()
+
+	if err := rbm.WriteHiddenFeaturesToFile(*output_file, model, data, *given_label,
+		rbm.WeightT(*min_activation)); err != nil {
+		log.Fatalf("Failed to write hidden features: %s", err)
+	}
+}
@@ -2,33 +2,217 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Parameter server of Downpour SGD, following Dean et al., 2012, Large Scale
+// Distributed Deep Networks: each ModelServer owns one shard of the
+// parameters of a SparseClassRBM (see rbm.ParameterShard), which the workers
+// pull and to which they push their gradients asynchronously over HTTP:
+//  GET  /parameters: the parameters of the shard
+//  POST /gradient:   applies the gradient in the request body
+//  GET  /status:     the number of updates and training instances so far
+
 package platform
 
 import (
+	"bytes"
+	"common/util"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"rbm"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 type ModelServer struct {
 	local_addr string
+	model      *rbm.SparseClassRBM //full model, holding only the parameters of the shard
+	shard      *rbm.ParameterShard //nil if no model is served
+	mutex      sync.Mutex          //guards shard
+}
+
+// serverConfig holds the settings of a ModelServer, read from a config file
+// with one "key value" pair per line; lines starting with # are comments.
+//  address              listening address, :8080 by default
+//  model                file of the initial model
+//  shard, num_shards    the shard of the parameters served
+//  learning_rate, regularization_rate, momentum_rate
+//                       parameters of the updates, see RBMTrainer.Initialize
+type serverConfig struct {
+	address             string
+	model_file          string
+	shard               int
+	num_shards          int
+	learning_rate       rbm.WeightT
+	regularization_rate rbm.WeightT
+	momentum_rate       rbm.WeightT
 }
 
+// NewModelServer creates a server with the settings of the given config file,
+// a server answering "hello, world!" if config_file is "". It returns nil if
+// the settings cannot be loaded.
 func NewModelServer(config_file string) *ModelServer {
 	var server ModelServer
 	server.local_addr = ":8080"
-	(&server).loadConfig(config_file)
+	if err := (&server).loadConfig(config_file); err != nil {
+		log.Printf("Failed to load config %s: %s", config_file, err)
+		return nil
+	}
 	return &server
 }
 
+// NewParameterServer creates a server at the given address, serving shard
+// shard of num_shards of the given model; the parameters of the other shards
+// are dropped from the model.
+func NewParameterServer(address string, model *rbm.SparseClassRBM, shard, num_shards int,
+	learning_rate, regularization_rate, momentum_rate rbm.WeightT) *ModelServer {
+	return &ModelServer{
+		local_addr: address,
+		model:      model,
+		shard: rbm.NewParameterShard(model, shard, num_shards, learning_rate,
+			regularization_rate, momentum_rate),
+	}
+}
+
+// Start serves requests until an error occurs.
 func (server *ModelServer) Start() {
-	http.HandleFunc("/", server.serveHome)
-	http.ListenAndServe(server.local_addr, nil)
+	if err := http.ListenAndServe(server.local_addr, server.Handler()); err != nil {
+		log.Printf("Server at %s stopped: %s", server.local_addr, err)
+	}
+}
+
+// Handler returns the handler of the requests to the server.
+func (server *ModelServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.serveHome)
+	if server.shard != nil {
+		mux.HandleFunc("/parameters", server.serveParameters)
+		mux.HandleFunc("/gradient", server.serveGradient)
+		mux.HandleFunc("/status", server.serveStatus)
+	}
+	return mux
 }
 
-func (server *ModelServer) loadConfig(config_file string) {
+func (server *ModelServer) loadConfig(config_file string) error {
+	if config_file == "" {
+		return nil
+	}
+	config := serverConfig{address: server.local_addr, num_shards: 1}
+	err := util.ForEachLineInFile(config_file, func(line string) (bool, error) {
+		if line == "" || strings.HasPrefix(line, "#") {
+			return true, nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return false, fmt.Errorf("Invalid config line: %q.", line)
+		}
+		if err := config.set(fields[0], fields[1]); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if config.model_file == "" {
+		server.local_addr = config.address
+		return nil
+	}
+	if config.shard < 0 || config.shard >= config.num_shards {
+		return fmt.Errorf("Invalid shard %d of %d.", config.shard, config.num_shards)
+	}
+	model, err := rbm.LoadModelFromFile(config.model_file)
+	if err != nil {
+		return err
+	}
+	server.local_addr = config.address
+	server.model = model
+	server.shard = rbm.NewParameterShard(model, config.shard, config.num_shards,
+		config.learning_rate, config.regularization_rate, config.momentum_rate)
+	return nil
+}
 
+// set sets the setting of the given key.
+func (config *serverConfig) set(key, value string) error {
+	var err error
+	var f float64
+	switch key {
+	case "address":
+		config.address = value
+	case "model":
+		config.model_file = value
+	case "shard":
+		config.shard, err = strconv.Atoi(value)
+	case "num_shards":
+		config.num_shards, err = strconv.Atoi(value)
+	case "learning_rate", "regularization_rate", "momentum_rate":
+		if f, err = strconv.ParseFloat(value, 64); err != nil {
+			break
+		}
+		switch key {
+		case "learning_rate":
+			config.learning_rate = rbm.WeightT(f)
+		case "regularization_rate":
+			config.regularization_rate = rbm.WeightT(f)
+		default:
+			config.momentum_rate = rbm.WeightT(f)
+		}
+	default:
+		return fmt.Errorf("Unknown config key: %s.", key)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid value of %s: %s.", key, value)
+	}
+	return nil
 }
 
 func (server *ModelServer) serveHome(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, "hello, world!\n")
 }
+
+func (server *ModelServer) serveParameters(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Expected GET.", http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	server.mutex.Lock()
+	err := server.shard.Write(&buf)
+	server.mutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("Failed to send parameters: %s", err)
+	}
+}
+
+func (server *ModelServer) serveGradient(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Expected POST.", http.StatusMethodNotAllowed)
+		return
+	}
+	gradient, err := rbm.ReadGradient(req.Body, server.model)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	server.mutex.Lock()
+	err = server.shard.Apply(gradient)
+	server.mutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *ModelServer) serveStatus(w http.ResponseWriter, req *http.Request) {
+	server.mutex.Lock()
+	updates, instances := server.shard.Updates(), server.shard.Instances()
+	server.mutex.Unlock()
+	fmt.Fprintf(w, "updates\t%d\ninstances\t%d\n", updates, instances)
+}
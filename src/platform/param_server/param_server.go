@@ -0,0 +1,30 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command param_server serves one shard of the parameters of a model for
+// distributed training, with the settings of a config file, e.g.
+//  address              :8080
+//  model                model.bin
+//  shard                0
+//  num_shards           2
+//  learning_rate        0.01
+//  regularization_rate  0.0001
+//  momentum_rate        0
+package main
+
+import (
+	"flag"
+	"log"
+	"platform"
+)
+
+func main() {
+	config_file := flag.String("config", "", "config file of the server")
+	flag.Parse()
+	server := platform.NewModelServer(*config_file)
+	if server == nil {
+		log.Fatalf("Failed to create server.")
+	}
+	server.Start()
+}
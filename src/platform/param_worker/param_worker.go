@@ -0,0 +1,76 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command param_worker trains a model with parameter servers on a local data
+// file, and optionally saves the trained model pulled from the servers.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"platform"
+	"rbm"
+	"strings"
+	"time"
+)
+
+func main() {
+	servers := flag.String("servers", "http://localhost:8080",
+		"comma separated URLs of the parameter servers, in the order of their shards")
+	model_file := flag.String("model", "", "file of the initial model, for its dimensions")
+	data_file := flag.String("data", "", "local training data")
+	vocabulary_file := flag.String("vocab", "", "vocabulary of the feature values, if they are not integers")
+	epochs := flag.Int("epochs", 1, "number of passes over the local data")
+	push_interval := flag.Int("push", 100, "number of instances per pushed gradient")
+	fetch_interval := flag.Int("fetch", 1, "number of pushes between fetches of the parameters")
+	gen_learn_importance := flag.Float64("gen_importance", 0, "importance of the generative objective")
+	gibbs_chain_length := flag.Int("gibbs", 1, "length of the Gibbs chains of CD-k")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed of the random number generator")
+	output_file := flag.String("output", "", "file to save the trained model to")
+	flag.Parse()
+
+	model, err := rbm.LoadModelFromFile(*model_file)
+	if err != nil {
+		log.Fatalf("Failed to load model: %s", err)
+	}
+	var encoder rbm.FeatureEncoder
+	if *vocabulary_file != "" {
+		vocabulary, err := rbm.LoadVocabularyFromFile(*vocabulary_file)
+		if err != nil {
+			log.Fatalf("Failed to load vocabulary: %s", err)
+		}
+		encoder = vocabulary
+	}
+	data := rbm.NewModelInstanceLoader(*data_file, model, encoder)
+	if data == nil {
+		log.Fatalf("Failed to open %s.", *data_file)
+	}
+	defer data.Close()
+
+	server_urls := strings.Split(*servers, ",")
+	worker := platform.NewWorker(server_urls, model, data, rbm.WeightT(*gen_learn_importance),
+		*gibbs_chain_length)
+	worker.SetIntervals(*push_interval, *fetch_interval)
+	worker.Trainer().SetSeed(*seed)
+	for epoch := 0; epoch < *epochs; epoch++ {
+		start := time.Now()
+		instances, err := worker.RunEpoch()
+		if err != nil {
+			log.Fatalf("Epoch %d failed: %s", epoch, err)
+		}
+		elapsed := time.Since(start).Seconds()
+		fmt.Printf("Epoch: %d\nInstances: %d in %.3fs, %.1f instances/s\n", epoch, instances,
+			elapsed, float64(instances)/elapsed)
+	}
+	if *output_file != "" {
+		if err := platform.PullModel(http.DefaultClient, server_urls, model); err != nil {
+			log.Fatalf("Failed to pull model: %s", err)
+		}
+		if err := model.SaveModelToFile(*output_file); err != nil {
+			log.Fatalf("Failed to save model: %s", err)
+		}
+	}
+}
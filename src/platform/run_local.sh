@@ -0,0 +1,89 @@
+#!/bin/sh
+# Copyright 2013 Weidong Liang. All rights reserved.
+# Use of this source code is governed by a BSD-style
+# license that can be found in the LICENSE file.
+#
+# Runs Downpour SGD on the local machine, with one process per parameter
+# server and per worker, the training data being split evenly among the
+# workers:
+#  run_local.sh model_file data_file output_file [num_shards] [num_workers] [epochs]
+# GOPATH must point to the root of the repository. Further worker flags, e.g.
+# -push or -gen_importance, can be given in WORKER_FLAGS, and the learning
+# parameters of the servers in LEARNING_RATE, REGULARIZATION_RATE and
+# MOMENTUM_RATE.
+
+set -e
+
+if [ $# -lt 3 ]; then
+	echo "usage: $0 model_file data_file output_file [num_shards] [num_workers] [epochs]" >&2
+	exit 1
+fi
+model_file=$1
+data_file=$2
+output_file=$3
+num_shards=${4:-2}
+num_workers=${5:-4}
+epochs=${6:-1}
+base_port=${BASE_PORT:-18080}
+
+work_dir=$(mktemp -d)
+server_pids=""
+cleanup() {
+	[ -n "$server_pids" ] && kill $server_pids 2>/dev/null
+	rm -rf "$work_dir"
+}
+trap cleanup EXIT
+
+GO111MODULE=off go build -o "$work_dir/param_server" platform/param_server
+GO111MODULE=off go build -o "$work_dir/param_worker" platform/param_worker
+
+servers=""
+shard=0
+while [ $shard -lt $num_shards ]; do
+	port=$((base_port + shard))
+	config="$work_dir/server_$shard.conf"
+	cat > "$config" <<EOF
+address             localhost:$port
+model               $model_file
+shard               $shard
+num_shards          $num_shards
+learning_rate       ${LEARNING_RATE:-0.01}
+regularization_rate ${REGULARIZATION_RATE:-0}
+momentum_rate       ${MOMENTUM_RATE:-0}
+EOF
+	"$work_dir/param_server" -config "$config" &
+	server_pids="$server_pids $!"
+	servers="$servers${servers:+,}http://localhost:$port"
+	shard=$((shard + 1))
+done
+
+# Wait for the servers to listen.
+for server in $(echo "$servers" | tr ',' ' '); do
+	until curl -s -o /dev/null "$server/status"; do
+		sleep 0.1
+	done
+done
+
+split -n l/$num_workers -d "$data_file" "$work_dir/data_"
+worker_pids=""
+for data in "$work_dir"/data_*; do
+	"$work_dir/param_worker" -servers "$servers" -model "$model_file" -data "$data" \
+		-epochs "$epochs" $WORKER_FLAGS > "$data.log" 2>&1 &
+	worker_pids="$worker_pids $!"
+done
+failed=0
+for pid in $worker_pids; do
+	wait $pid || failed=1
+done
+cat "$work_dir"/data_*.log
+if [ $failed -ne 0 ]; then
+	echo "Some workers failed." >&2
+	exit 1
+fi
+
+"$work_dir/param_worker" -servers "$servers" -model "$model_file" -data /dev/null -epochs 0 \
+	-output "$output_file"
+for server in $(echo "$servers" | tr ',' ' '); do
+	echo "$server:"
+	curl -s "$server/status"
+done
@@ -0,0 +1,141 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Worker of Downpour SGD: it computes gradients on its local training data
+// with a replica of the model, pushes them to the parameter servers and
+// refreshes its replica from them, without waiting for the other workers.
+
+package platform
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"rbm"
+	"time"
+)
+
+const (
+	kDefaultPushInterval  = 100 //number of instances per pushed gradient
+	kDefaultFetchInterval = 1   //number of pushes between two fetches of the parameters
+)
+
+// Worker trains a model with the parameter servers, servers[i] serving shard
+// i of len(servers) shards.
+type Worker struct {
+	servers        []string            //base URLs of the parameter servers, e.g. http://localhost:8080
+	model          *rbm.SparseClassRBM //replica of the model
+	trainer        rbm.RBMTrainer      //computes the gradients of the replica
+	data           rbm.DataInstanceAccessor
+	push_interval  int
+	fetch_interval int
+	client         *http.Client
+}
+
+// NewWorker creates a worker training on the given data, model being a model
+// of the same dimensions as those of the servers, whose parameters are
+// replaced by those of the servers. gen_learn_importance and
+// gibbs_chain_length are as in RBMTrainer.Initialize; the learning rate,
+// regularization and momentum are those of the servers.
+func NewWorker(servers []string, model *rbm.SparseClassRBM, data rbm.DataInstanceAccessor,
+	gen_learn_importance rbm.WeightT, gibbs_chain_length int) *Worker {
+	worker := &Worker{
+		servers:        servers,
+		model:          model,
+		data:           data,
+		push_interval:  kDefaultPushInterval,
+		fetch_interval: kDefaultFetchInterval,
+		client:         &http.Client{Timeout: time.Minute},
+	}
+	worker.trainer.Initialize(model, data, nil, 0, 0, 0, gen_learn_importance, gibbs_chain_length)
+	return worker
+}
+
+// SetIntervals makes the worker push a gradient every push_interval training
+// instances and fetch the parameters every fetch_interval pushes, n_push and
+// n_fetch in Downpour SGD.
+func (worker *Worker) SetIntervals(push_interval, fetch_interval int) {
+	if push_interval < 1 || fetch_interval < 1 {
+		panic(fmt.Sprintf("Expected positive intervals but got %d and %d.", push_interval, fetch_interval))
+	}
+	worker.push_interval = push_interval
+	worker.fetch_interval = fetch_interval
+}
+
+// Trainer returns the trainer computing the gradients, e.g. for seeding it.
+func (worker *Worker) Trainer() *rbm.RBMTrainer {
+	return &worker.trainer
+}
+
+// RunEpoch trains over all the local data once, returning the number of
+// training instances processed.
+func (worker *Worker) RunEpoch() (int, error) {
+	defer worker.data.Reset()
+	instances := 0
+	for pushes := 0; ; pushes++ {
+		if pushes%worker.fetch_interval == 0 {
+			if err := PullModel(worker.client, worker.servers, worker.model); err != nil {
+				return instances, err
+			}
+		}
+		gradient, err := worker.trainer.ComputeGradient(worker.push_interval)
+		if err == io.EOF {
+			return instances, nil
+		} else if err != nil {
+			return instances, err
+		}
+		for shard, part := range gradient.Split(len(worker.servers)) {
+			if err := pushGradient(worker.client, worker.servers[shard], part); err != nil {
+				return instances, err
+			}
+		}
+		instances += gradient.Instances()
+	}
+}
+
+// PullModel replaces the parameters of model by those of the parameter
+// servers, servers[i] serving shard i.
+func PullModel(client *http.Client, servers []string, model *rbm.SparseClassRBM) error {
+	for _, server := range servers {
+		resp, err := client.Get(server + "/parameters")
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = responseError(resp)
+		} else {
+			err = model.ReadParameterShard(resp.Body)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to pull parameters from %s: %s", server, err)
+		}
+	}
+	return nil
+}
+
+// pushGradient sends the gradient to the given parameter server.
+func pushGradient(client *http.Client, server string, gradient *rbm.Gradient) error {
+	var buf bytes.Buffer
+	if err := gradient.Write(&buf); err != nil {
+		return err
+	}
+	resp, err := client.Post(server+"/gradient", "application/octet-stream", &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Failed to push gradient to %s: %s", server, responseError(resp))
+	}
+	return nil
+}
+
+// responseError returns the error reported in an HTTP response.
+func responseError(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+}
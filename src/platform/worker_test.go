@@ -0,0 +1,127 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"bufio"
+	"common/util"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"rbm"
+	"sync"
+	"testing"
+)
+
+// newTestModel returns a model over 3 classes whose label is given by class 0.
+func newTestModel() *rbm.SparseClassRBM {
+	var model rbm.SparseClassRBM
+	model.Initialize([]int{2, 3, 4}, [][]rbm.WeightT{{0, 0}, {0, 0, 0}, {0, 0, 0, 0}}, 6, 0)
+	return &model
+}
+
+func saveTestData(filename string, offset, n int) error {
+	return util.WithNewOpenFileAsBufioWriter(filename, func(w *bufio.Writer) error {
+		for i := offset; i < offset+n; i++ {
+			fmt.Fprintf(w, "%d\t%d\t0:%d\t1:%d\t2:%d\n", 1-i%2, i%2, i%2, i%3, i%4)
+		}
+		return nil
+	})
+}
+
+func Test_DownpourTraining(t *testing.T) {
+	const num_shards, num_workers = 2, 3
+	initial := newTestModel()
+	var servers []string
+	for shard := 0; shard < num_shards; shard++ {
+		model := cloneModel(t, initial)
+		server := NewParameterServer("", model, shard, num_shards, 1, 0, 0.5)
+		http_server := httptest.NewServer(server.Handler())
+		defer http_server.Close()
+		servers = append(servers, http_server.URL)
+	}
+
+	var wg sync.WaitGroup
+	errors := make([]error, num_workers)
+	for i := 0; i < num_workers; i++ {
+		data_file := fmt.Sprintf("downpour_data_%d.txt", i)
+		if err := saveTestData(data_file, 100*i, 100); err != nil {
+			t.Fatalf("Failed to save data: %s.", err)
+		}
+		defer os.Remove(data_file)
+		model := cloneModel(t, initial)
+		data := rbm.NewModelInstanceLoader(data_file, model, nil)
+		defer data.Close()
+		worker := NewWorker(servers, model, data, 0.1, 1)
+		worker.SetIntervals(10, 2)
+		worker.Trainer().SetSeed(int64(i))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for epoch := 0; epoch < 5 && errors[i] == nil; epoch++ {
+				_, errors[i] = worker.RunEpoch()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errors {
+		if err != nil {
+			t.Fatalf("Worker %d failed: %s.", i, err)
+		}
+	}
+
+	resp, err := http.Get(servers[0] + "/status")
+	if err != nil {
+		t.Fatalf("Failed to get status: %s.", err)
+	}
+	status, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if expected := "updates\t150\ninstances\t1500\n"; string(status) != expected {
+		t.Errorf("Expected status %q but got %q.", expected, status)
+	}
+
+	trained := cloneModel(t, initial)
+	if err := PullModel(http.DefaultClient, servers, trained); err != nil {
+		t.Fatalf("Failed to pull model: %s.", err)
+	}
+	validation_file := "downpour_validation.txt"
+	saveTestData(validation_file, 0, 100)
+	defer os.Remove(validation_file)
+	validation := rbm.NewModelInstanceLoader(validation_file, trained, nil)
+	defer validation.Close()
+	if auc := rbm.ROCAuc(trained, validation); math.IsNaN(auc) || auc < 0.9 {
+		t.Errorf("Expected the trained model to separate the labels but got AUC %f.", auc)
+	}
+}
+
+func Test_ModelServerRejectsInvalidGradient(t *testing.T) {
+	server := NewParameterServer("", newTestModel(), 0, 1, 0.1, 0, 0)
+	http_server := httptest.NewServer(server.Handler())
+	defer http_server.Close()
+	resp, err := http.Post(http_server.URL+"/gradient", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatalf("Failed to post: %s.", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d but got %d.", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func cloneModel(t *testing.T, model *rbm.SparseClassRBM) *rbm.SparseClassRBM {
+	model_file := "downpour_model.bin"
+	defer os.Remove(model_file)
+	if err := model.SaveModelToFile(model_file); err != nil {
+		t.Fatalf("Failed to save model: %s.", err)
+	}
+	clone, err := rbm.LoadModelFromFile(model_file)
+	if err != nil {
+		t.Fatalf("Failed to load model: %s.", err)
+	}
+	return clone
+}
@@ -6,6 +6,10 @@
 
 package rbm
 
+import (
+	"fmt"
+)
+
 // Method SizeOfHiddenLayer returns the number of hidden units in the model.
 func (rbm *SparseClassRBM) SizeOfHiddenLayer() int {
 	return (*rbm).h_num
@@ -21,6 +25,76 @@ func (rbm *SparseClassRBM) ClassSize(class_id int) int {
 	return (*rbm).x_class_sizes[class_id]
 }
 
+// Method ClassType returns the type of the given visible unit class.
+func (rbm *SparseClassRBM) ClassType(class_id int) ClassType {
+	return (*rbm).x_class_types[class_id]
+}
+
+// Method SetClassType sets the type of the given visible unit class. A
+// Gaussian class must have size 1; use SetGaussianClass to also set its mean
+// and standard deviation.
+func (rbm *SparseClassRBM) SetClassType(class_id int, t ClassType) {
+	if t == KGaussianClass && (*rbm).x_class_sizes[class_id] != 1 {
+		panic(fmt.Sprintf("Expected Gaussian class %d to have size 1 but got %d.", class_id,
+			(*rbm).x_class_sizes[class_id]))
+	}
+	(*rbm).x_class_types[class_id] = t
+}
+
+// Method SetGaussianClass makes the given visible unit class Gaussian, with
+// its mean (i.e. its bias) and standard deviation initialized to the given
+// values, typically those of the training data.
+func (rbm *SparseClassRBM) SetGaussianClass(class_id int, mean, sigma WeightT) {
+	rbm.SetClassType(class_id, KGaussianClass)
+	rbm.SetB(class_id, 0, mean)
+	rbm.SetSigma(class_id, sigma)
+}
+
+// Method ClassTypes returns the types of all the visible unit classes.
+func (rbm *SparseClassRBM) ClassTypes() []ClassType {
+	return (*rbm).x_class_types
+}
+
+// Method isMultiValued determines whether the given class holds a bag of values.
+func (rbm *SparseClassRBM) isMultiValued(class_id int) bool {
+	t := (*rbm).x_class_types[class_id]
+	return t == KMultiValuedClass || t == KNormalizedMultiValuedClass
+}
+
+// Method isGaussian determines whether the given class holds a real value.
+func (rbm *SparseClassRBM) isGaussian(class_id int) bool {
+	return (*rbm).x_class_types[class_id] == KGaussianClass
+}
+
+// Method MissingValuePolicy returns how the model treats missing classes.
+func (rbm *SparseClassRBM) MissingValuePolicy() MissingValuePolicy {
+	return (*rbm).x_missing
+}
+
+// Method SetMissingValuePolicy sets how the model treats missing classes.
+func (rbm *SparseClassRBM) SetMissingValuePolicy(policy MissingValuePolicy) {
+	(*rbm).x_missing = policy
+}
+
+// Method Sigma returns the standard deviation of the given Gaussian class.
+func (rbm *SparseClassRBM) Sigma(class_id int) WeightT {
+	return (*rbm).x_sigmas[class_id]
+}
+
+// Method SetSigma sets the standard deviation of the given Gaussian class.
+func (rbm *SparseClassRBM) SetSigma(class_id int, v WeightT) {
+	(*rbm).x_sigmas[class_id] = v
+}
+
+// Method bagScale returns the factor applied to each of the n values of the
+// given multi-valued class.
+func (rbm *SparseClassRBM) bagScale(class_id int, n int) WeightT {
+	if (*rbm).x_class_types[class_id] == KNormalizedMultiValuedClass && n > 0 {
+		return 1 / WeightT(n)
+	}
+	return 1
+}
+
 // Method W returns the interaction of X and H
 func (rbm *SparseClassRBM) W(h_index, c_index, c_value int) WeightT {
 	return (*rbm).w[c_index][h_index][c_value]
@@ -31,14 +105,64 @@ func (rbm *SparseClassRBM) SetW(h_index, c_index, c_value int, v WeightT) {
 	(*rbm).w[c_index][h_index][c_value] = v
 }
 
-// Method B returns the bias of X.
+// Method B returns the bias of X; with one bias per class, it is the same for
+// all the values of the class.
 func (rbm *SparseClassRBM) B(c_index, c_value int) WeightT {
-	return (*rbm).b[c_index][c_value]
+	return (*rbm).b[c_index][rbm.biasIndex(c_value)]
 }
 
-// Method SetB sets the bias of X.
+// Method SetB sets the bias of X; with one bias per class, it sets the bias
+// shared by all the values of the class.
 func (rbm *SparseClassRBM) SetB(c_index, c_value int, v WeightT) {
-	(*rbm).b[c_index][c_value] = v
+	(*rbm).b[c_index][rbm.biasIndex(c_value)] = v
+}
+
+// Method biasIndex returns the index into b[c] of the bias of value c_value.
+func (rbm *SparseClassRBM) biasIndex(c_value int) int {
+	if (*rbm).x_bias_mode == KPerClassBias {
+		return 0
+	}
+	return c_value
+}
+
+// Method BiasParameterization returns how the visible biases are shared.
+func (rbm *SparseClassRBM) BiasParameterization() BiasParameterization {
+	return (*rbm).x_bias_mode
+}
+
+// Method SetBiasParameterization changes how the visible biases are shared,
+// converting the current biases: a class bias is the mean of the biases of
+// its values, i.e. the log of the geometric mean of their probabilities when
+// initialized by GetBiases, and the values of a class get the class bias. It
+// must be called before creating a trainer for the model.
+func (rbm *SparseClassRBM) SetBiasParameterization(mode BiasParameterization) {
+	if mode == (*rbm).x_bias_mode {
+		return
+	}
+	for c, biases := range (*rbm).b {
+		if mode == KPerClassBias {
+			mean := WeightT(0)
+			for _, v := range biases {
+				mean += v
+			}
+			(*rbm).b[c] = []WeightT{mean / WeightT(len(biases))}
+		} else {
+			(*rbm).b[c] = make([]WeightT, (*rbm).x_class_sizes[c])
+			for k := range (*rbm).b[c] {
+				(*rbm).b[c][k] = biases[0]
+			}
+		}
+	}
+	(*rbm).x_bias_mode = mode
+}
+
+// Method NumOfVisibleBiases returns the number of visible bias parameters.
+func (rbm *SparseClassRBM) NumOfVisibleBiases() int {
+	n := 0
+	for _, biases := range (*rbm).b {
+		n += len(biases)
+	}
+	return n
 }
 
 // Method C returns the bias of H.
@@ -74,3 +198,52 @@ func (rbm *SparseClassRBM) D() WeightT {
 func (rbm *SparseClassRBM) SetD(v WeightT) {
 	(*rbm).d = v
 }
+
+// Method NumOfLabels returns the number of label classes of a multi-class
+// model, or 0 if y is binary.
+func (rbm *SparseClassRBM) NumOfLabels() int {
+	return (*rbm).y_class_num
+}
+
+// Method IsMultiClass determines whether y is a softmax unit over more than
+// one label class, in which case UK and DK are used instead of U and D.
+func (rbm *SparseClassRBM) IsMultiClass() bool {
+	return (*rbm).y_class_num > 0
+}
+
+// Method IsRegression determines whether y is a real valued target, modeled
+// by a Gaussian unit whose mean is D + U . h, in which case U and D are used
+// on the normalized target.
+func (rbm *SparseClassRBM) IsRegression() bool {
+	return (*rbm).y_gaussian
+}
+
+// Method normalizeTarget maps a regression target to the scale of y.
+func (rbm *SparseClassRBM) normalizeTarget(target WeightT) WeightT {
+	return (target - (*rbm).y_mean) / (*rbm).y_stddev
+}
+
+// Method denormalizeTarget maps y back to the scale of the regression target.
+func (rbm *SparseClassRBM) denormalizeTarget(y WeightT) WeightT {
+	return y*(*rbm).y_stddev + (*rbm).y_mean
+}
+
+// Method UK returns the interaction of label class k and H.
+func (rbm *SparseClassRBM) UK(k, h_index int) WeightT {
+	return (*rbm).uk[k][h_index]
+}
+
+// Method SetUK sets the interaction of label class k and H.
+func (rbm *SparseClassRBM) SetUK(k, h_index int, v WeightT) {
+	(*rbm).uk[k][h_index] = v
+}
+
+// Method DK returns the bias of label class k.
+func (rbm *SparseClassRBM) DK(k int) WeightT {
+	return (*rbm).dk[k]
+}
+
+// Method SetDK sets the bias of label class k.
+func (rbm *SparseClassRBM) SetDK(k int, v WeightT) {
+	(*rbm).dk[k] = v
+}
@@ -0,0 +1,288 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Annealed importance sampling.
+//
+// AIS [6] estimates the partition function Z of the model by annealing from
+// the base-rate model, which keeps the biases b of X and d of y but has no
+// interaction with h, to the model through the intermediate distributions
+//	P*_beta(X, y) = exp{b . X + d . Y} * prod{0<=j<|H|}(1 + exp(beta * (w[j].X + c[j] + U_j . Y)))
+// for 0 = beta_0 < beta_1 < ... < beta_K = 1. Every run starts from a sample
+// of the base-rate model, whose partition function Z_0 is known, and moves it
+// by one Gibbs step at each beta_k, accumulating the importance weight
+//	w = prod{1<=k<=K}(P*_beta_k(X_k-1, y_k-1) / P*_beta_k-1(X_k-1, y_k-1))
+// whose mean over the runs estimates Z / Z_0.
+//
+// Reference:
+//  [6]. Salakhutdinov, Murray, 2008, On the Quantitative Analysis of Deep
+//  Belief Networks
+
+package rbm
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+const (
+	kDefaultAISTemperatures = 1000 //number of intermediate inverse temperatures of AIS
+	kDefaultAISRuns         = 100  //number of AIS runs
+	kAISConfidence          = 3    //half width of the confidence intervals in standard errors
+)
+
+// AISEstimate is an estimate of the log of a quantity by annealed importance
+// sampling, along with a confidence interval of kAISConfidence standard
+// errors of the mean importance weight around it. Low is -Inf if the interval
+// of the quantity itself reaches 0.
+type AISEstimate struct {
+	Value float64
+	Low   float64
+	High  float64
+}
+
+// AIS estimates the partition function of SparseClassRBMs by annealed
+// importance sampling.
+type AIS struct {
+	betas    []WeightT //inverse temperatures, from 0 to 1
+	num_runs int
+	rng      *rand.Rand
+}
+
+// NewAIS creates an AIS estimator annealing through num_temperatures
+// intermediate inverse temperatures, evenly spaced between 0 and 1, in each
+// of num_runs independent runs, sampling with the given seed.
+func NewAIS(num_temperatures, num_runs int, seed int64) *AIS {
+	if num_temperatures < 0 || num_runs < 1 {
+		panic(fmt.Sprintf("Invalid AIS with %d temperatures and %d runs.", num_temperatures, num_runs))
+	}
+	betas := make([]WeightT, num_temperatures+2)
+	for k := range betas {
+		betas[k] = WeightT(k) / WeightT(len(betas)-1)
+	}
+	return &AIS{betas: betas, num_runs: num_runs, rng: rand.New(rand.NewSource(seed))}
+}
+
+// LogPartition estimates log Z of the given model. The number of values of a
+// multi-valued class is not part of the model, so models with multi-valued
+// classes are not supported and return an error. For regression models, Z is
+// the one of the normalized target.
+func (ais *AIS) LogPartition(rbm *SparseClassRBM) (AISEstimate, error) {
+	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+		if rbm.isMultiValued(c) {
+			return AISEstimate{}, fmt.Errorf("AIS does not support the multi-valued class %d.", c)
+		}
+	}
+	log_weights := make([]WeightT, ais.num_runs)
+	h := make([]WeightT, rbm.SizeOfHiddenLayer())
+	for r := range log_weights {
+		p := rbm.sampleBaseRate(ais.rng)
+		for k := 1; k < len(ais.betas); k++ {
+			log_weights[r] += rbm.logUnnormalizedProbAt(p, ais.betas[k]) - rbm.logUnnormalizedProbAt(p, ais.betas[k-1])
+			if k < len(ais.betas)-1 {
+				rbm.annealedGibbsStep(ais.rng, p, h, ais.betas[k])
+			}
+		}
+	}
+	log_z := logMeanWithInterval(log_weights)
+	log_z_0 := float64(rbm.logBaseRatePartition())
+	return AISEstimate{log_z.Value + log_z_0, log_z.Low + log_z_0, log_z.High + log_z_0}, nil
+}
+
+// logMeanWithInterval returns the log of the mean of the weights whose logs
+// are given, along with its confidence interval.
+func logMeanWithInterval(log_weights []WeightT) AISEstimate {
+	n := float64(len(log_weights))
+	max := log_weights[0]
+	for _, l := range log_weights {
+		if l > max {
+			max = l
+		}
+	}
+	// the weights are scaled by exp(-max) to avoid overflows
+	mean, square := float64(0), float64(0)
+	for _, l := range log_weights {
+		w := math.Exp(float64(l - max))
+		mean += w
+		square += w * w
+	}
+	mean /= n
+	std_error := float64(0)
+	if n > 1 {
+		std_error = math.Sqrt(math.Max(square/n-mean*mean, 0) * n / (n - 1) / n)
+	}
+	offset := float64(max)
+	estimate := AISEstimate{Value: math.Log(mean) + offset, Low: math.Inf(-1),
+		High: math.Log(mean+kAISConfidence*std_error) + offset}
+	if low := mean - kAISConfidence*std_error; low > 0 {
+		estimate.Low = math.Log(low) + offset
+	}
+	return estimate
+}
+
+// Method logBaseRatePartition calculates log Z_0 of the base-rate model,
+//	Z_0 = 2^|H| * sum{Y}(exp{d . Y}) * prod{0<=c<C}(sum{k}(exp{b[c][k]}))
+// where the sum over the values of a Gaussian class is sqrt(2 * pi) * sigma_c,
+// and the one over a real valued y is sqrt(2 * pi) * exp{d^2 / 2}.
+func (rbm *SparseClassRBM) logBaseRatePartition() WeightT {
+	log_z := WeightT(rbm.SizeOfHiddenLayer()) * WeightT(math.Ln2)
+	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+		if rbm.isGaussian(c) {
+			log_z += WeightT(math.Log(math.Sqrt(2*math.Pi))) + WeightT(math.Log(float64(rbm.Sigma(c))))
+			continue
+		}
+		b := make([]WeightT, rbm.ClassSize(c))
+		for k := range b {
+			b[k] = rbm.B(c, k)
+		}
+		log_z += LogSumExp(b)
+	}
+	return log_z + rbm.logLabelPartition()
+}
+
+// Method logLabelPartition calculates log sum{Y}(exp{d . Y}) of the
+// base-rate model.
+func (rbm *SparseClassRBM) logLabelPartition() WeightT {
+	switch {
+	case rbm.IsRegression():
+		return WeightT(math.Log(math.Sqrt(2*math.Pi))) + rbm.D()*rbm.D()/2
+	case rbm.IsMultiClass():
+		return LogSumExp(rbm.dk)
+	}
+	return SoftPlus(rbm.D())
+}
+
+// Method sampleBaseRate samples a particle from the base-rate model.
+func (rbm *SparseClassRBM) sampleBaseRate(rng *rand.Rand) *particleT {
+	return rbm.sampleAnnealedVisible(rng, nil, make([]WeightT, rbm.SizeOfHiddenLayer()), 0)
+}
+
+// Method annealedGibbsStep moves the particle p by one Gibbs step of
+// P*_beta, using h for the hidden units.
+func (rbm *SparseClassRBM) annealedGibbsStep(rng *rand.Rand, p *particleT, h []WeightT, beta WeightT) {
+	for j := range h {
+		if randomWeight(rng) < Sigmoid(beta*rbm.hiddenInput(j, p)) {
+			h[j] = 1
+		} else {
+			h[j] = 0
+		}
+	}
+	rbm.sampleAnnealedVisible(rng, p, h, beta)
+}
+
+// Method sampleAnnealedVisible samples X and y from P*_beta(X, y | h), i.e.
+//	P(X_c = k | h) = softmax_k(b[c][k] + beta * sum{0<=j<|H|}(W[c][j][k] * h[j]))
+// and likewise for y, into p, or into a new particle if p is nil.
+func (rbm *SparseClassRBM) sampleAnnealedVisible(rng *rand.Rand, p *particleT, h []WeightT,
+	beta WeightT) *particleT {
+	if p == nil {
+		p = &particleT{v: &DataInstance{x: make([]int, rbm.NumOfVisibleClasses())}}
+		if rbm.hasGaussianClass() {
+			p.v.x_real = make([]WeightT, rbm.NumOfVisibleClasses())
+		}
+	}
+	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+		if rbm.isGaussian(c) {
+			p.v.x_real[c] = rbm.B(c, 0) + rbm.Sigma(c)*(beta*rbm.hDotW(h, c, 0)+WeightT(rng.NormFloat64()))
+			continue
+		}
+		p_dist := make([]WeightT, rbm.ClassSize(c))
+		for k := range p_dist {
+			p_dist[k] = rbm.B(c, k) + beta*rbm.hDotW(h, c, k)
+		}
+		SoftMax(p_dist)
+		p.v.x[c] = SelectKFromDist(randomWeight(rng), p_dist)
+	}
+	switch {
+	case rbm.IsRegression():
+		p.target = rbm.D() + beta*DotProduct(rbm.UVector(), h) + WeightT(rng.NormFloat64())
+	case rbm.IsMultiClass():
+		p_dist := make([]WeightT, rbm.NumOfLabels())
+		for k := range p_dist {
+			p_dist[k] = rbm.DK(k) + beta*DotProduct(rbm.uk[k], h)
+		}
+		SoftMax(p_dist)
+		p.y = SelectKFromDist(randomWeight(rng), p_dist)
+	default:
+		p.y = 0
+		if randomWeight(rng) < Sigmoid(rbm.D()+beta*DotProduct(rbm.UVector(), h)) {
+			p.y = 1
+		}
+	}
+	return p
+}
+
+// Method hDotW calculates sum{0<=j<|H|}(W[c][j][k] * h[j]).
+func (rbm *SparseClassRBM) hDotW(h []WeightT, c, k int) WeightT {
+	s := WeightT(0)
+	for j, h_j := range h {
+		s += rbm.W(j, c, k) * h_j
+	}
+	return s
+}
+
+// Method hasGaussianClass determines whether the model has a Gaussian class.
+func (rbm *SparseClassRBM) hasGaussianClass() bool {
+	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+		if rbm.isGaussian(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Method hiddenInput calculates w[j].X + c[j] + U_j . Y of the particle p.
+func (rbm *SparseClassRBM) hiddenInput(j int, p *particleT) WeightT {
+	return rbm.C(j) + rbm.wHDotInstance(j, p.v) + rbm.labelInput(j, p)
+}
+
+// Method logUnnormalizedProbAt calculates the part of log P*_beta(X, y) of
+// the particle p that depends on beta,
+//	sum{0<=j<|H|}(softplus(beta * (w[j].X + c[j] + U_j . Y)))
+func (rbm *SparseClassRBM) logUnnormalizedProbAt(p *particleT, beta WeightT) WeightT {
+	s := WeightT(0)
+	for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+		s += SoftPlus(beta * rbm.hiddenInput(j, p))
+	}
+	return s
+}
+
+// GenerativeLogLikelihood returns the sum of log P(X, y) over the given data,
+// with its confidence interval, Z being estimated by AIS. It returns an error
+// if LogPartition does not support the model.
+func (ais *AIS) GenerativeLogLikelihood(rbm *SparseClassRBM, data_accessor DataInstanceAccessor) (AISEstimate, error) {
+	log_z, err := ais.LogPartition(rbm)
+	if err != nil {
+		return AISEstimate{}, err
+	}
+	loglikelihood := float64(0)
+	cnt := 0
+	ForEachValidDataInstance(data_accessor, func(instance DataInstance) {
+		if rbm.IsRegression() {
+			target := rbm.normalizeTarget(instance.target)
+			loglikelihood += float64(rbm.logMarginalUnnormalizedProb(&instance, 0, target))
+			cnt++
+			return
+		}
+		for k, n := range labelCountsOf(&instance) {
+			if n > 0 {
+				loglikelihood += float64(n) * float64(rbm.logMarginalUnnormalizedProb(&instance, k, 0))
+				cnt += n
+			}
+		}
+	})
+	if cnt == 0 {
+		return AISEstimate{}, nil
+	}
+	n := float64(cnt)
+	return AISEstimate{loglikelihood - n*log_z.Value, loglikelihood - n*log_z.High, loglikelihood - n*log_z.Low}, nil
+}
+
+// GenerativeLogLikelihood returns the sum of log P(X, y) over the given data,
+// with its confidence interval, Z being estimated by AIS with the default
+// number of temperatures and runs. For regression models, y is the
+// normalized target.
+func GenerativeLogLikelihood(rbm *SparseClassRBM, data_accessor DataInstanceAccessor) (AISEstimate, error) {
+	return NewAIS(kDefaultAISTemperatures, kDefaultAISRuns, 1).GenerativeLogLikelihood(rbm, data_accessor)
+}
@@ -0,0 +1,105 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"math"
+	"testing"
+)
+
+// exactLogPartition calculates log Z by summing over all the configurations
+// of the single-valued classes and the labels.
+func exactLogPartition(rbm *SparseClassRBM) float64 {
+	labels := 2
+	if rbm.IsMultiClass() {
+		labels = rbm.NumOfLabels()
+	}
+	var log_p []WeightT
+	x := make([]int, rbm.NumOfVisibleClasses())
+	for {
+		for y := 0; y < labels; y++ {
+			v := &DataInstance{x: append([]int(nil), x...)}
+			log_p = append(log_p, rbm.logUnnormalizedProb(&particleT{v: v, y: y}))
+		}
+		c := 0
+		for ; c < len(x); c++ {
+			if x[c]++; x[c] < rbm.ClassSize(c) {
+				break
+			}
+			x[c] = 0
+		}
+		if c == len(x) {
+			return float64(LogSumExp(log_p))
+		}
+	}
+}
+
+func Test_LogPartition(t *testing.T) {
+	for _, rbm := range []*SparseClassRBM{getSampleRBMForProbabilityTest(), getSampleMultiClassRBM()} {
+		expected := exactLogPartition(rbm)
+		got, err := NewAIS(100, 100, 1).LogPartition(rbm)
+		if err != nil {
+			t.Fatalf("Failed to estimate log Z: %s.", err)
+		}
+		if math.Abs(got.Value-expected) > 0.01 || got.Low > expected || got.High < expected {
+			t.Errorf("Expected log Z %f but got %v.", expected, got)
+		}
+	}
+
+	// Without interactions, the model is the base-rate model and every run
+	// has the same weight.
+	rbm := getSampleRBMForProbabilityTest()
+	for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+		rbm.SetU(j, 0)
+		for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+			for k := 0; k < rbm.ClassSize(c); k++ {
+				rbm.SetW(j, c, k, 0)
+			}
+		}
+	}
+	expected := exactLogPartition(rbm)
+	got, err := NewAIS(10, 10, 1).LogPartition(rbm)
+	if err != nil {
+		t.Fatalf("Failed to estimate log Z: %s.", err)
+	}
+	if !EqualWithinPrecesionF64(got.Value, expected, kPrecision) || !EqualWithinPrecesionF64(got.Low, expected, kPrecision) ||
+		!EqualWithinPrecesionF64(got.High, expected, kPrecision) {
+		t.Errorf("Expected log Z %f but got %v.", expected, got)
+	}
+}
+
+func Test_logMeanWithInterval(t *testing.T) {
+	got := logMeanWithInterval([]WeightT{0, WeightT(math.Log(3))})
+	if !EqualWithinPrecesionF64(got.Value, math.Log(2), kPrecision) ||
+		!EqualWithinPrecesionF64(got.High, math.Log(5), kPrecision) || !math.IsInf(got.Low, -1) {
+		t.Errorf("Expected log 2 within (-Inf, log 5) but got %v.", got)
+	}
+}
+
+func Test_GenerativeLogLikelihood(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	data := getBatchTestData()
+	log_z := exactLogPartition(rbm)
+	expected := float64(0)
+	for _, instance := range data {
+		v := instance
+		for y, n := range labelCountsOf(&v) {
+			expected += float64(n) * (float64(rbm.logUnnormalizedProb(&particleT{v: &v, y: y})) - log_z)
+		}
+	}
+	got, err := NewAIS(100, 100, 1).GenerativeLogLikelihood(rbm, &instanceSlice{instances: data})
+	if err != nil {
+		t.Fatalf("Failed to estimate log likelihood: %s.", err)
+	}
+	if math.Abs(got.Value-expected) > 0.05 || got.Low > expected || got.High < expected || expected >= 0 {
+		t.Errorf("Expected log likelihood %f but got %v.", expected, got)
+	}
+
+	// Multi-valued classes are not supported.
+	rbm.SetClassType(1, KMultiValuedClass)
+	if _, err := NewAIS(10, 10, 1).GenerativeLogLikelihood(rbm, &instanceSlice{instances: data}); err == nil {
+		t.Errorf("Expected an error for a model with a multi-valued class.")
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Accumulation of the gradients of a mini-batch.
+
+package rbm
+
+import (
+	"sync/atomic"
+)
+
+type wIndexT struct {
+	h_index int
+	c_index int
+	c_value int
+}
+
+type bIndexT struct {
+	c_index int
+	c_value int
+}
+
+// batchDeltaT accumulates the deltas of the instances of a mini-batch. The
+// sparse deltas hitting the same parameter are merged, so that the update
+// touches each parameter and its momentum once per batch.
+type batchDeltaT struct {
+	delta     *deltaT
+	w_entries map[wIndexT]int //index into delta.delta_w of the entry of w[c][h][k]
+	b_entries map[bIndexT]int //index into delta.delta_b of the entry of b[c][k]
+	s_entries map[int]int     //index into delta.delta_s of the entry of class c
+	instances int             //number of instances accumulated
+}
+
+func (rbm *SparseClassRBM) newBatchDelta() *batchDeltaT {
+	return &batchDeltaT{
+		delta:     rbm.NewDeltaT(),
+		w_entries: make(map[wIndexT]int),
+		b_entries: make(map[bIndexT]int),
+		s_entries: make(map[int]int),
+	}
+}
+
+// add adds the deltas of d to the batch.
+func (batch *batchDeltaT) add(d *deltaT) {
+	batch.addScaled(d, 1)
+}
+
+// addScaled adds the deltas of d multiplied by x_t to the batch.
+func (batch *batchDeltaT) addScaled(d *deltaT, x_t WeightT) {
+	acc := batch.delta
+	for _, e := range d.delta_w {
+		key := wIndexT{e.h_index, e.c_index, e.c_value}
+		if i, ok := batch.w_entries[key]; ok {
+			acc.delta_w[i].delta_v += x_t * e.delta_v
+		} else {
+			batch.w_entries[key] = len(acc.delta_w)
+			acc.delta_w = append(acc.delta_w, deltaWT{e.h_index, e.c_index, e.c_value, x_t * e.delta_v})
+		}
+	}
+	for _, e := range d.delta_b {
+		key := bIndexT{e.c_index, e.c_value}
+		if i, ok := batch.b_entries[key]; ok {
+			acc.delta_b[i].delta_v += x_t * e.delta_v
+		} else {
+			batch.b_entries[key] = len(acc.delta_b)
+			acc.delta_b = append(acc.delta_b, deltaBT{e.c_index, e.c_value, x_t * e.delta_v})
+		}
+	}
+	for _, e := range d.delta_s {
+		if i, ok := batch.s_entries[e.c_index]; ok {
+			acc.delta_s[i].delta_v += x_t * e.delta_v
+		} else {
+			batch.s_entries[e.c_index] = len(acc.delta_s)
+			acc.delta_s = append(acc.delta_s, deltaBT{e.c_index, e.c_value, x_t * e.delta_v})
+		}
+	}
+	acc.delta_d += x_t * d.delta_d
+	addScaledTo(acc.delta_c, d.delta_c, x_t)
+	addScaledTo(acc.delta_u, d.delta_u, x_t)
+	for k := range d.delta_uk {
+		addScaledTo(acc.delta_uk[k], d.delta_uk[k], x_t)
+	}
+	addScaledTo(acc.delta_dk, d.delta_dk, x_t)
+}
+
+// reset empties the batch.
+func (batch *batchDeltaT) reset() {
+	acc := batch.delta
+	acc.Clear()
+	acc.delta_d = 0
+	setZero(acc.delta_c)
+	setZero(acc.delta_u)
+	for k := range acc.delta_uk {
+		setZero(acc.delta_uk[k])
+	}
+	setZero(acc.delta_dk)
+	for key := range batch.w_entries {
+		delete(batch.w_entries, key)
+	}
+	for key := range batch.b_entries {
+		delete(batch.b_entries, key)
+	}
+	for key := range batch.s_entries {
+		delete(batch.s_entries, key)
+	}
+	batch.instances = 0
+}
+
+// addTo adds b to a element-wise.
+func addTo(a, b []WeightT) {
+	addScaledTo(a, b, 1)
+}
+
+// addScaledTo adds b multiplied by x_t to a element-wise.
+func addScaledTo(a, b []WeightT, x_t WeightT) {
+	for i, v := range b {
+		a[i] += x_t * v
+	}
+}
+
+// setZero sets all the elements of a to 0.
+func setZero(a []WeightT) {
+	for i := range a {
+		a[i] = 0
+	}
+}
+
+// addInstance adds the deltas of the given labels of an instance to the batch.
+// With a batch size of 1, the deltas of all but the last label are applied
+// right away as separate updates, as the instance-by-instance path does,
+// instead of being merged.
+func (trainer *RBMTrainer) addInstance(batch *batchDeltaT, deltas []*deltaT, labels []int) {
+	for i, y := range labels {
+		if trainer.BatchSize() == 1 && i < len(labels)-1 {
+			trainer.applyDelta(deltas[y])
+		} else {
+			batch.add(deltas[y])
+		}
+	}
+	batch.instances++
+}
+
+// applyBatch updates the model, and the fast weights of FPCD, with the mean of
+// the deltas of the instances accumulated in the batch, then empties the
+// batch. A checkpoint is saved if the instances of the batch cross a multiple
+// of the checkpoint interval.
+func (trainer *RBMTrainer) applyBatch(batch *batchDeltaT) {
+	n := batch.instances
+	if n == 0 {
+		return
+	}
+	batch.delta.scale(1 / WeightT(n))
+	trainer.applyDelta(batch.delta)
+	batch.reset()
+	if interval := int64(trainer.checkpoint_interval); interval > 0 &&
+		(trainer.instances-int64(n))/interval != trainer.instances/interval {
+		trainer.saveCheckpoint()
+	}
+}
+
+// applyDelta updates the model, and the fast weights of FPCD, with delta.
+func (trainer *RBMTrainer) applyDelta(delta *deltaT) {
+	trainer.updateRates()
+	trainer.updateModel(delta)
+	atomic.AddInt64(&trainer.schedules.updates, 1)
+	trainer.updateFastWeights(delta, 1)
+}
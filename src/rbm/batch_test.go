@@ -0,0 +1,126 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func getBatchTestData() []DataInstance {
+	return []DataInstance{
+		{x: []int{0, 1, 2}, pos_y: 1},
+		{x: []int{0, 0, 2}, neg_y: 1},
+		{x: []int{0, 1, 0}, pos_y: 1},
+		{x: []int{0, 0, 1}, neg_y: 2},
+	}
+}
+
+func newBatchTestTrainer(data []DataInstance) *RBMTrainer {
+	rbm := getSampleRBMForProbabilityTest()
+	trainer := new(RBMTrainer)
+	trainer.Initialize(rbm, &instanceSlice{instances: data}, &instanceSlice{instances: data},
+		0.1, 0.01, 0.5, 0.5, 1)
+	trainer.SetSeed(1)
+	trainer.SetMaxEpochs(1)
+	return trainer
+}
+
+func Test_batchDeltaAdd(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	batch := rbm.newBatchDelta()
+	a := rbm.NewDeltaT()
+	a.delta_w = []deltaWT{{0, 1, 1, 0.5}, {1, 2, 0, 0.25}}
+	a.delta_b = []deltaBT{{1, 1, 0.5}}
+	a.delta_c[0], a.delta_d = 1, 2
+	b := rbm.NewDeltaT()
+	b.delta_w = []deltaWT{{1, 2, 0, 0.5}, {0, 1, 0, 1}}
+	b.delta_b = []deltaBT{{1, 1, 0.25}, {2, 0, 1}}
+	b.delta_c[0], b.delta_d = 3, -1
+	batch.add(a)
+	batch.add(b)
+
+	expected_w := []deltaWT{{0, 1, 1, 0.5}, {1, 2, 0, 0.75}, {0, 1, 0, 1}}
+	expected_b := []deltaBT{{1, 1, 0.75}, {2, 0, 1}}
+	if !reflect.DeepEqual(batch.delta.delta_w, expected_w) || !reflect.DeepEqual(batch.delta.delta_b, expected_b) {
+		t.Errorf("Expected merged deltas %v %v but got %v %v.", expected_w, expected_b,
+			batch.delta.delta_w, batch.delta.delta_b)
+	}
+	if batch.delta.delta_c[0] != 4 || batch.delta.delta_d != 1 {
+		t.Errorf("Expected delta c[0] = 4 and d = 1 but got %f and %f.", batch.delta.delta_c[0],
+			batch.delta.delta_d)
+	}
+
+	batch.reset()
+	batch.add(b)
+	if len(batch.delta.delta_w) != 2 || batch.delta.delta_c[0] != 3 || batch.delta.delta_d != -1 {
+		t.Errorf("Expected the batch to only hold b after reset but got %v.", batch.delta)
+	}
+}
+
+// Test_TrainWithBatchSizeOne checks that a batch of one instance updates the
+// model as the instance-by-instance path does, which applies the deltas of the
+// labels of an instance as separate updates.
+func Test_TrainWithBatchSizeOne(t *testing.T) {
+	data := append(getBatchTestData(), DataInstance{x: []int{0, 1, 2}, pos_y: 2, neg_y: 1})
+	batched := newBatchTestTrainer(data)
+	batched.SetBatchSize(1)
+	batched.Train()
+
+	single := newBatchTestTrainer(data)
+	deltas := single.rbm.newLabelDeltas()
+	for labels := single.doGradient(deltas); labels != nil; labels = single.doGradient(deltas) {
+		for _, y := range labels {
+			single.updateModel(deltas[y])
+		}
+	}
+	if !reflect.DeepEqual(batched.rbm, single.rbm) {
+		t.Errorf("Expected model\n%v\nbut got\n%v.", single.rbm, batched.rbm)
+	}
+}
+
+// Test_TrainWithBatch checks that a batch holding all the instances updates
+// the model once with the mean of their gradients.
+func Test_TrainWithBatch(t *testing.T) {
+	data := getBatchTestData()
+	batched := newBatchTestTrainer(data)
+	batched.SetBatchSize(len(data))
+	batched.Train()
+
+	trainer := newBatchTestTrainer(data)
+	rbm := trainer.rbm
+	n := WeightT(len(data))
+	eta, lambda := trainer.parameters.learning_rate, trainer.parameters.regularization_rate
+	sum_w := make(map[wIndexT]WeightT)
+	sum_c := make([]WeightT, rbm.SizeOfHiddenLayer())
+	sum_d := WeightT(0)
+	deltas := rbm.newLabelDeltas()
+	for labels := trainer.doGradient(deltas); labels != nil; labels = trainer.doGradient(deltas) {
+		for _, y := range labels {
+			for _, d := range deltas[y].delta_w {
+				sum_w[wIndexT{d.h_index, d.c_index, d.c_value}] += d.delta_v
+			}
+			addTo(sum_c, deltas[y].delta_c)
+			sum_d += deltas[y].delta_d
+		}
+	}
+
+	for key, s := range sum_w {
+		w := rbm.W(key.h_index, key.c_index, key.c_value)
+		expected := w + eta*s/n - lambda*w
+		if got := batched.rbm.W(key.h_index, key.c_index, key.c_value); !EqualWithinPrecision(got, expected, kPrecision) {
+			t.Errorf("Expected W%v to be %f but got %f.", key, expected, got)
+		}
+	}
+	for j, s := range sum_c {
+		expected := rbm.C(j) + eta*s/n
+		if got := batched.rbm.C(j); !EqualWithinPrecision(got, expected, kPrecision) {
+			t.Errorf("Expected C(%d) to be %f but got %f.", j, expected, got)
+		}
+	}
+	if expected := rbm.D() + eta*sum_d/n; !EqualWithinPrecision(batched.rbm.D(), expected, kPrecision) {
+		t.Errorf("Expected D to be %f but got %f.", expected, batched.rbm.D())
+	}
+}
@@ -0,0 +1,475 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Persistent contrastive divergence.
+//
+// With PCD [3], the negative phase of the gradient of the generative term is
+// sampled from a pool of fantasy particles (X_hat, y_hat), which every
+// training instance advances by k Gibbs steps from where they stopped,
+// instead of from a chain started at the instance. FPCD [4] samples the
+// particles with the sum of the parameters of the model and of fast weights,
+// which learn with the same gradient at a higher rate and decay quickly,
+// pushing the particles away from the modes they have just visited.
+//
+// References:
+//  [3]. Tieleman, 2008, Training Restricted Boltzmann Machines using
+//  Approximations to the Likelihood Gradient
+//  [4]. Tieleman, Hinton, 2009, Using Fast Weights to Improve Persistent
+//  Contrastive Divergence
+
+package rbm
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	kDefaultFastWeightDecay = 0.95 //decay of the fast weights per update, following [4]
+	kMinFastWeight          = 1e-8 //fast weights of smaller magnitude are dropped
+)
+
+// particleT is a fantasy particle: a visible configuration and its label,
+// target holding the normalized target for regression models.
+type particleT struct {
+	v      *DataInstance
+	y      int
+	target WeightT
+}
+
+// chainState holds the persistent chains of PCD, FPCD and PT.
+type chainState struct {
+	particles     []*particleT
+	next          int            //index of the particle to advance next
+	fast          *batchDeltaT   //fast weights divided by the fast learning rate, FPCD only
+	ladders       [][]*particleT //ladders[i][m-1] is the replica of particle i at betas[m], PT only
+	swap_attempts []int64        //number of proposed swaps between betas[m] and betas[m+1], PT only
+	swap_accepts  []int64        //number of accepted swaps between betas[m] and betas[m+1], PT only
+}
+
+// SetSamplingMethod selects how the negative phase of the generative term is
+// sampled. With PCD, FPCD and PT, the trainer keeps num_particles persistent
+// chains, which the training instances advance in turn by gibbs_chain_length
+// steps; a new chain starts from the first instance that uses it, and keeps
+// the missing classes and the number of values of the multi-valued classes
+// of that instance. The chains are part of the checkpoints but cannot be
+// shared by parallel workers, so training with persistent chains uses one
+// worker. Changing the method discards the chains.
+func (trainer *RBMTrainer) SetSamplingMethod(method SamplingMethod, num_particles int) {
+	if num_particles < 1 {
+		panic(fmt.Sprintf("Expected a positive number of particles but got %d.", num_particles))
+	}
+	trainer.parameters.sampling_method = method
+	trainer.parameters.num_particles = num_particles
+	trainer.chains = nil
+}
+
+// SamplingMethod returns how the negative phase of the generative term is
+// sampled.
+func (trainer *RBMTrainer) SamplingMethod() SamplingMethod {
+	return trainer.parameters.sampling_method
+}
+
+// SetFastWeights sets the learning rate of the fast weights of FPCD, by
+// default that of the model, and the factor by which they decay at every
+// update, 0.95 by default. The fast weights are updated with the gradient of
+// the model, without regularization nor momentum, and leave the standard
+// deviations of Gaussian classes alone.
+func (trainer *RBMTrainer) SetFastWeights(fast_learning_rate, decay WeightT) {
+	if fast_learning_rate <= 0 || decay < 0 || decay >= 1 {
+		panic(fmt.Sprintf("Invalid fast weights parameters: learning rate %f, decay %f.",
+			fast_learning_rate, decay))
+	}
+	trainer.parameters.fast_learning_rate = fast_learning_rate
+	trainer.parameters.fast_weight_decay = decay
+}
+
+// isPersistent determines whether the negative phase is sampled from
+// persistent chains.
+func (trainer *RBMTrainer) isPersistent() bool {
+	return trainer.parameters.sampling_method != KContrastiveDivergence
+}
+
+// negativeParticle returns the fantasy particle of the negative phase of the
+// generative term for the instance v with label y, or target for regression
+// models: a particle advanced by gibbs_chain_length Gibbs steps from v with
+// CD-k, or from where it stopped with PCD, FPCD and PT. h_hat receives
+// P(h|X_hat, y_hat).
+// The particle must not be modified.
+func (trainer *RBMTrainer) negativeParticle(v *DataInstance, y int, target WeightT,
+	h_hat []WeightT) *particleT {
+	rbm := trainer.rbm
+	var p *particleT
+	switch {
+	case trainer.parameters.sampling_method == KParallelTempering:
+		i := trainer.nextParticle(v, y, target)
+		trainer.temperingStep(i, h_hat)
+		p = trainer.chains.particles[i]
+	case trainer.isPersistent():
+		p = trainer.chains.particles[trainer.nextParticle(v, y, target)]
+	default:
+		p = &particleT{v.clone(), y, target}
+	}
+	if trainer.parameters.sampling_method != KParallelTempering {
+		var saved *deltaT
+		if fast := trainer.fastWeights(); fast != nil {
+			saved = rbm.addDelta(fast.delta, trainer.parameters.fast_learning_rate)
+		}
+		for t := 0; t < trainer.parameters.gibbs_chain_length; t++ {
+			trainer.gibbsStep(p, h_hat, 1)
+		}
+		if saved != nil {
+			rbm.setParameters(saved)
+		}
+	}
+	// Final H uses probability, not samples.
+	if rbm.IsRegression() {
+		rbm.probDistOfHGivenTarget(h_hat, p.v, p.target)
+	} else {
+		rbm.probDistOfHGivenInstance(h_hat, p.v, p.y)
+	}
+	return p
+}
+
+// gibbsStep advances the particle p by one Gibbs step of the model at
+// inverse temperature beta, leaving the sampled h in h.
+func (trainer *RBMTrainer) gibbsStep(p *particleT, h []WeightT, beta WeightT) {
+	rbm := trainer.rbm
+	if rbm.IsRegression() {
+		rbm.sampleHGivenTargetTempered(trainer.rng, h, p.v, p.target, beta)
+		rbm.sampleXGivenHTempered(trainer.rng, p.v, h, beta)
+		p.target = rbm.sampleTargetGivenHTempered(trainer.rng, h, beta)
+	} else {
+		rbm.sampleHGivenXYTempered(trainer.rng, h, p.v, p.y, beta)
+		rbm.sampleXGivenHTempered(trainer.rng, p.v, h, beta)
+		rbm.sampleYGivenHTempered(trainer.rng, &p.y, h, beta)
+	}
+}
+
+// nextParticle returns the index of the next persistent particle, starting a
+// new chain, with its ladder of replicas for PT, from (v, y, target) while
+// there are fewer than num_particles of them.
+func (trainer *RBMTrainer) nextParticle(v *DataInstance, y int, target WeightT) int {
+	method := trainer.parameters.sampling_method
+	if trainer.chains == nil {
+		trainer.chains = new(chainState)
+		if method == KFastPersistentCD {
+			trainer.chains.fast = trainer.rbm.newBatchDelta()
+		}
+		if method == KParallelTempering {
+			num_swaps := len(trainer.parameters.temperatures()) - 1
+			trainer.chains.swap_attempts = make([]int64, num_swaps)
+			trainer.chains.swap_accepts = make([]int64, num_swaps)
+		}
+	}
+	chains := trainer.chains
+	if len(chains.particles) < trainer.parameters.num_particles {
+		chains.particles = append(chains.particles, newParticle(v, y, target))
+		if method == KParallelTempering {
+			ladder := make([]*particleT, len(trainer.parameters.temperatures())-1)
+			for m := range ladder {
+				ladder[m] = newParticle(v, y, target)
+			}
+			chains.ladders = append(chains.ladders, ladder)
+		}
+		return len(chains.particles) - 1
+	}
+	i := chains.next
+	chains.next = (chains.next + 1) % len(chains.particles)
+	return i
+}
+
+// newParticle returns a particle starting from the visible configuration of
+// the instance v with label y, or target.
+func newParticle(v *DataInstance, y int, target WeightT) *particleT {
+	x := v.clone()
+	return &particleT{&DataInstance{x: x.x, x_bags: x.x_bags, x_real: x.x_real}, y, target}
+}
+
+// fastWeights returns the fast weights divided by the fast learning rate, nil
+// unless training with FPCD.
+func (trainer *RBMTrainer) fastWeights() *batchDeltaT {
+	if trainer.chains == nil || trainer.parameters.sampling_method != KFastPersistentCD {
+		return nil
+	}
+	return trainer.chains.fast
+}
+
+// updateFastWeights decays the fast weights and adds the deltas of an update
+// of the model multiplied by x_t to them:
+//	F = decay * F + x_t * delta
+// the fast weights being fast_learning_rate * F. Fast weights that have
+// decayed below kMinFastWeight are dropped.
+func (trainer *RBMTrainer) updateFastWeights(delta *deltaT, x_t WeightT) {
+	fast := trainer.fastWeights()
+	if fast == nil {
+		return
+	}
+	fast.delta.scale(trainer.parameters.fast_weight_decay)
+	fast.addScaled(delta, x_t)
+	fast.prune(kMinFastWeight / trainer.parameters.fast_learning_rate)
+}
+
+// prune drops the sparse deltas of the batch whose magnitude is below min.
+func (batch *batchDeltaT) prune(min WeightT) {
+	acc := batch.delta
+	delta_w := acc.delta_w[:0]
+	for _, e := range acc.delta_w {
+		key := wIndexT{e.h_index, e.c_index, e.c_value}
+		if math.Abs(float64(e.delta_v)) < float64(min) {
+			delete(batch.w_entries, key)
+			continue
+		}
+		batch.w_entries[key] = len(delta_w)
+		delta_w = append(delta_w, e)
+	}
+	acc.delta_w = delta_w
+	delta_b := acc.delta_b[:0]
+	for _, e := range acc.delta_b {
+		key := bIndexT{e.c_index, e.c_value}
+		if math.Abs(float64(e.delta_v)) < float64(min) {
+			delete(batch.b_entries, key)
+			continue
+		}
+		batch.b_entries[key] = len(delta_b)
+		delta_b = append(delta_b, e)
+	}
+	acc.delta_b = delta_b
+}
+
+// addDelta adds the deltas of d multiplied by x_t to the parameters of the
+// model, except the standard deviations, and returns the values they
+// replaced, in a deltaT of the same shape, for restoring them with
+// setParameters. The sparse deltas of d must not repeat a parameter.
+func (rbm *SparseClassRBM) addDelta(d *deltaT, x_t WeightT) *deltaT {
+	saved := rbm.NewDeltaT()
+	for _, e := range d.delta_w {
+		v := rbm.W(e.h_index, e.c_index, e.c_value)
+		saved.delta_w = append(saved.delta_w, deltaWT{e.h_index, e.c_index, e.c_value, v})
+		rbm.SetW(e.h_index, e.c_index, e.c_value, v+x_t*e.delta_v)
+	}
+	for _, e := range d.delta_b {
+		v := rbm.B(e.c_index, e.c_value)
+		saved.delta_b = append(saved.delta_b, deltaBT{e.c_index, e.c_value, v})
+		rbm.SetB(e.c_index, e.c_value, v+x_t*e.delta_v)
+	}
+	for j := range d.delta_c {
+		saved.delta_c[j] = rbm.C(j)
+		saved.delta_u[j] = rbm.U(j)
+		rbm.SetC(j, saved.delta_c[j]+x_t*d.delta_c[j])
+		rbm.SetU(j, saved.delta_u[j]+x_t*d.delta_u[j])
+	}
+	saved.delta_d = rbm.D()
+	rbm.SetD(saved.delta_d + x_t*d.delta_d)
+	for k := range d.delta_uk {
+		for j, delta_v := range d.delta_uk[k] {
+			saved.delta_uk[k][j] = rbm.UK(k, j)
+			rbm.SetUK(k, j, saved.delta_uk[k][j]+x_t*delta_v)
+		}
+	}
+	for k, delta_v := range d.delta_dk {
+		saved.delta_dk[k] = rbm.DK(k)
+		rbm.SetDK(k, saved.delta_dk[k]+x_t*delta_v)
+	}
+	return saved
+}
+
+// setParameters sets the parameters of the model to the values returned by
+// addDelta.
+func (rbm *SparseClassRBM) setParameters(values *deltaT) {
+	for _, e := range values.delta_w {
+		rbm.SetW(e.h_index, e.c_index, e.c_value, e.delta_v)
+	}
+	for _, e := range values.delta_b {
+		rbm.SetB(e.c_index, e.c_value, e.delta_v)
+	}
+	for j := range values.delta_c {
+		rbm.SetC(j, values.delta_c[j])
+		rbm.SetU(j, values.delta_u[j])
+	}
+	rbm.SetD(values.delta_d)
+	for k := range values.delta_uk {
+		for j, v := range values.delta_uk[k] {
+			rbm.SetUK(k, j, v)
+		}
+	}
+	for k, v := range values.delta_dk {
+		rbm.SetDK(k, v)
+	}
+}
+
+// writeChains writes the persistent chains of the trainer:
+//  num_particles uint32, 0 if there is no chain
+//  next          uint32
+//  particles     [num_particles]particle
+//  num_swaps     uint32, the number of temperatures minus one for PT, 0 otherwise
+//  swap_stats    [num_swaps]{attempts, accepts uint64}
+//  ladders       [num_particles][num_swaps]particle
+//  has_fast      uint32, 1 if the fast weights follow
+//  fast          fast weights divided by the fast learning rate, as the
+//                deltas of the Gradient layout with those of the hidden units
+// a particle being
+//  y             uint32
+//  target        float64
+//  x             [x_class_num]uint32, the value plus one, 0 if missing
+//  has_bags      uint32, 1 if the bags follow
+//  bags          [x_class_num]{n uint32, [n]uint32}
+//  has_real      uint32, 1 if the real values follow
+//  x_real        [x_class_num]float64
+func (trainer *RBMTrainer) writeChains(mw *modelWriter) {
+	chains := trainer.chains
+	if chains == nil {
+		chains = new(chainState)
+	}
+	mw.writeUint32(len(chains.particles))
+	mw.writeUint32(chains.next)
+	for _, p := range chains.particles {
+		mw.writeParticle(p)
+	}
+	mw.writeUint32(len(chains.swap_attempts))
+	for m := range chains.swap_attempts {
+		mw.writeUint64(uint64(chains.swap_attempts[m]))
+		mw.writeUint64(uint64(chains.swap_accepts[m]))
+	}
+	for _, ladder := range chains.ladders {
+		for _, p := range ladder {
+			mw.writeParticle(p)
+		}
+	}
+	if chains.fast == nil {
+		mw.writeUint32(0)
+		return
+	}
+	mw.writeUint32(1)
+	mw.writeDeltas(chains.fast.delta, true)
+}
+
+// readChains reads the persistent chains written by writeChains for the
+// given model, returning nil if there is none. The checkpoints before version
+// 9 have no swap section.
+func (mr *modelReader) readChains(rbm *SparseClassRBM, version int) *chainState {
+	num_particles := mr.readDimension("number of particles", 0)
+	next := mr.readUint32()
+	if mr.err == nil && next > 0 && next >= num_particles {
+		mr.err = fmt.Errorf("Invalid next particle %d of %d.", next, num_particles)
+	}
+	var chains chainState
+	chains.next = next
+	for i := 0; i < num_particles && mr.err == nil; i++ {
+		chains.particles = append(chains.particles, mr.readParticle(rbm))
+	}
+	num_swaps := 0
+	if version >= 9 {
+		num_swaps = mr.readDimension("number of swaps", 0)
+	}
+	if num_swaps > 0 && mr.err == nil {
+		chains.swap_attempts = make([]int64, num_swaps)
+		chains.swap_accepts = make([]int64, num_swaps)
+		for m := 0; m < num_swaps; m++ {
+			chains.swap_attempts[m] = int64(mr.readUint64())
+			chains.swap_accepts[m] = int64(mr.readUint64())
+		}
+		for i := 0; i < num_particles && mr.err == nil; i++ {
+			ladder := make([]*particleT, num_swaps)
+			for m := range ladder {
+				ladder[m] = mr.readParticle(rbm)
+			}
+			chains.ladders = append(chains.ladders, ladder)
+		}
+	}
+	has_fast := mr.readUint32()
+	if mr.err == nil && has_fast > 1 {
+		mr.err = fmt.Errorf("Invalid flag of fast weights %d.", has_fast)
+	}
+	if has_fast == 1 && mr.err == nil {
+		delta, hidden := mr.readDeltas(rbm)
+		if mr.err == nil && !hidden {
+			mr.err = fmt.Errorf("Missing fast weights of the hidden units.")
+		}
+		if mr.err == nil {
+			chains.fast = rbm.newBatchDelta()
+			chains.fast.add(delta)
+		}
+	}
+	if num_particles == 0 && num_swaps == 0 && chains.fast == nil {
+		return nil
+	}
+	return &chains
+}
+
+// writeParticle writes a particle, see writeChains.
+func (mw *modelWriter) writeParticle(p *particleT) {
+	mw.writeUint32(p.y)
+	mw.writeWeight(p.target)
+	mw.writeInstance(p.v)
+}
+
+// readParticle reads a particle written by writeParticle, making sure that it
+// fits the given model.
+func (mr *modelReader) readParticle(rbm *SparseClassRBM) *particleT {
+	p := &particleT{y: mr.readUint32(), target: mr.readWeight()}
+	if mr.err == nil && p.y >= len(rbm.newLabelDeltas()) {
+		mr.err = fmt.Errorf("Invalid label %d of particle.", p.y)
+	}
+	p.v = mr.readInstance(rbm)
+	return p
+}
+
+// writeInstance writes the visible configuration of an instance, as in the
+// particles of writeChains.
+func (mw *modelWriter) writeInstance(v *DataInstance) {
+	for _, k := range v.x {
+		mw.writeUint32(k + 1)
+	}
+	if v.x_bags == nil {
+		mw.writeUint32(0)
+	} else {
+		mw.writeUint32(1)
+		for _, bag := range v.x_bags {
+			mw.writeUint32(len(bag))
+			for _, k := range bag {
+				mw.writeUint32(k)
+			}
+		}
+	}
+	if v.x_real == nil {
+		mw.writeUint32(0)
+	} else {
+		mw.writeUint32(1)
+		mw.writeWeights(v.x_real)
+	}
+}
+
+// readInstance reads an instance written by writeInstance, making sure that
+// its values fit the given model.
+func (mr *modelReader) readInstance(rbm *SparseClassRBM) *DataInstance {
+	v := &DataInstance{x: make([]int, rbm.x_class_num)}
+	for c := range v.x {
+		v.x[c] = mr.readUint32() - 1
+		if mr.err == nil && v.x[c] >= rbm.ClassSize(c) {
+			mr.err = fmt.Errorf("Invalid value %d of class %d.", v.x[c], c)
+		}
+	}
+	if has_bags := mr.readUint32(); has_bags == 1 {
+		v.x_bags = make([][]int, rbm.x_class_num)
+		for c := range v.x_bags {
+			n := mr.readDimension("number of values", 0)
+			for i := 0; i < n && mr.err == nil; i++ {
+				k := mr.readUint32()
+				if mr.err == nil && k >= rbm.ClassSize(c) {
+					mr.err = fmt.Errorf("Invalid value %d of class %d.", k, c)
+				}
+				v.x_bags[c] = append(v.x_bags[c], k)
+			}
+		}
+	} else if mr.err == nil && has_bags != 0 {
+		mr.err = fmt.Errorf("Invalid flag of bags %d.", has_bags)
+	}
+	if has_real := mr.readUint32(); has_real == 1 {
+		v.x_real = mr.readWeights(rbm.x_class_num)
+	} else if mr.err == nil && has_real != 0 {
+		mr.err = fmt.Errorf("Invalid flag of real values %d.", has_real)
+	}
+	return v
+}
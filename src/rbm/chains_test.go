@@ -0,0 +1,92 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_PersistentParticles(t *testing.T) {
+	data := getBatchTestData()
+	cd := newBatchTestTrainer(data)
+	deltas := cd.rbm.newLabelDeltas()
+	for labels := cd.doGradient(deltas); labels != nil; labels = cd.doGradient(deltas) {
+	}
+	if cd.chains != nil {
+		t.Errorf("Expected no persistent chain with CD-k.")
+	}
+
+	pcd := newBatchTestTrainer(data)
+	pcd.SetSamplingMethod(KPersistentCD, 3)
+	for labels := pcd.doGradient(deltas); labels != nil; labels = pcd.doGradient(deltas) {
+	}
+	chains := pcd.chains
+	if chains == nil || len(chains.particles) != 3 || chains.next != 1 || chains.fast != nil {
+		t.Fatalf("Expected 3 particles, the second one being next, but got %v.", chains)
+	}
+	for i, p := range chains.particles {
+		if !pcd.rbm.IsValidInput(DataInstance{x: p.v.x, pos_y: 1}) || p.y < 0 || p.y > 1 {
+			t.Errorf("Invalid particle %d: %v, y = %d.", i, p.v, p.y)
+		}
+	}
+	if second := chains.particles[1]; chains.particles[pcd.nextParticle(nil, 0, 0)] != second || chains.next != 2 {
+		t.Errorf("Expected the particles to be advanced in turn.")
+	}
+
+	pcd.SetSamplingMethod(KPersistentCD, 2)
+	if pcd.chains != nil {
+		t.Errorf("Expected the chains to be discarded.")
+	}
+}
+
+func Test_addDelta(t *testing.T) {
+	rbm := getSampleMultiClassRBM()
+	original := getSampleMultiClassRBM()
+	d := rbm.NewDeltaT()
+	d.delta_w = []deltaWT{{0, 1, 1, 0.5}, {1, 2, 0, -1}}
+	d.delta_b = []deltaBT{{1, 1, 0.25}}
+	d.delta_c[1], d.delta_uk[0][1], d.delta_dk[1] = 1, -2, 3
+
+	saved := rbm.addDelta(d, 2)
+	if !EqualWithinPrecision(rbm.W(1, 2, 0), original.W(1, 2, 0)-2, kPrecision) ||
+		!EqualWithinPrecision(rbm.B(1, 1), original.B(1, 1)+0.5, kPrecision) ||
+		!EqualWithinPrecision(rbm.C(1), original.C(1)+2, kPrecision) ||
+		!EqualWithinPrecision(rbm.UK(0, 1), original.UK(0, 1)-4, kPrecision) ||
+		!EqualWithinPrecision(rbm.DK(1), original.DK(1)+6, kPrecision) {
+		t.Errorf("Expected the deltas to be added to the model but got\n%v.", rbm)
+	}
+	rbm.setParameters(saved)
+	if !reflect.DeepEqual(rbm, original) {
+		t.Errorf("Expected model\n%v\nbut got\n%v.", original, rbm)
+	}
+}
+
+func Test_updateFastWeights(t *testing.T) {
+	trainer := newBatchTestTrainer(getBatchTestData())
+	trainer.SetSamplingMethod(KFastPersistentCD, 1)
+	trainer.SetFastWeights(2, 0.5)
+	trainer.updateFastWeights(trainer.rbm.NewDeltaT(), 1)
+	if trainer.fastWeights() != nil {
+		t.Fatalf("Expected no fast weights before the chains are started.")
+	}
+	trainer.nextParticle(&DataInstance{x: []int{0, 1, 2}}, 1, 0)
+
+	d := trainer.rbm.NewDeltaT()
+	d.delta_w = []deltaWT{{0, 1, 1, 1}}
+	d.delta_c[0] = 1
+	trainer.updateFastWeights(d, 0.5)
+	trainer.updateFastWeights(d, 0.5)
+	fast := trainer.fastWeights()
+	if len(fast.delta.delta_w) != 1 || fast.delta.delta_w[0].delta_v != 0.75 || fast.delta.delta_c[0] != 0.75 {
+		t.Errorf("Expected fast weights 0.75 but got %v.", fast.delta)
+	}
+	for i := 0; i < 30; i++ {
+		trainer.updateFastWeights(trainer.rbm.NewDeltaT(), 1)
+	}
+	if len(fast.delta.delta_w) != 0 || len(fast.w_entries) != 0 {
+		t.Errorf("Expected the decayed fast weights to be dropped but got %v.", fast.delta.delta_w)
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Training checkpoints.
+//
+// A checkpoint captures everything needed for an interrupted training run to
+// continue exactly as the uninterrupted one would have. It uses the primitives
+// of the model file format (see model_io.go):
+//  magic               [8]byte "SCRBMCKP"
+//  version             uint32
+//  trainParameters     learning_rate, regularization_rate, momentum_rate,
+//                      gen_learn_importance as float64, gibbs_chain_length,
+//                      sampling_method, num_particles uint32,
+//                      fast_learning_rate, fast_weight_decay float64 (since
+//                      version 8), num_betas uint32, betas [num_betas]float64,
+//                      the inverse temperatures of PT, none for the default
+//                      ones (since version 9), unsup_importance float64 (since
+//                      version 10), sparsity_target, sparsity_cost,
+//                      sparsity_decay float64 (since version 13)
+//  epoch               uint32
+//  instances           uint64
+//  prev_auc, best_auc  float64
+//  reader offset       uint64
+//  rng seed, draws     uint64, see countingSource
+//  rbm                 model parameters, as in the model file of the same
+//                      version up to version 7, and of version 7 after that
+//  prev_delta          the previous changes of the parameters, in the layout of
+//                      rbm (before version 11)
+//  optimizer           name_length uint32, name [name_length]byte, the String()
+//                      of the optimizer, then its state, see writeOptimizerState
+//                      (since version 11)
+//  updates             uint64, the number of model updates (since version 12)
+//  schedules           schedules of the learning rate and of the momentum, see
+//                      writeSchedule (since version 12)
+//  activity            num_hidden uint32, activity [num_hidden]float64, the
+//                      average activations of the hidden units, none without
+//                      sparsity target (since version 13)
+//  chains              persistent chains of PCD and FPCD, see writeChains
+//                      (since version 8)
+//  checksum            uint32
+//
+// The fields missing from older checkpoints take their defaults, and the
+// previous changes of their parameters become the state of the SGD optimizer,
+// which they have to be resumed with.
+
+package rbm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	kCheckpointMagic   = "SCRBMCKP"
+	kCheckpointVersion = 13
+)
+
+// SaveCheckpoint writes the current training state to w. The training data
+// accessor must implement SeekableDataInstanceAccessor.
+func (trainer *RBMTrainer) SaveCheckpoint(w io.Writer) error {
+	accessor, ok := trainer.training_data_accessor.(SeekableDataInstanceAccessor)
+	if !ok {
+		return fmt.Errorf("Training data accessor does not support seeking.")
+	}
+	param := &trainer.parameters
+	mw := newModelWriter(w)
+	mw.writeBytes([]byte(kCheckpointMagic))
+	mw.writeUint32(kCheckpointVersion)
+	mw.writeWeight(param.learning_rate)
+	mw.writeWeight(param.regularization_rate)
+	mw.writeWeight(param.momentum_rate)
+	mw.writeWeight(param.gen_learn_importance)
+	mw.writeUint32(param.gibbs_chain_length)
+	mw.writeUint32(int(param.sampling_method))
+	mw.writeUint32(param.num_particles)
+	mw.writeWeight(param.fast_learning_rate)
+	mw.writeWeight(param.fast_weight_decay)
+	mw.writeUint32(len(param.betas))
+	mw.writeWeights(param.betas)
+	mw.writeWeight(param.unsup_importance)
+	mw.writeWeight(param.sparsity_target)
+	mw.writeWeight(param.sparsity_cost)
+	mw.writeWeight(param.sparsity_decay)
+	mw.writeUint32(trainer.epoch)
+	mw.writeUint64(uint64(trainer.instances))
+	mw.writeWeight(WeightT(trainer.prev_auc))
+	mw.writeWeight(WeightT(trainer.best_auc))
+	mw.writeUint64(uint64(accessor.Offset()))
+	mw.writeUint64(uint64(trainer.rng_source.seed))
+	mw.writeUint64(trainer.rng_source.draws)
+	trainer.rbm.writeParameters(mw)
+	mw.writeUint32(len(trainer.optimizer.String()))
+	mw.writeBytes([]byte(trainer.optimizer.String()))
+	mw.writeOptimizerState(trainer.optimizer_state)
+	mw.writeUint64(uint64(trainer.schedules.updates))
+	mw.writeSchedule(&trainer.schedules.learning_rate)
+	mw.writeSchedule(&trainer.schedules.momentum_rate)
+	activity := trainer.HiddenActivity()
+	mw.writeUint32(len(activity))
+	mw.writeWeights(activity)
+	trainer.writeChains(mw)
+	mw.writeChecksum()
+	if mw.err != nil {
+		return fmt.Errorf("Failed to save checkpoint: %s.", mw.err)
+	}
+	return nil
+}
+
+// LoadCheckpoint restores the training state saved by SaveCheckpoint,
+// including the model, and moves the training data accessor to where it was
+// when the checkpoint was taken. The trainer must have been initialized with
+// the same training data, and given the same optimizer and schedules.
+func (trainer *RBMTrainer) LoadCheckpoint(r io.Reader) error {
+	accessor, ok := trainer.training_data_accessor.(SeekableDataInstanceAccessor)
+	if !ok {
+		return fmt.Errorf("Training data accessor does not support seeking.")
+	}
+	mr := newModelReader(r)
+	magic := make([]byte, len(kCheckpointMagic))
+	mr.readBytes(magic)
+	if mr.err == nil && string(magic) != kCheckpointMagic {
+		return fmt.Errorf("Failed to load checkpoint: not a SparseClassRBM checkpoint.")
+	}
+	version := mr.readUint32()
+	if mr.err == nil && (version < 1 || version > kCheckpointVersion) {
+		return fmt.Errorf("Failed to load checkpoint: unsupported version %d, expected at most %d.",
+			version, kCheckpointVersion)
+	}
+	var param trainParameters
+	param.learning_rate = mr.readWeight()
+	param.regularization_rate = mr.readWeight()
+	param.momentum_rate = mr.readWeight()
+	param.gen_learn_importance = mr.readWeight()
+	param.gibbs_chain_length = mr.readUint32()
+	param.num_particles = 1
+	param.fast_learning_rate = param.learning_rate
+	param.fast_weight_decay = kDefaultFastWeightDecay
+	if version >= 8 {
+		param.sampling_method = SamplingMethod(mr.readUint32())
+		param.num_particles = mr.readDimension("number of particles", 1)
+		param.fast_learning_rate = mr.readWeight()
+		param.fast_weight_decay = mr.readWeight()
+	}
+	if version >= 9 {
+		if num_betas := mr.readDimension("number of temperatures", 0); num_betas > 0 {
+			param.betas = mr.readWeights(num_betas)
+		}
+	}
+	if version >= 10 {
+		param.unsup_importance = mr.readWeight()
+	}
+	if version >= 13 {
+		param.sparsity_target = mr.readWeight()
+		param.sparsity_cost = mr.readWeight()
+		param.sparsity_decay = mr.readWeight()
+	}
+	epoch := mr.readUint32()
+	instances := int64(mr.readUint64())
+	prev_auc := float64(mr.readWeight())
+	best_auc := float64(mr.readWeight())
+	offset := int64(mr.readUint64())
+	seed := int64(mr.readUint64())
+	draws := mr.readUint64()
+	model_version := version
+	if model_version > kModelVersion {
+		model_version = kModelVersion
+	}
+	var rbm SparseClassRBM
+	rbm.readParameters(mr, model_version)
+	var optimizer_state *optimizerStateT
+	if version >= 11 {
+		optimizer := make([]byte, mr.readDimension("length of the optimizer name", 0))
+		mr.readBytes(optimizer)
+		if mr.err == nil && string(optimizer) != trainer.optimizer.String() {
+			return fmt.Errorf("Failed to load checkpoint: optimizer %s, expected %s.", optimizer, trainer.optimizer)
+		}
+		optimizer_state = mr.readOptimizerState(&rbm, trainer.optimizer)
+	} else {
+		var prev_delta SparseClassRBM
+		prev_delta.readParameters(mr, model_version)
+		if mr.err == nil && trainer.optimizer.String() != NewMomentumSGD().String() {
+			return fmt.Errorf("Failed to load checkpoint: optimizer %s, expected %s.",
+				NewMomentumSGD(), trainer.optimizer)
+		}
+		if mr.err == nil && !rbm.sameDimensions(&prev_delta) {
+			return fmt.Errorf("Failed to load checkpoint: model and momentum dimensions differ.")
+		}
+		if mr.err == nil {
+			optimizer_state = rbm.momentumState(&prev_delta)
+		}
+	}
+	var updates int64
+	var learning_rate_state, momentum_rate_state []float64
+	if version >= 12 {
+		updates = int64(mr.readUint64())
+		learning_rate_state = mr.readSchedule(&trainer.schedules.learning_rate, "learning rate")
+		momentum_rate_state = mr.readSchedule(&trainer.schedules.momentum_rate, "momentum")
+	}
+	var activity *activityT
+	if version >= 13 {
+		if num_hidden := mr.readDimension("number of hidden activities", 0); num_hidden > 0 {
+			activity = &activityT{q: mr.readWeights(num_hidden)}
+		}
+	}
+	var chains *chainState
+	if version >= 8 {
+		chains = mr.readChains(&rbm, version)
+	}
+	mr.verifyChecksum()
+	if mr.err != nil {
+		return fmt.Errorf("Failed to load checkpoint: %s.", mr.err)
+	}
+	if param.sampling_method > KParallelTempering {
+		return fmt.Errorf("Failed to load checkpoint: invalid sampling method %d.", param.sampling_method)
+	}
+	for m, beta := range param.betas {
+		if beta <= 0 || (m == 0 && beta != 1) || (m > 0 && beta >= param.betas[m-1]) {
+			return fmt.Errorf("Failed to load checkpoint: invalid inverse temperatures %v.", param.betas)
+		}
+	}
+	if chains != nil && len(chains.particles) > param.num_particles {
+		return fmt.Errorf("Failed to load checkpoint: %d particles, expected at most %d.",
+			len(chains.particles), param.num_particles)
+	}
+	if num_swaps := len(param.temperatures()) - 1; chains != nil && len(chains.swap_attempts) > 0 &&
+		len(chains.swap_attempts) != num_swaps {
+		return fmt.Errorf("Failed to load checkpoint: %d replicas per particle, expected %d.",
+			len(chains.swap_attempts), num_swaps)
+	}
+	if (param.sparsity_cost > 0) != (activity != nil) ||
+		(activity != nil && len(activity.q) != rbm.SizeOfHiddenLayer()) {
+		return fmt.Errorf("Failed to load checkpoint: invalid hidden activities.")
+	}
+	if math.IsNaN(prev_auc) || math.IsNaN(best_auc) {
+		return fmt.Errorf("Failed to load checkpoint: invalid AUC.")
+	}
+	if err := accessor.SeekTo(offset); err != nil {
+		return fmt.Errorf("Failed to restore reader position: %s.", err)
+	}
+
+	trainer.parameters = param
+	*trainer.rbm = rbm
+	trainer.optimizer_state = optimizer_state
+	trainer.chains = chains
+	trainer.activity = activity
+	trainer.epoch = epoch
+	trainer.instances = instances
+	trainer.prev_auc = prev_auc
+	trainer.best_auc = best_auc
+	trainer.rng_source.restore(seed, draws)
+	trainer.schedules.updates = updates
+	copy(trainer.schedules.learning_rate.state, learning_rate_state)
+	copy(trainer.schedules.momentum_rate.state, momentum_rate_state)
+	trainer.updateRates()
+	return nil
+}
+
+// SaveCheckpointToFile saves a checkpoint to the given file. The checkpoint is
+// first written to a temporary file which then replaces the given file, so
+// that a crash while saving never leaves a partial checkpoint behind.
+func (trainer *RBMTrainer) SaveCheckpointToFile(filename string) error {
+	tmp_filename := filename + ".tmp"
+	file, err := os.Create(tmp_filename)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = trainer.SaveCheckpoint(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(tmp_filename)
+		return err
+	}
+	return os.Rename(tmp_filename, filename)
+}
+
+// ResumeFrom restores the training state from the given checkpoint file and
+// continues training from there.
+func (trainer *RBMTrainer) ResumeFrom(checkpoint string) error {
+	file, err := os.Open(checkpoint)
+	if err != nil {
+		return err
+	}
+	err = trainer.LoadCheckpoint(bufio.NewReader(file))
+	file.Close()
+	if err != nil {
+		return err
+	}
+	trainer.Train()
+	return nil
+}
+
+// sameDimensions determines whether the two RBMs have the same shape.
+func (rbm *SparseClassRBM) sameDimensions(a *SparseClassRBM) bool {
+	if rbm.h_num != a.h_num || rbm.x_class_num != a.x_class_num ||
+		rbm.y_class_num != a.y_class_num || rbm.y_gaussian != a.y_gaussian ||
+		rbm.x_bias_mode != a.x_bias_mode {
+		return false
+	}
+	for c, k := range rbm.x_class_sizes {
+		if a.x_class_sizes[c] != k {
+			return false
+		}
+	}
+	return true
+}
+
+// momentumState converts the previous changes of the parameters kept by the
+// checkpoints before version 11 into the state of the SGD optimizer, which is
+// the previous change of every parameter. The state of a parameter of X is
+// only kept when its change is not 0, and that of the standard deviation of a
+// Gaussian class is the change of its log.
+func (rbm *SparseClassRBM) momentumState(prev_delta *SparseClassRBM) *optimizerStateT {
+	state := rbm.newOptimizerState(NewMomentumSGD())
+	for c := range state.classes {
+		class := &state.classes[c]
+		for j := 0; j < rbm.h_num; j++ {
+			for k, delta := range prev_delta.w[c][j] {
+				if delta != 0 {
+					class.w[j*rbm.ClassSize(c)+k] = []WeightT{delta}
+				}
+			}
+		}
+		for i, delta := range prev_delta.b[c] {
+			if delta != 0 {
+				class.b[i] = []WeightT{delta}
+			}
+		}
+		if rbm.isGaussian(c) && prev_delta.x_sigmas[c] != 0 {
+			class.s = []WeightT{prev_delta.x_sigmas[c]}
+		}
+	}
+	copy(state.c, prev_delta.c)
+	copy(state.u, prev_delta.u)
+	state.d[0] = prev_delta.d
+	for k := range prev_delta.uk {
+		copy(state.uk[k*rbm.h_num:(k+1)*rbm.h_num], prev_delta.uk[k])
+	}
+	copy(state.dk, prev_delta.dk)
+	return state
+}
@@ -0,0 +1,282 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// crashingDataLoader simulates a crash by panicking after a given number of
+// instances have been read.
+type crashingDataLoader struct {
+	*SequentialDataLoader
+	remaining int
+}
+
+func (loader *crashingDataLoader) NextInstance() (DataInstance, error) {
+	if loader.remaining == 0 {
+		panic("simulated crash")
+	}
+	loader.remaining--
+	return loader.SequentialDataLoader.NextInstance()
+}
+
+func Test_ResumeFrom(t *testing.T) {
+	train_file := "./checkpoint_training.txt"
+	checkpoint_file := "./checkpoint_test.ckp"
+	class_sizes := []int{2, 3, 4}
+	train_data := []DataInstance{
+		{x: []int{0, 1, 1}, pos_y: 2, neg_y: 1},
+		{x: []int{1, 2, 1}, pos_y: 0, neg_y: 1},
+		{x: []int{1, 0, 3}, pos_y: 1, neg_y: 0},
+		{x: []int{1, 2, 3}, pos_y: 10, neg_y: 2},
+		{x: []int{0, 0, 2}, pos_y: 0, neg_y: 3},
+	}
+	saveDataToFile(train_file, train_data)
+	defer os.Remove(train_file)
+	defer os.Remove(checkpoint_file)
+
+	var initial SparseClassRBM
+	initial.Initialize(class_sizes,
+		[][]WeightT{{0.1, 0.2}, {0.3, 0.2, 0.1}, {0.1, 0.2, 0.3, 0.4}}, 3, 0.3)
+	var model_buf bytes.Buffer
+	if err := initial.SaveModel(&model_buf); err != nil {
+		t.Fatalf("Failed to save model: %s.", err)
+	}
+	newTrainer := func(accessor DataInstanceAccessor) *RBMTrainer {
+		rbm := new(SparseClassRBM)
+		if err := rbm.LoadModel(bytes.NewReader(model_buf.Bytes())); err != nil {
+			t.Fatalf("Failed to load model: %s.", err)
+		}
+		validation := NewInstanceLoader(train_file, len(class_sizes))
+		trainer := new(RBMTrainer)
+		trainer.Initialize(rbm, accessor, validation, 0.05, 0.001, 0.5, 0.5, 1)
+		trainer.SetSeed(1234)
+		trainer.SetMaxEpochs(3)
+		return trainer
+	}
+
+	// Uninterrupted run.
+	uninterrupted_loader := NewInstanceLoader(train_file, len(class_sizes))
+	defer uninterrupted_loader.Close()
+	uninterrupted := newTrainer(uninterrupted_loader)
+	uninterrupted.Train()
+
+	// Interrupted run, crashing in the middle of the second epoch.
+	crashing_loader := &crashingDataLoader{NewInstanceLoader(train_file, len(class_sizes)), 19}
+	defer crashing_loader.Close()
+	interrupted := newTrainer(crashing_loader)
+	interrupted.SetCheckpoint(checkpoint_file, 2)
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("Expected training to crash.")
+			}
+		}()
+		interrupted.Train()
+	}()
+
+	// Resume with a fresh trainer and model.
+	resumed_loader := NewInstanceLoader(train_file, len(class_sizes))
+	defer resumed_loader.Close()
+	resumed := newTrainer(resumed_loader)
+	resumed.SetSeed(99)
+	if err := resumed.ResumeFrom(checkpoint_file); err != nil {
+		t.Fatalf("Failed to resume: %s.", err)
+	}
+	if resumed.epoch != uninterrupted.epoch {
+		t.Errorf("Expected %d epochs but got %d.", uninterrupted.epoch, resumed.epoch)
+	}
+	if !reflect.DeepEqual(resumed.rbm, uninterrupted.rbm) {
+		t.Errorf("Expected resumed model\n%v\nto be equal to\n%v.", resumed.rbm, uninterrupted.rbm)
+	}
+	if !reflect.DeepEqual(resumed.optimizer_state, uninterrupted.optimizer_state) {
+		t.Errorf("Expected momentum of resumed run to be equal to that of the uninterrupted run.")
+	}
+	if resumed.best_auc != uninterrupted.best_auc {
+		t.Errorf("Expected best AUC %f but got %f.", uninterrupted.best_auc, resumed.best_auc)
+	}
+}
+
+// Test_CheckpointPersistentChains checks that the persistent chains, the
+// fast weights of FPCD and the replicas of PT are restored from a checkpoint,
+// so that training goes on as it would have.
+func Test_CheckpointPersistentChains(t *testing.T) {
+	train_file := "./checkpoint_chains.txt"
+	saveDataToFile(train_file, getBatchTestData())
+	defer os.Remove(train_file)
+	for _, method := range []SamplingMethod{KFastPersistentCD, KParallelTempering} {
+		newTrainer := func() *RBMTrainer {
+			loader := NewInstanceLoader(train_file, 3)
+			trainer := new(RBMTrainer)
+			trainer.Initialize(getSampleRBMForProbabilityTest(), loader, loader, 0.1, 0.01, 0.5, 0.5, 1)
+			trainer.SetSamplingMethod(method, 3)
+			trainer.SetFastWeights(0.5, 0.9)
+			trainer.SetTemperatures([]WeightT{1, 0.7, 0.4})
+			trainer.SetSeed(1)
+			trainer.SetMaxEpochs(1)
+			return trainer
+		}
+		trainer := newTrainer()
+		defer trainer.training_data_accessor.Close()
+		trainer.Train()
+		var buf bytes.Buffer
+		if err := trainer.SaveCheckpoint(&buf); err != nil {
+			t.Fatalf("Failed to save checkpoint: %s.", err)
+		}
+
+		resumed := newTrainer()
+		defer resumed.training_data_accessor.Close()
+		resumed.SetSamplingMethod(KContrastiveDivergence, 1)
+		resumed.SetTemperatures([]WeightT{1})
+		resumed.SetSeed(2)
+		if err := resumed.LoadCheckpoint(&buf); err != nil {
+			t.Fatalf("Failed to load checkpoint: %s.", err)
+		}
+		if resumed.SamplingMethod() != method || !reflect.DeepEqual(resumed.parameters, trainer.parameters) {
+			t.Errorf("Expected parameters %v but got %v.", trainer.parameters, resumed.parameters)
+		}
+		if !reflect.DeepEqual(resumed.chains, trainer.chains) {
+			t.Errorf("%s: expected chains\n%v\nbut got\n%v.", method, trainer.chains, resumed.chains)
+		}
+		trainer.SetMaxEpochs(2)
+		trainer.Train()
+		resumed.SetMaxEpochs(2)
+		resumed.Train()
+		if !reflect.DeepEqual(resumed.rbm, trainer.rbm) {
+			t.Errorf("%s: expected resumed model\n%v\nto be equal to\n%v.", method, resumed.rbm, trainer.rbm)
+		}
+	}
+}
+
+// writeOldCheckpoint writes the state of a trainer with the SGD optimizer as
+// a checkpoint of the given version, from 7 to 10, which kept the previous
+// changes of the parameters instead of the state of the optimizer.
+func writeOldCheckpoint(w io.Writer, trainer *RBMTrainer, version int) error {
+	param := &trainer.parameters
+	rbm := trainer.rbm
+	state := trainer.optimizer_state
+	prev_delta := rbm.CloneEmpty()
+	for c := range state.classes {
+		class := &state.classes[c]
+		for key, s := range class.w {
+			prev_delta.SetW(key/rbm.ClassSize(c), c, key%rbm.ClassSize(c), s[0])
+		}
+		for key, s := range class.b {
+			prev_delta.SetB(c, key, s[0])
+		}
+		if class.s != nil {
+			prev_delta.SetSigma(c, class.s[0])
+		}
+	}
+	for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+		prev_delta.SetC(j, state.c[j])
+		prev_delta.SetU(j, state.u[j])
+	}
+	prev_delta.SetD(state.d[0])
+
+	mw := newModelWriter(w)
+	mw.writeBytes([]byte(kCheckpointMagic))
+	mw.writeUint32(version)
+	mw.writeWeight(param.learning_rate)
+	mw.writeWeight(param.regularization_rate)
+	mw.writeWeight(param.momentum_rate)
+	mw.writeWeight(param.gen_learn_importance)
+	mw.writeUint32(param.gibbs_chain_length)
+	if version >= 8 {
+		mw.writeUint32(int(param.sampling_method))
+		mw.writeUint32(param.num_particles)
+		mw.writeWeight(param.fast_learning_rate)
+		mw.writeWeight(param.fast_weight_decay)
+	}
+	if version >= 9 {
+		mw.writeUint32(len(param.betas))
+		mw.writeWeights(param.betas)
+	}
+	if version >= 10 {
+		mw.writeWeight(param.unsup_importance)
+	}
+	mw.writeUint32(trainer.epoch)
+	mw.writeUint64(uint64(trainer.instances))
+	mw.writeWeight(WeightT(trainer.prev_auc))
+	mw.writeWeight(WeightT(trainer.best_auc))
+	mw.writeUint64(uint64(trainer.training_data_accessor.(SeekableDataInstanceAccessor).Offset()))
+	mw.writeUint64(uint64(trainer.rng_source.seed))
+	mw.writeUint64(trainer.rng_source.draws)
+	rbm.writeParameters(mw)
+	prev_delta.writeParameters(mw)
+	if version >= 8 {
+		trainer.writeChains(mw)
+	}
+	mw.writeChecksum()
+	return mw.err
+}
+
+// Test_LoadOldCheckpoint checks that the checkpoints of older versions are
+// loaded with the defaults of the fields they lack, and their momentum as the
+// state of the SGD optimizer, so that training goes on as it would have.
+func Test_LoadOldCheckpoint(t *testing.T) {
+	train_file := "./checkpoint_old.txt"
+	saveDataToFile(train_file, getBatchTestData())
+	defer os.Remove(train_file)
+	for _, version := range []int{7, 10} {
+		newTrainer := func() *RBMTrainer {
+			loader := NewInstanceLoader(train_file, 3)
+			trainer := new(RBMTrainer)
+			trainer.Initialize(getSampleRBMForProbabilityTest(), loader, loader, 0.1, 0.01, 0.5, 0.5, 1)
+			if version >= 9 {
+				trainer.SetSamplingMethod(KParallelTempering, 2)
+				trainer.SetTemperatures([]WeightT{1, 0.5})
+			}
+			trainer.SetSeed(1)
+			trainer.SetMaxEpochs(1)
+			return trainer
+		}
+		trainer := newTrainer()
+		defer trainer.training_data_accessor.Close()
+		trainer.Train()
+		var buf bytes.Buffer
+		if err := writeOldCheckpoint(&buf, trainer, version); err != nil {
+			t.Fatalf("Failed to write checkpoint: %s.", err)
+		}
+
+		resumed := newTrainer()
+		defer resumed.training_data_accessor.Close()
+		resumed.SetSeed(2)
+		if err := resumed.LoadCheckpoint(&buf); err != nil {
+			t.Fatalf("Version %d: failed to load checkpoint: %s.", version, err)
+		}
+		if !reflect.DeepEqual(resumed.parameters, trainer.parameters) {
+			t.Errorf("Version %d: expected parameters %v but got %v.", version, trainer.parameters, resumed.parameters)
+		}
+		if !reflect.DeepEqual(resumed.chains, trainer.chains) {
+			t.Errorf("Version %d: expected chains\n%v\nbut got\n%v.", version, trainer.chains, resumed.chains)
+		}
+		trainer.SetMaxEpochs(2)
+		trainer.Train()
+		resumed.SetMaxEpochs(2)
+		resumed.Train()
+		if !reflect.DeepEqual(resumed.rbm, trainer.rbm) {
+			t.Errorf("Version %d: expected resumed model\n%v\nto be equal to\n%v.", version, resumed.rbm, trainer.rbm)
+		}
+	}
+
+	trainer := new(RBMTrainer)
+	loader := NewInstanceLoader(train_file, 3)
+	defer loader.Close()
+	trainer.Initialize(getSampleRBMForProbabilityTest(), loader, loader, 0.1, 0.01, 0.5, 0.5, 1)
+	var buf bytes.Buffer
+	if err := writeOldCheckpoint(&buf, trainer, 10); err != nil {
+		t.Fatalf("Failed to write checkpoint: %s.", err)
+	}
+	trainer.SetOptimizer(NewAdaGrad(KDefaultOptimizerEpsilon))
+	if err := trainer.LoadCheckpoint(&buf); err == nil {
+		t.Errorf("Expected the momentum of an old checkpoint to require the SGD optimizer.")
+	}
+}
@@ -0,0 +1,407 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Deep Boltzmann machines.
+//
+// A SparseClassDBM [8] has two layers of binary hidden units, h1 over X and
+// h2 over h1, and a binary y attached to h2:
+//	E(y, X, h1, h2) = E_1(X, h1) - h1^T . W2^T . h2 - h2^T . c2 - d . y - h2^T . u . y
+// E_1 being the energy of a SparseClassRBM over X and h1 without y. Unlike
+// the layers of a DeepSparseClassRBM, all the layers are trained jointly
+// [9]: the positive phase of the gradient of log P(X, y) is the mean-field
+// approximation
+//	Q(h1, h2) = prod{j}(Q(h1_j)) * prod{k}(Q(h2_k))
+// of P(h1, h2 | X, y), found by iterating
+//	mu1_j = sigmoid(W[j].X + c[j] + sum{k}(W2[k][j] * mu2_k))
+//	mu2_k = sigmoid(c2[k] + W2[k] . mu1 + u[k] * y)
+// while the negative phase is sampled from persistent chains, as with PCD.
+// P(y | X) is likewise approximated by mean-field inference, y being one
+// more unit of Q, updated with
+//	Q(y = 1) = sigmoid(d + u . mu2)
+//
+// References:
+//  [8]. Salakhutdinov, Hinton, 2009, Deep Boltzmann Machines
+//  [9]. Goodfellow, Courville, Bengio, 2013, Joint Training of Deep Boltzmann
+//  Machines for Classification
+
+package rbm
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	kDefaultMeanFieldIterations = 10   //maximum number of mean-field updates of an inference
+	kMeanFieldTolerance         = 1e-4 //inference stops once no mean changes by more
+	kDefaultDBMParticles        = 100  //default number of persistent chains of a DBMTrainer
+)
+
+// dbmLayerT holds the parameters of the second hidden layer of a
+// SparseClassDBM and of y.
+type dbmLayerT struct {
+	w [][]WeightT //interactions between h1 and h2 [h2, h1]
+	c []WeightT   //biases of h2
+	u []WeightT   //interactions between h2 and y
+	d WeightT     //bias of y
+}
+
+// newDBMLayer creates the parameters of a second hidden layer of num_h2
+// units over num_h1 units, whose interactions are drawn by rng from
+// Norm(0, 0.01) and whose biases are 0.
+func newDBMLayer(rng *rand.Rand, num_h1, num_h2 int) *dbmLayerT {
+	const w_deviation WeightT = 0.01
+	layer := &dbmLayerT{w: make([][]WeightT, num_h2), c: make([]WeightT, num_h2),
+		u: make([]WeightT, num_h2)}
+	for k := range layer.w {
+		layer.w[k] = make([]WeightT, num_h1)
+		for j := range layer.w[k] {
+			layer.w[k][j] = WeightT(rng.NormFloat64()) * w_deviation
+		}
+		layer.u[k] = WeightT(rng.NormFloat64()) * w_deviation
+	}
+	return layer
+}
+
+// SparseClassDBM is a Deep Boltzmann Machine with two hidden layers over the
+// classes of X and a binary y.
+type SparseClassDBM struct {
+	first                 *SparseClassRBM //X, h1 and their interactions; its y is not used
+	second                *dbmLayerT      //h2, y and their interactions with h1 and with each other
+	mean_field_iterations int             //maximum number of mean-field updates of an inference
+}
+
+// NewSparseClassDBM creates a DBM whose first hidden layer is that of the
+// given binary SparseClassRBM, which the DBM takes over, with a second
+// hidden layer of num_hidden units. The bias of y is taken from the
+// SparseClassRBM, whose interactions with y are cleared. The interactions of
+// the second hidden layer are drawn from a random number generator seeded
+// with seed.
+func NewSparseClassDBM(first *SparseClassRBM, num_hidden int, seed int64) *SparseClassDBM {
+	if first.IsMultiClass() || first.IsRegression() {
+		panic("Expected a SparseClassRBM of a binary y.")
+	}
+	if num_hidden < 1 {
+		panic("Number of hidden units must be greater than 0.")
+	}
+	second := newDBMLayer(rand.New(rand.NewSource(seed)), first.SizeOfHiddenLayer(), num_hidden)
+	second.d = first.D()
+	for j := 0; j < first.SizeOfHiddenLayer(); j++ {
+		first.SetU(j, 0)
+	}
+	first.SetD(0)
+	return &SparseClassDBM{first: first, second: second, mean_field_iterations: kDefaultMeanFieldIterations}
+}
+
+// First returns the SparseClassRBM of X and the first hidden layer.
+func (dbm *SparseClassDBM) First() *SparseClassRBM {
+	return dbm.first
+}
+
+// SizeOfSecondHiddenLayer returns the number of units of the second hidden
+// layer.
+func (dbm *SparseClassDBM) SizeOfSecondHiddenLayer() int {
+	return len(dbm.second.c)
+}
+
+// SetMeanFieldIterations sets the maximum number of mean-field updates of an
+// inference, 10 by default.
+func (dbm *SparseClassDBM) SetMeanFieldIterations(iterations int) {
+	if iterations < 1 {
+		panic(fmt.Sprintf("Expected a positive number of iterations but got %d.", iterations))
+	}
+	dbm.mean_field_iterations = iterations
+}
+
+// h2DotW2 calculates sum{k}(W2[k][j] * h2[k]), the input of h1_j from h2.
+func (dbm *SparseClassDBM) h2DotW2(j int, h2 []WeightT) WeightT {
+	s := WeightT(0)
+	for k, h2_k := range h2 {
+		s += dbm.second.w[k][j] * h2_k
+	}
+	return s
+}
+
+// h2Input calculates c2[k] + W2[k] . h1 + u[k] * y.
+func (dbm *SparseClassDBM) h2Input(k int, h1 []WeightT, y WeightT) WeightT {
+	return dbm.second.c[k] + DotProduct(dbm.second.w[k], h1) + dbm.second.u[k]*y
+}
+
+// probOfY calculates P(y = 1 | h2).
+func (dbm *SparseClassDBM) probOfY(h2 []WeightT) WeightT {
+	return Sigmoid(dbm.second.d + DotProduct(dbm.second.u, h2))
+}
+
+// meanFieldT holds the means of the mean-field distribution Q.
+type meanFieldT struct {
+	h1 []WeightT //Q(h1_j = 1)
+	h2 []WeightT //Q(h2_k = 1)
+	y  WeightT   //Q(y = 1), or the clamped y
+}
+
+// meanField infers Q for the instance v with label y, or with y inferred as
+// well if y is negative. The means start from a bottom-up pass ignoring h2,
+// then are updated in turn, h1, h2 and y, until none changes by more than
+// kMeanFieldTolerance. Missing classes of v contribute nothing to h1, unless
+// the model treats them as value 0.
+func (dbm *SparseClassDBM) meanField(v *DataInstance, y int) *meanFieldT {
+	w_dot_x_add_c := dbm.first.wDotXAddC(v)
+	q := &meanFieldT{h1: make([]WeightT, len(w_dot_x_add_c)), h2: make([]WeightT, dbm.SizeOfSecondHiddenLayer()),
+		y: WeightT(y)}
+	for j, a := range w_dot_x_add_c {
+		q.h1[j] = Sigmoid(a)
+	}
+	if y < 0 {
+		q.y = 0.5
+	}
+	for t := 0; t < dbm.mean_field_iterations; t++ {
+		change := WeightT(0)
+		update := func(mu *WeightT, value WeightT) {
+			change = WeightT(math.Max(float64(change), math.Abs(float64(value-*mu))))
+			*mu = value
+		}
+		if t > 0 {
+			for j, a := range w_dot_x_add_c {
+				update(&q.h1[j], Sigmoid(a+dbm.h2DotW2(j, q.h2)))
+			}
+		}
+		for k := range q.h2 {
+			update(&q.h2[k], Sigmoid(dbm.h2Input(k, q.h1, q.y)))
+		}
+		if y < 0 {
+			update(&q.y, dbm.probOfY(q.h2))
+		}
+		if t > 0 && change <= kMeanFieldTolerance {
+			break
+		}
+	}
+	return q
+}
+
+// GetPrediction returns the mean-field approximation of P(y = 1 | X).
+func (dbm *SparseClassDBM) GetPrediction(instance *DataInstance) WeightT {
+	return dbm.meanField(instance, -1).y
+}
+
+// dbmParticleT is a fantasy particle of a SparseClassDBM: a configuration of
+// X and y, and of both hidden layers.
+type dbmParticleT struct {
+	particleT
+	h1 []WeightT
+	h2 []WeightT
+}
+
+// probOfH1 calculates P(h1_j = 1 | X, h2) of every unit j of the first
+// hidden layer.
+func (dbm *SparseClassDBM) probOfH1(v *DataInstance, h2 []WeightT) []WeightT {
+	h1 := dbm.first.wDotXAddC(v)
+	for j := range h1 {
+		h1[j] = Sigmoid(h1[j] + dbm.h2DotW2(j, h2))
+	}
+	return h1
+}
+
+// probOfH2 calculates P(h2_k = 1 | h1, y) of every unit k of the second
+// hidden layer.
+func (dbm *SparseClassDBM) probOfH2(h1 []WeightT, y int) []WeightT {
+	h2 := make([]WeightT, dbm.SizeOfSecondHiddenLayer())
+	for k := range h2 {
+		h2[k] = Sigmoid(dbm.h2Input(k, h1, WeightT(y)))
+	}
+	return h2
+}
+
+// gibbsStep advances the particle p by one Gibbs step, sampling h1 and y,
+// which are independent given X and h2, then X and h2, which are
+// independent given h1 and y.
+func (dbm *SparseClassDBM) gibbsStep(rng *rand.Rand, p *dbmParticleT) {
+	sample := func(h []WeightT) {
+		for i, p_i := range h {
+			h[i] = 0
+			if randomWeight(rng) < p_i {
+				h[i] = 1
+			}
+		}
+	}
+	p.h1 = dbm.probOfH1(p.v, p.h2)
+	sample(p.h1)
+	p.y = 0
+	if randomWeight(rng) < dbm.probOfY(p.h2) {
+		p.y = 1
+	}
+	dbm.first.sampleXGivenH(rng, p.v, p.h1)
+	p.h2 = dbm.probOfH2(p.h1, p.y)
+	sample(p.h2)
+}
+
+// DBMTrainer trains a SparseClassDBM jointly by stochastic gradient ascent
+// of log P(X, y).
+type DBMTrainer struct {
+	dbm                      *SparseClassDBM
+	first_trainer            *RBMTrainer          //Updates the first layer, with the optimizer of the network
+	second_state             []WeightT            //Optimizer state of the parameters of the second layer
+	parameters               trainParameters      //Training parameters
+	training_data_accessor   DataInstanceAccessor //Training data
+	validation_data_accessor DataInstanceAccessor //Test data
+	rng                      *rand.Rand           //Random number generator used for sampling
+	max_epochs               int                  //Number of epochs to train
+	particles                []*dbmParticleT      //Persistent chains
+	next                     int                  //index of the particle to advance next
+}
+
+// Initialize a trainer of the given DBM, with the parameters of
+// RBMTrainer.Initialize; every training instance advances one of the
+// persistent chains by gibbs_chain_length steps.
+func (trainer *DBMTrainer) Initialize(dbm *SparseClassDBM,
+	train_data_accessor DataInstanceAccessor,
+	validation_data_accessor DataInstanceAccessor,
+	learning_rate WeightT, regularization_rate WeightT,
+	momentum_rate WeightT, gibbs_chain_length int) {
+	trainer.dbm = dbm
+	trainer.parameters = trainParameters{
+		learning_rate:       learning_rate,
+		regularization_rate: regularization_rate,
+		momentum_rate:       momentum_rate,
+		gibbs_chain_length:  gibbs_chain_length,
+		num_particles:       kDefaultDBMParticles,
+	}
+	trainer.first_trainer = new(RBMTrainer)
+	trainer.first_trainer.Initialize(dbm.first, nil, nil, learning_rate, regularization_rate,
+		momentum_rate, 0, gibbs_chain_length)
+	trainer.SetOptimizer(trainer.first_trainer.Optimizer())
+	trainer.training_data_accessor = train_data_accessor
+	trainer.validation_data_accessor = validation_data_accessor
+	trainer.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	trainer.max_epochs = 1
+	trainer.particles = nil
+	trainer.next = 0
+}
+
+// SetSeed seeds the random number generator used for sampling during
+// training.
+func (trainer *DBMTrainer) SetSeed(seed int64) {
+	trainer.rng.Seed(seed)
+}
+
+// SetMaxEpochs sets the number of epochs to train, 1 by default.
+func (trainer *DBMTrainer) SetMaxEpochs(max_epochs int) {
+	if max_epochs < 1 {
+		panic(fmt.Sprintf("Expected a positive number of epochs but got %d.", max_epochs))
+	}
+	trainer.max_epochs = max_epochs
+}
+
+// SetOptimizer makes the trainer compute the changes of the parameters with
+// the given optimizer, momentum SGD by default, discarding the state of the
+// previous one.
+func (trainer *DBMTrainer) SetOptimizer(optimizer Optimizer) {
+	trainer.first_trainer.SetOptimizer(optimizer)
+	second := trainer.dbm.second
+	num_parameters := len(second.c)*(len(second.w[0])+2) + 1
+	trainer.second_state = make([]WeightT, optimizer.StateSize()*num_parameters)
+}
+
+// SetNumParticles sets the number of persistent chains, 100 by default; a
+// new chain starts from the first training instance that uses it. Changing
+// it discards the chains.
+func (trainer *DBMTrainer) SetNumParticles(num_particles int) {
+	if num_particles < 1 {
+		panic(fmt.Sprintf("Expected a positive number of particles but got %d.", num_particles))
+	}
+	trainer.parameters.num_particles = num_particles
+	trainer.particles = nil
+	trainer.next = 0
+}
+
+// nextParticle returns the next persistent particle, starting a new chain
+// from the instance v with label y while there are fewer than num_particles
+// of them.
+func (trainer *DBMTrainer) nextParticle(v *DataInstance, y int) *dbmParticleT {
+	if len(trainer.particles) < trainer.parameters.num_particles {
+		p := &dbmParticleT{particleT: *newParticle(v, y, 0)}
+		p.h1 = make([]WeightT, trainer.dbm.first.SizeOfHiddenLayer())
+		p.h2 = make([]WeightT, trainer.dbm.SizeOfSecondHiddenLayer())
+		trainer.particles = append(trainer.particles, p)
+		return p
+	}
+	p := trainer.particles[trainer.next]
+	trainer.next = (trainer.next + 1) % len(trainer.particles)
+	return p
+}
+
+// Train trains the model for the given number of epochs, printing the
+// training log likelihood and the validation AUC after each.
+func (trainer *DBMTrainer) Train() {
+	dbm := trainer.dbm
+	for epoch := 0; epoch < trainer.max_epochs; epoch++ {
+		ForEachValidDataInstance(trainer.training_data_accessor, func(instance DataInstance) {
+			if !dbm.first.IsValidInput(instance) {
+				return
+			}
+			labels, counts := dbm.first.labelCounts(&instance)
+			for i, y := range labels {
+				if counts[i] > 0 {
+					trainer.update(&instance, y, WeightT(counts[i]))
+				}
+			}
+		})
+		fmt.Printf("Epoch: %d\n", epoch)
+		fmt.Printf("Training LogLikelihood: %f\n", LogLikelihood(dbm, trainer.training_data_accessor))
+		fmt.Printf("Validation AUC: %f\n", ROCAuc(dbm, trainer.validation_data_accessor))
+	}
+}
+
+// update applies the gradient of log P(X, y) of the instance v with label y,
+// scaled by count. The positive statistics are taken on the mean-field
+// means, and the negative ones on the next particle, advanced by
+// gibbs_chain_length Gibbs steps, with P(h1 | X_hat, h2_hat) and
+// P(h2 | h1_hat, y_hat) in place of the sampled hidden units:
+//	delta_W[c][j][k] = mu1_j * 1{X_c = k} - P(h1_j | X_hat, h2_hat) * 1{X_hat_c = k}
+//	delta_W2[k][j] = mu2_k * mu1_j - P(h2_k | h1_hat, y_hat) * h1_hat_j
+//	delta_u[k] = mu2_k * y - P(h2_k | h1_hat, y_hat) * y_hat
+// and likewise for the biases.
+func (trainer *DBMTrainer) update(v *DataInstance, y int, count WeightT) {
+	dbm := trainer.dbm
+	first := dbm.first
+	q := dbm.meanField(v, y)
+	p := trainer.nextParticle(v, y)
+	for t := 0; t < trainer.parameters.gibbs_chain_length; t++ {
+		dbm.gibbsStep(trainer.rng, p)
+	}
+	neg_h1 := dbm.probOfH1(p.v, p.h2)
+	neg_h2 := dbm.probOfH2(p.h1, p.y)
+
+	delta := first.NewDeltaT()
+	visible_deltas := first.visibleDeltas(v, p.v)
+	for j := range q.h1 {
+		delta.delta_c[j] = count * (q.h1[j] - neg_h1[j])
+		for _, d := range visible_deltas {
+			delta.delta_w = append(delta.delta_w,
+				deltaWT{j, d.c_index, d.c_value, count * (d.pos*q.h1[j] - d.neg*neg_h1[j])})
+		}
+	}
+	delta.delta_b = first.visibleBiasDeltas(visible_deltas, count)
+	trainer.first_trainer.updateModel(delta)
+
+	// the parameters of the second layer are visited in the order of their
+	// optimizer states
+	second := dbm.second
+	lambda := trainer.parameters.regularization_rate
+	size := trainer.first_trainer.Optimizer().StateSize()
+	i := 0
+	step := func(theta *WeightT, delta_v, lambda WeightT) {
+		*theta += trainer.first_trainer.step(trainer.second_state[i*size:(i+1)*size], *theta, count*delta_v, lambda)
+		i++
+	}
+	for k := range second.w {
+		for j, h1_hat_j := range p.h1 {
+			step(&second.w[k][j], q.h2[k]*q.h1[j]-neg_h2[k]*h1_hat_j, lambda)
+		}
+		step(&second.c[k], q.h2[k]-neg_h2[k], 0)
+		step(&second.u[k], q.h2[k]*q.y-neg_h2[k]*WeightT(p.y), lambda)
+	}
+	step(&second.d, q.y-WeightT(p.y), 0)
+}
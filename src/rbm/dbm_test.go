@@ -0,0 +1,81 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"testing"
+)
+
+func Test_SparseClassDBM(t *testing.T) {
+	dbm := NewSparseClassDBM(getSampleRBMForProbabilityTest(), 2, 1)
+	if dbm.SizeOfSecondHiddenLayer() != 2 || dbm.second.d != 0.03 || dbm.First().D() != 0 {
+		t.Fatalf("Expected 2 units in the second hidden layer and the bias of y moved to it.")
+	}
+	v := &DataInstance{x: []int{0, 1, 2}}
+
+	// Without interactions between the second hidden layer and the first
+	// one or y, y is independent of X, and h1 of the rest.
+	for k := range dbm.second.w {
+		for j := range dbm.second.w[k] {
+			dbm.second.w[k][j] = 0
+		}
+		dbm.second.u[k] = 0
+	}
+	if p := dbm.GetPrediction(v); !EqualWithinPrecision(p, Sigmoid(0.03), kPrecision) {
+		t.Errorf("Expected P(y|X) %v but got %v.", Sigmoid(0.03), p)
+	}
+	h := make([]WeightT, dbm.First().SizeOfHiddenLayer())
+	dbm.First().probDistOfHGivenInstance(h, v, 1)
+	q := dbm.meanField(v, 1)
+	for j := range h {
+		if !EqualWithinPrecision(q.h1[j], h[j], kPrecision) {
+			t.Errorf("Expected mu1_%d %v but got %v.", j, h[j], q.h1[j])
+		}
+	}
+
+	// The means inferred for y are a fixed point of the mean-field updates.
+	for k := range dbm.second.w {
+		for j := range dbm.second.w[k] {
+			dbm.second.w[k][j] = WeightT(j-k) * 0.5
+		}
+		dbm.second.u[k] = WeightT(2*k - 1)
+	}
+	dbm.SetMeanFieldIterations(100)
+	q = dbm.meanField(v, -1)
+	const precision = 1e-3
+	for j, h1_j := range dbm.probOfH1(v, q.h2) {
+		if !EqualWithinPrecision(q.h1[j], h1_j, precision) {
+			t.Errorf("Expected mu1_%d %v but got %v.", j, h1_j, q.h1[j])
+		}
+	}
+	for k := range q.h2 {
+		if h2_k := Sigmoid(dbm.h2Input(k, q.h1, q.y)); !EqualWithinPrecision(q.h2[k], h2_k, precision) {
+			t.Errorf("Expected mu2_%d %v but got %v.", k, h2_k, q.h2[k])
+		}
+	}
+	if p := dbm.probOfY(q.h2); !EqualWithinPrecision(q.y, p, precision) || dbm.GetPrediction(v) != q.y {
+		t.Errorf("Expected P(y|X) %v but got %v.", p, q.y)
+	}
+}
+
+func Test_DBMTrainer(t *testing.T) {
+	data := &instanceSlice{instances: getBatchTestData()}
+	dbm := NewSparseClassDBM(getSampleRBMForProbabilityTest(), 4, 1)
+	trainer := new(DBMTrainer)
+	trainer.Initialize(dbm, data, data, 0.02, 0, 0, 1)
+	trainer.SetSeed(1)
+	trainer.SetNumParticles(20)
+	trainer.SetMaxEpochs(2000)
+	before := LogLikelihood(dbm, data)
+	trainer.Train()
+	if len(trainer.particles) != 20 {
+		t.Errorf("Expected 20 persistent chains but got %d.", len(trainer.particles))
+	}
+	after := LogLikelihood(dbm, data)
+	if auc := ROCAuc(dbm, data); !(after > before) || auc != 1 {
+		t.Errorf("Expected training to increase the log likelihood %f and separate the labels but got %f, AUC %f.",
+			before, after, auc)
+	}
+}
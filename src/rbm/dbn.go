@@ -0,0 +1,417 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Deep belief networks.
+//
+// A DeepSparseClassRBM [7] stacks, on the hidden units of a SparseClassRBM
+// over X, binary-binary RBMs, each modeling the activations of the hidden
+// units of the layer below, and a top SparseClassRBM that models the
+// activations of the last layer along with y. The layers are pre-trained
+// greedily from the bottom, each on the activations the trained layers
+// below produce for the training data, with y summed out of those of the
+// bottom model. The top model sees the activations as real values, i.e.
+// through Gaussian classes of unit variance, so that predictions are made
+// by a deterministic up-pass
+//	P(h_1 | X), P(h_2 | h_1), ..., P(y | h_L)
+// The binary layers and the top model can then be fine-tuned jointly by
+// back-propagating the gradient of log P(y | h_L) through the up-pass.
+//
+// Reference:
+//  [7]. Hinton, Osindero, Teh, 2006, A Fast Learning Algorithm for Deep
+//  Belief Nets
+
+package rbm
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// binaryLayerT is a binary-binary RBM.
+type binaryLayerT struct {
+	w [][]WeightT //interactions between the visible and the hidden units [hidden, visible]
+	b []WeightT   //biases of the visible units
+	c []WeightT   //biases of the hidden units
+}
+
+// newBinaryLayer creates a binary-binary RBM whose weights are initialized
+// with Norm(0, 0.01) and whose biases are 0.
+func newBinaryLayer(num_visible, num_hidden int) *binaryLayerT {
+	const w_deviation WeightT = 0.01
+	layer := &binaryLayerT{w: make([][]WeightT, num_hidden), b: make([]WeightT, num_visible),
+		c: make([]WeightT, num_hidden)}
+	for j := range layer.w {
+		layer.w[j] = make([]WeightT, num_visible)
+		for i := range layer.w[j] {
+			layer.w[j][i] = zero_mean_norm_rand(w_deviation)
+		}
+	}
+	return layer
+}
+
+// up returns P(h_j = 1 | v) of every hidden unit j.
+func (layer *binaryLayerT) up(v []WeightT) []WeightT {
+	h := make([]WeightT, len(layer.c))
+	for j := range h {
+		h[j] = Sigmoid(layer.c[j] + DotProduct(layer.w[j], v))
+	}
+	return h
+}
+
+// down returns P(v_i = 1 | h) of every visible unit i.
+func (layer *binaryLayerT) down(h []WeightT) []WeightT {
+	v := make([]WeightT, len(layer.b))
+	copy(v, layer.b)
+	for j, h_j := range h {
+		if h_j == 0 {
+			continue
+		}
+		for i, w := range layer.w[j] {
+			v[i] += w * h_j
+		}
+	}
+	for i := range v {
+		v[i] = Sigmoid(v[i])
+	}
+	return v
+}
+
+// contrastiveDivergence updates the layer with the CD-k gradient of the
+// activations v of the layer below, with learning rate eta and L2
+// regularization lambda of the weights. The hidden units are sampled in the
+// chain, while the statistics are taken on probabilities. It returns the
+// squared error of the reconstruction of v.
+func (layer *binaryLayerT) contrastiveDivergence(rng *rand.Rand, v []WeightT, k int, eta, lambda WeightT) WeightT {
+	h_0 := layer.up(v)
+	h := make([]WeightT, len(h_0))
+	v_k, h_k := v, h_0
+	for t := 0; t < k; t++ {
+		for j := range h {
+			h[j] = 0
+			if randomWeight(rng) < h_k[j] {
+				h[j] = 1
+			}
+		}
+		v_k = layer.down(h)
+		h_k = layer.up(v_k)
+	}
+	for j := range layer.w {
+		for i := range layer.w[j] {
+			layer.w[j][i] += eta*(h_0[j]*v[i]-h_k[j]*v_k[i]) - lambda*layer.w[j][i]
+		}
+		layer.c[j] += eta * (h_0[j] - h_k[j])
+	}
+	e := WeightT(0)
+	for i := range layer.b {
+		layer.b[i] += eta * (v[i] - v_k[i])
+		e += (v[i] - v_k[i]) * (v[i] - v_k[i])
+	}
+	return e
+}
+
+// DeepSparseClassRBM is a deep belief network whose bottom layer is a
+// SparseClassRBM over X and whose top layer is a SparseClassRBM with y.
+type DeepSparseClassRBM struct {
+	bottom *SparseClassRBM //model of X, whose hidden units are the input of the layers above
+	layers []*binaryLayerT //binary-binary RBMs between the bottom and the top models
+	top    *SparseClassRBM //model of the activations of the last layer and y
+}
+
+// NewDeepSparseClassRBM stacks on the given bottom model a binary layer for
+// each but the last of the given numbers of hidden units, then a top model
+// with the last number of hidden units and the label of the bottom model.
+func NewDeepSparseClassRBM(bottom *SparseClassRBM, hidden_sizes []int) *DeepSparseClassRBM {
+	if len(hidden_sizes) == 0 {
+		panic("Expected at least the hidden layer of the top model.")
+	}
+	dbn := &DeepSparseClassRBM{bottom: bottom}
+	num_visible := bottom.SizeOfHiddenLayer()
+	for _, num_hidden := range hidden_sizes[:len(hidden_sizes)-1] {
+		dbn.layers = append(dbn.layers, newBinaryLayer(num_visible, num_hidden))
+		num_visible = num_hidden
+	}
+	classes := make([]int, num_visible)
+	biases := make([][]WeightT, num_visible)
+	for c := range classes {
+		classes[c] = 1
+		biases[c] = []WeightT{0}
+	}
+	top := new(SparseClassRBM)
+	top.Initialize(classes, biases, hidden_sizes[len(hidden_sizes)-1], bottom.D())
+	for c := range classes {
+		top.SetGaussianClass(c, 0, 1)
+	}
+	switch {
+	case bottom.IsMultiClass():
+		top.InitializeMultiClass(bottom.dk)
+	case bottom.IsRegression():
+		top.InitializeRegression(bottom.y_mean, bottom.y_stddev)
+	}
+	dbn.top = top
+	return dbn
+}
+
+// Bottom returns the bottom model of the network.
+func (dbn *DeepSparseClassRBM) Bottom() *SparseClassRBM {
+	return dbn.bottom
+}
+
+// Top returns the top model of the network.
+func (dbn *DeepSparseClassRBM) Top() *SparseClassRBM {
+	return dbn.top
+}
+
+// NumOfLayers returns the number of binary layers between the bottom and
+// the top models.
+func (dbn *DeepSparseClassRBM) NumOfLayers() int {
+	return len(dbn.layers)
+}
+
+// activations returns the activations of the hidden units of the bottom
+// model for the instance v, y being summed out, followed by those of the
+// hidden units of the first num_layers binary layers.
+func (dbn *DeepSparseClassRBM) activations(v *DataInstance, num_layers int) [][]WeightT {
+	a := [][]WeightT{dbn.bottom.HiddenFeatures(v)}
+	for _, layer := range dbn.layers[:num_layers] {
+		a = append(a, layer.up(a[len(a)-1]))
+	}
+	return a
+}
+
+// layerInstance returns the instance whose Gaussian classes are the given
+// activations, with the labels of the instance v.
+func layerInstance(v *DataInstance, a []WeightT) *DataInstance {
+	return &DataInstance{x: make([]int, len(a)), x_real: a, pos_y: v.pos_y, neg_y: v.neg_y,
+		y_counts: v.y_counts, target: v.target}
+}
+
+// topInstance returns the instance of the top model given the instance v.
+func (dbn *DeepSparseClassRBM) topInstance(v *DataInstance) *DataInstance {
+	a := dbn.activations(v, len(dbn.layers))
+	return layerInstance(v, a[len(a)-1])
+}
+
+// GetPrediction returns P(y = 1 | X) of a binary network.
+func (dbn *DeepSparseClassRBM) GetPrediction(instance *DataInstance) WeightT {
+	return dbn.top.GetPrediction(dbn.topInstance(instance))
+}
+
+// GetPosterior returns P(y = k | X) of every label class k.
+func (dbn *DeepSparseClassRBM) GetPosterior(instance *DataInstance) []WeightT {
+	return dbn.top.GetPosterior(dbn.topInstance(instance))
+}
+
+// GetRegression returns E[target | X] of a regression network.
+func (dbn *DeepSparseClassRBM) GetRegression(instance *DataInstance) WeightT {
+	return dbn.top.GetRegression(dbn.topInstance(instance))
+}
+
+// upPassAccessor supplies the instances of the underlying data as seen by
+// the layer above the first num_layers binary layers of a network. Instances
+// that are not valid input of the bottom model are skipped.
+type upPassAccessor struct {
+	dbn        *DeepSparseClassRBM
+	num_layers int
+	data       DataInstanceAccessor
+}
+
+func (accessor *upPassAccessor) Reset() {
+	accessor.data.Reset()
+}
+
+func (accessor *upPassAccessor) NextInstance() (DataInstance, error) {
+	for {
+		instance, err := accessor.data.NextInstance()
+		if err != nil {
+			return instance, err
+		}
+		if !accessor.dbn.bottom.IsValidInput(instance) {
+			continue
+		}
+		a := accessor.dbn.activations(&instance, accessor.num_layers)
+		return *layerInstance(&instance, a[len(a)-1]), nil
+	}
+}
+
+func (accessor *upPassAccessor) Close() {
+}
+
+// DBNTrainer trains a DeepSparseClassRBM, pre-training its layers greedily
+// from the bottom and optionally fine-tuning them jointly.
+type DBNTrainer struct {
+	dbn                      *DeepSparseClassRBM
+	parameters               trainParameters      //Training parameters of every layer
+	training_data_accessor   DataInstanceAccessor //Training data
+	validation_data_accessor DataInstanceAccessor //Test data
+	rng                      *rand.Rand           //Random number generator used for sampling
+	max_epochs               int                  //Number of epochs to train each layer
+}
+
+// Initialize a trainer of the given network, with the parameters of
+// RBMTrainer.Initialize. The momentum only applies to the bottom and the top
+// models.
+func (trainer *DBNTrainer) Initialize(dbn *DeepSparseClassRBM,
+	train_data_accessor DataInstanceAccessor,
+	validation_data_accessor DataInstanceAccessor,
+	learning_rate WeightT, regularization_rate WeightT,
+	momentum_rate WeightT, gen_learn_importance WeightT, gibbs_chain_length int) {
+	trainer.dbn = dbn
+	trainer.parameters = trainParameters{
+		learning_rate:        learning_rate,
+		regularization_rate:  regularization_rate,
+		momentum_rate:        momentum_rate,
+		gen_learn_importance: gen_learn_importance,
+		gibbs_chain_length:   gibbs_chain_length,
+	}
+	trainer.training_data_accessor = train_data_accessor
+	trainer.validation_data_accessor = validation_data_accessor
+	trainer.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	trainer.max_epochs = 1
+}
+
+// SetSeed seeds the random number generator used for sampling during
+// training.
+func (trainer *DBNTrainer) SetSeed(seed int64) {
+	trainer.rng.Seed(seed)
+}
+
+// SetMaxEpochs sets the number of epochs each layer is trained for, 1 by
+// default.
+func (trainer *DBNTrainer) SetMaxEpochs(max_epochs int) {
+	if max_epochs < 1 {
+		panic(fmt.Sprintf("Expected a positive number of epochs but got %d.", max_epochs))
+	}
+	trainer.max_epochs = max_epochs
+}
+
+// modelTrainer returns a trainer of the given SparseClassRBM layer on the
+// given data, with the importance alpha of its generative term.
+func (trainer *DBNTrainer) modelTrainer(rbm *SparseClassRBM, training, validation DataInstanceAccessor,
+	alpha WeightT) *RBMTrainer {
+	param := &trainer.parameters
+	model_trainer := new(RBMTrainer)
+	model_trainer.Initialize(rbm, training, validation, param.learning_rate, param.regularization_rate,
+		param.momentum_rate, alpha, param.gibbs_chain_length)
+	model_trainer.SetSeed(trainer.rng.Int63())
+	model_trainer.SetMaxEpochs(trainer.max_epochs)
+	return model_trainer
+}
+
+// Pretrain trains the layers of the network greedily from the bottom: the
+// bottom model on the training data, then each binary layer with CD-k on
+// the activations of the layers below, and finally the top model on the
+// activations of the last binary layer.
+func (trainer *DBNTrainer) Pretrain() {
+	dbn := trainer.dbn
+	param := &trainer.parameters
+	fmt.Printf("Pre-training the bottom model\n")
+	trainer.modelTrainer(dbn.bottom, trainer.training_data_accessor, trainer.validation_data_accessor,
+		param.gen_learn_importance).Train()
+	for i := range dbn.layers {
+		trainer.pretrainLayer(i)
+	}
+	fmt.Printf("Pre-training the top model\n")
+	trainer.modelTrainer(dbn.top, trainer.upPass(trainer.training_data_accessor),
+		trainer.upPass(trainer.validation_data_accessor), param.gen_learn_importance).Train()
+}
+
+// upPass returns the accessor of the given data as seen by the top model.
+func (trainer *DBNTrainer) upPass(data DataInstanceAccessor) *upPassAccessor {
+	return &upPassAccessor{trainer.dbn, len(trainer.dbn.layers), data}
+}
+
+// pretrainLayer trains binary layer i with CD-k on the activations of the
+// layers below for the training data.
+func (trainer *DBNTrainer) pretrainLayer(i int) {
+	layer := trainer.dbn.layers[i]
+	param := &trainer.parameters
+	data := &upPassAccessor{trainer.dbn, i, trainer.training_data_accessor}
+	for epoch := 0; epoch < trainer.max_epochs; epoch++ {
+		reconstruction_error := WeightT(0)
+		cnt := 0
+		ForEachValidDataInstance(data, func(instance DataInstance) {
+			reconstruction_error += layer.contrastiveDivergence(trainer.rng, instance.x_real,
+				param.gibbs_chain_length, param.learning_rate, param.regularization_rate)
+			cnt++
+		})
+		if cnt > 0 {
+			reconstruction_error /= WeightT(cnt)
+		}
+		fmt.Printf("Layer: %d\nEpoch: %d\nReconstruction Error: %f\n", i+1, epoch, reconstruction_error)
+	}
+}
+
+// FineTune trains the binary layers and the top model jointly for the given
+// number of epochs by gradient ascent of log P(y | X), the gradient of the
+// discriminative term of the top model being back-propagated through the
+// up-pass. The bottom model is left unchanged.
+func (trainer *DBNTrainer) FineTune(epochs int) {
+	dbn := trainer.dbn
+	param := &trainer.parameters
+	top_trainer := trainer.modelTrainer(dbn.top, trainer.upPass(trainer.training_data_accessor),
+		trainer.upPass(trainer.validation_data_accessor), 0)
+	delta := dbn.top.NewDeltaT()
+	for epoch := 0; epoch < epochs; epoch++ {
+		ForEachValidDataInstance(trainer.training_data_accessor, func(instance DataInstance) {
+			if !dbn.bottom.IsValidInput(instance) {
+				return
+			}
+			a := dbn.activations(&instance, len(dbn.layers))
+			v := layerInstance(&instance, a[len(a)-1])
+			labels, counts := dbn.top.labelCounts(v)
+			for i, y := range labels {
+				if counts[i] == 0 {
+					continue
+				}
+				top_trainer.doInstanceGradient(v, y, delta)
+				delta.ScalarProduct(counts[i])
+				g := dbn.top.inputGradient(delta)
+				top_trainer.updateModel(delta)
+				for l := len(dbn.layers) - 1; l >= 0; l-- {
+					g = dbn.layers[l].backPropagate(a[l], a[l+1], g, param.learning_rate,
+						param.regularization_rate)
+				}
+			}
+		})
+		fmt.Printf("Fine-tuning Epoch: %d\n", epoch)
+		top_trainer.printEpochMetrics(top_trainer.validationScore())
+	}
+}
+
+// Method inputGradient returns the gradient of the objective whose deltas
+// are given with respect to the values of the Gaussian classes, the delta
+// of the bias of hidden unit j being the one of its input,
+//	sum{0<=j<|H|}(W[c][j][0] / sigma_c * delta_c[j])
+// The classes must all be Gaussian.
+func (rbm *SparseClassRBM) inputGradient(delta *deltaT) []WeightT {
+	g := make([]WeightT, rbm.NumOfVisibleClasses())
+	for c := range g {
+		for j, d_c := range delta.delta_c {
+			g[c] += rbm.W(j, c, 0) / rbm.Sigma(c) * d_c
+		}
+	}
+	return g
+}
+
+// backPropagate updates the weights and the hidden biases of the layer with
+// the gradient g of the objective with respect to its hidden activations h,
+// given its visible activations v, with learning rate eta and L2
+// regularization lambda of the weights. It returns the gradient with
+// respect to v.
+func (layer *binaryLayerT) backPropagate(v, h, g []WeightT, eta, lambda WeightT) []WeightT {
+	g_v := make([]WeightT, len(v))
+	for j := range layer.w {
+		g_j := g[j] * h[j] * (1 - h[j])
+		if g_j == 0 {
+			continue
+		}
+		for i, w := range layer.w[j] {
+			g_v[i] += w * g_j
+			layer.w[j][i] += eta*g_j*v[i] - lambda*w
+		}
+		layer.c[j] += eta * g_j
+	}
+	return g_v
+}
@@ -0,0 +1,143 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func Test_binaryLayer(t *testing.T) {
+	layer := newBinaryLayer(3, 2)
+	layer.w = [][]WeightT{{1, -1, 0.5}, {0, 2, -2}}
+	layer.b = []WeightT{0.1, 0, -0.1}
+	layer.c = []WeightT{-0.5, 0.5}
+	h := layer.up([]WeightT{1, 0, 1})
+	if !ArraysEqualWithinPrecision(h, []WeightT{Sigmoid(1), Sigmoid(-1.5)}, kPrecision) {
+		t.Errorf("Expected P(h|v) [%v %v] but got %v.", Sigmoid(1), Sigmoid(-1.5), h)
+	}
+	v := layer.down([]WeightT{1, 1})
+	if !ArraysEqualWithinPrecision(v, []WeightT{Sigmoid(1.1), Sigmoid(1), Sigmoid(-1.6)}, kPrecision) {
+		t.Errorf("Expected P(v|h) [%v %v %v] but got %v.", Sigmoid(1.1), Sigmoid(1), Sigmoid(-1.6), v)
+	}
+
+	// CD learns to reconstruct a pattern.
+	rng := rand.New(rand.NewSource(1))
+	layer = newBinaryLayer(4, 3)
+	pattern := []WeightT{1, 0, 1, 0}
+	first := layer.contrastiveDivergence(rng, pattern, 1, 0.1, 0)
+	last := first
+	for i := 0; i < 200; i++ {
+		last = layer.contrastiveDivergence(rng, pattern, 1, 0.1, 0)
+	}
+	if last >= first/2 {
+		t.Errorf("Expected the reconstruction error %f to decrease but got %f.", first, last)
+	}
+}
+
+// Test the gradients of the up-pass against finite differences.
+func Test_backPropagate(t *testing.T) {
+	const epsilon = 1e-6
+	layer := newBinaryLayer(3, 2)
+	layer.w = [][]WeightT{{1, -1, 0.5}, {0, 2, -2}}
+	v := []WeightT{0.2, 0.7, 0.4}
+	g := []WeightT{1.5, -0.5}
+	f := func(v []WeightT) WeightT {
+		return DotProduct(g, layer.up(v))
+	}
+	g_v := layer.backPropagate(v, layer.up(v), g, 0, 0)
+	for i := range v {
+		v_i := v[i]
+		v[i] = v_i + epsilon
+		f_plus := f(v)
+		v[i] = v_i - epsilon
+		f_minus := f(v)
+		v[i] = v_i
+		if expected := (f_plus - f_minus) / (2 * epsilon); !EqualWithinPrecision(g_v[i], expected, 1e-6) {
+			t.Errorf("Expected gradient %v of v_%d but got %v.", expected, i, g_v[i])
+		}
+	}
+
+	dbn := NewDeepSparseClassRBM(getSampleRBMForProbabilityTest(), []int{3})
+	top := dbn.Top()
+	for j := 0; j < top.SizeOfHiddenLayer(); j++ {
+		for c := 0; c < top.NumOfVisibleClasses(); c++ {
+			top.SetW(j, c, 0, WeightT(j-c)*0.3)
+		}
+		top.SetU(j, WeightT(j)*0.5-0.4)
+	}
+	trainer := new(RBMTrainer)
+	trainer.Initialize(top, nil, nil, 0.1, 0, 0, 0, 1)
+	instance := &DataInstance{x: make([]int, 4), x_real: []WeightT{0.2, 0.9, 0.5, 0.1}, pos_y: 1}
+	delta := top.NewDeltaT()
+	trainer.doInstanceGradient(instance, 1, delta)
+	g = top.inputGradient(delta)
+	for c, x := range instance.x_real {
+		instance.x_real[c] = x + epsilon
+		l_plus := math.Log(float64(top.probOfYGivenInstance(instance)))
+		instance.x_real[c] = x - epsilon
+		l_minus := math.Log(float64(top.probOfYGivenInstance(instance)))
+		instance.x_real[c] = x
+		if expected := (l_plus - l_minus) / (2 * epsilon); !EqualWithinPrecesionF64(float64(g[c]), expected, 1e-6) {
+			t.Errorf("Expected gradient %v of log P(y|X) for x_%d but got %v.", expected, c, g[c])
+		}
+	}
+}
+
+func Test_DeepSparseClassRBM(t *testing.T) {
+	bottom := getSampleRBMForProbabilityTest()
+	dbn := NewDeepSparseClassRBM(bottom, []int{3, 2})
+	if dbn.NumOfLayers() != 1 || dbn.Top().NumOfVisibleClasses() != 3 || dbn.Top().SizeOfHiddenLayer() != 2 ||
+		dbn.Top().IsMultiClass() {
+		t.Fatalf("Expected a binary layer of 3 hidden units below a top model of 2 but got %v.", dbn)
+	}
+	v := &DataInstance{x: []int{0, 1, 2}}
+	a := dbn.layers[0].up(bottom.HiddenFeatures(v))
+	expected := dbn.Top().GetPrediction(&DataInstance{x: make([]int, 3), x_real: a})
+	if p := dbn.GetPrediction(v); !EqualWithinPrecision(p, expected, kPrecision) {
+		t.Errorf("Expected P(y|X) %v but got %v.", expected, p)
+	}
+	if multi_class := NewDeepSparseClassRBM(getSampleMultiClassRBM(), []int{2}); multi_class.Top().NumOfLabels() != 3 {
+		t.Errorf("Expected the top model to have 3 label classes.")
+	}
+}
+
+func Test_DBNTrainer(t *testing.T) {
+	data := &instanceSlice{instances: getBatchTestData()}
+	dbn := NewDeepSparseClassRBM(getSampleRBMForProbabilityTest(), []int{3, 2})
+	trainer := new(DBNTrainer)
+	trainer.Initialize(dbn, data, data, 0.1, 0, 0.5, 0.5, 1)
+	trainer.SetSeed(1)
+	trainer.SetMaxEpochs(2)
+	trainer.Pretrain()
+	before := LogLikelihood(dbn, data)
+	trainer.FineTune(20)
+	if after := LogLikelihood(dbn, data); !(after > before) {
+		t.Errorf("Expected fine-tuning to increase the log likelihood %f but got %f.", before, after)
+	}
+}
+
+// Test_upPassAccessor checks that the instances the bottom model can't take
+// are skipped by the up-pass and by the pre-training of the layers.
+func Test_upPassAccessor(t *testing.T) {
+	invalid := DataInstance{x: []int{0, 5, 2}, pos_y: 1}
+	data := &instanceSlice{instances: append(getBatchTestData(), invalid)}
+	dbn := NewDeepSparseClassRBM(getSampleRBMForProbabilityTest(), []int{3, 2})
+	cnt := 0
+	ForEachValidDataInstance(&upPassAccessor{dbn, 1, data}, func(instance DataInstance) {
+		if len(instance.x_real) != 3 {
+			t.Errorf("Expected the 3 activations of the binary layer but got %v.", instance.x_real)
+		}
+		cnt++
+	})
+	if cnt != len(data.instances)-1 {
+		t.Errorf("Expected %d valid instances but got %d.", len(data.instances)-1, cnt)
+	}
+
+	trainer := new(DBNTrainer)
+	trainer.Initialize(dbn, &instanceSlice{instances: []DataInstance{invalid}}, nil, 0.1, 0, 0.5, 0.5, 1)
+	trainer.pretrainLayer(0)
+}
@@ -0,0 +1,437 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Support for distributed training with parameter servers.
+//
+// The parameters are partitioned into num_shards shards: the parameters of
+// visible class c, W[c], b[c] and its standard deviation, belong to shard
+// c % num_shards, those of the hidden units and of y, c, U, d, UK and DK, to
+// shard 0. Workers compute Gradients on their local data with a replica of
+// the model, split them by shard and send each part to the server owning the
+// shard, which applies it to its ParameterShard; they refresh their replica
+// from time to time with the parameters of every shard.
+//
+// Gradient layout:
+//  magic         [8]byte "SCRBMGRD"
+//  version       uint32
+//  instances     uint32
+//  num_w         uint32
+//  w             [num_w]{h_index, c_index, c_value uint32, delta float64}
+//  num_b         uint32
+//  b             [num_b]{c_index, c_value uint32, delta float64}
+//  num_s         uint32
+//  s             [num_s]{c_index uint32, delta float64}
+//  has_hidden    uint32, 1 if the following deltas are present
+//  c, u          [h_num]float64
+//  d             float64
+//  uk            [y_class_num][h_num]float64
+//  dk            [y_class_num]float64
+//  checksum      uint32
+//
+// Parameter shard layout:
+//  magic         [8]byte "SCRBMSHD"
+//  version       uint32
+//  shard         uint32
+//  num_shards    uint32
+//  for each class c of the shard: w[c] as in the model file, b[c], x_sigmas[c]
+//  for shard 0: c, u, d, uk, dk as in the model file
+//  checksum      uint32
+
+package rbm
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	kGradientMagic   = "SCRBMGRD"
+	kGradientVersion = 1
+	kShardMagic      = "SCRBMSHD"
+	kShardVersion    = 1
+)
+
+// Gradient is the sum of the gradients of the hybrid objective over a number
+// of training instances, or the part of it belonging to a parameter shard.
+type Gradient struct {
+	delta     *deltaT
+	instances int
+	hidden    bool //whether the deltas of the hidden units and of y are present
+}
+
+// Instances returns the number of training instances of the gradient.
+func (g *Gradient) Instances() int {
+	return g.instances
+}
+
+// ComputeGradient sums the gradients of the next max_instances training
+// instances, or of the remaining ones, with the current model, updating the
+// fast weights of FPCD with their mean as the model would be. It returns
+// io.EOF if there is no more training instance; the training data must then
+// be reset by the caller.
+func (trainer *RBMTrainer) ComputeGradient(max_instances int) (*Gradient, error) {
+	deltas := trainer.rbm.newLabelDeltas()
+	batch := trainer.rbm.newBatchDelta()
+	for batch.instances < max_instances {
+		labels := trainer.doGradient(deltas)
+		if len(labels) == 0 {
+			break
+		}
+		for _, y := range labels {
+			batch.add(deltas[y])
+		}
+		batch.instances++
+		trainer.instances++
+	}
+	if batch.instances == 0 {
+		return nil, io.EOF
+	}
+	trainer.updateFastWeights(batch.delta, 1/WeightT(batch.instances))
+	return &Gradient{batch.delta, batch.instances, true}, nil
+}
+
+// shardOfClass returns the shard owning the parameters of visible class c.
+func shardOfClass(c, num_shards int) int {
+	return c % num_shards
+}
+
+// Split returns the parts of the gradient belonging to each of num_shards
+// parameter shards.
+func (g *Gradient) Split(num_shards int) []*Gradient {
+	parts := make([]*Gradient, num_shards)
+	for i := range parts {
+		parts[i] = &Gradient{delta: new(deltaT), instances: g.instances}
+	}
+	for _, d := range g.delta.delta_w {
+		part := parts[shardOfClass(d.c_index, num_shards)].delta
+		part.delta_w = append(part.delta_w, d)
+	}
+	for _, d := range g.delta.delta_b {
+		part := parts[shardOfClass(d.c_index, num_shards)].delta
+		part.delta_b = append(part.delta_b, d)
+	}
+	for _, d := range g.delta.delta_s {
+		part := parts[shardOfClass(d.c_index, num_shards)].delta
+		part.delta_s = append(part.delta_s, d)
+	}
+	if g.hidden {
+		parts[0].hidden = true
+		parts[0].delta.delta_c = g.delta.delta_c
+		parts[0].delta.delta_u = g.delta.delta_u
+		parts[0].delta.delta_d = g.delta.delta_d
+		parts[0].delta.delta_uk = g.delta.delta_uk
+		parts[0].delta.delta_dk = g.delta.delta_dk
+	}
+	return parts
+}
+
+// Write writes the gradient to w.
+func (g *Gradient) Write(w io.Writer) error {
+	mw := newModelWriter(w)
+	mw.writeBytes([]byte(kGradientMagic))
+	mw.writeUint32(kGradientVersion)
+	mw.writeUint32(g.instances)
+	mw.writeDeltas(g.delta, g.hidden)
+	mw.writeChecksum()
+	if mw.err != nil {
+		return fmt.Errorf("Failed to write gradient: %s.", mw.err)
+	}
+	return nil
+}
+
+// ReadGradient reads a gradient written by Gradient.Write, making sure that
+// it fits the dimensions of the given model.
+func ReadGradient(r io.Reader, rbm *SparseClassRBM) (*Gradient, error) {
+	mr := newModelReader(r)
+	magic := make([]byte, len(kGradientMagic))
+	mr.readBytes(magic)
+	if mr.err == nil && string(magic) != kGradientMagic {
+		return nil, fmt.Errorf("Failed to read gradient: not a SparseClassRBM gradient.")
+	}
+	version := mr.readUint32()
+	if mr.err == nil && version != kGradientVersion {
+		return nil, fmt.Errorf("Failed to read gradient: unsupported version %d, expected %d.",
+			version, kGradientVersion)
+	}
+	g := new(Gradient)
+	g.instances = mr.readDimension("number of instances", 1)
+	g.delta, g.hidden = mr.readDeltas(rbm)
+	mr.verifyChecksum()
+	if mr.err != nil {
+		return nil, fmt.Errorf("Failed to read gradient: %s.", mr.err)
+	}
+	return g, nil
+}
+
+// writeDeltas writes the deltas as in the Gradient layout, from num_w on,
+// those of the hidden units and of y only if hidden is set.
+func (mw *modelWriter) writeDeltas(delta *deltaT, hidden bool) {
+	mw.writeUint32(len(delta.delta_w))
+	for _, d := range delta.delta_w {
+		mw.writeUint32(d.h_index)
+		mw.writeUint32(d.c_index)
+		mw.writeUint32(d.c_value)
+		mw.writeWeight(d.delta_v)
+	}
+	mw.writeUint32(len(delta.delta_b))
+	for _, d := range delta.delta_b {
+		mw.writeUint32(d.c_index)
+		mw.writeUint32(d.c_value)
+		mw.writeWeight(d.delta_v)
+	}
+	mw.writeUint32(len(delta.delta_s))
+	for _, d := range delta.delta_s {
+		mw.writeUint32(d.c_index)
+		mw.writeWeight(d.delta_v)
+	}
+	if hidden {
+		mw.writeUint32(1)
+		mw.writeWeights(delta.delta_c)
+		mw.writeWeights(delta.delta_u)
+		mw.writeWeight(delta.delta_d)
+		for k := range delta.delta_uk {
+			mw.writeWeights(delta.delta_uk[k])
+		}
+		mw.writeWeights(delta.delta_dk)
+	} else {
+		mw.writeUint32(0)
+	}
+}
+
+// readDeltas reads deltas written by writeDeltas, making sure that they fit
+// the dimensions of the given model, and whether those of the hidden units
+// and of y are present.
+func (mr *modelReader) readDeltas(rbm *SparseClassRBM) (*deltaT, bool) {
+	delta := new(deltaT)
+	// readValue reads a class and one of its values, of which there are n(c).
+	readValue := func(n func(c int) int) (int, int) {
+		c := mr.readUint32()
+		if mr.err == nil && c >= rbm.x_class_num {
+			mr.err = fmt.Errorf("Invalid class %d.", c)
+		}
+		k := 0
+		if n != nil {
+			k = mr.readUint32()
+			if mr.err == nil && k >= n(c) {
+				mr.err = fmt.Errorf("Invalid value %d of class %d.", k, c)
+			}
+		}
+		return c, k
+	}
+	num_w := mr.readDimension("number of deltas of W", 0)
+	for i := 0; i < num_w && mr.err == nil; i++ {
+		h := mr.readUint32()
+		if mr.err == nil && h >= rbm.h_num {
+			mr.err = fmt.Errorf("Invalid hidden unit %d.", h)
+		}
+		c, k := readValue(rbm.ClassSize)
+		delta.delta_w = append(delta.delta_w, deltaWT{h, c, k, mr.readWeight()})
+	}
+	num_b := mr.readDimension("number of deltas of b", 0)
+	for i := 0; i < num_b && mr.err == nil; i++ {
+		c, k := readValue(func(c int) int { return len(rbm.b[c]) })
+		delta.delta_b = append(delta.delta_b, deltaBT{c, k, mr.readWeight()})
+	}
+	num_s := mr.readDimension("number of deltas of the standard deviations", 0)
+	for i := 0; i < num_s && mr.err == nil; i++ {
+		c, _ := readValue(nil)
+		delta.delta_s = append(delta.delta_s, deltaBT{c, 0, mr.readWeight()})
+	}
+	has_hidden := mr.readUint32()
+	if mr.err == nil && has_hidden > 1 {
+		mr.err = fmt.Errorf("Invalid flag of hidden deltas %d.", has_hidden)
+	}
+	if has_hidden == 1 {
+		delta.delta_c = mr.readWeights(rbm.h_num)
+		delta.delta_u = mr.readWeights(rbm.h_num)
+		delta.delta_d = mr.readWeight()
+		if rbm.y_class_num > 0 {
+			delta.delta_uk = make([][]WeightT, rbm.y_class_num)
+			for k := range delta.delta_uk {
+				delta.delta_uk[k] = mr.readWeights(rbm.h_num)
+			}
+			delta.delta_dk = mr.readWeights(rbm.y_class_num)
+		}
+	}
+	return delta, has_hidden == 1
+}
+
+// ParameterShard holds the parameters of one shard of a model on a parameter
+// server, and applies the gradients sent by the workers. It is not safe for
+// concurrent use.
+type ParameterShard struct {
+	trainer    RBMTrainer
+	shard      int
+	num_shards int
+	updates    int64 //number of gradients applied
+}
+
+// NewParameterShard creates shard shard of num_shards with the parameters of
+// the given model, which are updated with the given learning parameters. The
+// parameters of the other shards are dropped from the model.
+func NewParameterShard(rbm *SparseClassRBM, shard, num_shards int,
+	learning_rate, regularization_rate, momentum_rate WeightT) *ParameterShard {
+	if shard < 0 || shard >= num_shards {
+		panic(fmt.Sprintf("Invalid shard %d of %d.", shard, num_shards))
+	}
+	s := &ParameterShard{shard: shard, num_shards: num_shards}
+	s.trainer.Initialize(rbm, nil, nil, learning_rate, regularization_rate, momentum_rate, 0, 1)
+	for c := range rbm.w {
+		if !s.owns(c) {
+			rbm.w[c] = nil
+		}
+	}
+	return s
+}
+
+// owns determines whether visible class c belongs to the shard.
+func (s *ParameterShard) owns(c int) bool {
+	return shardOfClass(c, s.num_shards) == s.shard
+}
+
+// Updates returns the number of gradients applied to the shard.
+func (s *ParameterShard) Updates() int64 {
+	return s.updates
+}
+
+// Instances returns the number of training instances of the gradients applied
+// to the shard.
+func (s *ParameterShard) Instances() int64 {
+	return s.trainer.instances
+}
+
+// Apply updates the parameters of the shard with the mean of the gradient over
+// its instances, as a mini-batch would (see SetBatchSize); the gradient is
+// scaled in place.
+func (s *ParameterShard) Apply(g *Gradient) error {
+	for _, deltas := range [][]deltaBT{g.delta.delta_b, g.delta.delta_s} {
+		for _, d := range deltas {
+			if !s.owns(d.c_index) {
+				return fmt.Errorf("Class %d does not belong to shard %d.", d.c_index, s.shard)
+			}
+		}
+	}
+	for _, d := range g.delta.delta_w {
+		if !s.owns(d.c_index) {
+			return fmt.Errorf("Class %d does not belong to shard %d.", d.c_index, s.shard)
+		}
+	}
+	if g.hidden && s.shard != 0 {
+		return fmt.Errorf("Hidden units do not belong to shard %d.", s.shard)
+	}
+	g.delta.scale(1 / WeightT(g.instances))
+	s.trainer.updateVisible(g.delta)
+	if g.hidden {
+		for j := range g.delta.delta_c {
+			s.trainer.updateHiddenUnit(g.delta, j)
+		}
+		s.trainer.updateLabelBiases(g.delta)
+	}
+	s.updates++
+	s.trainer.instances += int64(g.instances)
+	return nil
+}
+
+// Write writes the parameters of the shard to w.
+func (s *ParameterShard) Write(w io.Writer) error {
+	rbm := s.trainer.rbm
+	mw := newModelWriter(w)
+	mw.writeBytes([]byte(kShardMagic))
+	mw.writeUint32(kShardVersion)
+	mw.writeUint32(s.shard)
+	mw.writeUint32(s.num_shards)
+	for c := range rbm.w {
+		if !s.owns(c) {
+			continue
+		}
+		for h := range rbm.w[c] {
+			mw.writeWeights(rbm.w[c][h])
+		}
+		mw.writeWeights(rbm.b[c])
+		mw.writeWeight(rbm.x_sigmas[c])
+	}
+	if s.shard == 0 {
+		mw.writeWeights(rbm.c)
+		mw.writeWeights(rbm.u)
+		mw.writeWeight(rbm.d)
+		for k := range rbm.uk {
+			mw.writeWeights(rbm.uk[k])
+		}
+		mw.writeWeights(rbm.dk)
+	}
+	mw.writeChecksum()
+	if mw.err != nil {
+		return fmt.Errorf("Failed to write parameter shard: %s.", mw.err)
+	}
+	return nil
+}
+
+// ReadParameterShard replaces the parameters of the model belonging to the
+// shard written by ParameterShard.Write, which must have been created from a
+// model of the same dimensions. The model is left untouched if an error is
+// returned.
+func (rbm *SparseClassRBM) ReadParameterShard(r io.Reader) error {
+	mr := newModelReader(r)
+	magic := make([]byte, len(kShardMagic))
+	mr.readBytes(magic)
+	if mr.err == nil && string(magic) != kShardMagic {
+		return fmt.Errorf("Failed to read parameter shard: not a SparseClassRBM parameter shard.")
+	}
+	version := mr.readUint32()
+	if mr.err == nil && version != kShardVersion {
+		return fmt.Errorf("Failed to read parameter shard: unsupported version %d, expected %d.",
+			version, kShardVersion)
+	}
+	shard := mr.readUint32()
+	num_shards := mr.readDimension("number of shards", 1)
+	if mr.err == nil && shard >= num_shards {
+		mr.err = fmt.Errorf("Invalid shard %d of %d.", shard, num_shards)
+	}
+	if mr.err != nil {
+		return fmt.Errorf("Failed to read parameter shard: %s.", mr.err)
+	}
+	w := make(map[int][][]WeightT)
+	b := make(map[int][]WeightT)
+	sigmas := make(map[int]WeightT)
+	for c := 0; c < rbm.x_class_num && mr.err == nil; c++ {
+		if shardOfClass(c, num_shards) != shard {
+			continue
+		}
+		w[c] = make([][]WeightT, rbm.h_num)
+		for h := range w[c] {
+			w[c][h] = mr.readWeights(rbm.x_class_sizes[c])
+		}
+		b[c] = mr.readWeights(len(rbm.b[c]))
+		sigmas[c] = mr.readWeight()
+	}
+	var hidden SparseClassRBM
+	if shard == 0 {
+		hidden.c = mr.readWeights(rbm.h_num)
+		hidden.u = mr.readWeights(rbm.h_num)
+		hidden.d = mr.readWeight()
+		if rbm.y_class_num > 0 {
+			hidden.uk = make([][]WeightT, rbm.y_class_num)
+			for k := range hidden.uk {
+				hidden.uk[k] = mr.readWeights(rbm.h_num)
+			}
+			hidden.dk = mr.readWeights(rbm.y_class_num)
+		}
+	}
+	mr.verifyChecksum()
+	if mr.err != nil {
+		return fmt.Errorf("Failed to read parameter shard: %s.", mr.err)
+	}
+	for c := range w {
+		rbm.w[c] = w[c]
+		rbm.b[c] = b[c]
+		rbm.x_sigmas[c] = sigmas[c]
+	}
+	if shard == 0 {
+		rbm.c, rbm.u, rbm.d = hidden.c, hidden.u, hidden.d
+		if rbm.y_class_num > 0 {
+			rbm.uk, rbm.dk = hidden.uk, hidden.dk
+		}
+	}
+	return nil
+}
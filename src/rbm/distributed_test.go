@@ -0,0 +1,143 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func newDistributedTestTrainer(rbm *SparseClassRBM) *RBMTrainer {
+	data := &instanceSlice{instances: []DataInstance{
+		{x: []int{0, 1, 2}, pos_y: 1},
+		{x: []int{0, 0, 1}, neg_y: 2},
+		{x: []int{0, 1, 0}, pos_y: 1, neg_y: 1},
+	}}
+	if rbm.IsMultiClass() {
+		for i := range data.instances {
+			instance := &data.instances[i]
+			instance.y_counts = []int{instance.neg_y, instance.pos_y, i}
+		}
+	}
+	trainer := new(RBMTrainer)
+	trainer.Initialize(rbm, data, nil, 0.1, 0.01, 0.5, 0.5, 1)
+	trainer.SetSeed(1)
+	return trainer
+}
+
+func Test_GradientWriteRead(t *testing.T) {
+	for _, rbm := range []*SparseClassRBM{getSampleRBMForProbabilityTest(), getSampleMultiClassRBM()} {
+		trainer := newDistributedTestTrainer(rbm)
+		gradient, err := trainer.ComputeGradient(2)
+		if err != nil || gradient.Instances() != 2 {
+			t.Fatalf("Expected a gradient of 2 instances but got %v, %v.", gradient, err)
+		}
+		parts := append([]*Gradient{gradient}, gradient.Split(2)...)
+		for i, g := range parts {
+			var buf bytes.Buffer
+			if err := g.Write(&buf); err != nil {
+				t.Fatalf("Failed to write gradient: %s.", err)
+			}
+			read, err := ReadGradient(&buf, rbm)
+			if err != nil {
+				t.Fatalf("Failed to read gradient: %s.", err)
+			}
+			if !reflect.DeepEqual(read, g) {
+				t.Errorf("Part %d: expected gradient\n%v\nbut got\n%v.", i, g.delta, read.delta)
+			}
+		}
+
+		if g, err := trainer.ComputeGradient(2); err != nil || g.Instances() != 1 {
+			t.Errorf("Expected a gradient of the last instance but got %v, %v.", g, err)
+		}
+		if _, err := trainer.ComputeGradient(2); err != io.EOF {
+			t.Errorf("Expected EOF but got %v.", err)
+		}
+	}
+
+	small := getSampleRBMForProbabilityTest()
+	small.x_class_num = 2
+	var buf bytes.Buffer
+	gradient, _ := newDistributedTestTrainer(getSampleRBMForProbabilityTest()).ComputeGradient(1)
+	gradient.Write(&buf)
+	if _, err := ReadGradient(&buf, small); err == nil {
+		t.Errorf("Expected error for gradient not fitting the model.")
+	}
+}
+
+func Test_GradientSplit(t *testing.T) {
+	gradient, _ := newDistributedTestTrainer(getSampleRBMForProbabilityTest()).ComputeGradient(3)
+	parts := gradient.Split(2)
+	num_w := 0
+	for shard, part := range parts {
+		num_w += len(part.delta.delta_w)
+		for _, d := range part.delta.delta_w {
+			if d.c_index%2 != shard {
+				t.Errorf("Expected delta %v in shard %d.", d, d.c_index%2)
+			}
+		}
+		for _, d := range part.delta.delta_b {
+			if d.c_index%2 != shard {
+				t.Errorf("Expected delta %v in shard %d.", d, d.c_index%2)
+			}
+		}
+		if part.hidden != (shard == 0) || part.Instances() != 3 {
+			t.Errorf("Unexpected part %d: hidden %v, %d instances.", shard, part.hidden, part.Instances())
+		}
+	}
+	if num_w != len(gradient.delta.delta_w) {
+		t.Errorf("Expected %d deltas of W in the parts but got %d.", len(gradient.delta.delta_w), num_w)
+	}
+}
+
+// Test_ParameterShard checks that applying the parts of a gradient to the
+// shards and pulling them into a replica updates the model as a mini-batch
+// does.
+func Test_ParameterShard(t *testing.T) {
+	const num_shards = 2
+	for _, newRBM := range []func() *SparseClassRBM{getSampleRBMForProbabilityTest, getSampleMultiClassRBM} {
+		trainer := newDistributedTestTrainer(newRBM())
+		gradient, _ := trainer.ComputeGradient(3)
+		var shards []*ParameterShard
+		for i := 0; i < num_shards; i++ {
+			shards = append(shards, NewParameterShard(newRBM(), i, num_shards, 0.1, 0.01, 0.5))
+		}
+		for i := 0; i < 2; i++ {
+			g, _ := newDistributedTestTrainer(newRBM()).ComputeGradient(3)
+			for shard, part := range g.Split(num_shards) {
+				if err := shards[shard].Apply(part); err != nil {
+					t.Fatalf("Failed to apply gradient: %s.", err)
+				}
+			}
+			batch := trainer.rbm.newBatchDelta()
+			batch.add(gradient.delta)
+			batch.instances = gradient.Instances()
+			trainer.applyBatch(batch)
+		}
+		if err := shards[1].Apply(gradient.Split(num_shards)[0]); err == nil {
+			t.Errorf("Expected error for gradient of another shard.")
+		}
+
+		replica := newRBM()
+		for _, s := range shards {
+			var buf bytes.Buffer
+			if err := s.Write(&buf); err != nil {
+				t.Fatalf("Failed to write shard: %s.", err)
+			}
+			if err := replica.ReadParameterShard(&buf); err != nil {
+				t.Fatalf("Failed to read shard: %s.", err)
+			}
+		}
+		if !reflect.DeepEqual(replica, trainer.rbm) {
+			t.Errorf("Expected model\n%v\nbut got\n%v.", trainer.rbm, replica)
+		}
+		if shards[0].Updates() != 2 || shards[0].Instances() != 6 {
+			t.Errorf("Expected 2 updates of 6 instances but got %d of %d.", shards[0].Updates(),
+				shards[0].Instances())
+		}
+	}
+}
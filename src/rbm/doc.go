@@ -9,10 +9,9 @@
 //  E(y, X, h) = -SumOver_0<=i<C_{h^T . W(i) . e_x_i + b(i) . e_x_i} - h^T . c - d . y - h^T . U . y
 //  p(y, X, h) = exp(-E(y,X,h))/Z
 //
+// The visible biases are either one per visible unit (b(i) above) or one per
+// feature class, see SetBiasParameterization.
+//
 // Reference:
 //  [1]. Hinton, 2010, A Practical Guide to Training Restricted Boltzmann Machines (Ver. 1)
-//
-// TODO:
-//  One visible bias per feature class VS one visible bias per visible units
-//
 package rbm
@@ -18,6 +18,16 @@ type BinaryClassifier interface {
 	GetPrediction(instance *DataInstance) WeightT
 }
 
+// Regressor predicts a real valued target.
+type Regressor interface {
+	GetRegression(instance *DataInstance) WeightT
+}
+
+// MultiClassClassifier predicts the posterior P(y = k|X) of every label class k.
+type MultiClassClassifier interface {
+	GetPosterior(instance *DataInstance) []WeightT
+}
+
 type Coordinate struct {
 	n_pos int
 	n_neg int
@@ -138,6 +148,241 @@ func LogLikelihood(classifier BinaryClassifier, data_accessor DataInstanceAccess
 	return loglikelihood
 }
 
+// RegressionRMSE returns the root mean squared error of the predicted targets,
+// or 0 if there is no valid instance.
+func RegressionRMSE(regressor Regressor, data_accessor DataInstanceAccessor) float64 {
+	square_error := float64(0)
+	cnt := 0
+	ForEachValidDataInstance(data_accessor, func(instance DataInstance) {
+		e := float64(regressor.GetRegression(&instance) - instance.target)
+		square_error += e * e
+		cnt++
+	})
+	if cnt == 0 {
+		return 0
+	}
+	return math.Sqrt(square_error / float64(cnt))
+}
+
+// RegressionMAE returns the mean absolute error of the predicted targets, or 0
+// if there is no valid instance.
+func RegressionMAE(regressor Regressor, data_accessor DataInstanceAccessor) float64 {
+	absolute_error := float64(0)
+	cnt := 0
+	ForEachValidDataInstance(data_accessor, func(instance DataInstance) {
+		absolute_error += math.Abs(float64(regressor.GetRegression(&instance) - instance.target))
+		cnt++
+	})
+	if cnt == 0 {
+		return 0
+	}
+	return absolute_error / float64(cnt)
+}
+
+// PseudoLogLikelihood returns the sum over the given data of the pseudo
+// log-likelihood of the single-valued classes given the label,
+//	sum{c}(log P(X_c | X_-c, y))
+// each conditional being the softmax over the values k of class c of
+//	b[c][k] + sum{0<=j<|H|}(sotfplus( w[j].X_-c + W[c][j][k] + c[j] + U_j . Y ))
+// Multi-valued, Gaussian and missing classes only appear in the condition.
+func PseudoLogLikelihood(rbm *SparseClassRBM, data_accessor DataInstanceAccessor) float64 {
+	pseudo_loglikelihood := float64(0)
+	ForEachValidDataInstance(data_accessor, func(instance DataInstance) {
+		rbm.forEachLabel(&instance, func(p *particleT, n int) {
+			a := make([]WeightT, rbm.SizeOfHiddenLayer())
+			for j := range a {
+				a[j] = rbm.hiddenInput(j, p)
+			}
+			rbm.forEachCategoricalClass(&instance, func(c int) {
+				logits := make([]WeightT, rbm.ClassSize(c))
+				for k := range logits {
+					logits[k] = rbm.B(c, k)
+					for j, a_j := range a {
+						logits[k] += SoftPlus(a_j - rbm.W(j, c, instance.x[c]) + rbm.W(j, c, k))
+					}
+				}
+				pseudo_loglikelihood += float64(n) * float64(logits[instance.x[c]]-LogSumExp(logits))
+			})
+		})
+	})
+	return pseudo_loglikelihood
+}
+
+// ReconstructionError returns the expected fraction of the single-valued
+// classes of the given data whose value differs from the one of their
+// reconstruction by a Gibbs step of CD, i.e.
+//	1 - P(X_c = x_c | h)
+// averaged over the classes, P(X_c | h) being the softmax over the values k of
+// class c of b[c][k] + W[c][k] . h, and h being set to P(h | X, y).
+// Multi-valued, Gaussian and missing classes are not reconstructed.
+func ReconstructionError(rbm *SparseClassRBM, data_accessor DataInstanceAccessor) float64 {
+	reconstruction_error := float64(0)
+	cnt := 0
+	ForEachValidDataInstance(data_accessor, func(instance DataInstance) {
+		rbm.forEachLabel(&instance, func(p *particleT, n int) {
+			h := make([]WeightT, rbm.SizeOfHiddenLayer())
+			for j := range h {
+				h[j] = Sigmoid(rbm.hiddenInput(j, p))
+			}
+			rbm.forEachCategoricalClass(&instance, func(c int) {
+				p_x := rbm.probOfXInClassCGivenH(c, h)
+				reconstruction_error += float64(n) * float64(1-p_x[instance.x[c]])
+				cnt += n
+			})
+		})
+	})
+	if cnt == 0 {
+		return 0
+	}
+	return reconstruction_error / float64(cnt)
+}
+
+// Method forEachLabel calls f with the given instance and each of its label
+// classes, along with the number of instances of the class, or with its
+// normalized target for regression models.
+func (rbm *SparseClassRBM) forEachLabel(instance *DataInstance, f func(p *particleT, n int)) {
+	if rbm.IsRegression() {
+		f(&particleT{v: instance, target: rbm.normalizeTarget(instance.target)}, 1)
+		return
+	}
+	for y, n := range labelCountsOf(instance) {
+		if n > 0 {
+			f(&particleT{v: instance, y: y}, n)
+		}
+	}
+}
+
+// Method forEachCategoricalClass calls f with every observed single-valued
+// class of the given instance.
+func (rbm *SparseClassRBM) forEachCategoricalClass(instance *DataInstance, f func(c int)) {
+	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+		if !rbm.isMultiValued(c) && !rbm.isGaussian(c) && !instance.isMissing(c) {
+			f(c)
+		}
+	}
+}
+
+// labelCountsOf returns the number of instances of each label class of the
+// given instance, [neg_y, pos_y] for binary labels.
+func labelCountsOf(instance *DataInstance) []int {
+	if instance.y_counts != nil {
+		return instance.y_counts
+	}
+	return []int{instance.neg_y, instance.pos_y}
+}
+
+// MultiClassAccuracy returns the fraction of instances whose label class has
+// the highest posterior, or 0 if there is no valid instance.
+func MultiClassAccuracy(classifier MultiClassClassifier, data_accessor DataInstanceAccessor) float64 {
+	correct := 0
+	cnt := 0
+	ForEachValidDataInstance(data_accessor, func(instance DataInstance) {
+		p := classifier.GetPosterior(&instance)
+		best := 0
+		for k := range p {
+			if p[k] > p[best] {
+				best = k
+			}
+		}
+		for k, n := range labelCountsOf(&instance) {
+			cnt += n
+			if k == best {
+				correct += n
+			}
+		}
+	})
+	if cnt == 0 {
+		return 0
+	}
+	return float64(correct) / float64(cnt)
+}
+
+// PerClassLogLoss returns, for each label class k, the average of -log P(y = k|X)
+// over the instances of class k; it is NaN for classes without instances.
+func PerClassLogLoss(classifier MultiClassClassifier, data_accessor DataInstanceAccessor) []float64 {
+	var loss []float64
+	var cnt []int
+	ForEachValidDataInstance(data_accessor, func(instance DataInstance) {
+		p := classifier.GetPosterior(&instance)
+		for len(loss) < len(p) {
+			loss = append(loss, 0)
+			cnt = append(cnt, 0)
+		}
+		for k, n := range labelCountsOf(&instance) {
+			if n > 0 {
+				loss[k] -= float64(n) * math.Log(float64(p[k]))
+				cnt[k] += n
+			}
+		}
+	})
+	for k := range loss {
+		loss[k] /= float64(cnt[k])
+	}
+	return loss
+}
+
+// MultiClassLogLikelihood returns the log likelihood of the classifier fitting
+// the given data, i.e. the sum of log P(y|X) over all the instances.
+func MultiClassLogLikelihood(classifier MultiClassClassifier, data_accessor DataInstanceAccessor) float64 {
+	loglikelihood := float64(0)
+	ForEachValidDataInstance(data_accessor, func(instance DataInstance) {
+		p := classifier.GetPosterior(&instance)
+		for k, n := range labelCountsOf(&instance) {
+			if n > 0 {
+				loglikelihood += float64(n) * math.Log(float64(p[k]))
+			}
+		}
+	})
+	return loglikelihood
+}
+
+// MacroAUC returns the average of the one-vs-rest ROC AUC of every label class
+// that has both positive and negative instances, or 0 if no class has both.
+func MacroAUC(classifier MultiClassClassifier, data_accessor DataInstanceAccessor) float64 {
+	var eval_results []map[WeightT]*Coordinate
+	ForEachValidDataInstance(data_accessor, func(instance DataInstance) {
+		p := classifier.GetPosterior(&instance)
+		for len(eval_results) < len(p) {
+			eval_results = append(eval_results, make(map[WeightT]*Coordinate))
+		}
+		counts := labelCountsOf(&instance)
+		total := 0
+		for _, n := range counts {
+			total += n
+		}
+		for k, n := range counts {
+			r, ok := eval_results[k][p[k]]
+			if !ok {
+				r = &Coordinate{p: p[k]}
+				eval_results[k][p[k]] = r
+			}
+			(*r).n_pos += n
+			(*r).n_neg += total - n
+		}
+	})
+	sum := float64(0)
+	num_classes := 0
+	for _, eval_result := range eval_results {
+		coordinates := make(Coordinates, 0, len(eval_result))
+		n_pos, n_neg := 0, 0
+		for _, c := range eval_result {
+			coordinates = append(coordinates, c)
+			n_pos += c.n_pos
+			n_neg += c.n_neg
+		}
+		if n_pos == 0 || n_neg == 0 {
+			continue
+		}
+		sort.Sort(coordinates)
+		sum += AUC(coordinates)
+		num_classes++
+	}
+	if num_classes == 0 {
+		return 0
+	}
+	return sum / float64(num_classes)
+}
+
 // L2NormOfParamaeters returns the L2 norm of all the parameters of the given RBM.
 func (rbm *SparseClassRBM) L2NormOfParamaeters() float64 {
 	return 0
@@ -159,7 +404,6 @@ func L2Norm(w interface{}) float64 {
 		break
 	default:
 		panic(fmt.Sprintf("Invalid parameter w: %v.", w))
-		break
 	}
 	return l2norm
 }
@@ -187,7 +431,6 @@ func Sparsity(w interface{}, z interface{}) (zeros int, count int) {
 		break
 	default:
 		panic(fmt.Sprintf("Invalid parameter w: %v.", w))
-		break
 	}
 	return
 }
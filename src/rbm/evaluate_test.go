@@ -5,6 +5,8 @@
 package rbm
 
 import (
+	"io"
+	"math"
 	_ "reflect"
 	"testing"
 )
@@ -83,3 +85,176 @@ func Test_Sparsity(t *testing.T) {
 		}
 	}
 }
+
+// fixedPosteriors is a MultiClassClassifier returning the posterior stored
+// in the first class of the instance.
+type fixedPosteriors [][]WeightT
+
+func (f fixedPosteriors) GetPosterior(instance *DataInstance) []WeightT {
+	return f[instance.x[0]]
+}
+
+// instanceSlice is a DataInstanceAccessor over instances in memory.
+type instanceSlice struct {
+	instances []DataInstance
+	next      int
+}
+
+func (s *instanceSlice) Reset() {
+	s.next = 0
+}
+
+func (s *instanceSlice) NextInstance() (DataInstance, error) {
+	if s.next >= len(s.instances) {
+		return DataInstance{}, io.EOF
+	}
+	s.next++
+	return s.instances[s.next-1], nil
+}
+
+func (s *instanceSlice) Close() {
+}
+
+func Test_MultiClassMetrics(t *testing.T) {
+	classifier := fixedPosteriors{
+		{0.7, 0.2, 0.1},
+		{0.2, 0.5, 0.3},
+		{0.1, 0.3, 0.6},
+	}
+	accessor := &instanceSlice{instances: []DataInstance{
+		{x: []int{0}, y_counts: []int{2, 0, 0}},
+		{x: []int{1}, y_counts: []int{0, 1, 1}},
+		{x: []int{2}, y_counts: []int{0, 0, 1}},
+	}}
+
+	if accuracy := MultiClassAccuracy(classifier, accessor); !EqualWithinPrecesionF64(accuracy, 0.8, kPrecision) {
+		t.Errorf("Expected accuracy to be 0.8 but got %f.", accuracy)
+	}
+
+	expected_loss := []float64{-math.Log(0.7), -math.Log(0.5), -(math.Log(0.3) + math.Log(0.6)) / 2}
+	loss := PerClassLogLoss(classifier, accessor)
+	for k := range expected_loss {
+		if !EqualWithinPrecesionF64(loss[k], expected_loss[k], kPrecision) {
+			t.Errorf("Expected log loss of class %d to be %f but got %f.", k, expected_loss[k], loss[k])
+		}
+	}
+
+	expected_ll := 2*math.Log(0.7) + math.Log(0.5) + math.Log(0.3) + math.Log(0.6)
+	if ll := MultiClassLogLikelihood(classifier, accessor); !EqualWithinPrecesionF64(ll, expected_ll, kPrecision) {
+		t.Errorf("Expected log likelihood to be %f but got %f.", expected_ll, ll)
+	}
+
+	// Class 0 is perfectly ranked; in class 1 and 2 the positive scored 0.5
+	// and 0.3 respectively ties with a negative of the same instance.
+	expected_auc := (1 + 3.5/4 + 5.5/6) / 3
+	if auc := MacroAUC(classifier, accessor); !EqualWithinPrecesionF64(auc, expected_auc, kPrecision) {
+		t.Errorf("Expected macro AUC to be %f but got %f.", expected_auc, auc)
+	}
+
+	empty := &instanceSlice{}
+	if accuracy, auc := MultiClassAccuracy(classifier, empty), MacroAUC(classifier, empty); accuracy != 0 || auc != 0 {
+		t.Errorf("Expected accuracy and macro AUC of no instance to be 0 but got %f and %f.", accuracy, auc)
+	}
+	single := &instanceSlice{instances: []DataInstance{{x: []int{0}, y_counts: []int{2, 0, 0}}}}
+	if auc := MacroAUC(classifier, single); auc != 0 {
+		t.Errorf("Expected macro AUC without negative instances to be 0 but got %f.", auc)
+	}
+}
+
+// fixedTargets is a Regressor returning the target stored in the first class
+// of the instance.
+type fixedTargets []WeightT
+
+func (f fixedTargets) GetRegression(instance *DataInstance) WeightT {
+	return f[instance.x[0]]
+}
+
+func Test_RegressionMetrics(t *testing.T) {
+	regressor := fixedTargets{1, 2.5, -1}
+	accessor := &instanceSlice{instances: []DataInstance{
+		{x: []int{0}, target: 2},
+		{x: []int{1}, target: 2.5},
+		{x: []int{2}, target: 1},
+	}}
+	expected_rmse := math.Sqrt(5.0 / 3)
+	if rmse := RegressionRMSE(regressor, accessor); !EqualWithinPrecesionF64(rmse, expected_rmse, kPrecision) {
+		t.Errorf("Expected RMSE to be %f but got %f.", expected_rmse, rmse)
+	}
+	if mae := RegressionMAE(regressor, accessor); !EqualWithinPrecesionF64(mae, 1, kPrecision) {
+		t.Errorf("Expected MAE to be 1 but got %f.", mae)
+	}
+
+	empty := &instanceSlice{}
+	if rmse, mae := RegressionRMSE(regressor, empty), RegressionMAE(regressor, empty); rmse != 0 || mae != 0 {
+		t.Errorf("Expected RMSE and MAE of no instance to be 0 but got %f and %f.", rmse, mae)
+	}
+}
+
+func Test_PseudoLogLikelihood(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	data := getBatchTestData()
+	expected := float64(0)
+	for _, instance := range data {
+		for y, n := range labelCountsOf(&instance) {
+			for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+				log_p := make([]WeightT, rbm.ClassSize(c))
+				for k := range log_p {
+					x := append([]int(nil), instance.x...)
+					x[c] = k
+					log_p[k] = -rbm.FreeEnergy(&DataInstance{x: x}, y)
+				}
+				expected += float64(n) * float64(log_p[instance.x[c]]-LogSumExp(log_p))
+			}
+		}
+	}
+	if pll := PseudoLogLikelihood(rbm, &instanceSlice{instances: data}); !EqualWithinPrecesionF64(pll, expected, kPrecision) ||
+		pll >= 0 {
+		t.Errorf("Expected pseudo log likelihood %f but got %f.", expected, pll)
+	}
+}
+
+func Test_ReconstructionError(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	data := &instanceSlice{instances: getBatchTestData()}
+	e := ReconstructionError(rbm, data)
+	if e <= 0 || e >= 1 {
+		t.Errorf("Expected a reconstruction error in (0, 1) but got %f.", e)
+	}
+
+	// Without interactions, the reconstructions follow the visible biases.
+	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+		for k := 0; k < rbm.ClassSize(c); k++ {
+			for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+				rbm.SetW(j, c, k, 0)
+			}
+		}
+	}
+	expected, cnt := float64(0), 0
+	for _, instance := range data.instances {
+		n := instance.pos_y + instance.neg_y
+		for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+			p_x := make([]WeightT, rbm.ClassSize(c))
+			for k := range p_x {
+				p_x[k] = rbm.B(c, k)
+			}
+			SoftMax(p_x)
+			expected += float64(n) * float64(1-p_x[instance.x[c]])
+			cnt += n
+		}
+	}
+	expected /= float64(cnt)
+	if e := ReconstructionError(rbm, data); !EqualWithinPrecesionF64(e, expected, kPrecision) {
+		t.Errorf("Expected reconstruction error %f but got %f.", expected, e)
+	}
+
+	// Without interactions and visible biases, the reconstructions are uniform.
+	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+		for k := 0; k < rbm.ClassSize(c); k++ {
+			rbm.SetB(c, k, 0)
+		}
+	}
+	expected = (0 + 1.0/2 + 2.0/3) / 3
+	if e := ReconstructionError(rbm, data); !EqualWithinPrecesionF64(e, expected, kPrecision) {
+		t.Errorf("Expected reconstruction error %f but got %f.", expected, e)
+	}
+}
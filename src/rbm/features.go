@@ -0,0 +1,174 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Hidden features.
+//
+// The activations P(h_j = 1 | X) of the hidden units are features of the
+// instance that other models can be trained on. y is either summed out under
+// the model,
+//	P(h_j = 1 | X) = sum{y}(P(y | X) * P(h_j = 1 | X, y))
+// or conditioned on, e.g. to extract the features of labeled training data.
+
+package rbm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Method HiddenFeatures returns P(h_j = 1 | X) of every hidden unit j of the
+// instance v, y being summed out, or integrated out numerically for
+// regression models. Missing classes that the model marginalizes are summed
+// out.
+func (rbm *SparseClassRBM) HiddenFeatures(v *DataInstance) []WeightT {
+	var labels []*particleT
+	switch {
+	case rbm.IsRegression():
+		for _, y := range rbm.targetGrid() {
+			labels = append(labels, &particleT{target: y})
+		}
+	case rbm.IsMultiClass():
+		for y := 0; y < rbm.NumOfLabels(); y++ {
+			labels = append(labels, &particleT{y: y})
+		}
+	default:
+		labels = []*particleT{{y: 0}, {y: 1}}
+	}
+	return rbm.expectedHidden(v, labels)
+}
+
+// Method HiddenFeaturesGivenLabel returns P(h_j = 1 | X, y) of every hidden
+// unit j of the instance v with label class y. For regression models, y is
+// ignored and the normalized target of v is used instead. Missing classes
+// that the model marginalizes are summed out.
+func (rbm *SparseClassRBM) HiddenFeaturesGivenLabel(v *DataInstance, y int) []WeightT {
+	if rbm.IsRegression() {
+		return rbm.expectedHidden(v, []*particleT{{target: rbm.normalizeTarget(v.target)}})
+	}
+	return rbm.expectedHidden(v, []*particleT{{y: y}})
+}
+
+// Method expectedHidden calculates the mean of P(h | X, y) over the
+// completions X of the missing classes of v and the labels y of the given
+// particles, weighted by P(X, y).
+func (rbm *SparseClassRBM) expectedHidden(v *DataInstance, labels []*particleT) []WeightT {
+	completions, _ := rbm.missingCompletions(v)
+	log_weights := make([]WeightT, 0, len(completions)*len(labels))
+	hs := make([][]WeightT, 0, len(completions)*len(labels))
+	for _, completion := range completions {
+		w_dot_x_add_c := rbm.wDotXAddC(completion)
+		bias := rbm.visibleBiasTerm(completion)
+		for _, label := range labels {
+			h := make([]WeightT, len(w_dot_x_add_c))
+			log_w := bias + rbm.labelBiasTerm(label)
+			for j, a := range w_dot_x_add_c {
+				a += rbm.labelInput(j, label)
+				log_w += SoftPlus(a)
+				h[j] = Sigmoid(a)
+			}
+			log_weights = append(log_weights, log_w)
+			hs = append(hs, h)
+		}
+	}
+	if len(hs) == 1 {
+		return hs[0]
+	}
+	SoftMax(log_weights)
+	features := make([]WeightT, rbm.SizeOfHiddenLayer())
+	for i, h := range hs {
+		for j, h_j := range h {
+			features[j] += log_weights[i] * h_j
+		}
+	}
+	return features
+}
+
+// Method hiddenFeaturesOfInstance returns the hidden features of the instance
+// v, conditioned on its labels if given_label is set, the features given each
+// label class being weighted by its number of instances.
+func (rbm *SparseClassRBM) hiddenFeaturesOfInstance(v *DataInstance, given_label bool) []WeightT {
+	if !given_label {
+		return rbm.HiddenFeatures(v)
+	}
+	if rbm.IsRegression() {
+		return rbm.HiddenFeaturesGivenLabel(v, 0)
+	}
+	features := make([]WeightT, rbm.SizeOfHiddenLayer())
+	total := 0
+	for y, n := range labelCountsOf(v) {
+		if n == 0 {
+			continue
+		}
+		for j, h_j := range rbm.HiddenFeaturesGivenLabel(v, y) {
+			features[j] += WeightT(n) * h_j
+		}
+		total += n
+	}
+	if total > 0 {
+		ScalarProduct(features, 1/WeightT(total))
+	}
+	return features
+}
+
+// WriteHiddenFeatures writes the hidden features of every valid instance of
+// the given data, conditioned on its labels if given_label is set, see
+// hiddenFeaturesOfInstance. Each line is an instance in the format of the
+// data files, its label counts or target being followed by the features
+// j:P(h_j = 1 | X) of the hidden units j whose activation is at least
+// min_activation, all of them if it is 0, so that the output can be read as
+// instances with Gaussian classes. A sparse instance without any active
+// hidden unit has no feature.
+func WriteHiddenFeatures(w io.Writer, rbm *SparseClassRBM, data_accessor DataInstanceAccessor,
+	given_label bool, min_activation WeightT) error {
+	var err error
+	ForEachValidDataInstance(data_accessor, func(instance DataInstance) {
+		if err != nil {
+			return
+		}
+		var labels []string
+		switch {
+		case rbm.IsRegression():
+			labels = []string{fmt.Sprintf("%g", instance.target)}
+		case rbm.IsMultiClass():
+			for _, n := range instance.y_counts {
+				labels = append(labels, fmt.Sprintf("%d", n))
+			}
+		default:
+			labels = []string{fmt.Sprintf("%d", instance.pos_y), fmt.Sprintf("%d", instance.neg_y)}
+		}
+		_, err = fmt.Fprintf(w, "%s", strings.Join(labels, "\t"))
+		for j, h_j := range rbm.hiddenFeaturesOfInstance(&instance, given_label) {
+			if err == nil && h_j >= min_activation {
+				_, err = fmt.Fprintf(w, "\t%d:%g", j, h_j)
+			}
+		}
+		if err == nil {
+			_, err = fmt.Fprintf(w, "\n")
+		}
+	})
+	return err
+}
+
+// WriteHiddenFeaturesToFile writes the hidden features of the given data to
+// the file of the given name, see WriteHiddenFeatures.
+func WriteHiddenFeaturesToFile(filename string, rbm *SparseClassRBM, data_accessor DataInstanceAccessor,
+	given_label bool, min_activation WeightT) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if err := WriteHiddenFeatures(writer, rbm, data_accessor, given_label, min_activation); err != nil {
+		file.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to save hidden features to %s: %s.", filename, err)
+	}
+	return file.Close()
+}
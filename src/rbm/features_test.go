@@ -0,0 +1,94 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_HiddenFeatures(t *testing.T) {
+	for _, rbm := range []*SparseClassRBM{getSampleRBMForProbabilityTest(), getSampleMultiClassRBM()} {
+		v := &DataInstance{x: []int{0, 1, 2}}
+		p_y := rbm.probDistOfYGivenInstance(v)
+		expected := make([]WeightT, rbm.SizeOfHiddenLayer())
+		for y := range p_y {
+			h := make([]WeightT, rbm.SizeOfHiddenLayer())
+			rbm.probDistOfHGivenXY(h, v.x, y)
+			if got := rbm.HiddenFeaturesGivenLabel(v, y); !ArraysEqualWithinPrecision(got, h, kPrecision) {
+				t.Errorf("Expected P(h|X, y=%d) %v but got %v.", y, h, got)
+			}
+			for j := range h {
+				expected[j] += p_y[y] * h[j]
+			}
+		}
+		got := rbm.HiddenFeatures(v)
+		for j := range expected {
+			if !EqualWithinPrecision(got[j], expected[j], kPrecision) {
+				t.Errorf("Expected P(h|X) %v but got %v.", expected, got)
+				break
+			}
+		}
+	}
+
+	// For regression models, the features given the target are P(h|X, y) of
+	// the normalized target.
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.InitializeRegression(10, 2)
+	v := &DataInstance{x: []int{0, 1, 2}, target: 11}
+	h := make([]WeightT, rbm.SizeOfHiddenLayer())
+	rbm.probDistOfHGivenTarget(h, v, 0.5)
+	if got := rbm.HiddenFeaturesGivenLabel(v, 0); !ArraysEqualWithinPrecision(got, h, kPrecision) {
+		t.Errorf("Expected P(h|X, y) %v but got %v.", h, got)
+	}
+}
+
+func Test_WriteHiddenFeatures(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	data := getBatchTestData()
+	var dense, sparse bytes.Buffer
+	if err := WriteHiddenFeatures(&dense, rbm, &instanceSlice{instances: data}, true, 0); err != nil {
+		t.Fatalf("Failed to write features: %s.", err)
+	}
+	if err := WriteHiddenFeatures(&sparse, rbm, &instanceSlice{instances: data}, false, 0.55); err != nil {
+		t.Fatalf("Failed to write features: %s.", err)
+	}
+	dense_lines := strings.Split(strings.TrimSuffix(dense.String(), "\n"), "\n")
+	sparse_lines := strings.Split(strings.TrimSuffix(sparse.String(), "\n"), "\n")
+	if len(dense_lines) != len(data) || len(sparse_lines) != len(data) {
+		t.Fatalf("Expected %d lines but got\n%s\n%s", len(data), dense.String(), sparse.String())
+	}
+	for i := range data {
+		given := rbm.hiddenFeaturesOfInstance(&data[i], true)
+		expected := fmt.Sprintf("%d\t%d", data[i].pos_y, data[i].neg_y)
+		for j, h_j := range given {
+			expected += fmt.Sprintf("\t%d:%g", j, h_j)
+		}
+		if dense_lines[i] != expected {
+			t.Errorf("Expected dense line %q but got %q.", expected, dense_lines[i])
+		}
+		expected = fmt.Sprintf("%d\t%d", data[i].pos_y, data[i].neg_y)
+		for j, h_j := range rbm.HiddenFeatures(&data[i]) {
+			if h_j >= 0.55 {
+				expected += fmt.Sprintf("\t%d:%g", j, h_j)
+			}
+		}
+		if sparse_lines[i] != expected {
+			t.Errorf("Expected sparse line %q but got %q.", expected, sparse_lines[i])
+		}
+	}
+
+	// The dense features can be read back exactly as instances with Gaussian
+	// classes.
+	loader_format := instanceFormat{num_classes: rbm.SizeOfHiddenLayer(),
+		class_types: []ClassType{KGaussianClass, KGaussianClass, KGaussianClass, KGaussianClass}}
+	instance, err := parseInstance(dense_lines[0], loader_format)
+	if err != nil || instance.pos_y != 1 || instance.neg_y != 0 ||
+		instance.x_real[3] != rbm.HiddenFeaturesGivenLabel(&data[0], 1)[3] {
+		t.Errorf("Failed to read back the features %q: %v, %v.", dense_lines[0], instance, err)
+	}
+}
@@ -23,125 +23,478 @@ type deltaBT struct {
 }
 
 type deltaT struct {
-	delta_w []deltaWT
-	delta_b []deltaBT
-	delta_d WeightT
-	delta_c []WeightT
-	delta_u []WeightT
+	delta_w  []deltaWT
+	delta_b  []deltaBT
+	delta_d  WeightT
+	delta_c  []WeightT
+	delta_u  []WeightT
+	delta_uk [][]WeightT //multi-class models only
+	delta_dk []WeightT   //multi-class models only
+	delta_s  []deltaBT   //log of the standard deviations of Gaussian classes, if learned
 }
 
 func (d *deltaT) ScalarProduct(x int) {
 	if x == 1 {
 		return
 	}
-	x_t := WeightT(x)
+	d.scale(WeightT(x))
+}
+
+// scale multiplies all the deltas by x_t.
+func (d *deltaT) scale(x_t WeightT) {
 	for i, _ := range d.delta_w {
 		d.delta_w[i].delta_v *= x_t
 	}
 	for i, _ := range d.delta_b {
 		d.delta_b[i].delta_v *= x_t
 	}
+	for i := range d.delta_s {
+		d.delta_s[i].delta_v *= x_t
+	}
 	d.delta_d *= x_t
 	ScalarProduct(d.delta_c, x_t)
 	ScalarProduct(d.delta_u, x_t)
+	for k := range d.delta_uk {
+		ScalarProduct(d.delta_uk[k], x_t)
+	}
+	ScalarProduct(d.delta_dk, x_t)
 }
 
 func (delta *deltaT) Clear() {
 	(*delta).delta_w = (*delta).delta_w[0:0]
 	(*delta).delta_b = (*delta).delta_b[0:0]
+	(*delta).delta_s = (*delta).delta_s[0:0]
 }
 
 func (rbm *SparseClassRBM) NewDeltaT() *deltaT {
 	var delta deltaT
 	delta.delta_c = make([]WeightT, rbm.SizeOfHiddenLayer())
 	delta.delta_u = make([]WeightT, rbm.SizeOfHiddenLayer())
+	if rbm.IsMultiClass() {
+		delta.delta_uk = make([][]WeightT, rbm.NumOfLabels())
+		for k := range delta.delta_uk {
+			delta.delta_uk[k] = make([]WeightT, rbm.SizeOfHiddenLayer())
+		}
+		delta.delta_dk = make([]WeightT, rbm.NumOfLabels())
+	}
 	return &delta
 }
 
-// doGradient Calculates the gradient using one training instance.
-func (trainer *RBMTrainer) doGradient(pos_delta, neg_delta *deltaT) (bool, bool) {
-	has_pos, has_neg := false, false
+// newLabelDeltas returns one deltaT for each label class.
+func (rbm *SparseClassRBM) newLabelDeltas() []*deltaT {
+	num_labels := 2
+	if rbm.IsMultiClass() {
+		num_labels = rbm.NumOfLabels()
+	} else if rbm.IsRegression() {
+		num_labels = 1
+	}
+	deltas := make([]*deltaT, num_labels)
+	for y := range deltas {
+		deltas[y] = rbm.NewDeltaT()
+	}
+	return deltas
+}
+
+// labelCounts returns the labels of the given instance and their counts, the
+// positive label coming first for binary models. Regression instances have
+// the single label 0, their target being kept in the instance.
+func (rbm *SparseClassRBM) labelCounts(instance *DataInstance) (labels []int, counts []int) {
+	if rbm.IsRegression() {
+		return []int{0}, []int{1}
+	}
+	if !rbm.IsMultiClass() {
+		return []int{1, 0}, []int{instance.pos_y, instance.neg_y}
+	}
+	labels = make([]int, len(instance.y_counts))
+	for k := range labels {
+		labels[k] = k
+	}
+	return labels, instance.y_counts
+}
+
+// Method isUnlabeled determines whether the instance of a classification
+// model has no label, all its label counts being 0.
+func (rbm *SparseClassRBM) isUnlabeled(instance *DataInstance) bool {
+	if rbm.IsRegression() {
+		return false
+	}
+	_, counts := rbm.labelCounts(instance)
+	for _, n := range counts {
+		if n > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// doGradient Calculates the gradient using one training instance, storing the
+// gradient of label y, scaled by its count, in deltas[y]. It returns the
+// labels for which gradients have been calculated, nil if there is no more
+// training instance. The gradient of an unlabeled instance is stored in
+// deltas[0], label 0 being returned, or the instance is skipped if the
+// unsupervised term is not learned.
+func (trainer *RBMTrainer) doGradient(deltas []*deltaT) []int {
 	var data_instance DataInstance
 	for {
 		instance, err := trainer.training_data_accessor.NextInstance()
 		if err == io.EOF {
-			return has_pos, has_neg
+			return nil
 		}
-		if trainer.rbm.IsValidInput(instance) {
+		if !trainer.rbm.IsValidInput(instance) {
+			log.Printf("invalid input: %v.\n", instance)
+		} else if !trainer.rbm.isUnlabeled(&instance) || trainer.parameters.unsup_importance > 0 {
 			data_instance = instance
 			break
-		} else {
-			log.Printf("invalid input: %v.\n", instance)
 		}
 	}
 
-	pos_delta.Clear()
-	neg_delta.Clear()
-	if data_instance.pos_y > 0 {
-		has_pos = true
-		trainer.doInstanceGradient(data_instance.x, 1, pos_delta)
-		pos_delta.ScalarProduct(data_instance.pos_y)
+	if trainer.rbm.isUnlabeled(&data_instance) {
+		p_y_given_x := trainer.rbm.probDistOfYGivenInstance(&data_instance)
+		y := SelectKFromDist(randomWeight(trainer.rng), p_y_given_x)
+		instance := trainer.rbm.fillMissing(trainer.rng, &data_instance, y)
+		trainer.doUnlabeledGradient(instance, y, deltas[0])
+		return []int{0}
+	}
+
+	var updated []int
+	labels, counts := trainer.rbm.labelCounts(&data_instance)
+	for i, y := range labels {
+		if counts[i] > 0 {
+			instance := trainer.rbm.fillMissing(trainer.rng, &data_instance, y)
+			trainer.doInstanceGradient(instance, y, deltas[y])
+			deltas[y].ScalarProduct(counts[i])
+			updated = append(updated, y)
+		}
+	}
+	return updated
+}
+
+// visibleDeltaT records how often value k of class c is active in the data
+// (pos) and in the reconstruction (neg) of an instance, weighted by the scale
+// of the class. For Gaussian classes, k is 0 and the activities are the
+// values divided by the standard deviation of the class.
+type visibleDeltaT struct {
+	c_index int
+	c_value int
+	pos     WeightT
+	neg     WeightT
+}
+
+// visibleDeltas collects the active visible units of the data instance v and
+// of its reconstruction v_hat (which may be nil), merging the units active in
+// both so that each unit appears only once. Missing classes are left out.
+func (rbm *SparseClassRBM) visibleDeltas(v, v_hat *DataInstance) []visibleDeltaT {
+	var deltas []visibleDeltaT
+	add := func(first, c, k int, pos, neg WeightT) {
+		for i := first; i < len(deltas); i++ {
+			if deltas[i].c_value == k {
+				deltas[i].pos += pos
+				deltas[i].neg += neg
+				return
+			}
+		}
+		deltas = append(deltas, visibleDeltaT{c, k, pos, neg})
+	}
+	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+		first := len(deltas)
+		rbm.forEachActiveValue(v, c, func(k int, activity WeightT) {
+			add(first, c, k, activity, 0)
+		})
+		if v_hat != nil {
+			rbm.forEachActiveValue(v_hat, c, func(k int, activity WeightT) {
+				add(first, c, k, 0, activity)
+			})
+		}
+	}
+	return deltas
+}
+
+// forEachActiveValue calls f with every active value k of class c in the
+// instance v and its activity: 1 for single-valued classes, the scale of the
+// bag for multi-valued classes and the value divided by the standard
+// deviation, k being 0, for Gaussian classes. f is not called for a missing
+// class.
+func (rbm *SparseClassRBM) forEachActiveValue(v *DataInstance, c int, f func(k int, activity WeightT)) {
+	if v.isMissing(c) {
+		return
+	}
+	if rbm.isGaussian(c) {
+		f(0, v.realValue(c)/rbm.Sigma(c))
+		return
+	}
+	if !rbm.isMultiValued(c) {
+		f(v.x[c], 1)
+		return
+	}
+	bag := v.bag(c)
+	scale := rbm.bagScale(c, len(bag))
+	for _, k := range bag {
+		f(k, scale)
+	}
+}
+
+// visibleBiasDeltas returns the gradient of the generative term of the
+// biases of the active visible units, alpha * (pos - neg), divided by the
+// standard deviation for Gaussian classes as their bias is the mean. With one
+// bias per class, the deltas of the values of a class are summed into that of
+// value 0.
+func (rbm *SparseClassRBM) visibleBiasDeltas(visible_deltas []visibleDeltaT, alpha WeightT) []deltaBT {
+	deltas := make([]deltaBT, 0, len(visible_deltas))
+	for _, d := range visible_deltas {
+		delta_v := alpha * (d.pos - d.neg)
+		if rbm.isGaussian(d.c_index) {
+			delta_v /= rbm.Sigma(d.c_index)
+		}
+		if rbm.x_bias_mode == KPerClassBias {
+			if n := len(deltas); n > 0 && deltas[n-1].c_index == d.c_index {
+				deltas[n-1].delta_v += delta_v
+				continue
+			}
+			deltas = append(deltas, deltaBT{d.c_index, 0, delta_v})
+			continue
+		}
+		deltas = append(deltas, deltaBT{d.c_index, d.c_value, delta_v})
 	}
-	if data_instance.neg_y > 0 {
-		has_neg = true
-		trainer.doInstanceGradient(data_instance.x, 0, neg_delta)
-		pos_delta.ScalarProduct(data_instance.neg_y)
+	return deltas
+}
+
+// sigmaDeltas returns the gradient of the hybrid objective with respect to
+// the log of the standard deviation of every Gaussian class,
+//	alpha * ((X_c - b_c)^2 - (X_hat_c - b_c)^2) / sigma_c^2
+//		- X_c / sigma_c * sum{j}(W[c][j][0] * pos_h[j])
+//		+ alpha * X_hat_c / sigma_c * sum{j}(W[c][j][0] * h_hat[j])
+// pos_h being the factor of the visible activities in the gradient of W.
+func (rbm *SparseClassRBM) sigmaDeltas(v, v_hat *DataInstance, pos_h, h_hat []WeightT,
+	alpha WeightT) []deltaBT {
+	var deltas []deltaBT
+	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+		if !rbm.isGaussian(c) {
+			continue
+		}
+		sigma := rbm.Sigma(c)
+		x := v.realValue(c) - rbm.B(c, 0)
+		w_dot_pos_h, w_dot_h_hat := WeightT(0), WeightT(0)
+		for j := 0; j < rbm.h_num; j++ {
+			w_dot_pos_h += rbm.W(j, c, 0) * pos_h[j]
+			w_dot_h_hat += rbm.W(j, c, 0) * h_hat[j]
+		}
+		delta_v := alpha*x*x/(sigma*sigma) - v.realValue(c)/sigma*w_dot_pos_h
+		if v_hat != nil {
+			x_hat := v_hat.realValue(c) - rbm.B(c, 0)
+			delta_v += -alpha*x_hat*x_hat/(sigma*sigma) + alpha*v_hat.realValue(c)/sigma*w_dot_h_hat
+		}
+		deltas = append(deltas, deltaBT{c, 0, delta_v})
 	}
-	return has_pos, has_neg
+	return deltas
 }
 
-func (trainer *RBMTrainer) doInstanceGradient(x []int, y int, delta *deltaT) {
+// doInstanceGradient calculates the gradient of the hybrid objective
+//	log P(y|X) + alpha * log P(X, y)
+// where the gradient of the generative term is approximated with CD-k or PCD,
+// see SetSamplingMethod, plus the gradient of the sparsity penalty, if any.
+func (trainer *RBMTrainer) doInstanceGradient(v *DataInstance, y int, delta *deltaT) {
+	if trainer.rbm.IsRegression() {
+		trainer.doTargetGradient(v, delta)
+		return
+	}
 	rbm := trainer.rbm
 	param := &trainer.parameters
 	alpha := WeightT(param.gen_learn_importance)
 	one_plus_alpha := WeightT(1 + param.gen_learn_importance)
 
 	delta.Clear()
-	// CD-k
-	x_hat := make([]int, rbm.NumOfVisibleClasses())
+	// CD-k or PCD
+	var v_hat *DataInstance
 	y_hat := 0
 	h_hat := make([]WeightT, rbm.SizeOfHiddenLayer())
 	if param.gen_learn_importance > 0 {
-		copy(x_hat, x)
-		y_hat = y
-		for t := 0; t < param.gibbs_chain_length; t++ {
-			rbm.sampleHGivenXY(h_hat, x_hat, y_hat)
-			rbm.sampleXGivenH(x_hat, h_hat)
-			rbm.sampleYGivenH(&y_hat, h_hat)
+		p := trainer.negativeParticle(v, y, 0, h_hat)
+		v_hat, y_hat = p.v, p.y
+	}
+	// P(h | X, Y=k) for every label class k
+	p_y_given_x := rbm.probDistOfYGivenInstance(v)
+	p_dist_h_given_x_y := make([][]WeightT, len(p_y_given_x))
+	for k := range p_dist_h_given_x_y {
+		p_dist_h_given_x_y[k] = make([]WeightT, rbm.h_num)
+		rbm.probDistOfHGivenInstance(p_dist_h_given_x_y[k], v, k)
+	}
+
+	//Gradient Calculation
+	p_dist_h_given_xy := p_dist_h_given_x_y[y]
+	visible_deltas := rbm.visibleDeltas(v, v_hat)
+	sparsity := trainer.sparsityPenalties(p_dist_h_given_xy)
+
+	//delta_W[c][j][k], valid only if X_c = k or X_hat_c = k
+	pos_h := make([]WeightT, rbm.h_num)
+	for j := 0; j < rbm.h_num; j++ {
+		ep_hj_yx := WeightT(0)
+		for k, p_k := range p_y_given_x {
+			ep_hj_yx += p_k * p_dist_h_given_x_y[k][j]
+		}
+		pos_hj := one_plus_alpha*p_dist_h_given_xy[j] - ep_hj_yx
+		pos_h[j] = pos_hj
+		(*delta).delta_c[j] = pos_hj - alpha*h_hat[j] + sparsity[j]
+		if rbm.IsMultiClass() {
+			for k, p_k := range p_y_given_x {
+				d_uk_j := -p_k * p_dist_h_given_x_y[k][j]
+				if k == y {
+					d_uk_j += one_plus_alpha * p_dist_h_given_xy[j]
+				}
+				if k == y_hat {
+					d_uk_j -= alpha * h_hat[j]
+				}
+				(*delta).delta_uk[k][j] = d_uk_j
+			}
+		} else {
+			(*delta).delta_u[j] = one_plus_alpha*p_dist_h_given_xy[j]*WeightT(y) - p_y_given_x[1]*p_dist_h_given_x_y[1][j] - alpha*h_hat[j]*WeightT(y_hat)
+		}
+		for _, d := range visible_deltas {
+			//when neither X_c nor X_hat_c is k, delta_w_c_j_k = 0
+			delta_w_c_j_k := d.pos*(pos_hj+sparsity[j]) - d.neg*alpha*h_hat[j]
+			(*delta).delta_w = append((*delta).delta_w, deltaWT{j, d.c_index, d.c_value, delta_w_c_j_k})
+		}
+	}
+	(*delta).delta_b = append((*delta).delta_b, rbm.visibleBiasDeltas(visible_deltas, alpha)...)
+	if trainer.learn_variance {
+		(*delta).delta_s = append((*delta).delta_s, rbm.sigmaDeltas(v, v_hat, pos_h, h_hat, alpha)...)
+	}
+	if rbm.IsMultiClass() {
+		for k, p_k := range p_y_given_x {
+			d_dk := -p_k
+			if k == y {
+				d_dk += one_plus_alpha
+			}
+			if alpha > 0 && k == y_hat {
+				d_dk -= alpha
+			}
+			(*delta).delta_dk[k] = d_dk
 		}
-		// Final H uses probability, not samples.
-		rbm.probDistOfHGivenXY(h_hat, x_hat, y_hat)
+	} else {
+		(*delta).delta_d = one_plus_alpha*WeightT(y) - p_y_given_x[1] - alpha*WeightT(y_hat)
 	}
-	p_dist_h_given_x_posy := make([]WeightT, rbm.h_num)
-	rbm.probDistOfHGivenXY(p_dist_h_given_x_posy, x, 1)
+}
 
-	p_dist_h_given_x_negy := make([]WeightT, rbm.h_num)
-	rbm.probDistOfHGivenXY(p_dist_h_given_x_negy, x, 1)
+// doUnlabeledGradient calculates the gradient of the generative term
+//	beta * log P(X)
+// of an unlabeled instance v, beta being the unsupervised importance. y is
+// summed out of the positive phase, while the negative phase is sampled as
+// for doInstanceGradient, from the label y drawn from P(y|X) if a new chain
+// starts from v:
+//	delta_W[c][j][k] = beta * (sum{y}(P(y|X) * P(h_j|X, y)) * 1{X_c = k} - h_hat[j] * 1{X_hat_c = k})
+func (trainer *RBMTrainer) doUnlabeledGradient(v *DataInstance, y int, delta *deltaT) {
+	rbm := trainer.rbm
+	beta := trainer.parameters.unsup_importance
 
-	//Gradient Calculation
-	var p_dist_h_given_xy []WeightT
-	if y == 1 {
-		p_dist_h_given_xy = p_dist_h_given_x_posy
+	delta.Clear()
+	h_hat := make([]WeightT, rbm.SizeOfHiddenLayer())
+	p := trainer.negativeParticle(v, y, 0, h_hat)
+	v_hat, y_hat := p.v, p.y
+	p_y_given_x := rbm.probDistOfYGivenInstance(v)
+	p_dist_h_given_x_y := make([][]WeightT, len(p_y_given_x))
+	for k := range p_dist_h_given_x_y {
+		p_dist_h_given_x_y[k] = make([]WeightT, rbm.h_num)
+		rbm.probDistOfHGivenInstance(p_dist_h_given_x_y[k], v, k)
+	}
+	visible_deltas := rbm.visibleDeltas(v, v_hat)
+	ep_h_x := make([]WeightT, rbm.h_num)
+	for k, p_k := range p_y_given_x {
+		addScaledTo(ep_h_x, p_dist_h_given_x_y[k], p_k)
+	}
+	sparsity := trainer.sparsityPenalties(ep_h_x)
+
+	pos_h := make([]WeightT, rbm.h_num)
+	for j := 0; j < rbm.h_num; j++ {
+		ep_hj_x := ep_h_x[j]
+		pos_h[j] = beta * ep_hj_x
+		(*delta).delta_c[j] = beta*(ep_hj_x-h_hat[j]) + sparsity[j]
+		if rbm.IsMultiClass() {
+			for k, p_k := range p_y_given_x {
+				d_uk_j := p_k * p_dist_h_given_x_y[k][j]
+				if k == y_hat {
+					d_uk_j -= h_hat[j]
+				}
+				(*delta).delta_uk[k][j] = beta * d_uk_j
+			}
+		} else {
+			(*delta).delta_u[j] = beta * (p_y_given_x[1]*p_dist_h_given_x_y[1][j] - h_hat[j]*WeightT(y_hat))
+		}
+		for _, d := range visible_deltas {
+			delta_w_c_j_k := beta*(d.pos*ep_hj_x-d.neg*h_hat[j]) + d.pos*sparsity[j]
+			(*delta).delta_w = append((*delta).delta_w, deltaWT{j, d.c_index, d.c_value, delta_w_c_j_k})
+		}
+	}
+	(*delta).delta_b = append((*delta).delta_b, rbm.visibleBiasDeltas(visible_deltas, beta)...)
+	if trainer.learn_variance {
+		(*delta).delta_s = append((*delta).delta_s, rbm.sigmaDeltas(v, v_hat, pos_h, h_hat, beta)...)
+	}
+	if rbm.IsMultiClass() {
+		for k, p_k := range p_y_given_x {
+			d_dk := p_k
+			if k == y_hat {
+				d_dk -= 1
+			}
+			(*delta).delta_dk[k] = beta * d_dk
+		}
 	} else {
-		p_dist_h_given_xy = p_dist_h_given_x_negy
+		(*delta).delta_d = beta * (p_y_given_x[1] - WeightT(y_hat))
 	}
+}
 
-	p_y_given_x := rbm.probOfYGivenX(x)
+// doTargetGradient calculates the gradient of the hybrid objective
+//	log P(y|X) + alpha * log P(X, y)
+// for a real valued y, the normalized target of the instance. The
+// expectations over P(y|X) of the discriminative term are calculated on the
+// grid of targetGrid.
+func (trainer *RBMTrainer) doTargetGradient(v *DataInstance, delta *deltaT) {
+	rbm := trainer.rbm
+	param := &trainer.parameters
+	alpha := WeightT(param.gen_learn_importance)
+	one_plus_alpha := WeightT(1 + param.gen_learn_importance)
+	y := rbm.normalizeTarget(v.target)
+
+	delta.Clear()
+	// CD-k or PCD
+	var v_hat *DataInstance
+	y_hat := WeightT(0)
+	h_hat := make([]WeightT, rbm.SizeOfHiddenLayer())
+	if param.gen_learn_importance > 0 {
+		p := trainer.negativeParticle(v, 0, y, h_hat)
+		v_hat, y_hat = p.v, p.target
+	}
+	// P(y|X) on the grid
+	w_dot_x_add_c := rbm.wDotXAddC(v)
+	grid := rbm.targetGrid()
+	p_grid := rbm.probDistOfTargetOnGrid(w_dot_x_add_c, grid)
 
-	//delta_W[c][j][k], valid only if X_c = k
+	//Gradient Calculation
+	visible_deltas := rbm.visibleDeltas(v, v_hat)
+	p_h := make([]WeightT, rbm.h_num)
+	for j := range p_h {
+		p_h[j] = Sigmoid(w_dot_x_add_c[j] + rbm.U(j)*y)
+	}
+	sparsity := trainer.sparsityPenalties(p_h)
+	pos_h := make([]WeightT, rbm.h_num)
 	for j := 0; j < rbm.h_num; j++ {
-		ep_hj_yx := p_dist_h_given_x_posy[j]*p_y_given_x + p_dist_h_given_x_negy[j]*(1-p_y_given_x)
-		delta_c_j := one_plus_alpha*p_dist_h_given_xy[j] - ep_hj_yx - alpha*h_hat[j]
-		(*delta).delta_c[j] = delta_c_j
-		(*delta).delta_u[j] = one_plus_alpha*p_dist_h_given_xy[j]*WeightT(y) - p_y_given_x*p_dist_h_given_x_posy[j] - alpha*h_hat[j]*WeightT(y_hat)
-		for c, k := range x {
-			delta_w_c_j_k := delta_c_j
-			//when X_c != k, delta_w_c_j_k = 0
-			(*delta).delta_w = append((*delta).delta_w, deltaWT{j, c, k, delta_w_c_j_k})
+		// E[P(h_j = 1|X, y)] and E[y * P(h_j = 1|X, y)] over P(y|X)
+		ep_hj, ep_y_hj := WeightT(0), WeightT(0)
+		for i, y_i := range grid {
+			p_hj := Sigmoid(w_dot_x_add_c[j] + rbm.U(j)*y_i)
+			ep_hj += p_grid[i] * p_hj
+			ep_y_hj += p_grid[i] * y_i * p_hj
+		}
+		p_hj := p_h[j]
+		pos_hj := one_plus_alpha*p_hj - ep_hj
+		pos_h[j] = pos_hj
+		(*delta).delta_c[j] = pos_hj - alpha*h_hat[j] + sparsity[j]
+		(*delta).delta_u[j] = one_plus_alpha*y*p_hj - ep_y_hj - alpha*y_hat*h_hat[j]
+		for _, d := range visible_deltas {
+			delta_w_c_j_k := d.pos*(pos_hj+sparsity[j]) - d.neg*alpha*h_hat[j]
+			(*delta).delta_w = append((*delta).delta_w, deltaWT{j, d.c_index, d.c_value, delta_w_c_j_k})
 		}
 	}
-	for c, k := range x {
-		(*delta).delta_b = append((*delta).delta_b, deltaBT{c, k, alpha * WeightT(k-x_hat[c])})
+	(*delta).delta_b = append((*delta).delta_b, rbm.visibleBiasDeltas(visible_deltas, alpha)...)
+	if trainer.learn_variance {
+		(*delta).delta_s = append((*delta).delta_s, rbm.sigmaDeltas(v, v_hat, pos_h, h_hat, alpha)...)
 	}
-	(*delta).delta_d = one_plus_alpha*WeightT(y) - p_y_given_x - alpha*WeightT(y_hat)
+	(*delta).delta_d = one_plus_alpha*y - DotProduct(p_grid, grid) - alpha*y_hat
 }
@@ -3,3 +3,418 @@
 // license that can be found in the LICENSE file.
 
 package rbm
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// logProbOfYGivenInstance returns log P(y|X) for y in {0, 1}.
+func logProbOfYGivenInstance(rbm *SparseClassRBM, v *DataInstance, y int) float64 {
+	p := float64(rbm.probOfYGivenInstance(v))
+	if y == 1 {
+		return math.Log(p)
+	}
+	return math.Log(1 - p)
+}
+
+// Test the discriminative gradient against finite differences of log P(y|X).
+func Test_doInstanceGradient(t *testing.T) {
+	const epsilon = 1e-6
+	const precision = 1e-5
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.SetClassType(2, KNormalizedMultiValuedClass)
+	var trainer RBMTrainer
+	trainer.Initialize(rbm, nil, nil, 0.1, 0, 0, 0, 1)
+	trainer.rng = rand.New(rand.NewSource(1))
+
+	v := DataInstance{x: []int{0, 1, 0}, x_bags: [][]int{nil, nil, {2, 0, 2}}}
+	for y := 0; y <= 1; y++ {
+		delta := rbm.NewDeltaT()
+		trainer.doInstanceGradient(&v, y, delta)
+		numerical := func(get func() WeightT, set func(WeightT)) float64 {
+			theta := get()
+			set(theta + epsilon)
+			l_plus := logProbOfYGivenInstance(rbm, &v, y)
+			set(theta - epsilon)
+			l_minus := logProbOfYGivenInstance(rbm, &v, y)
+			set(theta)
+			return (l_plus - l_minus) / (2 * epsilon)
+		}
+		for _, d := range delta.delta_w {
+			expected := numerical(func() WeightT { return rbm.W(d.h_index, d.c_index, d.c_value) },
+				func(w WeightT) { rbm.SetW(d.h_index, d.c_index, d.c_value, w) })
+			if math.Abs(expected-float64(d.delta_v)) > precision {
+				t.Errorf("y=%d: expected delta W(%d, %d, %d) to be %f but got %f.", y,
+					d.h_index, d.c_index, d.c_value, expected, d.delta_v)
+			}
+		}
+		if len(delta.delta_w) != 4*rbm.SizeOfHiddenLayer() {
+			t.Errorf("Expected one delta W per hidden unit and active value, got %d.", len(delta.delta_w))
+		}
+		for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+			expected := numerical(func() WeightT { return rbm.C(j) }, func(c WeightT) { rbm.SetC(j, c) })
+			if math.Abs(expected-float64(delta.delta_c[j])) > precision {
+				t.Errorf("y=%d: expected delta c[%d] to be %f but got %f.", y, j, expected, delta.delta_c[j])
+			}
+			expected = numerical(func() WeightT { return rbm.U(j) }, func(u WeightT) { rbm.SetU(j, u) })
+			if math.Abs(expected-float64(delta.delta_u[j])) > precision {
+				t.Errorf("y=%d: expected delta u[%d] to be %f but got %f.", y, j, expected, delta.delta_u[j])
+			}
+		}
+		expected := numerical(rbm.D, rbm.SetD)
+		if math.Abs(expected-float64(delta.delta_d)) > precision {
+			t.Errorf("y=%d: expected delta d to be %f but got %f.", y, expected, delta.delta_d)
+		}
+	}
+}
+
+// Test the discriminative gradient of a multi-class model against finite
+// differences of log P(y|X).
+func Test_doInstanceGradientMultiClass(t *testing.T) {
+	const epsilon = 1e-6
+	const precision = 1e-5
+	rbm := getSampleMultiClassRBM()
+	var trainer RBMTrainer
+	trainer.Initialize(rbm, nil, nil, 0.1, 0, 0, 0, 1)
+	trainer.rng = rand.New(rand.NewSource(1))
+
+	v := DataInstance{x: []int{0, 1, 2}}
+	for y := 0; y < rbm.NumOfLabels(); y++ {
+		delta := rbm.NewDeltaT()
+		trainer.doInstanceGradient(&v, y, delta)
+		numerical := func(get func() WeightT, set func(WeightT)) float64 {
+			theta := get()
+			set(theta + epsilon)
+			l_plus := math.Log(float64(rbm.probDistOfYGivenInstance(&v)[y]))
+			set(theta - epsilon)
+			l_minus := math.Log(float64(rbm.probDistOfYGivenInstance(&v)[y]))
+			set(theta)
+			return (l_plus - l_minus) / (2 * epsilon)
+		}
+		for _, d := range delta.delta_w {
+			expected := numerical(func() WeightT { return rbm.W(d.h_index, d.c_index, d.c_value) },
+				func(w WeightT) { rbm.SetW(d.h_index, d.c_index, d.c_value, w) })
+			if math.Abs(expected-float64(d.delta_v)) > precision {
+				t.Errorf("y=%d: expected delta W(%d, %d, %d) to be %f but got %f.", y,
+					d.h_index, d.c_index, d.c_value, expected, d.delta_v)
+			}
+		}
+		for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+			expected := numerical(func() WeightT { return rbm.C(j) }, func(c WeightT) { rbm.SetC(j, c) })
+			if math.Abs(expected-float64(delta.delta_c[j])) > precision {
+				t.Errorf("y=%d: expected delta c[%d] to be %f but got %f.", y, j, expected, delta.delta_c[j])
+			}
+			for k := 0; k < rbm.NumOfLabels(); k++ {
+				expected = numerical(func() WeightT { return rbm.UK(k, j) },
+					func(u WeightT) { rbm.SetUK(k, j, u) })
+				if math.Abs(expected-float64(delta.delta_uk[k][j])) > precision {
+					t.Errorf("y=%d: expected delta u[%d][%d] to be %f but got %f.", y, k, j,
+						expected, delta.delta_uk[k][j])
+				}
+			}
+		}
+		for k := 0; k < rbm.NumOfLabels(); k++ {
+			expected := numerical(func() WeightT { return rbm.DK(k) }, func(d WeightT) { rbm.SetDK(k, d) })
+			if math.Abs(expected-float64(delta.delta_dk[k])) > precision {
+				t.Errorf("y=%d: expected delta d[%d] to be %f but got %f.", y, k, expected, delta.delta_dk[k])
+			}
+		}
+	}
+}
+
+// Test the discriminative gradient of a regression model against finite
+// differences of log P(y|X).
+func Test_doTargetGradient(t *testing.T) {
+	const epsilon = 1e-6
+	const precision = 1e-5
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.InitializeRegression(3, 2)
+	rbm.SetU(0, 0.5)
+	rbm.SetU(2, -0.4)
+	var trainer RBMTrainer
+	trainer.Initialize(rbm, nil, nil, 0.1, 0, 0, 0, 1)
+	trainer.rng = rand.New(rand.NewSource(1))
+
+	for _, target := range []WeightT{-1, 3.5, 6} {
+		v := DataInstance{x: []int{0, 1, 2}, target: target}
+		y := rbm.normalizeTarget(target)
+		delta := rbm.NewDeltaT()
+		trainer.doInstanceGradient(&v, 0, delta)
+		numerical := func(get func() WeightT, set func(WeightT)) float64 {
+			theta := get()
+			set(theta + epsilon)
+			l_plus := float64(rbm.logProbOfTargetGivenInstance(&v, y))
+			set(theta - epsilon)
+			l_minus := float64(rbm.logProbOfTargetGivenInstance(&v, y))
+			set(theta)
+			return (l_plus - l_minus) / (2 * epsilon)
+		}
+		for _, d := range delta.delta_w {
+			expected := numerical(func() WeightT { return rbm.W(d.h_index, d.c_index, d.c_value) },
+				func(w WeightT) { rbm.SetW(d.h_index, d.c_index, d.c_value, w) })
+			if math.Abs(expected-float64(d.delta_v)) > precision {
+				t.Errorf("target=%v: expected delta W(%d, %d, %d) to be %f but got %f.", target,
+					d.h_index, d.c_index, d.c_value, expected, d.delta_v)
+			}
+		}
+		for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+			expected := numerical(func() WeightT { return rbm.C(j) }, func(c WeightT) { rbm.SetC(j, c) })
+			if math.Abs(expected-float64(delta.delta_c[j])) > precision {
+				t.Errorf("target=%v: expected delta c[%d] to be %f but got %f.", target, j, expected, delta.delta_c[j])
+			}
+			expected = numerical(func() WeightT { return rbm.U(j) }, func(u WeightT) { rbm.SetU(j, u) })
+			if math.Abs(expected-float64(delta.delta_u[j])) > precision {
+				t.Errorf("target=%v: expected delta u[%d] to be %f but got %f.", target, j, expected, delta.delta_u[j])
+			}
+		}
+		expected := numerical(rbm.D, rbm.SetD)
+		if math.Abs(expected-float64(delta.delta_d)) > precision {
+			t.Errorf("target=%v: expected delta d to be %f but got %f.", target, expected, delta.delta_d)
+		}
+	}
+}
+
+// Test the discriminative gradient of a model with a Gaussian class, including
+// the log of its standard deviation, against finite differences of log P(y|X).
+func Test_doInstanceGradientWithGaussianClass(t *testing.T) {
+	const epsilon = 1e-6
+	const precision = 1e-5
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.SetGaussianClass(0, 0.5, 1.5)
+	var trainer RBMTrainer
+	trainer.Initialize(rbm, nil, nil, 0.1, 0, 0, 0, 1)
+	trainer.SetLearnVariance(true)
+	trainer.rng = rand.New(rand.NewSource(1))
+
+	v := DataInstance{x: []int{0, 1, 2}, x_real: []WeightT{2.5, 0, 0}}
+	for y := 0; y <= 1; y++ {
+		delta := rbm.NewDeltaT()
+		trainer.doInstanceGradient(&v, y, delta)
+		numerical := func(get func() WeightT, set func(WeightT)) float64 {
+			theta := get()
+			set(theta + epsilon)
+			l_plus := logProbOfYGivenInstance(rbm, &v, y)
+			set(theta - epsilon)
+			l_minus := logProbOfYGivenInstance(rbm, &v, y)
+			set(theta)
+			return (l_plus - l_minus) / (2 * epsilon)
+		}
+		for _, d := range delta.delta_w {
+			expected := numerical(func() WeightT { return rbm.W(d.h_index, d.c_index, d.c_value) },
+				func(w WeightT) { rbm.SetW(d.h_index, d.c_index, d.c_value, w) })
+			if math.Abs(expected-float64(d.delta_v)) > precision {
+				t.Errorf("y=%d: expected delta W(%d, %d, %d) to be %f but got %f.", y,
+					d.h_index, d.c_index, d.c_value, expected, d.delta_v)
+			}
+		}
+		if len(delta.delta_s) != 1 || delta.delta_s[0].c_index != 0 {
+			t.Fatalf("y=%d: expected delta of the standard deviation of class 0 but got %v.", y, delta.delta_s)
+		}
+		expected := numerical(func() WeightT { return WeightT(math.Log(float64(rbm.Sigma(0)))) },
+			func(s WeightT) { rbm.SetSigma(0, Exp(s)) })
+		if math.Abs(expected-float64(delta.delta_s[0].delta_v)) > precision {
+			t.Errorf("y=%d: expected delta log sigma to be %f but got %f.", y, expected, delta.delta_s[0].delta_v)
+		}
+	}
+}
+
+func Test_visibleBiasDeltasPerClass(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.SetClassType(2, KMultiValuedClass)
+	v := DataInstance{x: []int{0, 1, 0}, x_bags: [][]int{nil, nil, {0, 2, 2}}}
+	v_hat := DataInstance{x: []int{0, 0, 0}, x_bags: [][]int{nil, nil, {1}}}
+	visible_deltas := rbm.visibleDeltas(&v, &v_hat)
+
+	per_unit := rbm.visibleBiasDeltas(visible_deltas, 0.5)
+	if len(per_unit) != 6 {
+		t.Errorf("Expected 6 per-unit deltas but got %v.", per_unit)
+	}
+	rbm.SetBiasParameterization(KPerClassBias)
+	expected := []deltaBT{{0, 0, 0}, {1, 0, 0}, {2, 0, 1}}
+	if per_class := rbm.visibleBiasDeltas(visible_deltas, 0.5); !reflect.DeepEqual(per_class, expected) {
+		t.Errorf("Expected per-class deltas %v but got %v.", expected, per_class)
+	}
+}
+
+// Test the gradient of an unlabeled instance against finite differences of
+// beta * (log P*(X) - log P*(X_hat, y_hat)), (X_hat, y_hat) being the
+// particle of its negative phase.
+func Test_doUnlabeledGradient(t *testing.T) {
+	const epsilon = 1e-6
+	const precision = 1e-5
+	const beta = 0.5
+	rbm := getSampleRBMForProbabilityTest()
+	var trainer RBMTrainer
+	trainer.Initialize(rbm, nil, nil, 0.1, 0, 0, 0, 1)
+	trainer.SetUnsupervisedImportance(beta)
+	trainer.SetSamplingMethod(KPersistentCD, 1)
+	trainer.rng = rand.New(rand.NewSource(1))
+
+	v := DataInstance{x: []int{0, 1, 2}}
+	if !rbm.IsValidInput(v) || !rbm.isUnlabeled(&v) {
+		t.Fatalf("Expected an unlabeled instance to be valid.")
+	}
+	delta := rbm.NewDeltaT()
+	trainer.doUnlabeledGradient(&v, 1, delta)
+	p := trainer.chains.particles[0]
+	numerical := func(get func() WeightT, set func(WeightT)) float64 {
+		l := func() float64 {
+			return float64(beta * (rbm.FreeEnergy(p.v, p.y) - rbm.FreeEnergyX(&v)))
+		}
+		theta := get()
+		set(theta + epsilon)
+		l_plus := l()
+		set(theta - epsilon)
+		l_minus := l()
+		set(theta)
+		return (l_plus - l_minus) / (2 * epsilon)
+	}
+	for _, d := range delta.delta_w {
+		expected := numerical(func() WeightT { return rbm.W(d.h_index, d.c_index, d.c_value) },
+			func(w WeightT) { rbm.SetW(d.h_index, d.c_index, d.c_value, w) })
+		if math.Abs(expected-float64(d.delta_v)) > precision {
+			t.Errorf("Expected delta W(%d, %d, %d) to be %f but got %f.",
+				d.h_index, d.c_index, d.c_value, expected, d.delta_v)
+		}
+	}
+	for _, d := range delta.delta_b {
+		expected := numerical(func() WeightT { return rbm.B(d.c_index, d.c_value) },
+			func(b WeightT) { rbm.SetB(d.c_index, d.c_value, b) })
+		if math.Abs(expected-float64(d.delta_v)) > precision {
+			t.Errorf("Expected delta B(%d, %d) to be %f but got %f.", d.c_index, d.c_value, expected, d.delta_v)
+		}
+	}
+	for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+		expected := numerical(func() WeightT { return rbm.C(j) }, func(c WeightT) { rbm.SetC(j, c) })
+		if math.Abs(expected-float64(delta.delta_c[j])) > precision {
+			t.Errorf("Expected delta c[%d] to be %f but got %f.", j, expected, delta.delta_c[j])
+		}
+		expected = numerical(func() WeightT { return rbm.U(j) }, func(u WeightT) { rbm.SetU(j, u) })
+		if math.Abs(expected-float64(delta.delta_u[j])) > precision {
+			t.Errorf("Expected delta u[%d] to be %f but got %f.", j, expected, delta.delta_u[j])
+		}
+	}
+	expected := numerical(rbm.D, rbm.SetD)
+	if math.Abs(expected-float64(delta.delta_d)) > precision {
+		t.Errorf("Expected delta d to be %f but got %f.", expected, delta.delta_d)
+	}
+}
+
+func Test_doGradientUnlabeled(t *testing.T) {
+	data := []DataInstance{{x: []int{0, 1, 2}}, {x: []int{0, 0, 1}, neg_y: 2}}
+	trainer := newBatchTestTrainer(data)
+	deltas := trainer.rbm.newLabelDeltas()
+	if labels := trainer.doGradient(deltas); !reflect.DeepEqual(labels, []int{0}) {
+		t.Errorf("Expected the unlabeled instance to be skipped but got labels %v.", labels)
+	}
+	if labels := trainer.doGradient(deltas); labels != nil {
+		t.Errorf("Expected the end of the data but got labels %v.", labels)
+	}
+
+	trainer.training_data_accessor.Reset()
+	trainer.SetUnsupervisedImportance(0.5)
+	if labels := trainer.doGradient(deltas); !reflect.DeepEqual(labels, []int{0}) || deltas[0].delta_d == 0 {
+		t.Errorf("Expected the gradient of the unlabeled instance in label 0 but got labels %v.", labels)
+	}
+	if delta_d := deltas[0].delta_d; delta_d < -0.5 || delta_d > 0.5 {
+		t.Errorf("Expected delta d within the unsupervised importance but got %f.", delta_d)
+	}
+}
+
+// Test_doGradientScalesEachLabel checks that the gradient of each label is
+// scaled by its own count.
+func Test_doGradientScalesEachLabel(t *testing.T) {
+	filename := "./gradient_counts.txt"
+	v := DataInstance{x: []int{0, 1, 2}, pos_y: 2, neg_y: 3}
+	saveDataToFile(filename, []DataInstance{v})
+	defer os.Remove(filename)
+	loader := NewInstanceLoader(filename, len(v.x))
+	defer loader.Close()
+	var trainer RBMTrainer
+	trainer.Initialize(getSampleRBMForProbabilityTest(), loader, loader, 0.1, 0, 0, 0, 1)
+
+	deltas := trainer.rbm.newLabelDeltas()
+	trainer.doGradient(deltas)
+	for y, count := range []int{3, 2} {
+		expected := trainer.rbm.NewDeltaT()
+		trainer.doInstanceGradient(&v, y, expected)
+		expected.ScalarProduct(count)
+		delta := deltas[y]
+		if !EqualWithinPrecision(delta.delta_d, expected.delta_d, 1e-9) ||
+			!ArraysEqualWithinPrecision(delta.delta_c, expected.delta_c, 1e-9) {
+			t.Errorf("Expected the gradient of label %d scaled by %d.", y, count)
+		}
+	}
+}
+
+// Test_doInstanceGradientNegativeLabel checks that the gradient of label 0
+// uses P(h | X, y = 0): with alpha = 0,
+//	delta_c[j] = P(h_j | X, y = 0) - E[P(h_j | X, y)] = P(y = 1 | X) * (P(h_j | X, 0) - P(h_j | X, 1))
+func Test_doInstanceGradientNegativeLabel(t *testing.T) {
+	v := &DataInstance{x: []int{0, 1, 2}}
+	var trainer RBMTrainer
+	trainer.Initialize(getSampleRBMForProbabilityTest(), nil, nil, 0.1, 0, 0, 0, 1)
+	rbm := trainer.rbm
+	delta := rbm.NewDeltaT()
+	trainer.doInstanceGradient(v, 0, delta)
+
+	p_y := -delta.delta_d
+	p_h_0, p_h_1 := make([]WeightT, rbm.SizeOfHiddenLayer()), make([]WeightT, rbm.SizeOfHiddenLayer())
+	rbm.probDistOfHGivenInstance(p_h_0, v, 0)
+	rbm.probDistOfHGivenInstance(p_h_1, v, 1)
+	for j := range p_h_0 {
+		expected := p_y * (p_h_0[j] - p_h_1[j])
+		if expected == 0 || !EqualWithinPrecision(delta.delta_c[j], expected, 1e-9) {
+			t.Errorf("Expected delta c[%d] %f but got %f.", j, expected, delta.delta_c[j])
+		}
+	}
+}
+
+// Test_doInstanceGradientReconstruction checks the generative term of the
+// gradients of W and b when the reconstruction differs from the data:
+//	delta_W[c][j][k] = pos_h[j] * 1{X_c = k} - alpha * h_hat[j] * 1{X_hat_c = k}
+//	delta_b[c][k] = alpha * (1{X_c = k} - 1{X_hat_c = k})
+// Every hidden unit is on and pulls class 2 to value 0, while X_2 is 2.
+func Test_doInstanceGradientReconstruction(t *testing.T) {
+	const alpha = 0.5
+	v := &DataInstance{x: []int{0, 1, 2}}
+	rbm := getSampleRBMForProbabilityTest()
+	for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+		rbm.SetC(j, 10)
+		rbm.SetW(j, 2, 0, 20)
+	}
+	var trainer RBMTrainer
+	trainer.Initialize(rbm, nil, nil, 0.1, 0, 0, alpha, 1)
+	trainer.SetSeed(1)
+	delta := rbm.NewDeltaT()
+	trainer.doInstanceGradient(v, 1, delta)
+
+	delta_b := make(map[int]WeightT)
+	for _, d := range delta.delta_b {
+		if d.c_index == 2 {
+			delta_b[d.c_value] += d.delta_v
+		}
+	}
+	if delta_b[2] != alpha || delta_b[0] != -alpha || delta_b[1] != 0 {
+		t.Errorf("Expected delta b of class 2 to be %f for the data and %f for the reconstruction but got %v.",
+			alpha, -alpha, delta_b)
+	}
+	for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+		delta_w := make(map[int]WeightT)
+		for _, d := range delta.delta_w {
+			if d.h_index == j && d.c_index == 2 {
+				delta_w[d.c_value] += d.delta_v
+			}
+		}
+		// h_hat[j] is 1
+		if math.Abs(float64(delta_w[0]+alpha)) > 1e-3 ||
+			math.Abs(float64(delta_w[2]-(delta.delta_c[j]+alpha))) > 1e-3 {
+			t.Errorf("Expected delta W of class 2 of unit %d to be %f for the data and %f for the reconstruction but got %v.",
+				j, delta.delta_c[j]+alpha, -alpha, delta_w)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Feature hashing for feature classes with unbounded number of values.
+
+package rbm
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	kHasherHeader  = "#SCRBMHASH"
+	kHasherVersion = 1
+)
+
+// FeatureHasher implements FeatureEncoder by hashing the raw values of each
+// feature class into a fixed number of buckets, so that the size of the model
+// does not depend on the number of distinct values. Value KOutOfVocabulary of
+// every class is reserved for the values of unknown classes, and the values of
+// class c are hashed into [1, bucket_counts[c]]. Absent classes are
+// KMissingValue.
+type FeatureHasher struct {
+	bucket_counts []int
+}
+
+// NewFeatureHasher creates a FeatureHasher with the given number of buckets
+// for each class.
+func NewFeatureHasher(bucket_counts []int) *FeatureHasher {
+	for c, n := range bucket_counts {
+		if n < 1 {
+			panic(fmt.Sprintf("Class %d must have at least one bucket but got %d.", c, n))
+		}
+	}
+	hasher := &FeatureHasher{make([]int, len(bucket_counts))}
+	copy(hasher.bucket_counts, bucket_counts)
+	return hasher
+}
+
+// NumOfClasses returns the number of feature classes.
+func (hasher *FeatureHasher) NumOfClasses() int {
+	return len(hasher.bucket_counts)
+}
+
+// ClassSizes returns the size of each class, which is the number of buckets
+// plus the reserved value KOutOfVocabulary.
+func (hasher *FeatureHasher) ClassSizes() []int {
+	sizes := make([]int, len(hasher.bucket_counts))
+	for c, n := range hasher.bucket_counts {
+		sizes[c] = n + 1
+	}
+	return sizes
+}
+
+// Encode returns the bucket of the given value. Values of unknown classes are
+// mapped to KOutOfVocabulary.
+func (hasher *FeatureHasher) Encode(class_id int, value string) int {
+	if class_id < 0 || class_id >= len(hasher.bucket_counts) {
+		return KOutOfVocabulary
+	}
+	return 1 + int(hashValue(value)%uint64(hasher.bucket_counts[class_id]))
+}
+
+// hashValue returns the 64-bit FNV-1a hash of the given value.
+func hashValue(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return h.Sum64()
+}
+
+// Save writes the configuration of the hasher in a tab separated text format:
+//  #SCRBMHASH \t version \t num_classes
+//  class_id \t bucket_count
+//  ...
+func (hasher *FeatureHasher) Save(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	fmt.Fprintf(writer, "%s\t%d\t%d\n", kHasherHeader, kHasherVersion, len(hasher.bucket_counts))
+	for c, n := range hasher.bucket_counts {
+		fmt.Fprintf(writer, "%d\t%d\n", c, n)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("Failed to save feature hasher: %s.", err)
+	}
+	return nil
+}
+
+// LoadFeatureHasher reads a hasher configuration written by FeatureHasher.Save.
+func LoadFeatureHasher(r io.Reader) (*FeatureHasher, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("Failed to load feature hasher: missing header.")
+	}
+	header := strings.Split(scanner.Text(), "\t")
+	if len(header) != 3 || header[0] != kHasherHeader {
+		return nil, fmt.Errorf("Failed to load feature hasher: invalid header %q.", scanner.Text())
+	}
+	version, err_v := strconv.Atoi(header[1])
+	num_classes, err_n := strconv.Atoi(header[2])
+	if err_v != nil || err_n != nil || num_classes < 0 {
+		return nil, fmt.Errorf("Failed to load feature hasher: invalid header %q.", scanner.Text())
+	}
+	if version != kHasherVersion {
+		return nil, fmt.Errorf("Failed to load feature hasher: unsupported version %d, expected %d.",
+			version, kHasherVersion)
+	}
+	bucket_counts := make([]int, num_classes)
+	for c := range bucket_counts {
+		if !scanner.Scan() {
+			return nil, fmt.Errorf("Failed to load feature hasher: missing class %d.", c)
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Failed to load feature hasher: invalid line %q.", scanner.Text())
+		}
+		class_id, err_c := strconv.Atoi(fields[0])
+		n, err_n := strconv.Atoi(fields[1])
+		if err_c != nil || err_n != nil || class_id != c || n < 1 {
+			return nil, fmt.Errorf("Failed to load feature hasher: invalid line %q.", scanner.Text())
+		}
+		bucket_counts[c] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to load feature hasher: %s.", err)
+	}
+	return NewFeatureHasher(bucket_counts), nil
+}
+
+// FeatureHasherFilename returns the name of the hasher configuration file
+// that goes with the given model file.
+func FeatureHasherFilename(model_file string) string {
+	return model_file + ".hash"
+}
+
+// SaveToFile saves the hasher configuration to the file of the given name.
+func (hasher *FeatureHasher) SaveToFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := hasher.Save(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadFeatureHasherFromFile loads a hasher configuration from the given file.
+func LoadFeatureHasherFromFile(filename string) (*FeatureHasher, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadFeatureHasher(file)
+}
+
+// HashCollisionStats summarizes the hash collisions of one feature class.
+type HashCollisionStats struct {
+	ClassId             int
+	Buckets             int
+	DistinctValues      int //number of distinct raw values
+	UsedBuckets         int //number of buckets holding at least one value
+	CollidedValues      int //number of values sharing their bucket with another value
+	Occurrences         int //number of occurrences of all values
+	CollidedOccurrences int //occurrences of values that are not the most frequent of their bucket
+}
+
+// CollisionRate returns the fraction of occurrences whose value cannot be told
+// apart from the most frequent value of its bucket.
+func (s *HashCollisionStats) CollisionRate() float64 {
+	if s.Occurrences == 0 {
+		return 0
+	}
+	return float64(s.CollidedOccurrences) / float64(s.Occurrences)
+}
+
+// ExpectedUsedBuckets returns the number of buckets expected to be used if
+// the distinct values were hashed uniformly, m * (1 - (1 - 1/m)^n).
+func (s *HashCollisionStats) ExpectedUsedBuckets() float64 {
+	m, n := float64(s.Buckets), float64(s.DistinctValues)
+	return m * (1 - math.Pow(1-1/m, n))
+}
+
+// HashCollisionReport scans the given data file and reports, for every class
+// of the hasher, how the distinct values are spread across the buckets.
+// Distinct values are identified by their 64-bit hash.
+func HashCollisionReport(filename string, hasher *FeatureHasher) ([]HashCollisionStats, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	value_counts := make([]map[uint64]int, hasher.NumOfClasses())
+	for c := range value_counts {
+		value_counts[c] = make(map[uint64]int)
+	}
+	reader := bufio.NewReader(file)
+	for line_no := 1; ; line_no++ {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %s.", filename, err)
+		}
+		_, features, err := parseInstanceLine(line)
+		if err != nil {
+			log.Printf("Skipping line %d of %s: %s", line_no, filename, err)
+			continue
+		}
+		for _, f := range features {
+			if f.class_id < len(value_counts) {
+				value_counts[f.class_id][hashValue(f.value)]++
+			}
+		}
+	}
+
+	report := make([]HashCollisionStats, hasher.NumOfClasses())
+	for c, counts := range value_counts {
+		buckets := uint64(hasher.bucket_counts[c])
+		bucket_values := make(map[uint64]int)
+		bucket_max := make(map[uint64]int)
+		stats := &report[c]
+		stats.ClassId = c
+		stats.Buckets = hasher.bucket_counts[c]
+		stats.DistinctValues = len(counts)
+		for h, n := range counts {
+			bucket := h % buckets
+			bucket_values[bucket]++
+			if n > bucket_max[bucket] {
+				bucket_max[bucket] = n
+			}
+			stats.Occurrences += n
+		}
+		stats.UsedBuckets = len(bucket_values)
+		for h := range counts {
+			if bucket_values[h%buckets] > 1 {
+				stats.CollidedValues++
+			}
+		}
+		stats.CollidedOccurrences = stats.Occurrences
+		for _, n := range bucket_max {
+			stats.CollidedOccurrences -= n
+		}
+	}
+	return report, nil
+}
+
+// WriteHashCollisionReport writes the report in a human readable table,
+// skipping classes that did not occur in the data.
+func WriteHashCollisionReport(w io.Writer, report []HashCollisionStats) {
+	fmt.Fprintf(w, "class\tbuckets\tvalues\tused\texpected_used\tcollided_values\tcollision_rate\n")
+	for i := range report {
+		s := &report[i]
+		if s.DistinctValues == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%.1f\t%d\t%f\n", s.ClassId, s.Buckets,
+			s.DistinctValues, s.UsedBuckets, s.ExpectedUsedBuckets(), s.CollidedValues,
+			s.CollisionRate())
+	}
+}
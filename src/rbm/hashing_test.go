@@ -0,0 +1,88 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_FeatureHasher(t *testing.T) {
+	hasher := NewFeatureHasher([]int{1, 16, 1000})
+	if sizes := hasher.ClassSizes(); !reflect.DeepEqual(sizes, []int{2, 17, 1001}) {
+		t.Errorf("Unexpected class sizes %v.", sizes)
+	}
+	values := []string{"41-149660412063915533", "246_237_165", "a", ""}
+	for c, size := range hasher.ClassSizes() {
+		for _, v := range values {
+			k := hasher.Encode(c, v)
+			if k < 1 || k >= size {
+				t.Errorf("Expected Encode(%d, %q) in [1, %d) but got %d.", c, v, size, k)
+			}
+			if k != hasher.Encode(c, v) {
+				t.Errorf("Encode(%d, %q) is not deterministic.", c, v)
+			}
+		}
+	}
+	if k := hasher.Encode(3, "a"); k != KOutOfVocabulary {
+		t.Errorf("Expected unknown class to be encoded as %d but got %d.", KOutOfVocabulary, k)
+	}
+
+	var buf bytes.Buffer
+	if err := hasher.Save(&buf); err != nil {
+		t.Fatalf("Failed to save hasher: %s.", err)
+	}
+	loaded, err := LoadFeatureHasher(&buf)
+	if err != nil {
+		t.Fatalf("Failed to load hasher: %s.", err)
+	}
+	if !reflect.DeepEqual(hasher, loaded) {
+		t.Errorf("Expected loaded hasher %v to be equal to %v.", loaded, hasher)
+	}
+}
+
+func Test_HashCollisionReport(t *testing.T) {
+	data_file := "test_hashing.dat"
+	lines := []string{
+		"1\t0\t0:a\t1:x",
+		"0\t1\t0:b\t1:x",
+		"0\t2\t0:a\t1:x",
+		"1\t1\t0:c",
+	}
+	if err := saveLinesToFile(data_file, lines); err != nil {
+		t.Fatalf("Failed to create test file: %s.", err)
+	}
+	defer os.Remove(data_file)
+
+	// A single bucket for class 0 forces all of its values to collide.
+	hasher := NewFeatureHasher([]int{1, 8})
+	report, err := HashCollisionReport(data_file, hasher)
+	if err != nil {
+		t.Fatalf("Failed to create report: %s.", err)
+	}
+	expected := []HashCollisionStats{
+		{0, 1, 3, 1, 3, 4, 2},
+		{1, 8, 1, 1, 0, 3, 0},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Expected report %v but got %v.", expected, report)
+	}
+	if rate := report[0].CollisionRate(); rate != 0.5 {
+		t.Errorf("Expected collision rate 0.5 but got %f.", rate)
+	}
+
+	loader := NewEncodedInstanceLoader(data_file, hasher)
+	defer loader.Close()
+	instance, err := loader.NextInstance()
+	if err != nil {
+		t.Fatalf("Failed to load instance: %s.", err)
+	}
+	parsed, err := parseInstance(lines[0], instanceFormat{num_classes: 2, encoder: hasher})
+	if err != nil || !parsed.Equal(&instance) {
+		t.Errorf("Expected %v but got %v, %v.", instance, parsed, err)
+	}
+}
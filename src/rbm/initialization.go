@@ -19,6 +19,11 @@ func (rbm *SparseClassRBM) CloneEmpty() *SparseClassRBM {
 	for i, v := range rbm.x_class_sizes {
 		empty_rbm.x_class_sizes[i] = v
 	}
+	empty_rbm.x_class_types = make([]ClassType, rbm.x_class_num)
+	copy(empty_rbm.x_class_types, rbm.x_class_types)
+	empty_rbm.x_sigmas = make([]WeightT, rbm.x_class_num)
+	empty_rbm.x_missing = rbm.x_missing
+	empty_rbm.x_bias_mode = rbm.x_bias_mode
 	empty_rbm.w = make([][][]WeightT, rbm.NumOfVisibleClasses())
 	for c, k := range rbm.x_class_sizes {
 		empty_rbm.w[c] = make([][]WeightT, rbm.SizeOfHiddenLayer())
@@ -33,12 +38,24 @@ func (rbm *SparseClassRBM) CloneEmpty() *SparseClassRBM {
 	empty_rbm.c = make([]WeightT, rbm.h_num)
 	empty_rbm.u = make([]WeightT, rbm.h_num)
 	empty_rbm.d = 0
+	empty_rbm.y_class_num = rbm.y_class_num
+	empty_rbm.y_gaussian = rbm.y_gaussian
+	if rbm.y_class_num > 0 {
+		empty_rbm.uk = make([][]WeightT, rbm.y_class_num)
+		for k := range empty_rbm.uk {
+			empty_rbm.uk[k] = make([]WeightT, rbm.h_num)
+		}
+		empty_rbm.dk = make([]WeightT, rbm.y_class_num)
+	}
 	return &empty_rbm
 }
 
-// Initialize a SparseClassRBM
+// Initialize a SparseClassRBM, all the classes are single valued; use
+// SetClassType or SetGaussianClass to change the type of a class.
 //  feature_classes: an array specifying the number features in each feature class
-//  member_biases: bias for every features in every class
+//  member_biases: bias for every features in every class, e.g. its log
+//  probability (see GetBiases); use SetBiasParameterization to share a single
+//  bias among the values of each class.
 //  param num_hidden_units: number of hidden units for this RBM
 //  param positive_y_bias: initial bias for the case y = 1.
 //
@@ -57,6 +74,11 @@ func (rbm *SparseClassRBM) Initialize(feature_classes []int,
 	rbm.x_class_num = len(feature_classes)
 	rbm.x_class_sizes = make([]int, len(feature_classes))
 	copy(rbm.x_class_sizes, feature_classes)
+	rbm.x_class_types = make([]ClassType, len(feature_classes))
+	rbm.x_sigmas = make([]WeightT, len(feature_classes))
+	for c := range rbm.x_sigmas {
+		rbm.x_sigmas[c] = 1
+	}
 	rbm.h_num = num_hidden_units
 
 	if num_hidden_units < 1 {
@@ -124,6 +146,43 @@ func (rbm *SparseClassRBM) init_U_D(num_hidden_units int, positive_y_bias Weight
 	rbm.d = positive_y_bias
 }
 
+// InitializeMultiClass turns an initialized SparseClassRBM into a multi-class
+// model with a softmax y over len(label_biases) label classes, following
+// Larochelle's ClassRBM; U and D are not used afterwards.
+//  label_biases: initial bias of each label class, e.g. its log frequency.
+func (rbm *SparseClassRBM) InitializeMultiClass(label_biases []WeightT) {
+	const u_devivation WeightT = 0.01
+	if len(label_biases) < 2 {
+		panic(fmt.Sprintf("Expected at least 2 label classes but got %d.", len(label_biases)))
+	}
+	rbm.y_class_num = len(label_biases)
+	rbm.uk = make([][]WeightT, rbm.y_class_num)
+	for k := range rbm.uk {
+		rbm.uk[k] = make([]WeightT, rbm.h_num)
+		for j := range rbm.uk[k] {
+			rbm.uk[k][j] = zero_mean_norm_rand(u_devivation)
+		}
+	}
+	rbm.dk = make([]WeightT, rbm.y_class_num)
+	copy(rbm.dk, label_biases)
+}
+
+// InitializeRegression turns an initialized binary SparseClassRBM into a
+// regression model with a real valued y, the targets being normalized with
+// the given mean and standard deviation (see GetTargetStats).
+func (rbm *SparseClassRBM) InitializeRegression(target_mean, target_stddev WeightT) {
+	if rbm.IsMultiClass() {
+		panic("Expected a binary model to turn into a regression model.")
+	}
+	if !(target_stddev > 0) {
+		panic(fmt.Sprintf("Expected positive target standard deviation but got %f.", target_stddev))
+	}
+	rbm.y_gaussian = true
+	rbm.y_mean = target_mean
+	rbm.y_stddev = target_stddev
+	rbm.d = 0
+}
+
 func zero_mean_norm_rand(stddev WeightT) WeightT {
 	return WeightT(rand.NormFloat64()) * stddev
 }
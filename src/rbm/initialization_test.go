@@ -133,3 +133,38 @@ func Test_Initialize(t *testing.T) {
 		t.Errorf("len(rbm.u) not equal.")
 	}
 }
+
+func Test_SetBiasParameterization(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.SetBiasParameterization(KPerClassBias)
+	if rbm.BiasParameterization() != KPerClassBias || rbm.NumOfVisibleBiases() != 3 {
+		t.Errorf("Expected 3 per-class biases but got %d %s biases.", rbm.NumOfVisibleBiases(),
+			rbm.BiasParameterization())
+	}
+	expected := [][]WeightT{{0.1}, {0.25, 0.25}, {0.25 / 3, 0.25 / 3, 0.25 / 3}}
+	for c, biases := range expected {
+		for k, b := range biases {
+			if !EqualWithinPrecision(rbm.B(c, k), b, kPrecision) {
+				t.Errorf("Expected B(%d, %d) to be %f but got %f.", c, k, b, rbm.B(c, k))
+			}
+		}
+	}
+	rbm.SetB(1, 1, 0.5)
+	if rbm.B(1, 0) != 0.5 {
+		t.Errorf("Expected the bias of class 1 to be shared but got %f.", rbm.B(1, 0))
+	}
+	empty := rbm.CloneEmpty()
+	if empty.BiasParameterization() != KPerClassBias || empty.NumOfVisibleBiases() != 3 {
+		t.Errorf("Expected the empty clone to have 3 per-class biases but got %d.",
+			empty.NumOfVisibleBiases())
+	}
+
+	rbm.SetBiasParameterization(KPerUnitBias)
+	if rbm.NumOfVisibleBiases() != 6 {
+		t.Errorf("Expected 6 per-unit biases but got %d.", rbm.NumOfVisibleBiases())
+	}
+	rbm.SetB(1, 1, 0.75)
+	if rbm.B(1, 0) != 0.5 || rbm.B(1, 1) != 0.75 {
+		t.Errorf("Expected biases of class 1 to be [0.5 0.75] but got [%f %f].", rbm.B(1, 0), rbm.B(1, 1))
+	}
+}
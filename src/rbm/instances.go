@@ -9,37 +9,137 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"strconv"
 	"strings"
 )
 
+const (
+	KMissingValue = -1 //value in DataInstance.x of a class that is not observed
+
+	kBiasPseudoCount WeightT = 0.5 //pseudo count of every value and label when initializing the biases
+)
+
 // DataInstance is used for storing data sample for training and prediction.
-// In the case of prediction, the value of y is ignored.
+// In the case of prediction, the value of y is ignored. The classes that are
+// not observed have value KMissingValue, an empty bag for multi-valued
+// classes.
 type DataInstance struct {
-	x     []int //values of each classes, in the order of Class0, Class1, ...
-	pos_y int   //number of positive instances
-	neg_y int   //number of negative instances
+	x        []int     //values of each classes, in the order of Class0, Class1, ..., or KMissingValue
+	x_bags   [][]int   //values of multi-valued classes, nil for single-valued classes
+	x_real   []WeightT //values of Gaussian classes, nil if there is no Gaussian class
+	pos_y    int       //number of positive instances
+	neg_y    int       //number of negative instances
+	y_counts []int     //number of instances of each label class, for multi-class labels
+	target   WeightT   //real valued target, for regression
 }
 
 func (instance *DataInstance) GetX() []int {
 	return instance.x
 }
 
+// GetBags returns the values of the multi-valued classes, the entries of the
+// single-valued classes are nil.
+func (instance *DataInstance) GetBags() [][]int {
+	return instance.x_bags
+}
+
+// GetRealValues returns the values of the Gaussian classes, the entries of the
+// other classes are 0.
+func (instance *DataInstance) GetRealValues() []WeightT {
+	return instance.x_real
+}
+
+// GetLabelCounts returns the number of instances of each label class of an
+// instance with multi-class labels.
+func (instance *DataInstance) GetLabelCounts() []int {
+	return instance.y_counts
+}
+
+// GetTarget returns the real valued target of a regression instance.
+func (instance *DataInstance) GetTarget() WeightT {
+	return instance.target
+}
+
+// bag returns the values of the given multi-valued class.
+func (instance *DataInstance) bag(class_id int) []int {
+	if instance.x_bags == nil {
+		return nil
+	}
+	return instance.x_bags[class_id]
+}
+
+// isMissing determines whether the given class is not observed.
+func (instance *DataInstance) isMissing(class_id int) bool {
+	return instance.x[class_id] == KMissingValue
+}
+
+// realValue returns the value of the given Gaussian class.
+func (instance *DataInstance) realValue(class_id int) WeightT {
+	if instance.x_real == nil {
+		return 0
+	}
+	return instance.x_real[class_id]
+}
+
 // Equal determines whether the given two DataInstance are equal.
 func (instance *DataInstance) Equal(a *DataInstance) bool {
-	if !(instance.pos_y == a.pos_y && instance.neg_y == a.neg_y &&
-		len(instance.x) == len(a.x)) {
+	if !(instance.pos_y == a.pos_y && instance.neg_y == a.neg_y && instance.target == a.target &&
+		len(instance.x) == len(a.x) && len(instance.x_bags) == len(a.x_bags) &&
+		len(instance.x_real) == len(a.x_real) &&
+		len(instance.y_counts) == len(a.y_counts)) {
 		return false
 	}
+	for k, n := range instance.y_counts {
+		if n != a.y_counts[k] {
+			return false
+		}
+	}
 	for i, v := range instance.x {
 		if v != a.x[i] {
 			return false
 		}
 	}
+	for i, v := range instance.x_real {
+		if v != a.x_real[i] {
+			return false
+		}
+	}
+	for c, bag := range instance.x_bags {
+		if (bag == nil) != (a.x_bags[c] == nil) || len(bag) != len(a.x_bags[c]) {
+			return false
+		}
+		for i, v := range bag {
+			if v != a.x_bags[c][i] {
+				return false
+			}
+		}
+	}
 	return true
 }
 
+// clone returns a deep copy of the instance.
+func (instance *DataInstance) clone() *DataInstance {
+	c := *instance
+	c.x = make([]int, len(instance.x))
+	copy(c.x, instance.x)
+	if instance.x_real != nil {
+		c.x_real = make([]WeightT, len(instance.x_real))
+		copy(c.x_real, instance.x_real)
+	}
+	if instance.x_bags != nil {
+		c.x_bags = make([][]int, len(instance.x_bags))
+		for i, bag := range instance.x_bags {
+			if bag != nil {
+				c.x_bags[i] = make([]int, len(bag))
+				copy(c.x_bags[i], bag)
+			}
+		}
+	}
+	return &c
+}
+
 // DataInstanceAccessor specifies an interface for retrieving training
 // and testing data.
 type DataInstanceAccessor interface {
@@ -48,13 +148,32 @@ type DataInstanceAccessor interface {
 	Close()
 }
 
+// SeekableDataInstanceAccessor is a DataInstanceAccessor whose reading
+// position can be saved and restored, e.g. for resuming training.
+type SeekableDataInstanceAccessor interface {
+	DataInstanceAccessor
+	Offset() int64
+	SeekTo(offset int64) error
+}
+
 // SequentialDataLoader implements the DataInstanceAccessor interface, and supplies
 // training instances in a sequential manner.
 type SequentialDataLoader struct {
-	filename    string
-	file        *os.File
-	reader      *bufio.Reader
-	num_classes int
+	filename string
+	file     *os.File
+	reader   *bufio.Reader
+	format   instanceFormat //layout of the instances
+	offset   int64          //offset of the next unread line
+	start    int64          //offset of the first line, for shards
+	end      int64          //offset past the last line of a shard, -1 for the end of file
+}
+
+// ShardableDataInstanceAccessor is a DataInstanceAccessor whose instances can
+// be split into disjoint shards, each read by its own accessor, e.g. for
+// training in parallel.
+type ShardableDataInstanceAccessor interface {
+	DataInstanceAccessor
+	Shards(n int) ([]DataInstanceAccessor, error)
 }
 
 // NewInstanceLoader creates an InstnaceLoader from the given file, with each
@@ -65,16 +184,81 @@ func NewInstanceLoader(filename string, num_feature_class int) *SequentialDataLo
 		log.Printf("Failed to open file: %s. %s.", filename, err)
 		return nil
 	}
-	return &SequentialDataLoader{filename, file, bufio.NewReader(file), num_feature_class}
+	format := instanceFormat{num_classes: num_feature_class}
+	return &SequentialDataLoader{filename, file, bufio.NewReader(file), format, 0, 0, -1}
+}
+
+// NewEncodedInstanceLoader creates an InstanceLoader from the given file whose
+// feature values are arbitrary strings, which are mapped to integer values
+// using the given encoder.
+func NewEncodedInstanceLoader(filename string, encoder FeatureEncoder) *SequentialDataLoader {
+	loader := NewInstanceLoader(filename, encoder.NumOfClasses())
+	if loader != nil {
+		loader.format.encoder = encoder
+	}
+	return loader
+}
+
+// NewModelInstanceLoader creates an InstanceLoader from the given file whose
+// instances are in the format of the given model, i.e. having its class
+// types and label classes. encoder may be nil if the values are integers.
+func NewModelInstanceLoader(filename string, rbm *SparseClassRBM,
+	encoder FeatureEncoder) *SequentialDataLoader {
+	loader := NewInstanceLoader(filename, rbm.NumOfVisibleClasses())
+	if loader != nil {
+		loader.format = rbm.instanceFormat(encoder)
+	}
+	return loader
+}
+
+// SetClassTypes specifies the type of each feature class; all the classes are
+// single valued by default. The values of multi-valued classes are given by
+// repeating the class, e.g. "210:a \t 210:b", and those of Gaussian classes
+// are real numbers, e.g. "50:28.5", which are not passed to the encoder.
+func (loader *SequentialDataLoader) SetClassTypes(class_types []ClassType) {
+	if len(class_types) != loader.format.num_classes {
+		panic(fmt.Sprintf("Expected %d class types but got %d.", loader.format.num_classes,
+			len(class_types)))
+	}
+	loader.format.class_types = make([]ClassType, len(class_types))
+	copy(loader.format.class_types, class_types)
+}
+
+// SetNumOfLabels makes the loader read instances with multi-class labels,
+// each line starting with the count of each of the num_labels label classes.
+func (loader *SequentialDataLoader) SetNumOfLabels(num_labels int) {
+	loader.format.num_labels = num_labels
+}
+
+// SetRegression makes the loader read instances with a real valued target,
+// each line starting with the target instead of the label counts.
+func (loader *SequentialDataLoader) SetRegression() {
+	loader.format.regression = true
 }
 
 // Reset resets the underlying file cursor.
 func (loader *SequentialDataLoader) Reset() {
-	if _, err := loader.file.Seek(0, 0); err != nil {
+	if err := loader.SeekTo(loader.start); err != nil {
 		log.Printf("Failed to reset file %s: %s.", loader.filename, err)
 	}
 }
 
+// Offset returns the byte offset of the next instance to be read.
+func (loader *SequentialDataLoader) Offset() int64 {
+	return loader.offset
+}
+
+// SeekTo moves the file cursor to the given byte offset, which should have been
+// obtained from Offset.
+func (loader *SequentialDataLoader) SeekTo(offset int64) error {
+	if _, err := loader.file.Seek(offset, 0); err != nil {
+		return err
+	}
+	loader.reader.Reset(loader.file)
+	loader.offset = offset
+	return nil
+}
+
 // Close closes the underlying file.
 func (loader *SequentialDataLoader) Close() {
 	loader.reader = nil
@@ -86,6 +270,9 @@ func (loader *SequentialDataLoader) Close() {
 // a valid DataInstance when everything is fine.
 func (loader *SequentialDataLoader) NextInstance() (DataInstance, error) {
 	var instance DataInstance
+	if loader.end >= 0 && loader.offset >= loader.end {
+		return instance, io.EOF
+	}
 	line, err := loader.reader.ReadString('\n')
 	if err != nil {
 		if err == io.EOF {
@@ -94,45 +281,239 @@ func (loader *SequentialDataLoader) NextInstance() (DataInstance, error) {
 			return instance, fmt.Errorf("Failed to retrieve instance: %s.", err)
 		}
 	}
-	line = strings.Trim(line, "\n\t\r\f")
-	fields := strings.Split(line, "\t")
-	if len(fields) < 3 {
-		return instance, fmt.Errorf("Expected each instance to have at least 3 fields: %s.", line)
+	loader.offset += int64(len(line))
+	return parseInstance(line, loader.format)
+}
+
+// Shards splits the file of the loader into n shards of about the same size,
+// each read by a new loader with the format of this one; a line belongs to the
+// shard its first byte falls in. The shards must be closed by the caller.
+func (loader *SequentialDataLoader) Shards(n int) ([]DataInstanceAccessor, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("Expected a positive number of shards but got %d.", n)
 	}
-	pos_y_cnt, err := strconv.ParseUint(fields[0], 10, 16)
+	info, err := loader.file.Stat()
 	if err != nil {
-		return instance, fmt.Errorf("Expected postitive instance counnt: %s.", line)
+		return nil, err
+	}
+	size := info.Size()
+	starts := make([]int64, n+1)
+	starts[n] = size
+	for i := 1; i < n; i++ {
+		if starts[i], err = lineStartFrom(loader.file, size*int64(i)/int64(n), size); err != nil {
+			return nil, fmt.Errorf("Failed to split %s: %s.", loader.filename, err)
+		}
+	}
+	shards := make([]DataInstanceAccessor, n)
+	for i := range shards {
+		shard := NewInstanceLoader(loader.filename, loader.format.num_classes)
+		if shard == nil {
+			for _, s := range shards[:i] {
+				s.Close()
+			}
+			return nil, fmt.Errorf("Failed to open %s.", loader.filename)
+		}
+		shard.format = loader.format
+		shard.start, shard.end = starts[i], starts[i+1]
+		shard.Reset()
+		shards[i] = shard
 	}
-	neg_y_cnt, err := strconv.ParseUint(fields[1], 10, 16)
+	return shards, nil
+}
+
+// lineStartFrom returns the offset of the first line of file starting at or
+// after offset, size if there is none.
+func lineStartFrom(file *os.File, offset, size int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, offset-1, size-offset+1))
+	skipped, err := reader.ReadString('\n')
+	if err == io.EOF {
+		return size, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return offset - 1 + int64(len(skipped)), nil
+}
+
+// ParseInstance parses a line in the data file format of the model, mapping
+// the raw feature values to integers with the given encoder, which may be nil
+// if the values are integers. It allows instances to be constructed at
+// prediction time exactly as they were during training.
+func (rbm *SparseClassRBM) ParseInstance(line string, encoder FeatureEncoder) (DataInstance, error) {
+	return parseInstance(line, rbm.instanceFormat(encoder))
+}
+
+// instanceFormat describes the layout of the instances of a data file.
+type instanceFormat struct {
+	num_classes int            //number of feature classes
+	encoder     FeatureEncoder //maps raw values to integers, nil if values are integers
+	class_types []ClassType    //type of each class, nil if all are single valued
+	num_labels  int            //number of label classes, 0 for binary labels
+	regression  bool           //whether instances have a real valued target
+}
+
+// instanceFormat returns the format of the data files of the model.
+func (rbm *SparseClassRBM) instanceFormat(encoder FeatureEncoder) instanceFormat {
+	return instanceFormat{rbm.x_class_num, encoder, rbm.x_class_types, rbm.y_class_num, rbm.y_gaussian}
+}
+
+// parseInstance parses a data line of the given format.
+func parseInstance(line string, format instanceFormat) (DataInstance, error) {
+	var instance DataInstance
+	labels, features, err := parseInstanceLine(line)
 	if err != nil {
-		return instance, fmt.Errorf("Expected negative instance count: %s.", line)
+		return instance, err
 	}
-	feature_sets := make([]int, loader.num_classes)
-	for _, v := range fields[2:] {
-		feature := strings.Split(v, ":")
-		if len(feature) != 2 {
-			return instance, fmt.Errorf("Invalid feature: %s.", feature)
+	if len(features) == 0 {
+		return instance, fmt.Errorf("Expected each instance to have at least 1 feature: %s.", line)
+	}
+	var counts []int
+	if format.regression {
+		if len(labels) != 1 {
+			return instance, fmt.Errorf("Expected a single target but got %d fields: %s.",
+				len(labels), line)
 		}
-		class_id, err := strconv.ParseInt(feature[0], 10, 16)
-		if err != nil {
-			return instance, fmt.Errorf("Expected class_id to be integer but got %s.", feature[0])
+		target, err := strconv.ParseFloat(labels[0], 64)
+		if err != nil || math.IsNaN(target) || math.IsInf(target, 0) {
+			return instance, fmt.Errorf("Expected real valued target but got %s: %s.", labels[0], line)
 		}
-		class_val, err := strconv.ParseInt(feature[1], 10, 16)
-		if err != nil {
-			return instance, fmt.Errorf("Expected class_val to be integer but got %s.", feature[1])
+		instance.target = WeightT(target)
+	} else {
+		for _, l := range labels {
+			cnt, err := strconv.ParseUint(l, 10, 16)
+			if err != nil {
+				return instance, fmt.Errorf("Expected instance count but got %s: %s.", l, line)
+			}
+			counts = append(counts, int(cnt))
 		}
-		if int(class_id) > len(feature_sets) {
+	}
+	if !format.regression && format.num_labels == 0 && len(counts) != 2 {
+		return instance, fmt.Errorf("Expected postitive and negative instance counts: %s.", line)
+	} else if format.num_labels > 0 && len(counts) != format.num_labels {
+		return instance, fmt.Errorf("Expected %d label counts but got %d: %s.",
+			format.num_labels, len(counts), line)
+	}
+	num_classes := format.num_classes
+	feature_sets := make([]int, num_classes)
+	var bags [][]int
+	var real_values []WeightT
+	seen := make([]bool, num_classes)
+	for c, t := range format.class_types {
+		if t == KMultiValuedClass || t == KNormalizedMultiValuedClass {
+			if bags == nil {
+				bags = make([][]int, num_classes)
+			}
+			bags[c] = []int{}
+		} else if t == KGaussianClass && real_values == nil {
+			real_values = make([]WeightT, num_classes)
+		}
+	}
+	for _, f := range features {
+		if f.class_id >= len(feature_sets) {
 			return instance, fmt.Errorf("Error, expected max class id to be %d but got %d.",
-				len(feature_sets)-1, class_id)
+				len(feature_sets)-1, f.class_id)
+		}
+		if real_values != nil && format.class_types[f.class_id] == KGaussianClass {
+			v, err := strconv.ParseFloat(f.value, 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return instance, fmt.Errorf("Expected class_val of Gaussian class %d to be real but got %s.",
+					f.class_id, f.value)
+			}
+			if seen[f.class_id] {
+				return instance, fmt.Errorf("Class %d is single valued but appears more than once.",
+					f.class_id)
+			}
+			seen[f.class_id] = true
+			real_values[f.class_id] = WeightT(v)
+			continue
+		}
+		var class_val int
+		if format.encoder != nil {
+			class_val = format.encoder.Encode(f.class_id, f.value)
+		} else {
+			v, err := strconv.ParseInt(f.value, 10, 16)
+			if err != nil {
+				return instance, fmt.Errorf("Expected class_val to be integer but got %s.", f.value)
+			}
+			class_val = int(v)
+		}
+		if bags != nil && bags[f.class_id] != nil {
+			bags[f.class_id] = append(bags[f.class_id], class_val)
+			seen[f.class_id] = true
+			continue
+		}
+		if seen[f.class_id] {
+			return instance, fmt.Errorf("Class %d is single valued but appears more than once.",
+				f.class_id)
+		}
+		seen[f.class_id] = true
+		feature_sets[f.class_id] = class_val
+	}
+	if format.num_labels > 0 {
+		instance.y_counts = counts
+	} else if !format.regression {
+		instance.pos_y = counts[0]
+		instance.neg_y = counts[1]
+	}
+	for c := range feature_sets {
+		if !seen[c] {
+			feature_sets[c] = KMissingValue
 		}
-		feature_sets[int(class_id)] = int(class_val)
 	}
-	instance.pos_y = int(pos_y_cnt)
-	instance.neg_y = int(neg_y_cnt)
 	instance.x = feature_sets
+	instance.x_bags = bags
+	instance.x_real = real_values
 	return instance, nil
 }
 
+// rawFeature is a feature as it appears in the data file, i.e. before its
+// value has been mapped to an integer.
+type rawFeature struct {
+	class_id int
+	value    string
+}
+
+// parseInstanceLine splits an instance line of the form
+//  pos_y_cnt \t neg_y_cnt \t class_id:class_val \t class_id:class_val ...
+// or, for multi-class labels,
+//  label_0_cnt \t label_1_cnt \t ... \t class_id:class_val \t ...
+// or, for regression,
+//  target \t class_id:class_val \t ...
+// into its labels and raw features. The labels are the leading fields that
+// are not features.
+func parseInstanceLine(line string) ([]string, []rawFeature, error) {
+	line = strings.Trim(line, "\n\t\r\f")
+	fields := strings.Split(line, "\t")
+	if len(fields) < 2 {
+		return nil, nil, fmt.Errorf("Expected each instance to have at least 2 fields: %s.", line)
+	}
+	num_labels := 0
+	for num_labels < len(fields) && !strings.Contains(fields[num_labels], ":") {
+		num_labels++
+	}
+	features := make([]rawFeature, 0, len(fields)-num_labels)
+	for _, v := range fields[num_labels:] {
+		feature := strings.SplitN(v, ":", 2)
+		if len(feature) != 2 {
+			return nil, nil, fmt.Errorf("Invalid feature: %s.", feature)
+		}
+		class_id, err := strconv.ParseInt(feature[0], 10, 16)
+		if err != nil || class_id < 0 {
+			return nil, nil, fmt.Errorf("Expected class_id to be integer but got %s.", feature[0])
+		}
+		features = append(features, rawFeature{int(class_id), feature[1]})
+	}
+	return fields[:num_labels], features, nil
+}
+
+// GetBiases returns the initial biases of a model over the classes of the
+// given sizes, computed from the instances of accessor following ref. [1], 8:
+// the bias of every value is its log probability within its class and the
+// bias of y is the log odds of y = 1. Counts are smoothed by kBiasPseudoCount
+// so that values which never occur get a finite bias. Missing classes are not
+// counted.
 func GetBiases(class_sizes []int, accessor DataInstanceAccessor) ([][]WeightT, WeightT) {
 	biases := make([][]WeightT, len(class_sizes))
 	for i, s := range class_sizes {
@@ -147,7 +528,13 @@ func GetBiases(class_sizes []int, accessor DataInstanceAccessor) ([][]WeightT, W
 			break
 		} else if err == nil {
 			for i, v := range inst.x {
-				biases[i][v]++
+				if bag := inst.bag(i); bag != nil {
+					for _, k := range bag {
+						biases[i][k]++
+					}
+				} else if v != KMissingValue {
+					biases[i][v]++
+				}
 			}
 			pos_y += inst.pos_y
 			neg_y += inst.neg_y
@@ -157,12 +544,76 @@ func GetBiases(class_sizes []int, accessor DataInstanceAccessor) ([][]WeightT, W
 	for i := range biases {
 		s := WeightT(0)
 		for _, v := range biases[i] {
-			s += v
+			s += v + kBiasPseudoCount
 		}
-		for j, _ := range biases[i] {
-			biases[i][j] /= s
+		for j, v := range biases[i] {
+			biases[i][j] = WeightT(math.Log(float64((v + kBiasPseudoCount) / s)))
+		}
+	}
+
+	y_bias := math.Log(float64((WeightT(pos_y) + kBiasPseudoCount) / (WeightT(neg_y) + kBiasPseudoCount)))
+	return biases, WeightT(y_bias)
+}
+
+// GetTargetStats returns the mean and the standard deviation of the targets
+// of the regression instances, for InitializeRegression.
+func GetTargetStats(accessor DataInstanceAccessor) (WeightT, WeightT) {
+	n := 0
+	sum, sum_sq := float64(0), float64(0)
+	for {
+		inst, err := accessor.NextInstance()
+		if err == io.EOF {
+			break
+		} else if err == nil {
+			n++
+			sum += float64(inst.target)
+			sum_sq += float64(inst.target * inst.target)
 		}
 	}
+	if n == 0 {
+		return 0, 1
+	}
+	mean := sum / float64(n)
+	stddev := math.Sqrt(math.Max(sum_sq/float64(n)-mean*mean, 0))
+	if stddev == 0 {
+		stddev = 1
+	}
+	return WeightT(mean), WeightT(stddev)
+}
 
-	return biases, WeightT(pos_y) / WeightT(pos_y+neg_y)
+// GetRealValueStats returns the mean and the standard deviation of the values
+// of every Gaussian class, for SetGaussianClass; the entries of the other
+// classes are 0 and 1.
+func GetRealValueStats(class_types []ClassType, accessor DataInstanceAccessor) ([]WeightT, []WeightT) {
+	n := make([]int, len(class_types))
+	sum := make([]float64, len(class_types))
+	sum_sq := make([]float64, len(class_types))
+	for {
+		inst, err := accessor.NextInstance()
+		if err == io.EOF {
+			break
+		} else if err == nil && inst.x_real != nil {
+			for c, v := range inst.x_real {
+				if !inst.isMissing(c) {
+					n[c]++
+					sum[c] += float64(v)
+					sum_sq[c] += float64(v * v)
+				}
+			}
+		}
+	}
+	means := make([]WeightT, len(class_types))
+	sigmas := make([]WeightT, len(class_types))
+	for c, t := range class_types {
+		sigmas[c] = 1
+		if t != KGaussianClass || n[c] == 0 {
+			continue
+		}
+		mean := sum[c] / float64(n[c])
+		means[c] = WeightT(mean)
+		if sigma := math.Sqrt(math.Max(sum_sq[c]/float64(n[c])-mean*mean, 0)); sigma > 0 {
+			sigmas[c] = WeightT(sigma)
+		}
+	}
+	return means, sigmas
 }
@@ -9,7 +9,9 @@ import (
 	"common/util"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -18,13 +20,13 @@ func Test_SequentialDataLoader(t *testing.T) {
 	num_feature_classes := 6
 	test_cases := []DataInstance{
 		{
-			[]int{0, 1, 2, 3, 4, 5},
-			1,
-			2,
+			x:     []int{0, 1, 2, 3, 4, 5},
+			pos_y: 1,
+			neg_y: 2,
 		}, {
-			[]int{1, 2, 3, 4, 5, 0},
-			0,
-			1,
+			x:     []int{1, 2, 3, 4, 5, 0},
+			pos_y: 0,
+			neg_y: 1,
 		},
 	}
 	err := util.WithNewOpenFileAsBufioWriter(test_file,
@@ -69,3 +71,204 @@ func Test_SequentialDataLoader(t *testing.T) {
 		t.Errorf("Expected instance but got error.")
 	}
 }
+
+func Test_SequentialDataLoaderWithMultiValuedClasses(t *testing.T) {
+	test_file := "test_multi_valued_instances.dat"
+	lines := []string{
+		"1\t0\t0:3\t1:2\t1:5\t2:1\t1:2",
+		"0\t1\t0:1\t2:0",
+		"0\t1\t0:1\t0:2\t1:0",
+	}
+	if err := saveLinesToFile(test_file, lines); err != nil {
+		t.Fatalf("Failed to create test file: %s.", err)
+	}
+	defer os.Remove(test_file)
+
+	loader := NewInstanceLoader(test_file, 3)
+	defer loader.Close()
+	loader.SetClassTypes([]ClassType{KSingleValuedClass, KMultiValuedClass, KSingleValuedClass})
+	expected := []DataInstance{
+		{x: []int{3, 0, 1}, x_bags: [][]int{nil, {2, 5, 2}, nil}, pos_y: 1},
+		{x: []int{1, KMissingValue, 0}, x_bags: [][]int{nil, {}, nil}, neg_y: 1},
+	}
+	for i, e := range expected {
+		instance, err := loader.NextInstance()
+		if err != nil || !instance.Equal(&e) {
+			t.Errorf("Instance #%d: expected %v but got %v, %v.", i, e, instance, err)
+		}
+	}
+	if _, err := loader.NextInstance(); err == nil {
+		t.Errorf("Expected error for repeated single-valued class.")
+	}
+}
+
+func Test_SequentialDataLoaderWithMultiClassLabels(t *testing.T) {
+	test_file := "test_multi_class_instances.dat"
+	lines := []string{
+		"0\t2\t1\t0:3\t1:2",
+		"1\t0\t0\t1:1",
+		"1\t0\t0:1",
+	}
+	if err := saveLinesToFile(test_file, lines); err != nil {
+		t.Fatalf("Failed to create test file: %s.", err)
+	}
+	defer os.Remove(test_file)
+
+	loader := NewInstanceLoader(test_file, 2)
+	defer loader.Close()
+	loader.SetNumOfLabels(3)
+	expected := []DataInstance{
+		{x: []int{3, 2}, y_counts: []int{0, 2, 1}},
+		{x: []int{KMissingValue, 1}, y_counts: []int{1, 0, 0}},
+	}
+	for i, e := range expected {
+		instance, err := loader.NextInstance()
+		if err != nil || !instance.Equal(&e) {
+			t.Errorf("Instance #%d: expected %v but got %v, %v.", i, e, instance, err)
+		}
+	}
+	if _, err := loader.NextInstance(); err == nil {
+		t.Errorf("Expected error for wrong number of label counts.")
+	}
+}
+
+func Test_SequentialDataLoaderWithTargets(t *testing.T) {
+	test_file := "test_regression_instances.dat"
+	lines := []string{
+		"12.5\t0:3\t1:2",
+		"-0.25\t1:1",
+		"1\t0\t0:1",
+	}
+	if err := saveLinesToFile(test_file, lines); err != nil {
+		t.Fatalf("Failed to create test file: %s.", err)
+	}
+	defer os.Remove(test_file)
+
+	loader := NewInstanceLoader(test_file, 2)
+	defer loader.Close()
+	loader.SetRegression()
+	expected := []DataInstance{
+		{x: []int{3, 2}, target: 12.5},
+		{x: []int{KMissingValue, 1}, target: -0.25},
+	}
+	for i, e := range expected {
+		instance, err := loader.NextInstance()
+		if err != nil || !instance.Equal(&e) {
+			t.Errorf("Instance #%d: expected %v but got %v, %v.", i, e, instance, err)
+		}
+	}
+	if _, err := loader.NextInstance(); err == nil {
+		t.Errorf("Expected error for line with label counts.")
+	}
+
+	loader.Reset()
+	mean, stddev := GetTargetStats(loader)
+	if !EqualWithinPrecision(mean, 6.125, kPrecision) || !EqualWithinPrecision(stddev, 6.375, kPrecision) {
+		t.Errorf("Expected target stats (6.125, 6.375) but got (%v, %v).", mean, stddev)
+	}
+}
+
+func Test_SequentialDataLoaderWithGaussianClasses(t *testing.T) {
+	test_file := "test_gaussian_instances.dat"
+	lines := []string{
+		"1\t0\t0:3\t1:28.5",
+		"0\t1\t0:1\t1:-1.5",
+		"0\t1\t0:1\t1:abc",
+	}
+	if err := saveLinesToFile(test_file, lines); err != nil {
+		t.Fatalf("Failed to create test file: %s.", err)
+	}
+	defer os.Remove(test_file)
+
+	class_types := []ClassType{KSingleValuedClass, KGaussianClass}
+	loader := NewInstanceLoader(test_file, 2)
+	defer loader.Close()
+	loader.SetClassTypes(class_types)
+	expected := []DataInstance{
+		{x: []int{3, 0}, x_real: []WeightT{0, 28.5}, pos_y: 1},
+		{x: []int{1, 0}, x_real: []WeightT{0, -1.5}, neg_y: 1},
+	}
+	for i, e := range expected {
+		instance, err := loader.NextInstance()
+		if err != nil || !instance.Equal(&e) {
+			t.Errorf("Instance #%d: expected %v but got %v, %v.", i, e, instance, err)
+		}
+	}
+	if _, err := loader.NextInstance(); err == nil {
+		t.Errorf("Expected error for non-real value of Gaussian class.")
+	}
+
+	loader.Reset()
+	means, sigmas := GetRealValueStats(class_types, loader)
+	if means[0] != 0 || sigmas[0] != 1 || !EqualWithinPrecision(means[1], 13.5, kPrecision) ||
+		!EqualWithinPrecision(sigmas[1], 15, kPrecision) {
+		t.Errorf("Expected stats [0 13.5] [1 15] but got %v %v.", means, sigmas)
+	}
+}
+
+func Test_GetBiases(t *testing.T) {
+	accessor := &instanceSlice{instances: []DataInstance{
+		{x: []int{0, 1}, pos_y: 1},
+		{x: []int{0, KMissingValue}, pos_y: 2},
+		{x: []int{1, 1}, neg_y: 1},
+	}}
+	biases, y_bias := GetBiases([]int{3, 2}, accessor)
+	log := func(p float64) WeightT { return WeightT(math.Log(p)) }
+	expected := [][]WeightT{
+		{log(2.5 / 4.5), log(1.5 / 4.5), log(0.5 / 4.5)},
+		{log(0.5 / 3), log(2.5 / 3)},
+	}
+	for c := range expected {
+		if !ArraysEqualWithinPrecision(biases[c], expected[c], kPrecision) {
+			t.Errorf("Expected biases of class %d to be %v but got %v.", c, expected[c], biases[c])
+		}
+	}
+	if !EqualWithinPrecision(y_bias, log(3.5/1.5), kPrecision) {
+		t.Errorf("Expected y bias %f but got %f.", log(3.5/1.5), y_bias)
+	}
+}
+
+func Test_SequentialDataLoaderShards(t *testing.T) {
+	test_file := "test_shard_instances.dat"
+	lines := []string{
+		"1\t0\t0:0",
+		"0\t1\t0:1\t1:2",
+		"1\t0\t0:2",
+		"0\t1\t0:3\t1:1\t2:0",
+		"1\t0\t0:4",
+		"0\t1\t0:5",
+		"1\t0\t0:6\t1:0",
+	}
+	if err := saveLinesToFile(test_file, lines); err != nil {
+		t.Fatalf("Failed to create test file: %s.", err)
+	}
+	defer os.Remove(test_file)
+
+	loader := NewInstanceLoader(test_file, 3)
+	defer loader.Close()
+	for n := 1; n <= 10; n++ {
+		shards, err := loader.Shards(n)
+		if err != nil {
+			t.Fatalf("Failed to split into %d shards: %s.", n, err)
+		}
+		for pass := 0; pass < 2; pass++ {
+			var values []int
+			for _, shard := range shards {
+				for {
+					instance, err := shard.NextInstance()
+					if err != nil {
+						break
+					}
+					values = append(values, instance.x[0])
+				}
+				shard.Reset()
+			}
+			if !reflect.DeepEqual(values, []int{0, 1, 2, 3, 4, 5, 6}) {
+				t.Errorf("Expected %d shards to hold each instance once but got %v.", n, values)
+			}
+		}
+		for _, shard := range shards {
+			shard.Close()
+		}
+	}
+}
@@ -45,3 +45,40 @@ func ScalarProduct(a []WeightT, b WeightT) {
 		a[i] *= b
 	}
 }
+
+// LogSumExp returns log(sum(exp(a[i]))), avoiding overflow.
+func LogSumExp(a []WeightT) WeightT {
+	max_a := WeightT(math.Inf(-1))
+	for _, v := range a {
+		if v > max_a {
+			max_a = v
+		}
+	}
+	if math.IsInf(float64(max_a), -1) {
+		return max_a
+	}
+	s := WeightT(0)
+	for _, v := range a {
+		s += Exp(v - max_a)
+	}
+	return max_a + WeightT(math.Log(float64(s)))
+}
+
+// SoftMax replaces a with exp(a[i])/sum{j}(exp(a[j])), subtracting the maximum
+// of a first to avoid overflow.
+func SoftMax(a []WeightT) {
+	max := a[0]
+	for _, v := range a {
+		if v > max {
+			max = v
+		}
+	}
+	s := WeightT(0)
+	for i, v := range a {
+		a[i] = Exp(v - max)
+		s += a[i]
+	}
+	for i := range a {
+		a[i] /= s
+	}
+}
@@ -0,0 +1,407 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Persistence of SparseClassRBM models.
+//
+// Model file layout (all integers are little endian uint32, all weights are
+// little endian IEEE-754 float64 bit patterns):
+//  magic         [8]byte "SCRBMMDL"
+//  version       uint32
+//  h_num         uint32
+//  x_class_num   uint32
+//  x_class_sizes [x_class_num]uint32
+//  x_class_types [x_class_num]uint32 (since version 2)
+//  x_bias_mode   uint32, the BiasParameterization (since version 7)
+//  w             [x_class_num][h_num][x_class_sizes[c]]float64
+//  b             [x_class_num][x_class_sizes[c], or 1 with one bias per class]float64
+//  c             [h_num]float64
+//  u             [h_num]float64
+//  d             float64
+//  y_class_num   uint32, 0 for binary y (since version 3)
+//  uk            [y_class_num][h_num]float64 (since version 3)
+//  dk            [y_class_num]float64 (since version 3)
+//  y_gaussian    uint32, 1 for a real valued y (since version 4)
+//  y_mean        float64 (since version 4)
+//  y_stddev      float64 (since version 4)
+//  x_sigmas      [x_class_num]float64 (since version 5)
+//  x_missing     uint32, the MissingValuePolicy (since version 6)
+//  checksum      uint32, CRC-32 (IEEE) of all the preceding bytes
+
+package rbm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	kModelMagic        = "SCRBMMDL"
+	kModelVersion      = 7       //current version of the model file format
+	kMaxModelDimension = 1 << 28 //sanity limit on any single dimension read from file
+)
+
+var (
+	ErrModelTruncated = errors.New("model file is truncated")
+	ErrModelChecksum  = errors.New("model file checksum mismatch")
+)
+
+// modelWriter writes the model file primitives while maintaining a running
+// checksum; the first error encountered is kept and all subsequent writes
+// are ignored.
+type modelWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	buf []byte
+	err error
+}
+
+func newModelWriter(w io.Writer) *modelWriter {
+	crc := crc32.NewIEEE()
+	return &modelWriter{w: io.MultiWriter(w, crc), crc: crc, buf: make([]byte, 8)}
+}
+
+func (mw *modelWriter) writeBytes(p []byte) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = mw.w.Write(p)
+}
+
+func (mw *modelWriter) writeUint32(v int) {
+	binary.LittleEndian.PutUint32(mw.buf[:4], uint32(v))
+	mw.writeBytes(mw.buf[:4])
+}
+
+func (mw *modelWriter) writeUint64(v uint64) {
+	binary.LittleEndian.PutUint64(mw.buf, v)
+	mw.writeBytes(mw.buf)
+}
+
+func (mw *modelWriter) writeWeight(v WeightT) {
+	binary.LittleEndian.PutUint64(mw.buf, math.Float64bits(float64(v)))
+	mw.writeBytes(mw.buf)
+}
+
+func (mw *modelWriter) writeWeights(v []WeightT) {
+	if mw.err != nil {
+		return
+	}
+	p := make([]byte, 8*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint64(p[8*i:], math.Float64bits(float64(x)))
+	}
+	mw.writeBytes(p)
+}
+
+// writeChecksum appends the checksum of everything written so far.
+func (mw *modelWriter) writeChecksum() {
+	mw.writeUint32(int(mw.crc.Sum32()))
+}
+
+// modelReader is the counterpart of modelWriter.
+type modelReader struct {
+	r   io.Reader
+	crc hash.Hash32
+	buf []byte
+	err error
+}
+
+func newModelReader(r io.Reader) *modelReader {
+	crc := crc32.NewIEEE()
+	return &modelReader{r: io.TeeReader(r, crc), crc: crc, buf: make([]byte, 8)}
+}
+
+func (mr *modelReader) readBytes(p []byte) {
+	if mr.err != nil {
+		return
+	}
+	if _, err := io.ReadFull(mr.r, p); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			mr.err = ErrModelTruncated
+		} else {
+			mr.err = err
+		}
+	}
+}
+
+func (mr *modelReader) readUint32() int {
+	mr.readBytes(mr.buf[:4])
+	if mr.err != nil {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(mr.buf[:4]))
+}
+
+func (mr *modelReader) readUint64() uint64 {
+	mr.readBytes(mr.buf)
+	if mr.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(mr.buf)
+}
+
+// readDimension reads a size field and makes sure it is within [min, kMaxModelDimension].
+func (mr *modelReader) readDimension(name string, min int) int {
+	v := mr.readUint32()
+	if mr.err == nil && (v < min || v > kMaxModelDimension) {
+		mr.err = fmt.Errorf("Invalid %s in model file: %d.", name, v)
+	}
+	return v
+}
+
+func (mr *modelReader) readWeight() WeightT {
+	mr.readBytes(mr.buf)
+	if mr.err != nil {
+		return 0
+	}
+	return WeightT(math.Float64frombits(binary.LittleEndian.Uint64(mr.buf)))
+}
+
+func (mr *modelReader) readWeights(n int) []WeightT {
+	v := make([]WeightT, n)
+	if mr.err != nil {
+		return v
+	}
+	p := make([]byte, 8*n)
+	mr.readBytes(p)
+	if mr.err != nil {
+		return v
+	}
+	for i := range v {
+		v[i] = WeightT(math.Float64frombits(binary.LittleEndian.Uint64(p[8*i:])))
+	}
+	return v
+}
+
+// verifyChecksum reads the stored checksum and compares it with the one
+// calculated over all the bytes read so far.
+func (mr *modelReader) verifyChecksum() {
+	if mr.err != nil {
+		return
+	}
+	expected := mr.crc.Sum32()
+	stored := mr.readUint32()
+	if mr.err == nil && stored != int(expected) {
+		mr.err = ErrModelChecksum
+	}
+}
+
+// Method SaveModel writes all the parameters of the RBM to w.
+func (rbm *SparseClassRBM) SaveModel(w io.Writer) error {
+	mw := newModelWriter(w)
+	mw.writeBytes([]byte(kModelMagic))
+	mw.writeUint32(kModelVersion)
+	rbm.writeParameters(mw)
+	mw.writeChecksum()
+	if mw.err != nil {
+		return fmt.Errorf("Failed to save model: %s.", mw.err)
+	}
+	return nil
+}
+
+func (rbm *SparseClassRBM) writeParameters(mw *modelWriter) {
+	mw.writeUint32(rbm.h_num)
+	mw.writeUint32(rbm.x_class_num)
+	for _, k := range rbm.x_class_sizes {
+		mw.writeUint32(k)
+	}
+	for _, t := range rbm.x_class_types {
+		mw.writeUint32(int(t))
+	}
+	mw.writeUint32(int(rbm.x_bias_mode))
+	for c := range rbm.w {
+		for h := range rbm.w[c] {
+			mw.writeWeights(rbm.w[c][h])
+		}
+	}
+	for c := range rbm.b {
+		mw.writeWeights(rbm.b[c])
+	}
+	mw.writeWeights(rbm.c)
+	mw.writeWeights(rbm.u)
+	mw.writeWeight(rbm.d)
+	mw.writeUint32(rbm.y_class_num)
+	for k := range rbm.uk {
+		mw.writeWeights(rbm.uk[k])
+	}
+	mw.writeWeights(rbm.dk)
+	if rbm.y_gaussian {
+		mw.writeUint32(1)
+	} else {
+		mw.writeUint32(0)
+	}
+	mw.writeWeight(rbm.y_mean)
+	mw.writeWeight(rbm.y_stddev)
+	mw.writeWeights(rbm.x_sigmas)
+	mw.writeUint32(int(rbm.x_missing))
+}
+
+// Method LoadModel replaces the parameters of the RBM with those read from r,
+// which must have been produced by SaveModel. The RBM is left untouched if
+// an error is returned.
+func (rbm *SparseClassRBM) LoadModel(r io.Reader) error {
+	mr := newModelReader(r)
+	magic := make([]byte, len(kModelMagic))
+	mr.readBytes(magic)
+	if mr.err == nil && string(magic) != kModelMagic {
+		return fmt.Errorf("Failed to load model: not a SparseClassRBM model file.")
+	}
+	version := mr.readUint32()
+	if mr.err == nil && (version < 1 || version > kModelVersion) {
+		return fmt.Errorf("Failed to load model: unsupported version %d, expected at most %d.",
+			version, kModelVersion)
+	}
+	var loaded SparseClassRBM
+	loaded.readParameters(mr, version)
+	mr.verifyChecksum()
+	if mr.err != nil {
+		return fmt.Errorf("Failed to load model: %s.", mr.err)
+	}
+	*rbm = loaded
+	return nil
+}
+
+// readParameters reads the parameters in the layout of the given version of
+// the model file format.
+func (rbm *SparseClassRBM) readParameters(mr *modelReader, version int) {
+	rbm.h_num = mr.readDimension("number of hidden units", 1)
+	rbm.x_class_num = mr.readDimension("number of visible classes", 0)
+	if mr.err != nil {
+		return
+	}
+	rbm.x_class_sizes = make([]int, rbm.x_class_num)
+	for c := range rbm.x_class_sizes {
+		rbm.x_class_sizes[c] = mr.readDimension(fmt.Sprintf("size of class %d", c), 1)
+	}
+	rbm.x_class_types = make([]ClassType, rbm.x_class_num)
+	if version >= 2 {
+		for c := range rbm.x_class_types {
+			t := ClassType(mr.readUint32())
+			if mr.err == nil && t != KSingleValuedClass && t != KMultiValuedClass &&
+				t != KNormalizedMultiValuedClass && t != KGaussianClass {
+				mr.err = fmt.Errorf("Invalid type of class %d in model file: %d.", c, t)
+			}
+			if mr.err == nil && t == KGaussianClass && rbm.x_class_sizes[c] != 1 {
+				mr.err = fmt.Errorf("Invalid size of Gaussian class %d in model file: %d.", c,
+					rbm.x_class_sizes[c])
+			}
+			rbm.x_class_types[c] = t
+		}
+	}
+	rbm.x_bias_mode = KPerUnitBias
+	if version >= 7 {
+		mode := BiasParameterization(mr.readUint32())
+		if mr.err == nil && mode != KPerUnitBias && mode != KPerClassBias {
+			mr.err = fmt.Errorf("Invalid bias parameterization in model file: %d.", mode)
+		}
+		rbm.x_bias_mode = mode
+	}
+	if mr.err != nil {
+		return
+	}
+	rbm.w = make([][][]WeightT, rbm.x_class_num)
+	for c, k := range rbm.x_class_sizes {
+		rbm.w[c] = make([][]WeightT, rbm.h_num)
+		for h := range rbm.w[c] {
+			rbm.w[c][h] = mr.readWeights(k)
+			if mr.err != nil {
+				return
+			}
+		}
+	}
+	rbm.b = make([][]WeightT, rbm.x_class_num)
+	for c, k := range rbm.x_class_sizes {
+		if rbm.x_bias_mode == KPerClassBias {
+			k = 1
+		}
+		rbm.b[c] = mr.readWeights(k)
+	}
+	rbm.c = mr.readWeights(rbm.h_num)
+	rbm.u = mr.readWeights(rbm.h_num)
+	rbm.d = mr.readWeight()
+	rbm.x_sigmas = make([]WeightT, rbm.x_class_num)
+	for c := range rbm.x_sigmas {
+		rbm.x_sigmas[c] = 1
+	}
+	if version < 3 {
+		return
+	}
+	rbm.y_class_num = mr.readDimension("number of label classes", 0)
+	if mr.err == nil && rbm.y_class_num == 1 {
+		mr.err = fmt.Errorf("Invalid number of label classes in model file: 1.")
+	}
+	if mr.err != nil {
+		return
+	}
+	if rbm.y_class_num > 0 {
+		rbm.uk = make([][]WeightT, rbm.y_class_num)
+		for k := range rbm.uk {
+			rbm.uk[k] = mr.readWeights(rbm.h_num)
+			if mr.err != nil {
+				return
+			}
+		}
+		rbm.dk = mr.readWeights(rbm.y_class_num)
+	}
+	if version < 4 {
+		return
+	}
+	y_gaussian := mr.readUint32()
+	if mr.err == nil && (y_gaussian > 1 || (y_gaussian == 1 && rbm.y_class_num > 0)) {
+		mr.err = fmt.Errorf("Invalid type of y in model file: %d.", y_gaussian)
+	}
+	rbm.y_gaussian = y_gaussian == 1
+	rbm.y_mean = mr.readWeight()
+	rbm.y_stddev = mr.readWeight()
+	if version >= 5 {
+		rbm.x_sigmas = mr.readWeights(rbm.x_class_num)
+	}
+	if version >= 6 {
+		policy := MissingValuePolicy(mr.readUint32())
+		if mr.err == nil && policy != KMissingAsZero && policy != KSkipMissing &&
+			policy != KMarginalizeMissing {
+			mr.err = fmt.Errorf("Invalid missing value policy in model file: %d.", policy)
+		}
+		rbm.x_missing = policy
+	}
+}
+
+// Method SaveModelToFile saves the RBM to the file of the given name.
+func (rbm *SparseClassRBM) SaveModelToFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if err := rbm.SaveModel(writer); err != nil {
+		file.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to save model to %s: %s.", filename, err)
+	}
+	return file.Close()
+}
+
+// LoadModelFromFile loads a SparseClassRBM from the file of the given name.
+func LoadModelFromFile(filename string) (*SparseClassRBM, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rbm := new(SparseClassRBM)
+	if err := rbm.LoadModel(bufio.NewReader(file)); err != nil {
+		return nil, err
+	}
+	return rbm, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_SaveLoadModel(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	// Values that only survive a bit-exact round trip.
+	rbm.SetB(2, 1, WeightT(math.Nextafter(0.1, 1)))
+	rbm.SetD(WeightT(math.Inf(-1)))
+	rbm.SetU(3, WeightT(math.SmallestNonzeroFloat64))
+	rbm.SetGaussianClass(0, 0.25, 1.75)
+	rbm.SetMissingValuePolicy(KMarginalizeMissing)
+
+	var buf bytes.Buffer
+	if err := rbm.SaveModel(&buf); err != nil {
+		t.Fatalf("Failed to save model: %s.", err)
+	}
+	loaded := new(SparseClassRBM)
+	if err := loaded.LoadModel(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to load model: %s.", err)
+	}
+	if !reflect.DeepEqual(rbm, loaded) {
+		t.Errorf("Expected loaded model\n%v\nto be equal to\n%v.", loaded, rbm)
+	}
+}
+
+func Test_SaveLoadMultiClassModel(t *testing.T) {
+	rbm := getSampleMultiClassRBM()
+	var buf bytes.Buffer
+	if err := rbm.SaveModel(&buf); err != nil {
+		t.Fatalf("Failed to save model: %s.", err)
+	}
+	loaded := new(SparseClassRBM)
+	if err := loaded.LoadModel(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to load model: %s.", err)
+	}
+	if !reflect.DeepEqual(rbm, loaded) {
+		t.Errorf("Expected loaded model\n%v\nto be equal to\n%v.", loaded, rbm)
+	}
+}
+
+func Test_SaveLoadRegressionModel(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.InitializeRegression(12.5, 3)
+	var buf bytes.Buffer
+	if err := rbm.SaveModel(&buf); err != nil {
+		t.Fatalf("Failed to save model: %s.", err)
+	}
+	loaded := new(SparseClassRBM)
+	if err := loaded.LoadModel(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to load model: %s.", err)
+	}
+	if !reflect.DeepEqual(rbm, loaded) {
+		t.Errorf("Expected loaded model\n%v\nto be equal to\n%v.", loaded, rbm)
+	}
+}
+
+func Test_LoadModelRejectsInvalidInput(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	var buf bytes.Buffer
+	if err := rbm.SaveModel(&buf); err != nil {
+		t.Fatalf("Failed to save model: %s.", err)
+	}
+	data := buf.Bytes()
+
+	for n := 0; n < len(data); n++ {
+		if err := new(SparseClassRBM).LoadModel(bytes.NewReader(data[:n])); err == nil {
+			t.Errorf("Expected error when loading model truncated to %d bytes.", n)
+		}
+	}
+
+	test_cases := []struct {
+		offset int
+		value  byte
+	}{
+		{0, 'X'},               //magic
+		{len(kModelMagic), 9},  //version
+		{len(data) - 20, 0x5a}, //weights
+		{len(data) - 1, 0xff},  //checksum
+	}
+	for i, t_case := range test_cases {
+		corrupted := make([]byte, len(data))
+		copy(corrupted, data)
+		corrupted[t_case.offset] ^= t_case.value
+		if err := new(SparseClassRBM).LoadModel(bytes.NewReader(corrupted)); err == nil {
+			t.Errorf("TestCase #%d: expected error for corrupted model file.", i)
+		}
+	}
+}
+
+func Test_SaveLoadModelFile(t *testing.T) {
+	model_file := "test_model.bin"
+	defer os.Remove(model_file)
+
+	rbm := getSampleRBMForProbabilityTest()
+	if err := rbm.SaveModelToFile(model_file); err != nil {
+		t.Fatalf("Failed to save model: %s.", err)
+	}
+	loaded, err := LoadModelFromFile(model_file)
+	if err != nil {
+		t.Fatalf("Failed to load model: %s.", err)
+	}
+	if !reflect.DeepEqual(rbm, loaded) {
+		t.Errorf("Expected loaded model to be equal to the saved one.")
+	}
+}
+
+func Test_SaveLoadPerClassBiasModel(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.SetBiasParameterization(KPerClassBias)
+	var buf bytes.Buffer
+	if err := rbm.SaveModel(&buf); err != nil {
+		t.Fatalf("Failed to save model: %s.", err)
+	}
+	loaded := new(SparseClassRBM)
+	if err := loaded.LoadModel(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to load model: %s.", err)
+	}
+	if !reflect.DeepEqual(rbm, loaded) {
+		t.Errorf("Expected loaded model\n%v\nto be equal to\n%v.", loaded, rbm)
+	}
+}
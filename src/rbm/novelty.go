@@ -0,0 +1,85 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Novelty scores.
+//
+// The novelty score of an instance is its free energy F(X), y being summed
+// out: P(X) = exp{-F(X)} / Z, so the instances the model finds the least
+// probable have the highest scores, whatever their label. Z being the same
+// for all the instances, the scores rank the instances without estimating it.
+
+package rbm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// forEachNumberedInstance calls f with every instance of the given data that
+// is valid input of the model, along with its 1-based number among all the
+// instances read, including those that failed to parse or are not valid. For
+// a data file, it is the line number of the instance.
+func forEachNumberedInstance(rbm *SparseClassRBM, data_accessor DataInstanceAccessor,
+	f func(n int, instance DataInstance)) {
+	data_accessor.Reset()
+	n := 0
+	for {
+		instance, err := data_accessor.NextInstance()
+		if err == io.EOF {
+			break
+		}
+		n++
+		if err == nil && rbm.IsValidInput(instance) {
+			f(n, instance)
+		}
+	}
+}
+
+// NoveltyScores returns the novelty score of every instance of the given data
+// that is valid input of the model, in order.
+func NoveltyScores(rbm *SparseClassRBM, data_accessor DataInstanceAccessor) []WeightT {
+	var scores []WeightT
+	forEachNumberedInstance(rbm, data_accessor, func(n int, instance DataInstance) {
+		scores = append(scores, rbm.FreeEnergyX(&instance))
+	})
+	return scores
+}
+
+// WriteNoveltyScores writes the novelty score of every instance of the given
+// data that is valid input of the model, one line per instance holding its
+// 1-based line number in the data, see forEachNumberedInstance, and its score,
+// separated by a tab. Lines that are not valid instances have no score.
+func WriteNoveltyScores(w io.Writer, rbm *SparseClassRBM, data_accessor DataInstanceAccessor) error {
+	var err error
+	if _, err = fmt.Fprintf(w, "line\tnovelty\n"); err != nil {
+		return err
+	}
+	forEachNumberedInstance(rbm, data_accessor, func(n int, instance DataInstance) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, "%d\t%g\n", n, rbm.FreeEnergyX(&instance))
+		}
+	})
+	return err
+}
+
+// WriteNoveltyScoresToFile writes the novelty scores of the given data to the
+// file of the given name, see WriteNoveltyScores.
+func WriteNoveltyScoresToFile(filename string, rbm *SparseClassRBM, data_accessor DataInstanceAccessor) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if err := WriteNoveltyScores(writer, rbm, data_accessor); err != nil {
+		file.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to save novelty scores to %s: %s.", filename, err)
+	}
+	return file.Close()
+}
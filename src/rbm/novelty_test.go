@@ -0,0 +1,68 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func Test_WriteNoveltyScores(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	data := getBatchTestData()
+	scores := NoveltyScores(rbm, &instanceSlice{instances: data})
+	if len(scores) != len(data) {
+		t.Fatalf("Expected %d scores but got %v.", len(data), scores)
+	}
+	expected := "line\tnovelty\n"
+	for i := range data {
+		if f := rbm.FreeEnergyX(&data[i]); scores[i] != f {
+			t.Errorf("Instance %d: expected score %v but got %v.", i, f, scores[i])
+		}
+		expected += fmt.Sprintf("%d\t%g\n", i+1, scores[i])
+	}
+	var buf bytes.Buffer
+	if err := WriteNoveltyScores(&buf, rbm, &instanceSlice{instances: data}); err != nil {
+		t.Fatalf("Failed to write scores: %s.", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s\nbut got\n%s.", expected, buf.String())
+	}
+}
+
+// Test_WriteNoveltyScoresOfInvalidLines checks that the lines that fail to
+// parse or are not valid input are skipped without shifting the line numbers
+// of the others.
+func Test_WriteNoveltyScoresOfInvalidLines(t *testing.T) {
+	data_file := "./novelty_lines.txt"
+	lines := []string{
+		"1\t0\t0:0\t1:1\t2:2",
+		"not an instance",
+		"0\t1\t0:0\t1:5\t2:2",
+		"0\t1\t0:0\t1:0\t2:1",
+	}
+	if err := saveLinesToFile(data_file, lines); err != nil {
+		t.Fatalf("Failed to create test file: %s.", err)
+	}
+	defer os.Remove(data_file)
+	loader := NewInstanceLoader(data_file, 3)
+	defer loader.Close()
+
+	rbm := getSampleRBMForProbabilityTest()
+	expected := fmt.Sprintf("line\tnovelty\n1\t%g\n4\t%g\n",
+		rbm.FreeEnergyX(&DataInstance{x: []int{0, 1, 2}}), rbm.FreeEnergyX(&DataInstance{x: []int{0, 0, 1}}))
+	var buf bytes.Buffer
+	if err := WriteNoveltyScores(&buf, rbm, loader); err != nil {
+		t.Fatalf("Failed to write scores: %s.", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s\nbut got\n%s.", expected, buf.String())
+	}
+	if scores := NoveltyScores(rbm, loader); len(scores) != 2 {
+		t.Errorf("Expected the scores of 2 valid instances but got %v.", scores)
+	}
+}
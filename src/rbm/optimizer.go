@@ -0,0 +1,325 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Optimizers.
+//
+// An Optimizer turns the gradient g of the objective with respect to a
+// parameter theta into the change of the parameter, given the learning rate
+// eta, the momentum mu and the L2 regularization lambda of the trainer. The
+// regularization is applied as a decay of the parameter, -lambda * theta,
+// which the adaptive optimizers leave out of the adaptation. The optimizer
+// keeps a state of StateSize() values for every parameter, which the trainer
+// stores: densely for the parameters of the hidden units and of y, and
+// sparsely for those of X, so that the state only takes memory for the
+// parameters that have been updated.
+//
+// References:
+//  [10]. Sutskever, Martens, Dahl, Hinton, 2013, On the Importance of
+//  Initialization and Momentum in Deep Learning
+//  [11]. Duchi, Hazan, Singer, 2011, Adaptive Subgradient Methods for Online
+//  Learning and Stochastic Optimization
+//  [12]. Tieleman, Hinton, 2012, Lecture 6.5 - RMSProp, COURSERA: Neural
+//  Networks for Machine Learning
+//  [13]. Kingma, Ba, 2015, Adam: A Method for Stochastic Optimization
+
+package rbm
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	KDefaultOptimizerEpsilon = 1e-8  //default constant added to the adaptive denominators
+	KDefaultRMSPropDecay     = 0.9   //default decay of the mean squared gradient of RMSProp
+	KDefaultAdamBeta1        = 0.9   //default decay of the mean gradient of Adam
+	KDefaultAdamBeta2        = 0.999 //default decay of the mean squared gradient of Adam
+)
+
+// Optimizer computes the changes of the parameters of a model from their
+// gradients.
+type Optimizer interface {
+	// StateSize returns the number of values of the state of a parameter,
+	// which are 0 before its first update.
+	StateSize() int
+	// Step returns the change of a parameter of value theta whose gradient
+	// is g, updating its state.
+	Step(state []WeightT, theta, g, eta, mu, lambda WeightT) WeightT
+	// String describes the optimizer and its hyper-parameters.
+	String() string
+}
+
+// momentumSGD is stochastic gradient ascent with momentum:
+//	delta_theta = eta * g - lambda * theta + mu * prev_delta_theta
+type momentumSGD struct{}
+
+// NewMomentumSGD returns the optimizer of stochastic gradient ascent with
+// momentum, the default one.
+func NewMomentumSGD() Optimizer {
+	return momentumSGD{}
+}
+
+func (momentumSGD) StateSize() int {
+	return 1
+}
+
+func (momentumSGD) Step(state []WeightT, theta, g, eta, mu, lambda WeightT) WeightT {
+	delta_theta := eta*g - lambda*theta + mu*state[0]
+	state[0] = delta_theta
+	return delta_theta
+}
+
+func (momentumSGD) String() string {
+	return "SGD"
+}
+
+// nesterovMomentum is the Nesterov accelerated gradient in the formulation
+// of [10], where the parameters are kept at their look-ahead values:
+//	v = mu * v + eta * g - lambda * theta
+//	delta_theta = mu * v + eta * g - lambda * theta
+type nesterovMomentum struct{}
+
+// NewNesterovMomentum returns the optimizer of Nesterov momentum.
+func NewNesterovMomentum() Optimizer {
+	return nesterovMomentum{}
+}
+
+func (nesterovMomentum) StateSize() int {
+	return 1
+}
+
+func (nesterovMomentum) Step(state []WeightT, theta, g, eta, mu, lambda WeightT) WeightT {
+	step := eta*g - lambda*theta
+	state[0] = mu*state[0] + step
+	return mu*state[0] + step
+}
+
+func (nesterovMomentum) String() string {
+	return "Nesterov"
+}
+
+// adaGrad scales the learning rate of every parameter by the root of the sum
+// of its squared gradients [11]:
+//	G = G + g^2
+//	delta_theta = eta * g / (sqrt(G) + epsilon) - lambda * theta
+type adaGrad struct {
+	epsilon WeightT
+}
+
+// NewAdaGrad returns the optimizer of AdaGrad with the given constant added
+// to the denominators.
+func NewAdaGrad(epsilon WeightT) Optimizer {
+	if epsilon <= 0 {
+		panic(fmt.Sprintf("Expected a positive epsilon but got %g.", epsilon))
+	}
+	return adaGrad{epsilon}
+}
+
+func (adaGrad) StateSize() int {
+	return 1
+}
+
+func (opt adaGrad) Step(state []WeightT, theta, g, eta, mu, lambda WeightT) WeightT {
+	state[0] += g * g
+	return eta*g/(WeightT(math.Sqrt(float64(state[0])))+opt.epsilon) - lambda*theta
+}
+
+func (opt adaGrad) String() string {
+	return fmt.Sprintf("AdaGrad(epsilon=%g)", opt.epsilon)
+}
+
+// rmsProp scales the learning rate of every parameter by the root of a
+// decaying mean of its squared gradients [12]:
+//	E = decay * E + (1 - decay) * g^2
+//	delta_theta = eta * g / (sqrt(E) + epsilon) - lambda * theta
+type rmsProp struct {
+	decay   WeightT
+	epsilon WeightT
+}
+
+// NewRMSProp returns the optimizer of RMSProp with the given decay of the
+// mean squared gradients and constant added to the denominators.
+func NewRMSProp(decay, epsilon WeightT) Optimizer {
+	if decay < 0 || decay >= 1 || epsilon <= 0 {
+		panic(fmt.Sprintf("Invalid RMSProp parameters: decay %g, epsilon %g.", decay, epsilon))
+	}
+	return rmsProp{decay, epsilon}
+}
+
+func (rmsProp) StateSize() int {
+	return 1
+}
+
+func (opt rmsProp) Step(state []WeightT, theta, g, eta, mu, lambda WeightT) WeightT {
+	state[0] = opt.decay*state[0] + (1-opt.decay)*g*g
+	return eta*g/(WeightT(math.Sqrt(float64(state[0])))+opt.epsilon) - lambda*theta
+}
+
+func (opt rmsProp) String() string {
+	return fmt.Sprintf("RMSProp(decay=%g, epsilon=%g)", opt.decay, opt.epsilon)
+}
+
+// adam keeps decaying means of the gradients and of the squared gradients of
+// every parameter, corrected for their initialization at 0 [13]:
+//	m = beta1 * m + (1 - beta1) * g
+//	v = beta2 * v + (1 - beta2) * g^2
+//	delta_theta = eta * m / (1 - beta1^t) / (sqrt(v / (1 - beta2^t)) + epsilon) - lambda * theta
+// t being the number of updates of the parameter, as the parameters of X
+// are only updated when they are active.
+type adam struct {
+	beta1   WeightT
+	beta2   WeightT
+	epsilon WeightT
+}
+
+// NewAdam returns the optimizer of Adam with the given decays of the mean
+// gradients and of the mean squared gradients, and constant added to the
+// denominators.
+func NewAdam(beta1, beta2, epsilon WeightT) Optimizer {
+	if beta1 < 0 || beta1 >= 1 || beta2 < 0 || beta2 >= 1 || epsilon <= 0 {
+		panic(fmt.Sprintf("Invalid Adam parameters: beta1 %g, beta2 %g, epsilon %g.", beta1, beta2, epsilon))
+	}
+	return adam{beta1, beta2, epsilon}
+}
+
+func (adam) StateSize() int {
+	return 3
+}
+
+func (opt adam) Step(state []WeightT, theta, g, eta, mu, lambda WeightT) WeightT {
+	state[0] = opt.beta1*state[0] + (1-opt.beta1)*g
+	state[1] = opt.beta2*state[1] + (1-opt.beta2)*g*g
+	state[2]++
+	m := state[0] / (1 - WeightT(math.Pow(float64(opt.beta1), float64(state[2]))))
+	v := state[1] / (1 - WeightT(math.Pow(float64(opt.beta2), float64(state[2]))))
+	return eta*m/(WeightT(math.Sqrt(float64(v)))+opt.epsilon) - lambda*theta
+}
+
+func (opt adam) String() string {
+	return fmt.Sprintf("Adam(beta1=%g, beta2=%g, epsilon=%g)", opt.beta1, opt.beta2, opt.epsilon)
+}
+
+// classStateT holds the optimizer state of the parameters of a visible
+// class that have been updated. The workers of parallel training update the
+// parameters of X without locking, but not their state, which is locked only
+// when there are several workers.
+type classStateT struct {
+	mutex sync.Mutex
+	w     map[int][]WeightT //state of W[c][j][k], keyed by j * |X_c| + k
+	b     map[int][]WeightT //state of the biases of X_c, keyed by their index
+	s     []WeightT         //state of the log of the standard deviation of a Gaussian class, nil until updated
+}
+
+// optimizerStateT holds the state of an optimizer for every parameter of a
+// model, StateSize() values each.
+type optimizerStateT struct {
+	size    int
+	classes []classStateT
+	c       []WeightT //state of the biases of h [hidden]
+	u       []WeightT //state of the interactions between y and h [hidden]
+	d       []WeightT //state of the bias of y
+	uk      []WeightT //state of the interactions between the label classes and h [label, hidden], multi-class models only
+	dk      []WeightT //state of the biases of the label classes [label], multi-class models only
+}
+
+// Method newOptimizerState creates the empty state of the given optimizer
+// for the parameters of the model.
+func (rbm *SparseClassRBM) newOptimizerState(optimizer Optimizer) *optimizerStateT {
+	size := optimizer.StateSize()
+	state := &optimizerStateT{size: size, classes: make([]classStateT, rbm.NumOfVisibleClasses()),
+		c: make([]WeightT, size*rbm.SizeOfHiddenLayer()), u: make([]WeightT, size*rbm.SizeOfHiddenLayer()),
+		d: make([]WeightT, size)}
+	if rbm.IsMultiClass() {
+		state.uk = make([]WeightT, size*rbm.NumOfLabels()*rbm.SizeOfHiddenLayer())
+		state.dk = make([]WeightT, size*rbm.NumOfLabels())
+	}
+	for c := range state.classes {
+		state.classes[c].w = make(map[int][]WeightT)
+		state.classes[c].b = make(map[int][]WeightT)
+	}
+	return state
+}
+
+// of returns the state of the parameter i of the given dense parameters.
+func (state *optimizerStateT) of(values []WeightT, i int) []WeightT {
+	return values[i*state.size : (i+1)*state.size]
+}
+
+// sparse returns the state of the parameter of the given key, creating it if
+// needed. The state of its class must be locked.
+func (state *optimizerStateT) sparse(values map[int][]WeightT, key int) []WeightT {
+	s, ok := values[key]
+	if !ok {
+		s = make([]WeightT, state.size)
+		values[key] = s
+	}
+	return s
+}
+
+// writeSparse writes the number of entries of the given sparse state, then
+// each entry in the order of the keys: its key and its values.
+func (mw *modelWriter) writeSparse(values map[int][]WeightT) {
+	keys := make([]int, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	mw.writeUint32(len(keys))
+	for _, key := range keys {
+		mw.writeUint32(key)
+		mw.writeWeights(values[key])
+	}
+}
+
+// readSparse reads the sparse state written by writeSparse, of keys below
+// max_key.
+func (mr *modelReader) readSparse(size, max_key int) map[int][]WeightT {
+	values := make(map[int][]WeightT)
+	n := mr.readDimension("number of optimizer states", 0)
+	for i := 0; i < n && mr.err == nil; i++ {
+		key := mr.readUint32()
+		if mr.err == nil && key >= max_key {
+			mr.err = fmt.Errorf("Invalid optimizer state key %d.", key)
+		}
+		values[key] = mr.readWeights(size)
+	}
+	return values
+}
+
+// writeOptimizerState writes the state: the dense states, then the sparse
+// states of every class and the state of its standard deviation, if any.
+func (mw *modelWriter) writeOptimizerState(state *optimizerStateT) {
+	for _, values := range [][]WeightT{state.c, state.u, state.d, state.uk, state.dk} {
+		mw.writeWeights(values)
+	}
+	for c := range state.classes {
+		class := &state.classes[c]
+		mw.writeSparse(class.w)
+		mw.writeSparse(class.b)
+		mw.writeUint32(len(class.s))
+		mw.writeWeights(class.s)
+	}
+}
+
+// readOptimizerState reads the state of the given optimizer for the model,
+// written by writeOptimizerState.
+func (mr *modelReader) readOptimizerState(rbm *SparseClassRBM, optimizer Optimizer) *optimizerStateT {
+	state := rbm.newOptimizerState(optimizer)
+	for _, values := range [][]WeightT{state.c, state.u, state.d, state.uk, state.dk} {
+		copy(values, mr.readWeights(len(values)))
+	}
+	for c := range state.classes {
+		class := &state.classes[c]
+		class.w = mr.readSparse(state.size, rbm.SizeOfHiddenLayer()*rbm.ClassSize(c))
+		class.b = mr.readSparse(state.size, rbm.ClassSize(c))
+		if n := mr.readUint32(); mr.err == nil && n != 0 && n != state.size {
+			mr.err = fmt.Errorf("Invalid optimizer state size %d of class %d.", n, c)
+		} else if n > 0 {
+			class.s = mr.readWeights(n)
+		}
+	}
+	return state
+}
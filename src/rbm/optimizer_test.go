@@ -0,0 +1,111 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_OptimizerStep(t *testing.T) {
+	const eta, mu, lambda, theta WeightT = 0.1, 0.5, 0.01, 2
+	gs := []WeightT{1, -2}
+	tests := []struct {
+		optimizer Optimizer
+		expected  []WeightT
+	}{
+		// eta * g - lambda * theta + mu * prev
+		{NewMomentumSGD(), []WeightT{0.08, -0.18}},
+		// v = mu * v + eta * g - lambda * theta, mu * v + eta * g - lambda * theta
+		{NewNesterovMomentum(), []WeightT{0.12, -0.31}},
+		// eta * g / sqrt(sum of g^2) - lambda * theta
+		{NewAdaGrad(1e-8), []WeightT{0.08, WeightT(-0.2/math.Sqrt(5)) - 0.02}},
+		// E = 0.5 * E + 0.5 * g^2
+		{NewRMSProp(0.5, 1e-8), []WeightT{WeightT(0.1/math.Sqrt(0.5)) - 0.02,
+			WeightT(-0.2/math.Sqrt(2.25)) - 0.02}},
+		// the first step of Adam is eta * sign(g)
+		{NewAdam(0.5, 0.5, 1e-8), []WeightT{0.08,
+			WeightT(-0.1/math.Sqrt(2.25/0.75)) - 0.02}},
+	}
+	for _, test := range tests {
+		state := make([]WeightT, test.optimizer.StateSize())
+		for i, g := range gs {
+			delta := test.optimizer.Step(state, theta, g, eta, mu, lambda)
+			if math.Abs(float64(delta-test.expected[i])) > 1e-6 {
+				t.Errorf("Expected step %d of %s to be %f but got %f.", i, test.optimizer, test.expected[i], delta)
+			}
+		}
+	}
+}
+
+func Test_OptimizerSparseState(t *testing.T) {
+	trainer := newBatchTestTrainer(getBatchTestData())
+	trainer.SetOptimizer(NewAdam(KDefaultAdamBeta1, KDefaultAdamBeta2, KDefaultOptimizerEpsilon))
+	delta := trainer.rbm.NewDeltaT()
+	delta.delta_w = []deltaWT{{0, 1, 1, 0.5}, {2, 1, 0, -0.5}, {0, 1, 1, 0.25}}
+	delta.delta_b = []deltaBT{{2, 2, 1}}
+	trainer.updateModel(delta)
+
+	state := trainer.optimizer_state
+	if len(state.classes[0].w) != 0 || len(state.classes[2].w) != 0 || len(state.classes[1].w) != 2 {
+		t.Errorf("Expected states of only the 2 updated interactions but got %v.", state.classes)
+	}
+	if s := state.classes[1].w[1]; s[2] != 2 {
+		t.Errorf("Expected interaction updated twice but got state %v.", s)
+	}
+	if len(state.classes[2].b) != 1 || len(state.classes[1].b) != 0 {
+		t.Errorf("Expected state of only the updated bias but got %v.", state.classes)
+	}
+	if len(state.c) != 3*trainer.rbm.SizeOfHiddenLayer() {
+		t.Errorf("Expected dense state of the hidden biases but got %v.", state.c)
+	}
+}
+
+func Test_CheckpointOptimizer(t *testing.T) {
+	train_file := "./optimizer_checkpoint.txt"
+	data := getBatchTestData()
+	saveDataToFile(train_file, data)
+	defer os.Remove(train_file)
+	newAdam := func() Optimizer {
+		return NewAdam(KDefaultAdamBeta1, KDefaultAdamBeta2, KDefaultOptimizerEpsilon)
+	}
+	var loaders []*SequentialDataLoader
+	defer func() {
+		for _, loader := range loaders {
+			loader.Close()
+		}
+	}()
+	newTrainer := func() *RBMTrainer {
+		loader := NewInstanceLoader(train_file, 3)
+		loaders = append(loaders, loader)
+		trainer := newBatchTestTrainer(data)
+		trainer.training_data_accessor = loader
+		return trainer
+	}
+	trainer := newTrainer()
+	trainer.SetOptimizer(newAdam())
+	trainer.Train()
+	var buf bytes.Buffer
+	if err := trainer.SaveCheckpoint(&buf); err != nil {
+		t.Fatalf("Failed to save checkpoint: %s.", err)
+	}
+
+	resumed := newTrainer()
+	resumed.SetOptimizer(newAdam())
+	if err := resumed.LoadCheckpoint(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to load checkpoint: %s.", err)
+	}
+	if !reflect.DeepEqual(resumed.optimizer_state, trainer.optimizer_state) {
+		t.Errorf("Expected optimizer state\n%v\nbut got\n%v.", trainer.optimizer_state, resumed.optimizer_state)
+	}
+
+	mismatched := newTrainer()
+	if err := mismatched.LoadCheckpoint(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Errorf("Expected loading a checkpoint of Adam with momentum SGD to fail.")
+	}
+}
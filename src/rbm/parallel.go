@@ -0,0 +1,168 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Hogwild-style parallel training.
+//
+// Reference:
+//  [2]. Niu, Recht, Re, Wright, 2011, HOGWILD!: A Lock-Free Approach to
+//  Parallelizing Stochastic Gradient Descent
+
+package rbm
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kNumLockStripes = 16 //number of locks striping the hidden units
+)
+
+// stripedLocks guards the dense parameters, which every update touches: the
+// parameters of hidden unit j are guarded by stripes[j % len(stripes)] and
+// those of y by label.
+type stripedLocks struct {
+	stripes []sync.Mutex
+	label   sync.Mutex
+}
+
+func newStripedLocks(n int) *stripedLocks {
+	return &stripedLocks{stripes: make([]sync.Mutex, n)}
+}
+
+// SetNumWorkers makes the trainer run the epochs with the given number of
+// workers in parallel, each computing the gradients of its own shard of the
+// training data, which must then implement ShardableDataInstanceAccessor.
+// Following [2], the workers update the sparse parameters of X without
+// locking, while those of the hidden units and of y are updated under striped
+// locks. Parallel training is not reproducible and takes no checkpoint within
+// an epoch; with one worker, the default, training runs in the calling
+// goroutine and is reproducible given the seed.
+func (trainer *RBMTrainer) SetNumWorkers(num_workers int) {
+	if num_workers < 1 {
+		panic("Number of workers must be greater than 0.")
+	}
+	trainer.num_workers = num_workers
+}
+
+// NumWorkers returns the number of parallel training workers.
+func (trainer *RBMTrainer) NumWorkers() int {
+	if trainer.num_workers < 1 {
+		return 1
+	}
+	return trainer.num_workers
+}
+
+// trainingShards splits the training data into one shard per worker, or
+// returns nil, falling back to a single worker, if it cannot be split or if
+// the generative terms are sampled with persistent chains.
+func (trainer *RBMTrainer) trainingShards() []DataInstanceAccessor {
+	param := &trainer.parameters
+	if trainer.isPersistent() && (param.gen_learn_importance > 0 || param.unsup_importance > 0) {
+		log.Printf("Persistent chains cannot be shared by parallel workers, training with one worker.")
+		return nil
+	}
+	accessor, ok := trainer.training_data_accessor.(ShardableDataInstanceAccessor)
+	if !ok {
+		log.Printf("Training data cannot be split into shards, training with one worker.")
+		return nil
+	}
+	shards, err := accessor.Shards(trainer.num_workers)
+	if err != nil {
+		log.Printf("Failed to split training data, training with one worker: %s", err)
+		return nil
+	}
+	return shards
+}
+
+// trainParallel trains the model with one worker per shard of the training
+// data, until the end of training.
+func (trainer *RBMTrainer) trainParallel(shards []DataInstanceAccessor) {
+	defer func() {
+		for _, shard := range shards {
+			shard.Close()
+		}
+	}()
+	trainer.locks = newStripedLocks(kNumLockStripes)
+	defer func() {
+		trainer.locks = nil
+	}()
+	reset := func() {
+		trainer.training_data_accessor.Reset()
+		for _, shard := range shards {
+			shard.Reset()
+		}
+	}
+	for trainer.max_epochs <= 0 || trainer.epoch < trainer.max_epochs {
+		epoch_start := time.Now()
+		epoch_instances := int64(0)
+		var wg sync.WaitGroup
+		for _, shard := range shards {
+			worker := trainer.newWorker(shard)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				worker.trainShard(&epoch_instances)
+			}()
+		}
+		wg.Wait()
+		trainer.instances += epoch_instances
+		if !trainer.endEpoch(epoch_instances, time.Since(epoch_start), reset) {
+			break
+		}
+	}
+}
+
+// newWorker returns a trainer sharing the model, the momentum and the locks
+// of trainer, which trains on the given shard with its own random number
+// generator.
+func (trainer *RBMTrainer) newWorker(shard DataInstanceAccessor) *RBMTrainer {
+	worker := *trainer
+	worker.training_data_accessor = shard
+	worker.validation_data_accessor = nil
+	worker.rng_source = newCountingSource(trainer.rng.Int63())
+	worker.rng = rand.New(worker.rng_source)
+	worker.checkpoint_file = ""
+	worker.checkpoint_interval = 0
+	return &worker
+}
+
+// trainShard runs one epoch over the shard of the worker, adding the number of
+// instances processed to instances.
+func (worker *RBMTrainer) trainShard(instances *int64) {
+	deltas := worker.rbm.newLabelDeltas()
+	batch := worker.rbm.newBatchDelta()
+	for {
+		labels := worker.doGradient(deltas)
+		if len(labels) == 0 {
+			break
+		}
+		worker.addInstance(batch, deltas, labels)
+		atomic.AddInt64(instances, 1)
+		if batch.instances >= worker.BatchSize() {
+			worker.applyBatch(batch)
+		}
+	}
+	worker.applyBatch(batch)
+}
+
+// updateModelStriped applies the deltas like updateModel, locking the stripes
+// of the hidden units and the parameters of y while updating them.
+func (trainer *RBMTrainer) updateModelStriped(delta *deltaT) {
+	locks := trainer.locks
+	trainer.updateVisible(delta)
+	for s := range locks.stripes {
+		locks.stripes[s].Lock()
+		for j := s; j < len(delta.delta_c); j += len(locks.stripes) {
+			trainer.updateHiddenUnit(delta, j)
+		}
+		locks.stripes[s].Unlock()
+	}
+	locks.label.Lock()
+	trainer.updateLabelBiases(delta)
+	locks.label.Unlock()
+}
@@ -0,0 +1,96 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_updateModelStriped(t *testing.T) {
+	newTrainer := func() *RBMTrainer {
+		rbm := getSampleMultiClassRBM()
+		trainer := new(RBMTrainer)
+		trainer.Initialize(rbm, nil, nil, 0.1, 0.01, 0.5, 0.5, 1)
+		return trainer
+	}
+	sequential, striped := newTrainer(), newTrainer()
+	striped.locks = newStripedLocks(3)
+
+	delta := sequential.rbm.NewDeltaT()
+	delta.delta_w = []deltaWT{{0, 1, 1, 0.5}, {3, 2, 0, -0.25}}
+	for j := range delta.delta_c {
+		delta.delta_c[j] = WeightT(j) * 0.1
+		delta.delta_u[j] = -WeightT(j) * 0.2
+		for k := range delta.delta_uk {
+			delta.delta_uk[k][j] = WeightT(k-j) * 0.3
+		}
+	}
+	for k := range delta.delta_dk {
+		delta.delta_dk[k] = WeightT(k) * 0.4
+	}
+	for i := 0; i < 2; i++ {
+		sequential.updateModel(delta)
+		striped.updateModel(delta)
+	}
+	if !reflect.DeepEqual(sequential.rbm, striped.rbm) || !reflect.DeepEqual(sequential.optimizer_state, striped.optimizer_state) {
+		t.Errorf("Expected striped update\n%v\nto be equal to\n%v.", striped.rbm, sequential.rbm)
+	}
+}
+
+func Test_TrainParallel(t *testing.T) {
+	train_file := "./parallel_training.txt"
+	class_sizes := []int{2, 3, 4}
+	var train_data []DataInstance
+	for i := 0; i < 200; i++ {
+		instance := DataInstance{x: []int{i % 2, i % 3, i % 4}}
+		if i%2 == 0 {
+			instance.pos_y = 1
+		} else {
+			instance.neg_y = 1
+		}
+		train_data = append(train_data, instance)
+	}
+	if err := saveDataToFile(train_file, train_data); err != nil {
+		t.Fatalf("Failed to create training data: %s.", err)
+	}
+	defer os.Remove(train_file)
+
+	train_loader := NewInstanceLoader(train_file, len(class_sizes))
+	defer train_loader.Close()
+	validation_loader := NewInstanceLoader(train_file, len(class_sizes))
+	defer validation_loader.Close()
+	var rbm SparseClassRBM
+	rbm.Initialize(class_sizes, [][]WeightT{{0, 0}, {0, 0, 0}, {0, 0, 0, 0}}, 8, 0)
+	var trainer RBMTrainer
+	trainer.Initialize(&rbm, train_loader, validation_loader, 0.5, 0, 0.5, 0.1, 1)
+	trainer.SetSeed(1)
+	trainer.SetMaxEpochs(5)
+	trainer.SetBatchSize(4)
+	trainer.SetNumWorkers(4)
+	trainer.Train()
+
+	if trainer.epoch != 5 || trainer.instances != 5*int64(len(train_data)) {
+		t.Errorf("Expected 5 epochs of %d instances but got %d epochs of %d instances.", len(train_data),
+			trainer.epoch, trainer.instances)
+	}
+	if trainer.locks != nil {
+		t.Errorf("Expected the locks to be released after training.")
+	}
+	for c := range rbm.w {
+		for j := range rbm.w[c] {
+			for _, w := range rbm.w[c][j] {
+				if math.IsNaN(float64(w)) || math.IsInf(float64(w), 0) {
+					t.Fatalf("Expected finite weights but got %v.", rbm.w)
+				}
+			}
+		}
+	}
+	if auc := ROCAuc(&rbm, validation_loader); auc < 0.9 {
+		t.Errorf("Expected the parallel trainer to separate the labels but got AUC %f.", auc)
+	}
+}
@@ -4,67 +4,169 @@
 
 package rbm
 
+import (
+	"math"
+)
+
+const (
+	KMinSigma = 1e-3 //lower bound of the learned standard deviations of Gaussian classes
+)
+
+// SetOptimizer makes the trainer compute the changes of the parameters with
+// the given optimizer, momentum SGD by default, discarding the state of the
+// previous one.
+func (trainer *RBMTrainer) SetOptimizer(optimizer Optimizer) {
+	trainer.optimizer = optimizer
+	trainer.optimizer_state = trainer.rbm.newOptimizerState(optimizer)
+}
+
+// Optimizer returns the optimizer of the trainer.
+func (trainer *RBMTrainer) Optimizer() Optimizer {
+	return trainer.optimizer
+}
+
+// step returns the change of a parameter of value theta whose gradient is g,
+// given its optimizer state and its regularization lambda, with the
+// learning rate and the momentum of the current update.
+func (trainer *RBMTrainer) step(state []WeightT, theta, g, lambda WeightT) WeightT {
+	return trainer.optimizer.Step(state, theta, g, trainer.learning_rate, trainer.momentum_rate, lambda)
+}
+
+// updateModel applies the deltas to the model, with the optimizer, the
+// learning rate, the regularization and the momentum of the trainer. With
+// several workers, the parameters of the hidden units and of y are updated
+// under striped locks.
 func (trainer *RBMTrainer) updateModel(delta *deltaT) {
+	if trainer.locks != nil {
+		trainer.updateModelStriped(delta)
+		return
+	}
+	trainer.updateVisible(delta)
+	for j := range delta.delta_c {
+		trainer.updateHiddenUnit(delta, j)
+	}
+	trainer.updateLabelBiases(delta)
+}
+
+// updateVisible applies the sparse deltas of the parameters of X.
+func (trainer *RBMTrainer) updateVisible(delta *deltaT) {
 	rbm := trainer.rbm
-	prev_delta := trainer.prev_delta
-	eta := trainer.parameters.learning_rate
+	state := trainer.optimizer_state
 	lambda := trainer.parameters.regularization_rate
-	mu := trainer.parameters.momentum_rate
 
 	//Update interaction matrix of X and H
 	for _, d := range delta.delta_w {
-		prev_delta_theta := prev_delta.W(d.h_index, d.c_index, d.c_value)
+		class := &state.classes[d.c_index]
+		trainer.lockClass(class)
+		s := state.sparse(class.w, d.h_index*rbm.ClassSize(d.c_index)+d.c_value)
 
 		cur_theta := rbm.W(d.h_index, d.c_index, d.c_value)
-		delta_theta := eta*d.delta_v - lambda*cur_theta + mu*prev_delta_theta
+		delta_theta := trainer.step(s, cur_theta, d.delta_v, lambda)
+		trainer.unlockClass(class)
 		rbm.SetW(d.h_index, d.c_index, d.c_value, cur_theta+delta_theta)
-
-		prev_delta.SetW(d.h_index, d.c_index, d.c_value, delta_theta)
 	}
 
 	//Update interaction bias of X
 	for _, d := range delta.delta_b {
-		prev_delta_theta := prev_delta.B(d.c_index, d.c_value)
+		class := &state.classes[d.c_index]
+		trainer.lockClass(class)
+		s := state.sparse(class.b, rbm.biasIndex(d.c_value))
 
 		cur_theta := rbm.B(d.c_index, d.c_value)
-		delta_theta := eta*d.delta_v - lambda*cur_theta + mu*prev_delta_theta
+		delta_theta := trainer.step(s, cur_theta, d.delta_v, lambda)
+		trainer.unlockClass(class)
 		rbm.SetB(d.c_index, d.c_value, cur_theta+delta_theta)
+	}
 
-		prev_delta.SetB(d.c_index, d.c_value, delta_theta)
+	//Update standard deviations of Gaussian classes, on the log scale so
+	//that they stay positive, without regularization.
+	for _, d := range delta.delta_s {
+		class := &state.classes[d.c_index]
+		trainer.lockClass(class)
+		if class.s == nil {
+			class.s = make([]WeightT, state.size)
+		}
+
+		log_sigma := WeightT(math.Log(float64(rbm.Sigma(d.c_index))))
+		delta_theta := trainer.step(class.s, log_sigma, d.delta_v, 0)
+		trainer.unlockClass(class)
+		sigma := rbm.Sigma(d.c_index) * Exp(delta_theta)
+		if sigma < KMinSigma {
+			sigma = KMinSigma
+		}
+		rbm.SetSigma(d.c_index, sigma)
 	}
+}
 
-	//Update bias of H
-	for j, delta_v := range delta.delta_c {
-		prev_delta_theta := prev_delta.C(j)
+// lockClass locks the optimizer state of a visible class, if it is shared by
+// the workers of parallel training.
+func (trainer *RBMTrainer) lockClass(class *classStateT) {
+	if trainer.locks != nil {
+		class.mutex.Lock()
+	}
+}
 
+// unlockClass unlocks the optimizer state of a visible class locked by
+// lockClass.
+func (trainer *RBMTrainer) unlockClass(class *classStateT) {
+	if trainer.locks != nil {
+		class.mutex.Unlock()
+	}
+}
+
+// updateHiddenUnit applies the deltas of the bias of hidden unit j and of its
+// interactions with y.
+func (trainer *RBMTrainer) updateHiddenUnit(delta *deltaT, j int) {
+	rbm := trainer.rbm
+	state := trainer.optimizer_state
+	lambda := trainer.parameters.regularization_rate
+
+	//Update bias of H, without regularization
+	{
 		cur_theta := rbm.C(j)
-		//delta_theta := eta*delta_v - lambda*cur_theta + mu*prev_delta_theta
-		delta_theta := eta*delta_v + mu*prev_delta_theta
+		delta_theta := trainer.step(state.of(state.c, j), cur_theta, delta.delta_c[j], 0)
 		rbm.SetC(j, cur_theta+delta_theta)
-
-		prev_delta.SetC(j, delta_theta)
 	}
 
 	//Update interactions between Y and H
-	for j, delta_v := range delta.delta_u {
-		prev_delta_theta := prev_delta.U(j)
-
+	{
 		cur_theta := rbm.U(j)
-		delta_theta := eta*delta_v - lambda*cur_theta + mu*prev_delta_theta
+		delta_theta := trainer.step(state.of(state.u, j), cur_theta, delta.delta_u[j], lambda)
 		rbm.SetU(j, cur_theta+delta_theta)
+	}
+	if !rbm.IsMultiClass() {
+		return
+	}
 
-		prev_delta.SetU(j, delta_theta)
+	//Update interactions between label classes and H
+	for k := range delta.delta_uk {
+		cur_theta := rbm.UK(k, j)
+		delta_theta := trainer.step(state.of(state.uk, k*rbm.SizeOfHiddenLayer()+j), cur_theta,
+			delta.delta_uk[k][j], lambda)
+		rbm.SetUK(k, j, cur_theta+delta_theta)
 	}
+}
+
+// updateLabelBiases applies the deltas of the biases of y, without
+// regularization.
+func (trainer *RBMTrainer) updateLabelBiases(delta *deltaT) {
+	rbm := trainer.rbm
+	state := trainer.optimizer_state
 
 	//Update bias of Y
 	{
-		prev_delta_theta := prev_delta.D()
-
 		cur_theta := rbm.D()
-		//delta_theta := eta*delta.delta_d - lambda*cur_theta + mu*prev_delta_theta
-		delta_theta := eta*delta.delta_d + mu*prev_delta_theta
+		delta_theta := trainer.step(state.d, cur_theta, delta.delta_d, 0)
 		rbm.SetD(cur_theta + delta_theta)
+	}
+	if !rbm.IsMultiClass() {
+		return
+	}
 
-		prev_delta.SetD(delta_theta)
+	//Update biases of label classes
+	for k, delta_v := range delta.delta_dk {
+		cur_theta := rbm.DK(k)
+		delta_theta := trainer.step(state.of(state.dk, k), cur_theta, delta_v, 0)
+		rbm.SetDK(k, cur_theta+delta_theta)
 	}
 }
@@ -4,8 +4,29 @@
 
 package rbm
 
-// Calculate P(y = 1|X)
+// Calculate P(y = 1|X), for multi-class models the probability of label
+// class 1 and for regression models the expected target.
 // Note instance.y is ignored in the calcuation.
 func (rbm *SparseClassRBM) GetPrediction(instance *DataInstance) WeightT {
-	return rbm.probOfYGivenX(instance.x)
+	if rbm.IsRegression() {
+		return rbm.GetRegression(instance)
+	}
+	if rbm.IsMultiClass() {
+		return rbm.probDistOfYGivenInstance(instance)[1]
+	}
+	return rbm.probOfYGivenInstance(instance)
+}
+
+// Calculate the posterior P(y = k|X) of every label class k, which is
+// [P(y = 0|X), P(y = 1|X)] for binary models.
+// Note the labels of the instance are ignored in the calcuation.
+func (rbm *SparseClassRBM) GetPosterior(instance *DataInstance) []WeightT {
+	return rbm.probDistOfYGivenInstance(instance)
+}
+
+// Calculate the expected target E[y|X] of a regression model, in the scale of
+// the targets of the training data.
+// Note instance.target is ignored in the calcuation.
+func (rbm *SparseClassRBM) GetRegression(instance *DataInstance) WeightT {
+	return rbm.denormalizeTarget(rbm.expectedTargetGivenInstance(instance))
 }
@@ -6,61 +6,476 @@
 
 package rbm
 
+import (
+	"math"
+)
+
 // Method probDistOfHGivenXY calculates the probability distribution of
-// p(h = [1]| X, Y) and store the result in h.
+// p(h = [1]| X, Y) and store the result in h, X being the values of the
+// single-valued classes.
 func (rbm *SparseClassRBM) probDistOfHGivenXY(h []WeightT, x []int, y int) {
+	rbm.probDistOfHGivenInstance(h, &DataInstance{x: x}, y)
+}
+
+// Method probDistOfHGivenInstance calculates the probability distribution of
+// p(h = [1]| X, Y) and store the result in h, X being the visible
+// configuration of the given instance.
+func (rbm *SparseClassRBM) probDistOfHGivenInstance(h []WeightT, v *DataInstance, y int) {
 	for j := range h {
-		h[j] = rbm.probOfHGivenXY(j, x, y)
+		h[j] = rbm.probOfHGivenInstance(j, v, y)
 	}
 }
 
-// Method probOfHGivenXY calculates the probability of P(h_j = 1 | X, Y) using
+// Method probOfHGivenInstance calculates the probability of P(h_j = 1 | X, Y) using
 // 	P(h_j = 1 | X, Y) = sigmoid(sum{0<=c<=C}(W[c][j][X_c]) + c[j] + U_j . Y)
-func (rbm *SparseClassRBM) probOfHGivenXY(j int, x []int, y int) WeightT {
-	s := rbm.C(j) + WeightT(y)*rbm.U(j) + rbm.wHDotX(j, x)
+func (rbm *SparseClassRBM) probOfHGivenInstance(j int, v *DataInstance, y int) WeightT {
+	s := rbm.C(j) + rbm.uDotY(j, y) + rbm.wHDotInstance(j, v)
 	return Sigmoid(s)
 }
 
+// Method uDotY returns the contribution U_j . Y of label y to the input of
+// hidden unit j, Y being the one-hot coding of y for multi-class models.
+func (rbm *SparseClassRBM) uDotY(j int, y int) WeightT {
+	if rbm.IsMultiClass() {
+		return rbm.UK(y, j)
+	}
+	return WeightT(y) * rbm.U(j)
+}
+
 // Method probOfXInClassCGivenH calculates the probability of P(X_c | h).
-//	E(X_c = k, H) = exp(sum{0 <= j <= |H}(W[c][j][k] * H[j]))
+//	E(X_c = k, H) = exp(b[c][k] + sum{0 <= j <= |H}(W[c][j][k] * H[j]))
 //	P(X_c = k | H) = E(X_c = k, H) / ( sum{0 <= q < |X_c|}(E(X_c = q, H) )
 func (rbm *SparseClassRBM) probOfXInClassCGivenH(c int, h []WeightT) []WeightT {
+	return rbm.probOfXInClassCGivenHScaled(c, h, 1)
+}
+
+// Method meanOfXInClassCGivenH calculates the mean of the Gaussian class c
+// given h.
+//	P(X_c | H) = N(b[c] + sigma_c * sum{0 <= j < |H|}(W[c][j][0] * H[j]), sigma_c^2)
+func (rbm *SparseClassRBM) meanOfXInClassCGivenH(c int, h []WeightT) WeightT {
+	s := WeightT(0)
+	for j := 0; j < rbm.h_num; j++ {
+		s += rbm.W(j, c, 0) * h[j]
+	}
+	return rbm.B(c, 0) + rbm.Sigma(c)*s
+}
+
+// Method probOfXInClassCGivenHScaled calculates the probability P(X_c | h) of
+// a single value of a class whose bias and interactions with h are scaled by
+// scale, as is the case for the values of a normalized multi-valued class.
+func (rbm *SparseClassRBM) probOfXInClassCGivenHScaled(c int, h []WeightT, scale WeightT) []WeightT {
 	p := make([]WeightT, rbm.x_class_sizes[c])
-	var denominator WeightT
 	for k := 0; k < rbm.ClassSize(c); k++ {
-		s := WeightT(0.0)
+		s := rbm.B(c, k)
 		for j := 0; j < rbm.h_num; j++ {
 			s += rbm.W(j, c, k) * h[j]
 		}
-		p[k] = Exp(s)
-		denominator += p[k]
-	}
-	for k := 0; k < rbm.ClassSize(c); k++ {
-		p[k] /= denominator
+		p[k] = scale * s
 	}
+	SoftMax(p)
 	return p
 }
 
-// Method probOfYGivenX calculates the probability of P(Y=1 | X).
+// Method probOfYGivenX calculates the probability of P(Y=1 | X), X being the
+// values of the single-valued classes.
+func (rbm *SparseClassRBM) probOfYGivenX(x []int) WeightT {
+	return rbm.probOfYGivenInstance(&DataInstance{x: x})
+}
+
+// Method probOfYGivenInstance calculates the probability of P(Y=1 | X).
 //	P(Y=1|X) = exp{d + sum{0<=j<|H|}(sotfplus( w[j].X + c[j] + u[j] )) } /
 //		( exp{ d + sum{0<=j<|H|}(sotfplus( w[j].X + c[j] + u[j] )) } +
 //			 exp{ sum{0<=j<|H|}(sotfplus( w[j].X + c[j] )) } )
-func (rbm *SparseClassRBM) probOfYGivenX(x []int) WeightT {
-	neg := WeightT(0)
-	pos := WeightT(0)
-	for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
-		w_dot_x_add_c := rbm.wHDotX(j, x) + rbm.C(j)
-		neg += SoftPlus(w_dot_x_add_c)
-		pos += SoftPlus(w_dot_x_add_c + rbm.U(j))
+func (rbm *SparseClassRBM) probOfYGivenInstance(v *DataInstance) WeightT {
+	return rbm.probDistOfYGivenInstance(v)[1]
+}
+
+// Method probDistOfYGivenInstance calculates the posterior P(Y=k | X) of every
+// label class k, i.e. [P(Y=0|X), P(Y=1|X)] for binary models.
+//	P(Y=k|X) = exp{d_k + sum{0<=j<|H|}(sotfplus( w[j].X + c[j] + u_k[j] )) } /
+//		sum{0<=q<K}( exp{d_q + sum{0<=j<|H|}(sotfplus( w[j].X + c[j] + u_q[j] )) } )
+// Missing classes that the model marginalizes are summed out, weighting every
+// completion of X by exp{sum{c missing}(b[c][X_c])}.
+func (rbm *SparseClassRBM) probDistOfYGivenInstance(v *DataInstance) []WeightT {
+	completions, log_priors := rbm.missingCompletions(v)
+	if len(completions) == 1 {
+		p := rbm.labelLogits(v)
+		SoftMax(p)
+		return p
+	}
+	var logits []WeightT
+	for i, completion := range completions {
+		for _, l := range rbm.labelLogits(completion) {
+			logits = append(logits, log_priors[i]+l)
+		}
 	}
-	return Exp(rbm.D()+pos) / (Exp(rbm.D()+pos) + Exp(neg))
+	SoftMax(logits)
+	num_labels := len(logits) / len(completions)
+	p := make([]WeightT, num_labels)
+	for i, p_i := range logits {
+		p[i%num_labels] += p_i
+	}
+	return p
 }
 
-// Method wClassCDotX calculates the dot product of W[j] . X
-func (rbm *SparseClassRBM) wHDotX(j int, x []int) WeightT {
+// Method labelLogits calculates log P(Y=k, X) of every label class k up to a
+// constant, i.e.
+//	d_k + sum{0<=j<|H|}(sotfplus( w[j].X + c[j] + u_k[j] ))
+// where d_0 = 0 and u_0 = 0 for binary models.
+func (rbm *SparseClassRBM) labelLogits(v *DataInstance) []WeightT {
+	w_dot_x_add_c := rbm.wDotXAddC(v)
+	if !rbm.IsMultiClass() {
+		neg := WeightT(0)
+		pos := rbm.D()
+		for j, a := range w_dot_x_add_c {
+			neg += SoftPlus(a)
+			pos += SoftPlus(a + rbm.U(j))
+		}
+		return []WeightT{neg, pos}
+	}
+	p := make([]WeightT, rbm.y_class_num)
+	for k := range p {
+		p[k] = rbm.DK(k)
+		for j, a := range w_dot_x_add_c {
+			p[k] += SoftPlus(a + rbm.UK(k, j))
+		}
+	}
+	return p
+}
+
+// Method missingCompletions returns the completions of v in which the missing
+// single-valued classes take every combination of values, along with the log
+// prior weight sum{c missing}(b[c][X_c]) of each. Unless the model
+// marginalizes missing classes, v itself is the only completion. Classes that
+// would bring the number of completions beyond kMaxMissingCompletions take
+// their most probable value under b instead.
+func (rbm *SparseClassRBM) missingCompletions(v *DataInstance) ([]*DataInstance, []WeightT) {
+	completions := []*DataInstance{v}
+	log_priors := []WeightT{0}
+	if rbm.x_missing != KMarginalizeMissing {
+		return completions, log_priors
+	}
+	for c := 0; c < rbm.x_class_num; c++ {
+		if !v.isMissing(c) || rbm.isGaussian(c) || rbm.isMultiValued(c) {
+			continue
+		}
+		values := make([]int, rbm.ClassSize(c))
+		for k := range values {
+			values[k] = k
+		}
+		if len(completions)*len(values) > kMaxMissingCompletions {
+			best := 0
+			for k := range values {
+				if rbm.B(c, k) > rbm.B(c, best) {
+					best = k
+				}
+			}
+			values = values[best : best+1]
+		}
+		expanded := make([]*DataInstance, 0, len(completions)*len(values))
+		expanded_priors := make([]WeightT, 0, len(completions)*len(values))
+		for i, completion := range completions {
+			for _, k := range values {
+				e := completion.clone()
+				e.x[c] = k
+				expanded = append(expanded, e)
+				expanded_priors = append(expanded_priors, log_priors[i]+rbm.B(c, k))
+			}
+		}
+		completions, log_priors = expanded, expanded_priors
+	}
+	return completions, log_priors
+}
+
+// Method probDistOfYGivenH calculates P(Y=k | h) of every label class k.
+func (rbm *SparseClassRBM) probDistOfYGivenH(h []WeightT) []WeightT {
+	if !rbm.IsMultiClass() {
+		p := Sigmoid(rbm.D() + DotProduct(rbm.UVector(), h))
+		return []WeightT{1 - p, p}
+	}
+	p := make([]WeightT, rbm.y_class_num)
+	for k := range p {
+		p[k] = rbm.DK(k) + DotProduct(rbm.uk[k], h)
+	}
+	SoftMax(p)
+	return p
+}
+
+// Method wHDotInstance calculates the dot product of W[j] . X, where each
+// multi-valued class contributes the (optionally normalized) sum of
+// W[c][j][k] over its values k, and each Gaussian class contributes
+// W[c][j][0] * X_c / sigma_c. Missing classes contribute nothing, unless the
+// model treats them as value 0.
+func (rbm *SparseClassRBM) wHDotInstance(j int, v *DataInstance) WeightT {
 	p := WeightT(0)
 	for c := 0; c < rbm.x_class_num; c++ {
-		p += rbm.W(j, c, x[c])
+		if v.isMissing(c) {
+			if rbm.x_missing == KMissingAsZero && !rbm.isGaussian(c) && !rbm.isMultiValued(c) {
+				p += rbm.W(j, c, 0)
+			}
+			continue
+		}
+		if rbm.isGaussian(c) {
+			p += rbm.W(j, c, 0) * v.realValue(c) / rbm.Sigma(c)
+			continue
+		}
+		if !rbm.isMultiValued(c) {
+			p += rbm.W(j, c, v.x[c])
+			continue
+		}
+		bag := v.bag(c)
+		s := WeightT(0)
+		for _, k := range bag {
+			s += rbm.W(j, c, k)
+		}
+		p += rbm.bagScale(c, len(bag)) * s
+	}
+	return p
+}
+
+// Method wDotXAddC returns W[j] . X + c[j] for every hidden unit j.
+func (rbm *SparseClassRBM) wDotXAddC(v *DataInstance) []WeightT {
+	w_dot_x_add_c := make([]WeightT, rbm.SizeOfHiddenLayer())
+	for j := range w_dot_x_add_c {
+		w_dot_x_add_c[j] = rbm.wHDotInstance(j, v) + rbm.C(j)
+	}
+	return w_dot_x_add_c
+}
+
+const (
+	kMaxMissingCompletions = 1024 //maximum number of completions of the missing classes of an instance
+	kTargetGridStep        = 0.05 //spacing of the grid for integrating over a real valued y
+	kTargetGridMargin      = 8.0  //distance between the grid ends and the modes of P(y|X)
+)
+
+// Method targetGrid returns equally spaced values of the (normalized) real
+// valued y covering the mass of P(y|X) for any X. Since
+//	d log P(y|X) / dy = d - y + sum{0<=j<|H|}(u[j] * sigmoid(w[j].X + c[j] + u[j] * y))
+// all the modes of P(y|X) lie within [d + sum(min(u[j], 0)), d + sum(max(u[j], 0))],
+// outside of which the density decays at least as fast as a unit variance
+// Gaussian. The grid points are multiples of kTargetGridStep so that the grid
+// is the same for all the instances.
+func (rbm *SparseClassRBM) targetGrid() []WeightT {
+	lo, hi := rbm.D(), rbm.D()
+	for _, u := range rbm.u {
+		if u < 0 {
+			lo += u
+		} else {
+			hi += u
+		}
+	}
+	first := math.Floor(float64(lo-kTargetGridMargin) / kTargetGridStep)
+	last := math.Ceil(float64(hi+kTargetGridMargin) / kTargetGridStep)
+	grid := make([]WeightT, int(last-first)+1)
+	for i := range grid {
+		grid[i] = WeightT((first + float64(i)) * kTargetGridStep)
+	}
+	return grid
+}
+
+// Method logUnnormalizedProbOfTarget calculates log P(y|X) up to the
+// normalization constant of X, w_dot_x_add_c being W[j] . X + c[j].
+//	log P(y|X) = d * y - y^2 / 2 + sum{0<=j<|H|}(sotfplus( w[j].X + c[j] + u[j] * y )) - log Z(X)
+func (rbm *SparseClassRBM) logUnnormalizedProbOfTarget(w_dot_x_add_c []WeightT, y WeightT) WeightT {
+	s := rbm.D()*y - y*y/2
+	for j, a := range w_dot_x_add_c {
+		s += SoftPlus(a + rbm.U(j)*y)
+	}
+	return s
+}
+
+// Method probDistOfTargetOnGrid calculates the probability of each point of
+// the grid under P(y|X), i.e. the weights for integrating over y.
+func (rbm *SparseClassRBM) probDistOfTargetOnGrid(w_dot_x_add_c []WeightT, grid []WeightT) []WeightT {
+	p := make([]WeightT, len(grid))
+	for i, y := range grid {
+		p[i] = rbm.logUnnormalizedProbOfTarget(w_dot_x_add_c, y)
 	}
+	SoftMax(p)
 	return p
 }
+
+// Method expectedTargetGivenInstance calculates E[y|X] of the normalized
+// real valued y, summing out the missing classes that the model marginalizes.
+func (rbm *SparseClassRBM) expectedTargetGivenInstance(v *DataInstance) WeightT {
+	grid := rbm.targetGrid()
+	completions, log_priors := rbm.missingCompletions(v)
+	expectations := make([]WeightT, len(completions))
+	for i, completion := range completions {
+		w_dot_x_add_c := rbm.wDotXAddC(completion)
+		log_p := make([]WeightT, len(grid))
+		for q, y := range grid {
+			log_p[q] = rbm.logUnnormalizedProbOfTarget(w_dot_x_add_c, y)
+		}
+		// the weight of a completion is its prior times the normalization constant
+		log_priors[i] += LogSumExp(log_p)
+		SoftMax(log_p)
+		expectations[i] = DotProduct(log_p, grid)
+	}
+	SoftMax(log_priors)
+	return DotProduct(log_priors, expectations)
+}
+
+// Method logProbOfTargetGivenInstance calculates the log density log P(y|X)
+// of the normalized real valued y.
+func (rbm *SparseClassRBM) logProbOfTargetGivenInstance(v *DataInstance, y WeightT) WeightT {
+	w_dot_x_add_c := rbm.wDotXAddC(v)
+	grid := rbm.targetGrid()
+	log_p := make([]WeightT, len(grid))
+	for i, y_i := range grid {
+		log_p[i] = rbm.logUnnormalizedProbOfTarget(w_dot_x_add_c, y_i)
+	}
+	log_z := LogSumExp(log_p) + WeightT(math.Log(kTargetGridStep))
+	return rbm.logUnnormalizedProbOfTarget(w_dot_x_add_c, y) - log_z
+}
+
+// Method probDistOfHGivenTarget calculates the probability distribution of
+// p(h = [1]| X, y) for a real valued y.
+func (rbm *SparseClassRBM) probDistOfHGivenTarget(h []WeightT, v *DataInstance, y WeightT) {
+	for j := range h {
+		h[j] = Sigmoid(rbm.C(j) + rbm.U(j)*y + rbm.wHDotInstance(j, v))
+	}
+}
+
+// Method samplingEnergy calculates the energy E(X, y, h) of the distribution
+// the Gibbs steps sample from (see sampleXGivenH):
+//	E(X, y, h) = -h . (W . X + c + U . Y) - b . X - d . Y
+// b . X being as in visibleBiasTerm, with the additional term y^2 / 2 for a
+// real valued y, target being y for regression models and ignored otherwise.
+func (rbm *SparseClassRBM) samplingEnergy(v *DataInstance, y int, target WeightT, h []WeightT) WeightT {
+	e := WeightT(0)
+	for j, h_j := range h {
+		if h_j == 0 {
+			continue
+		}
+		a := rbm.C(j) + rbm.wHDotInstance(j, v)
+		if rbm.IsRegression() {
+			a += rbm.U(j) * target
+		} else {
+			a += rbm.uDotY(j, y)
+		}
+		e -= h_j * a
+	}
+	switch {
+	case rbm.IsRegression():
+		e += target*target/2 - rbm.D()*target
+	case rbm.IsMultiClass():
+		e -= rbm.DK(y)
+	default:
+		e -= rbm.D() * WeightT(y)
+	}
+	return e - rbm.visibleBiasTerm(v)
+}
+
+// Method FreeEnergy calculates the free energy F(X, y) = -log sum{h}(exp{-E(X, y, h)})
+// of the instance v with label class y,
+//	F(X, y) = -b . X - d . Y - sum{0<=j<|H|}(sotfplus( w[j].X + c[j] + U_j . Y ))
+// so that P(X, y) = exp{-F(X, y)} / Z. For regression models, y is ignored
+// and the normalized target of v is used instead. Missing classes that the
+// model marginalizes are summed out.
+func (rbm *SparseClassRBM) FreeEnergy(v *DataInstance, y int) WeightT {
+	if rbm.IsRegression() {
+		return -rbm.logMarginalUnnormalizedProb(v, 0, rbm.normalizeTarget(v.target))
+	}
+	return -rbm.logMarginalUnnormalizedProb(v, y, 0)
+}
+
+// Method FreeEnergyX calculates the free energy F(X) = -log sum{y}(exp{-F(X, y)})
+// of the instance v, y being summed out, or integrated out numerically for
+// regression models, so that P(X) = exp{-F(X)} / Z.
+func (rbm *SparseClassRBM) FreeEnergyX(v *DataInstance) WeightT {
+	if !rbm.IsRegression() {
+		num_labels := 2
+		if rbm.IsMultiClass() {
+			num_labels = rbm.NumOfLabels()
+		}
+		log_p := make([]WeightT, num_labels)
+		for y := range log_p {
+			log_p[y] = rbm.logMarginalUnnormalizedProb(v, y, 0)
+		}
+		return -LogSumExp(log_p)
+	}
+	grid := rbm.targetGrid()
+	completions, _ := rbm.missingCompletions(v)
+	log_p := make([]WeightT, len(completions))
+	for i, completion := range completions {
+		w_dot_x_add_c := rbm.wDotXAddC(completion)
+		log_p_y := make([]WeightT, len(grid))
+		for q, y := range grid {
+			log_p_y[q] = rbm.logUnnormalizedProbOfTarget(w_dot_x_add_c, y)
+		}
+		log_p[i] = rbm.visibleBiasTerm(completion) + LogSumExp(log_p_y) + WeightT(math.Log(kTargetGridStep))
+	}
+	return -LogSumExp(log_p)
+}
+
+// Method logUnnormalizedProb calculates log P(X, y) + log Z, i.e. minus the
+// free energy of the particle p without summing out missing classes,
+//	b . X + d . Y + sum{0<=j<|H|}(softplus(w[j].X + c[j] + U_j . Y))
+// where a real valued y contributes d * y - y^2 / 2.
+func (rbm *SparseClassRBM) logUnnormalizedProb(p *particleT) WeightT {
+	return rbm.logUnnormalizedProbAt(p, 1) + rbm.visibleBiasTerm(p.v) + rbm.labelBiasTerm(p)
+}
+
+// Method labelInput returns the contribution U_j . Y of the label of the
+// particle p to the input of hidden unit j, Y being its target for
+// regression models.
+func (rbm *SparseClassRBM) labelInput(j int, p *particleT) WeightT {
+	if rbm.IsRegression() {
+		return rbm.U(j) * p.target
+	}
+	return rbm.uDotY(j, p.y)
+}
+
+// Method labelBiasTerm calculates d . Y of the label of the particle p, and
+// d * y - y^2 / 2 for a real valued y.
+func (rbm *SparseClassRBM) labelBiasTerm(p *particleT) WeightT {
+	switch {
+	case rbm.IsRegression():
+		return rbm.D()*p.target - p.target*p.target/2
+	case rbm.IsMultiClass():
+		return rbm.DK(p.y)
+	}
+	return rbm.D() * WeightT(p.y)
+}
+
+// Method visibleBiasTerm calculates b . X, where each multi-valued class
+// contributes the (optionally normalized) sum of b[c][k] over its values k,
+// and each Gaussian class contributes -(X_c - b[c])^2 / (2 * sigma_c^2).
+// Missing classes contribute nothing, unless the model treats them as value 0.
+func (rbm *SparseClassRBM) visibleBiasTerm(v *DataInstance) WeightT {
+	s := WeightT(0)
+	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+		switch {
+		case rbm.isMultiValued(c):
+			bag := v.bag(c)
+			b := WeightT(0)
+			for _, k := range bag {
+				b += rbm.B(c, k)
+			}
+			s += rbm.bagScale(c, len(bag)) * b
+		case v.isMissing(c):
+			if rbm.x_missing == KMissingAsZero && !rbm.isGaussian(c) {
+				s += rbm.B(c, 0)
+			}
+		case rbm.isGaussian(c):
+			x := (v.realValue(c) - rbm.B(c, 0)) / rbm.Sigma(c)
+			s -= x * x / 2
+		default:
+			s += rbm.B(c, v.x[c])
+		}
+	}
+	return s
+}
+
+// Method logMarginalUnnormalizedProb calculates logUnnormalizedProb of the
+// instance v with label y and target, summing out the missing classes that
+// the model marginalizes.
+func (rbm *SparseClassRBM) logMarginalUnnormalizedProb(v *DataInstance, y int, target WeightT) WeightT {
+	completions, _ := rbm.missingCompletions(v)
+	log_p := make([]WeightT, len(completions))
+	for i, completion := range completions {
+		log_p[i] = rbm.logUnnormalizedProb(&particleT{v: completion, y: y, target: target})
+	}
+	return LogSumExp(log_p)
+}
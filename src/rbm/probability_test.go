@@ -5,6 +5,7 @@
 package rbm
 
 import (
+	"math"
 	"testing"
 )
 
@@ -118,14 +119,14 @@ func Test_probOfXInClassCGivenH(t *testing.T) {
 			0,
 		}, {
 			[]WeightT{1, 0, 0, 1},
-			[]WeightT{Exp(0.02) / (Exp(0.02) + Exp(0.03)), Exp(0.03) / (Exp(0.02) + Exp(0.03))},
+			[]WeightT{Exp(0.22) / (Exp(0.22) + Exp(0.33)), Exp(0.33) / (Exp(0.22) + Exp(0.33))},
 			1,
 		}, {
 			[]WeightT{0.4, 0.3, 0.2, 0.1},
 			[]WeightT{
-				Exp(0.106) / (Exp(0.106) + Exp(0.115) + Exp(0.124)),
-				Exp(0.115) / (Exp(0.106) + Exp(0.115) + Exp(0.124)),
-				Exp(0.124) / (Exp(0.106) + Exp(0.115) + Exp(0.124)),
+				Exp(0.506) / (Exp(0.506) + Exp(0.165) + Exp(-0.076)),
+				Exp(0.165) / (Exp(0.506) + Exp(0.165) + Exp(-0.076)),
+				Exp(-0.076) / (Exp(0.506) + Exp(0.165) + Exp(-0.076)),
 			},
 			2,
 		},
@@ -167,7 +168,7 @@ func Test_probOfYGivenX(t *testing.T) {
 	}
 }
 
-func Test_wHDotX(t *testing.T) {
+func Test_wHDotInstanceOfSingleValuedClasses(t *testing.T) {
 	test_cases := []struct {
 		h_index int
 		x       []int
@@ -189,14 +190,218 @@ func Test_wHDotX(t *testing.T) {
 			3,
 			[]int{0, 1, 1},
 			0.0,
+		}, {
+			0,
+			[]int{0, KMissingValue, 2},
+			0.09,
 		},
 	}
 
 	rbm := getSampleRBMForProbabilityTest()
 	for i, t_case := range test_cases {
-		p := rbm.wHDotX(t_case.h_index, t_case.x)
+		p := rbm.wHDotInstance(t_case.h_index, &DataInstance{x: t_case.x})
+		if !EqualWithinPrecision(t_case.p, p, kPrecision) {
+			t.Errorf("TestCase #%d: expected %v but got %v.", i, t_case.p, p)
+		}
+	}
+}
+
+func Test_wHDotInstance(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.SetClassType(1, KMultiValuedClass)
+	rbm.SetClassType(2, KNormalizedMultiValuedClass)
+	test_cases := []struct {
+		h_index int
+		v       DataInstance
+		p       WeightT
+	}{
+		{
+			0,
+			DataInstance{x: []int{0, 0, 0}, x_bags: [][]int{nil, {0, 1, 1}, {0, 2}}},
+			0.01 + (0.02 + 0.03 + 0.03) + (0.04+0.06)/2,
+		}, {
+			1,
+			DataInstance{x: []int{0, 0, 0}, x_bags: [][]int{nil, {}, {1}}},
+			0.11 + 0.15,
+		},
+	}
+	for i, t_case := range test_cases {
+		p := rbm.wHDotInstance(t_case.h_index, &t_case.v)
 		if !EqualWithinPrecision(t_case.p, p, kPrecision) {
 			t.Errorf("TestCase #%d: expected %v but got %v.", i, t_case.p, p)
 		}
 	}
 }
+
+// getSampleMultiClassRBM returns the sample RBM with three label classes, the
+// interactions and biases of label classes 0 and 1 being those of y = 0 and
+// y = 1 of the binary model.
+func getSampleMultiClassRBM() *SparseClassRBM {
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.InitializeMultiClass([]WeightT{0, rbm.D(), -0.5})
+	for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+		rbm.SetUK(0, j, 0)
+		rbm.SetUK(1, j, rbm.U(j))
+		rbm.SetUK(2, j, WeightT(j)*0.1-0.2)
+	}
+	return rbm
+}
+
+// Test the calculation of P(Y=k | X).
+func Test_probDistOfYGivenInstance(t *testing.T) {
+	binary := getSampleRBMForProbabilityTest()
+	multi_class := getSampleMultiClassRBM()
+	for i, x := range [][]int{{0, 0, 0}, {0, 1, 2}} {
+		v := DataInstance{x: x}
+		p_y := binary.probOfYGivenX(x)
+		p := binary.probDistOfYGivenInstance(&v)
+		if !EqualWithinPrecision(p[0], 1-p_y, kPrecision) || !EqualWithinPrecision(p[1], p_y, kPrecision) {
+			t.Errorf("TestCase: #%d, expected [%v %v] but got %v.", i, 1-p_y, p_y, p)
+		}
+
+		p = multi_class.probDistOfYGivenInstance(&v)
+		if len(p) != 3 || !EqualWithinPrecision(p[0]+p[1]+p[2], 1, kPrecision) {
+			t.Fatalf("TestCase: #%d, expected a distribution over 3 labels but got %v.", i, p)
+		}
+		// The ratio of label classes 1 and 0 is the one of the binary model.
+		if !EqualWithinPrecision(p[1]/(p[0]+p[1]), p_y, kPrecision) {
+			t.Errorf("TestCase: #%d, expected P(y=1|X, y<2) to be %v but got %v.", i, p_y, p[1]/(p[0]+p[1]))
+		}
+	}
+}
+
+// With no interactions between y and h, P(y|X) is the unit variance Gaussian
+// centered at d.
+func Test_probOfTargetGivenInstance(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.InitializeRegression(0, 1)
+	rbm.SetD(0.7)
+	for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+		rbm.SetU(j, 0)
+	}
+	v := DataInstance{x: []int{0, 1, 2}}
+	if e := rbm.expectedTargetGivenInstance(&v); !EqualWithinPrecision(e, 0.7, kPrecision) {
+		t.Errorf("Expected E[y|X] to be 0.7 but got %v.", e)
+	}
+	for _, y := range []WeightT{-1, 0.7, 2.5} {
+		expected := -(y-0.7)*(y-0.7)/2 - WeightT(math.Log(2*math.Pi))/2
+		if l := rbm.logProbOfTargetGivenInstance(&v, y); !EqualWithinPrecision(l, expected, kPrecision) {
+			t.Errorf("Expected log P(y=%v|X) to be %v but got %v.", y, expected, l)
+		}
+	}
+
+	// The expectation is independent of the normalization of the target.
+	rbm.SetU(1, 0.8)
+	rbm.SetU(2, -0.3)
+	e := rbm.GetRegression(&v)
+	rbm.InitializeRegression(10, 2)
+	rbm.SetD(0.7)
+	if e_scaled := rbm.GetRegression(&v); !EqualWithinPrecision(e_scaled, 10+2*e, kPrecision) {
+		t.Errorf("Expected E[target|X] to be %v but got %v.", 10+2*e, e_scaled)
+	}
+}
+
+func Test_wHDotInstanceWithGaussianClass(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.SetGaussianClass(0, 1.5, 2)
+	v := DataInstance{x: []int{0, 1, 2}, x_real: []WeightT{3, 0, 0}}
+	for j := 0; j < rbm.SizeOfHiddenLayer(); j++ {
+		expected := rbm.W(j, 0, 0)*1.5 + rbm.W(j, 1, 1) + rbm.W(j, 2, 2)
+		if p := rbm.wHDotInstance(j, &v); !EqualWithinPrecision(p, expected, kPrecision) {
+			t.Errorf("Hidden unit %d: expected %v but got %v.", j, expected, p)
+		}
+	}
+	h := []WeightT{1, 0, 1, 1}
+	expected := 1.5 + 2*(rbm.W(0, 0, 0)+rbm.W(2, 0, 0)+rbm.W(3, 0, 0))
+	if mean := rbm.meanOfXInClassCGivenH(0, h); !EqualWithinPrecision(mean, expected, kPrecision) {
+		t.Errorf("Expected mean of X_0 given h to be %v but got %v.", expected, mean)
+	}
+}
+
+// Test P(Y | X) of an instance whose class 1 is missing under every policy.
+func Test_probDistOfYGivenInstanceWithMissingClasses(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	v := DataInstance{x: []int{0, KMissingValue, 2}}
+
+	// Treated as value 0.
+	expected := rbm.probOfYGivenX([]int{0, 0, 2})
+	if p := rbm.probOfYGivenInstance(&v); !EqualWithinPrecision(p, expected, kPrecision) {
+		t.Errorf("Missing as zero: expected %v but got %v.", expected, p)
+	}
+
+	// Skipped, i.e. as if class 1 had no interactions with h.
+	rbm.SetMissingValuePolicy(KSkipMissing)
+	no_class_1 := getSampleRBMForProbabilityTest()
+	for j := 0; j < no_class_1.SizeOfHiddenLayer(); j++ {
+		no_class_1.SetW(j, 1, 0, 0)
+		no_class_1.SetW(j, 1, 1, 0)
+	}
+	expected = no_class_1.probOfYGivenX([]int{0, 0, 2})
+	if p := rbm.probOfYGivenInstance(&v); !EqualWithinPrecision(p, expected, kPrecision) {
+		t.Errorf("Skip missing: expected %v but got %v.", expected, p)
+	}
+
+	// Marginalized, P(Y|X_obs) = sum{k}(P(Y|X_obs, X_1=k) P(X_1=k|X_obs)) with
+	//	P(X_1=k|X_obs) ~ exp(b[1][k]) * sum{y}(exp(-F(X_obs, X_1=k, y)))
+	rbm.SetMissingValuePolicy(KMarginalizeMissing)
+	p_x1 := make([]WeightT, 2)
+	p_y := make([]WeightT, 2)
+	for k := range p_x1 {
+		logits := rbm.labelLogits(&DataInstance{x: []int{0, k, 2}})
+		p_x1[k] = rbm.B(1, k) + LogSumExp(logits)
+		p_y[k] = rbm.probOfYGivenX([]int{0, k, 2})
+	}
+	SoftMax(p_x1)
+	expected = p_x1[0]*p_y[0] + p_x1[1]*p_y[1]
+	p := rbm.probDistOfYGivenInstance(&v)
+	if !EqualWithinPrecision(p[1], expected, kPrecision) || !EqualWithinPrecision(p[0]+p[1], 1, kPrecision) {
+		t.Errorf("Marginalize missing: expected %v but got %v.", expected, p)
+	}
+	if v.x[1] != KMissingValue {
+		t.Errorf("Expected instance to be left unchanged but got %v.", v)
+	}
+}
+
+func Test_FreeEnergy(t *testing.T) {
+	for _, rbm := range []*SparseClassRBM{getSampleRBMForProbabilityTest(), getSampleMultiClassRBM()} {
+		log_z := exactLogPartition(rbm)
+		total := float64(0)
+		for _, x := range [][]int{{0, 0, 0}, {0, 0, 1}, {0, 0, 2}, {0, 1, 0}, {0, 1, 1}, {0, 1, 2}} {
+			v := DataInstance{x: x}
+			p := rbm.probDistOfYGivenInstance(&v)
+			f_x := rbm.FreeEnergyX(&v)
+			for y := range p {
+				// P(y|X) = exp{F(X) - F(X, y)}
+				if expected, got := p[y], Exp(f_x-rbm.FreeEnergy(&v, y)); !EqualWithinPrecision(got, expected, kPrecision) {
+					t.Errorf("X = %v: expected P(y=%d|X) %v but got %v.", x, y, expected, got)
+				}
+			}
+			total += math.Exp(-float64(f_x) - log_z)
+		}
+		if !EqualWithinPrecesionF64(total, 1, kPrecision) {
+			t.Errorf("Expected P(X) to sum to 1 but got %f.", total)
+		}
+	}
+
+	// Summing out a missing class.
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.SetMissingValuePolicy(KMarginalizeMissing)
+	f := []WeightT{rbm.FreeEnergy(&DataInstance{x: []int{0, 0, 2}}, 1), rbm.FreeEnergy(&DataInstance{x: []int{0, 1, 2}}, 1)}
+	expected := -LogSumExp([]WeightT{-f[0], -f[1]})
+	if got := rbm.FreeEnergy(&DataInstance{x: []int{0, KMissingValue, 2}}, 1); !EqualWithinPrecision(got, expected, kPrecision) {
+		t.Errorf("Expected the free energy %v but got %v.", expected, got)
+	}
+}
+
+// For regression models, log P(y|X) = F(X) - F(X, y).
+func Test_FreeEnergyOfTarget(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.InitializeRegression(10, 2)
+	rbm.SetU(1, 0.8)
+	rbm.SetU(2, -0.3)
+	v := DataInstance{x: []int{0, 1, 2}, target: 11}
+	expected := rbm.logProbOfTargetGivenInstance(&v, 0.5)
+	if got := rbm.FreeEnergyX(&v) - rbm.FreeEnergy(&v, 0); !EqualWithinPrecision(got, expected, kPrecision) {
+		t.Errorf("Expected log P(y|X) %v but got %v.", expected, got)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Reproducible random number generation.
+
+package rbm
+
+import (
+	"math/rand"
+)
+
+const (
+	kMaxDrawsPerSeed = 1 << 20 //number of values drawn from a seed before reseeding
+)
+
+// countingSource is a rand.Source that records its seed and the number of
+// values drawn from it, so that its state can be saved and later restored by
+// re-seeding and skipping the same number of values. To keep restoring cheap,
+// it reseeds itself with its next value after every kMaxDrawsPerSeed values.
+type countingSource struct {
+	src   rand.Source
+	seed  int64
+	draws uint64
+}
+
+func newCountingSource(seed int64) *countingSource {
+	return &countingSource{rand.NewSource(seed), seed, 0}
+}
+
+func (s *countingSource) Int63() int64 {
+	if s.draws >= kMaxDrawsPerSeed {
+		s.Seed(s.src.Int63())
+	}
+	s.draws++
+	return s.src.Int63()
+}
+
+func (s *countingSource) Seed(seed int64) {
+	s.src.Seed(seed)
+	s.seed = seed
+	s.draws = 0
+}
+
+// restore puts the source into the state it had after draws values were
+// drawn following seeding with seed. The states saved before the source
+// reseeded itself may have more than kMaxDrawsPerSeed draws, which are all
+// skipped.
+func (s *countingSource) restore(seed int64, draws uint64) {
+	s.Seed(seed)
+	for ; s.draws < draws; s.draws++ {
+		s.src.Int63()
+	}
+}
+
+// randomWeight returns a random WeightT in [0, 1) drawn from rng.
+func randomWeight(rng *rand.Rand) WeightT {
+	return WeightT(rng.Float64())
+}
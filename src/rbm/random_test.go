@@ -0,0 +1,58 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func Test_countingSource(t *testing.T) {
+	src := newCountingSource(42)
+	rng := rand.New(src)
+	for i := 0; i < 17; i++ {
+		rng.NormFloat64()
+		rng.Float64()
+	}
+	seed, draws := src.seed, src.draws
+	expected := []float64{rng.Float64(), rng.NormFloat64(), rng.Float64()}
+
+	restored_src := newCountingSource(0)
+	restored_src.restore(seed, draws)
+	restored_rng := rand.New(restored_src)
+	actual := []float64{restored_rng.Float64(), restored_rng.NormFloat64(), restored_rng.Float64()}
+	for i := range expected {
+		if expected[i] != actual[i] {
+			t.Errorf("Value #%d: expected %v but got %v.", i, expected[i], actual[i])
+		}
+	}
+}
+
+func Test_countingSourceReseeding(t *testing.T) {
+	src := newCountingSource(42)
+	for i := 0; i < kMaxDrawsPerSeed+10; i++ {
+		src.Int63()
+	}
+	if src.seed == 42 || src.draws != 10 {
+		t.Errorf("Expected a new seed with 10 draws but got seed %d with %d draws.", src.seed, src.draws)
+	}
+	restored_src := newCountingSource(0)
+	restored_src.restore(src.seed, src.draws)
+	for i := 0; i < 3; i++ {
+		if expected, actual := src.Int63(), restored_src.Int63(); expected != actual {
+			t.Errorf("Value #%d: expected %v but got %v.", i, expected, actual)
+		}
+	}
+
+	//States saved before the reseeding existed may have more draws.
+	plain_src := rand.NewSource(42)
+	for i := 0; i < kMaxDrawsPerSeed+5; i++ {
+		plain_src.Int63()
+	}
+	restored_src.restore(42, kMaxDrawsPerSeed+5)
+	if expected, actual := plain_src.Int63(), restored_src.src.Int63(); expected != actual {
+		t.Errorf("Expected %v after the draws of an old state but got %v.", expected, actual)
+	}
+}
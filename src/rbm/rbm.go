@@ -7,22 +7,101 @@
 package rbm
 
 import (
+	"fmt"
 	"math/rand"
 	"time"
 )
 
 type WeightT float64
 
+// ClassType specifies how the values of a visible feature class are observed.
+type ClassType int
+
+const (
+	KSingleValuedClass          ClassType = iota //exactly one value per instance
+	KMultiValuedClass                            //a bag of values, contributing their sum
+	KNormalizedMultiValuedClass                  //a bag of values, contributing their mean
+	KGaussianClass                               //a real value with Gaussian noise, the class has size 1
+)
+
+// MissingValuePolicy specifies how a model treats the feature classes whose
+// value is KMissingValue. When marginalizing, missing single-valued classes
+// are summed out of P(y|X) and sampled during training, while missing
+// multi-valued classes, whose number of values is unknown, are skipped.
+type MissingValuePolicy int
+
+const (
+	KMissingAsZero      MissingValuePolicy = iota //a missing class takes value 0
+	KSkipMissing                                  //a missing class does not contribute to h
+	KMarginalizeMissing                           //a missing class is summed out of P(y|X)
+)
+
+// BiasParameterization specifies how the biases of the visible units are
+// shared. With one bias per class, all the values of a class share the same
+// bias, which then only matters for multi-valued classes as the number of
+// their active values varies.
+type BiasParameterization int
+
+const (
+	KPerUnitBias  BiasParameterization = iota //one bias per visible unit
+	KPerClassBias                             //one bias per visible class
+)
+
+func (mode BiasParameterization) String() string {
+	switch mode {
+	case KPerUnitBias:
+		return "per-unit"
+	case KPerClassBias:
+		return "per-class"
+	}
+	return fmt.Sprintf("BiasParameterization(%d)", int(mode))
+}
+
+// SamplingMethod specifies how the negative phase of the gradient of the
+// generative term is sampled.
+type SamplingMethod int
+
+const (
+	KContrastiveDivergence SamplingMethod = iota //CD-k, a chain started from each training instance
+	KPersistentCD                                //PCD, persistent chains of fantasy particles
+	KFastPersistentCD                            //FPCD, PCD sampling with additional fast weights
+	KParallelTempering                           //PT, persistent chains with replicas at higher temperatures
+)
+
+func (method SamplingMethod) String() string {
+	switch method {
+	case KContrastiveDivergence:
+		return "CD"
+	case KPersistentCD:
+		return "PCD"
+	case KFastPersistentCD:
+		return "FPCD"
+	case KParallelTempering:
+		return "PT"
+	}
+	return fmt.Sprintf("SamplingMethod(%d)", int(method))
+}
+
 // RBM Object for storing the parameters of a gven SparseClassRBM
 type SparseClassRBM struct {
-	w             [][][]WeightT //interactions between X and h [feature_class, hidden, visible]
-	b             [][]WeightT   //bias of X
-	c             []WeightT     //bias of h
-	u             []WeightT     //interactions between y and h
-	d             WeightT       //bias of y
-	x_class_num   int           //number of Classes in X
-	x_class_sizes []int         //Size of each classes
-	h_num         int           //number of hidden units
+	w             [][][]WeightT        //interactions between X and h [feature_class, hidden, visible]
+	b             [][]WeightT          //bias of X
+	c             []WeightT            //bias of h
+	u             []WeightT            //interactions between y and h
+	d             WeightT              //bias of y
+	uk            [][]WeightT          //interactions between each label class and h [label, hidden]
+	dk            []WeightT            //bias of each label class
+	y_class_num   int                  //number of label classes of a softmax y, 0 for binary y
+	y_gaussian    bool                 //whether y is a real valued unit with unit variance Gaussian noise
+	y_mean        WeightT              //mean of the regression target, for normalizing it
+	y_stddev      WeightT              //standard deviation of the regression target
+	x_class_num   int                  //number of Classes in X
+	x_class_sizes []int                //Size of each classes
+	x_class_types []ClassType          //Type of each classes
+	x_sigmas      []WeightT            //standard deviation of each Gaussian class, 1 for other classes
+	x_missing     MissingValuePolicy   //treatment of missing classes
+	x_bias_mode   BiasParameterization //sharing of the visible biases
+	h_num         int                  //number of hidden units
 }
 
 type trainParameters struct {
@@ -30,16 +109,44 @@ type trainParameters struct {
 	regularization_rate  WeightT //equivalent to the \lambda in the Delta Rule
 	momentum_rate        WeightT //equivalent to the \mu in the Delta Rule
 	gen_learn_importance WeightT //equivalent to the \alpha in the hybrid learning equation
+	unsup_importance     WeightT //importance of the generative term of unlabeled instances
 	gibbs_chain_length   int     //the k value of CD-k
+	sampling_method      SamplingMethod
+	num_particles        int       //number of persistent chains of PCD, FPCD and PT
+	fast_learning_rate   WeightT   //learning rate of the fast weights of FPCD
+	fast_weight_decay    WeightT   //decay of the fast weights of FPCD at every update
+	betas                []WeightT //inverse temperatures of the replicas of PT, nil for the default ones
+	sparsity_target      WeightT   //target average activation of the hidden units
+	sparsity_cost        WeightT   //cost of the sparsity penalty, 0 for none
+	sparsity_decay       WeightT   //decay of the average activations of the hidden units
 }
 
 // RBMTrainer specifiers how an RBM should be trained.
 type RBMTrainer struct {
 	rbm                      *SparseClassRBM      //RBM model
-	prev_delta               *SparseClassRBM      //For storing previous Delta
+	optimizer                Optimizer            //Computes the changes of the parameters
+	optimizer_state          *optimizerStateT     //State of the optimizer, e.g. the previous deltas for the momentum
+	schedules                *schedulesT          //Schedules of the learning rate and of the momentum
+	learning_rate            WeightT              //Learning rate of the next update, see schedules
+	momentum_rate            WeightT              //Momentum of the next update, see schedules
 	parameters               trainParameters      //Training parameters
 	training_data_accessor   DataInstanceAccessor //Training data
 	validation_data_accessor DataInstanceAccessor //Test data
+	rng                      *rand.Rand           //Random number generator used for sampling
+	rng_source               *countingSource      //Source of rng, kept for checkpointing
+	epoch                    int                  //Number of completed epochs
+	instances                int64                //Number of training instances processed so far
+	prev_auc                 float64              //Validation AUC of the previous epoch
+	best_auc                 float64              //Best validation AUC (negative RMSE for regression) so far
+	max_epochs               int                  //Number of epochs to train, 0 for no limit
+	checkpoint_file          string               //File for saving checkpoints, "" for none
+	checkpoint_interval      int                  //Number of instances between checkpoints
+	learn_variance           bool                 //Whether to learn the variances of Gaussian classes
+	batch_size               int                  //Number of instances per model update, 0 or 1 for one
+	num_workers              int                  //Number of parallel training workers, 0 or 1 for one
+	locks                    *stripedLocks        //Locks of the dense parameters shared by parallel workers
+	chains                   *chainState          //Persistent chains of PCD and FPCD, nil until first used
+	activity                 *activityT           //Average activations of the hidden units, nil without sparsity target
 }
 
 func init() {
@@ -5,14 +5,23 @@
 package rbm
 
 import (
+	"math"
 	"math/rand"
 )
 
 // Method sampleHGivenXY samples H according to the p.d. P(H|X, Y).
-func (rbm *SparseClassRBM) sampleHGivenXY(h []WeightT, x []int, y int) {
+func (rbm *SparseClassRBM) sampleHGivenXY(rng *rand.Rand, h []WeightT, v *DataInstance, y int) {
+	rbm.sampleHGivenXYTempered(rng, h, v, y, 1)
+}
+
+// Method sampleHGivenXYTempered samples H according to the p.d. P(H|X, Y) of
+// the model at inverse temperature beta, i.e. with its energy multiplied by
+// beta.
+func (rbm *SparseClassRBM) sampleHGivenXYTempered(rng *rand.Rand, h []WeightT, v *DataInstance, y int,
+	beta WeightT) {
 	for i := range h {
-		p := rbm.probOfHGivenXY(i, x, y)
-		if RandomWeight() < p {
+		p := Sigmoid(beta * (rbm.C(i) + rbm.uDotY(i, y) + rbm.wHDotInstance(i, v)))
+		if randomWeight(rng) < p {
 			h[i] = WeightT(1)
 		} else {
 			h[i] = WeightT(0)
@@ -20,23 +29,154 @@ func (rbm *SparseClassRBM) sampleHGivenXY(h []WeightT, x []int, y int) {
 	}
 }
 
-// Method sampleXGivenH sample X according to the p.d. P(X|h).
-func (rbm *SparseClassRBM) sampleXGivenH(x []int, h []WeightT) {
+// Method sampleXGivenH sample X according to the p.d. P(X|h). Every value of
+// a multi-valued class is sampled independently, keeping the number of values
+// of the class unchanged. Missing classes stay missing.
+func (rbm *SparseClassRBM) sampleXGivenH(rng *rand.Rand, v *DataInstance, h []WeightT) {
+	rbm.sampleXGivenHTempered(rng, v, h, 1)
+}
+
+// Method sampleXGivenHTempered samples X according to the p.d. P(X|h) of the
+// model at inverse temperature beta, see sampleXGivenH.
+func (rbm *SparseClassRBM) sampleXGivenHTempered(rng *rand.Rand, v *DataInstance, h []WeightT, beta WeightT) {
 	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
-		p_dist := rbm.probOfXInClassCGivenH(c, h)
-		x[c] = SampleKFromDistribution(p_dist)
+		if v.isMissing(c) {
+			continue
+		}
+		if rbm.isGaussian(c) {
+			sigma := rbm.Sigma(c)
+			if beta != 1 {
+				sigma /= WeightT(math.Sqrt(float64(beta)))
+			}
+			v.x_real[c] = rbm.meanOfXInClassCGivenH(c, h) + sigma*WeightT(rng.NormFloat64())
+			continue
+		}
+		if !rbm.isMultiValued(c) {
+			p_dist := rbm.probOfXInClassCGivenHScaled(c, h, beta)
+			v.x[c] = SelectKFromDist(randomWeight(rng), p_dist)
+			continue
+		}
+		bag := v.bag(c)
+		if len(bag) == 0 {
+			continue
+		}
+		p_dist := rbm.probOfXInClassCGivenHScaled(c, h, beta*rbm.bagScale(c, len(bag)))
+		for i := range bag {
+			bag[i] = SelectKFromDist(randomWeight(rng), p_dist)
+		}
 	}
 }
 
 // Method sampleYGivenH samples Y according to the p.d. P(Y|H)
-func (rbm *SparseClassRBM) sampleYGivenH(y *int, h []WeightT) {
-	if RandomWeight() < Sigmoid(rbm.D()+DotProduct(rbm.UVector(), h)) {
+func (rbm *SparseClassRBM) sampleYGivenH(rng *rand.Rand, y *int, h []WeightT) {
+	rbm.sampleYGivenHTempered(rng, y, h, 1)
+}
+
+// Method sampleYGivenHTempered samples Y according to the p.d. P(Y|H) of the
+// model at inverse temperature beta.
+func (rbm *SparseClassRBM) sampleYGivenHTempered(rng *rand.Rand, y *int, h []WeightT, beta WeightT) {
+	if rbm.IsMultiClass() {
+		p_dist := rbm.probDistOfYGivenH(h)
+		if beta != 1 {
+			for k := range p_dist {
+				p_dist[k] = beta * (rbm.DK(k) + DotProduct(rbm.uk[k], h))
+			}
+			SoftMax(p_dist)
+		}
+		*y = SelectKFromDist(randomWeight(rng), p_dist)
+		return
+	}
+	if randomWeight(rng) < Sigmoid(beta*(rbm.D()+DotProduct(rbm.UVector(), h))) {
 		*y = 1
 	} else {
 		*y = 0
 	}
 }
 
+// Method sampleHGivenTarget samples H according to the p.d. P(H|X, y) for a
+// real valued y.
+func (rbm *SparseClassRBM) sampleHGivenTarget(rng *rand.Rand, h []WeightT, v *DataInstance, y WeightT) {
+	rbm.sampleHGivenTargetTempered(rng, h, v, y, 1)
+}
+
+// Method sampleHGivenTargetTempered samples H according to the p.d.
+// P(H|X, y) of the model at inverse temperature beta, for a real valued y.
+func (rbm *SparseClassRBM) sampleHGivenTargetTempered(rng *rand.Rand, h []WeightT, v *DataInstance, y WeightT,
+	beta WeightT) {
+	for i := range h {
+		p := Sigmoid(beta * (rbm.C(i) + rbm.U(i)*y + rbm.wHDotInstance(i, v)))
+		if randomWeight(rng) < p {
+			h[i] = WeightT(1)
+		} else {
+			h[i] = WeightT(0)
+		}
+	}
+}
+
+// Method sampleTargetGivenH samples a real valued y according to the p.d.
+//	P(y|H) = N(d + U . H, 1)
+func (rbm *SparseClassRBM) sampleTargetGivenH(rng *rand.Rand, h []WeightT) WeightT {
+	return rbm.sampleTargetGivenHTempered(rng, h, 1)
+}
+
+// Method sampleTargetGivenHTempered samples a real valued y according to the
+// p.d. of the model at inverse temperature beta
+//	P(y|H) = N(d + U . H, 1 / beta)
+func (rbm *SparseClassRBM) sampleTargetGivenHTempered(rng *rand.Rand, h []WeightT, beta WeightT) WeightT {
+	noise := WeightT(rng.NormFloat64())
+	if beta != 1 {
+		noise /= WeightT(math.Sqrt(float64(beta)))
+	}
+	return rbm.D() + DotProduct(rbm.UVector(), h) + noise
+}
+
+// Method fillMissing returns the instance v with label y as the model sees it
+// during training: missing classes take value 0 if the model treats them so,
+// and are sampled from P(X_c | h), h being sampled from P(h | X_observed, y),
+// if the model marginalizes them. Missing multi-valued classes and the
+// missing classes of models that skip them stay missing. v is returned as is
+// if nothing changes.
+func (rbm *SparseClassRBM) fillMissing(rng *rand.Rand, v *DataInstance, y int) *DataInstance {
+	if rbm.x_missing == KSkipMissing {
+		return v
+	}
+	var filled *DataInstance
+	var h []WeightT
+	for c := 0; c < rbm.NumOfVisibleClasses(); c++ {
+		if !v.isMissing(c) || rbm.isMultiValued(c) {
+			continue
+		}
+		if filled == nil {
+			filled = v.clone()
+		}
+		if rbm.x_missing == KMissingAsZero {
+			filled.x[c] = 0
+			continue
+		}
+		if h == nil {
+			h = make([]WeightT, rbm.SizeOfHiddenLayer())
+			if rbm.IsRegression() {
+				rbm.sampleHGivenTarget(rng, h, v, rbm.normalizeTarget(v.target))
+			} else {
+				rbm.sampleHGivenXY(rng, h, v, y)
+			}
+		}
+		filled.x[c] = 0
+		if rbm.isGaussian(c) {
+			if filled.x_real == nil {
+				filled.x_real = make([]WeightT, len(filled.x))
+			}
+			filled.x_real[c] = rbm.meanOfXInClassCGivenH(c, h) + rbm.Sigma(c)*WeightT(rng.NormFloat64())
+			continue
+		}
+		filled.x[c] = SelectKFromDist(randomWeight(rng), rbm.probOfXInClassCGivenH(c, h))
+	}
+	if filled == nil {
+		return v
+	}
+	return filled
+}
+
 // Method SampleKFromDistribution selects a sample from the multinomial distribution p_dist.
 func SampleKFromDistribution(p_dist []WeightT) int {
 	return SelectKFromDist(RandomWeight(), p_dist)
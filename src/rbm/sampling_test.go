@@ -5,6 +5,7 @@
 package rbm
 
 import (
+	"math/rand"
 	"testing"
 )
 
@@ -48,3 +49,66 @@ func Test_SelectKFromDist(t *testing.T) {
 		}
 	}
 }
+
+func Test_sampleXGivenH(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.SetClassType(2, KNormalizedMultiValuedClass)
+	rng := rand.New(rand.NewSource(1))
+	h := []WeightT{1, 0, 1, 1}
+	for i := 0; i < 100; i++ {
+		v := DataInstance{x: []int{0, 1, 0}, x_bags: [][]int{nil, nil, {0, 0, 2, 1}}}
+		rbm.sampleXGivenH(rng, &v, h)
+		if len(v.x_bags[2]) != 4 {
+			t.Fatalf("Expected the number of values of a multi-valued class to be kept.")
+		}
+		if !rbm.IsValidInput(DataInstance{x: v.x, x_bags: v.x_bags, pos_y: 1}) {
+			t.Fatalf("Sampled invalid visible configuration %v.", v)
+		}
+	}
+}
+
+// Test_sampleXGivenHTemperedWithBiases checks that the visible biases are the
+// prior of X at every temperature.
+func Test_sampleXGivenHTemperedWithBiases(t *testing.T) {
+	rbm := getSampleRBMForProbabilityTest()
+	rbm.SetB(2, 1, 40)
+	rng := rand.New(rand.NewSource(1))
+	h := make([]WeightT, rbm.SizeOfHiddenLayer())
+	for _, beta := range []WeightT{1, 0.5} {
+		for i := 0; i < 100; i++ {
+			v := DataInstance{x: []int{0, 1, 0}}
+			rbm.sampleXGivenHTempered(rng, &v, h, beta)
+			if v.x[2] != 1 {
+				t.Fatalf("Expected class 2 to follow its bias at beta %f but got %v.", beta, v.x)
+			}
+		}
+	}
+}
+
+func Test_fillMissing(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	rbm := getSampleRBMForProbabilityTest()
+	v := DataInstance{x: []int{0, KMissingValue, 2}}
+
+	if filled := rbm.fillMissing(rng, &v, 1); filled.x[1] != 0 || v.x[1] != KMissingValue {
+		t.Errorf("Missing as zero: expected class 1 to be filled with 0 but got %v.", filled)
+	}
+	rbm.SetMissingValuePolicy(KSkipMissing)
+	if filled := rbm.fillMissing(rng, &v, 1); filled != &v {
+		t.Errorf("Skip missing: expected instance to be returned as is but got %v.", filled)
+	}
+	rbm.SetMissingValuePolicy(KMarginalizeMissing)
+	for i := 0; i < 10; i++ {
+		filled := rbm.fillMissing(rng, &v, 1)
+		if filled.x[1] < 0 || filled.x[1] >= rbm.ClassSize(1) || filled.x[0] != 0 || filled.x[2] != 2 {
+			t.Errorf("Marginalize missing: expected class 1 to be sampled but got %v.", filled)
+		}
+	}
+	if v.x[1] != KMissingValue {
+		t.Errorf("Expected instance to be left unchanged but got %v.", v)
+	}
+	complete := DataInstance{x: []int{0, 1, 2}}
+	if filled := rbm.fillMissing(rng, &complete, 1); filled != &complete {
+		t.Errorf("Expected complete instance to be returned as is but got %v.", filled)
+	}
+}
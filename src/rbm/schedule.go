@@ -0,0 +1,400 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Learning rate and momentum schedules.
+//
+// A Schedule varies a training rate over the run, from the base value given
+// to the trainer, as a function of the time t, which counts either epochs or
+// model updates. Following [1], the momentum can be raised from 0.5 to 0.9
+// with a warmup towards a base of 0.9, and the learning rate decayed. The
+// schedules are told the validation score at the end of every epoch, so that
+// they can also react to the progress of training. Like the optimizers, the
+// schedules keep their state in StateSize() values stored by the trainer.
+//
+// References:
+//  [14]. Loshchilov, Hutter, 2017, SGDR: Stochastic Gradient Descent with
+//  Warm Restarts
+//  [15]. Goyal et al., 2017, Accurate, Large Minibatch SGD: Training
+//  ImageNet in 1 Hour
+
+package rbm
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// Schedule computes the value of a training rate over time.
+type Schedule interface {
+	// StateSize returns the number of values of the state of the
+	// schedule, which are 0 at the start of training.
+	StateSize() int
+	// Value returns the rate at time t, given its base value.
+	Value(state []float64, base WeightT, t int64) WeightT
+	// Observe updates the state with the validation score of the epoch
+	// that just ended, higher scores being better.
+	Observe(state []float64, score float64)
+	// String describes the schedule and its hyper-parameters.
+	String() string
+}
+
+// ScheduleUnit specifies what the time of a schedule counts.
+type ScheduleUnit int
+
+const (
+	KPerEpoch  ScheduleUnit = iota //the time counts the completed epochs
+	KPerUpdate                     //the time counts the model updates
+)
+
+// stepDecay multiplies the rate by factor every step_size units of time:
+//	rate = base * factor^floor(t / step_size)
+type stepDecay struct {
+	step_size int64
+	factor    WeightT
+}
+
+// NewStepDecay returns the schedule that multiplies the rate by factor every
+// step_size units of time.
+func NewStepDecay(step_size int64, factor WeightT) Schedule {
+	if step_size < 1 || factor <= 0 {
+		panic(fmt.Sprintf("Invalid step decay parameters: step size %d, factor %g.", step_size, factor))
+	}
+	return stepDecay{step_size, factor}
+}
+
+func (stepDecay) StateSize() int {
+	return 0
+}
+
+func (s stepDecay) Value(state []float64, base WeightT, t int64) WeightT {
+	return base * WeightT(math.Pow(float64(s.factor), float64(t/s.step_size)))
+}
+
+func (stepDecay) Observe(state []float64, score float64) {
+}
+
+func (s stepDecay) String() string {
+	return fmt.Sprintf("StepDecay(step_size=%d, factor=%g)", s.step_size, s.factor)
+}
+
+// exponentialDecay multiplies the rate by gamma every unit of time:
+//	rate = base * gamma^t
+type exponentialDecay struct {
+	gamma WeightT
+}
+
+// NewExponentialDecay returns the schedule that multiplies the rate by gamma
+// every unit of time.
+func NewExponentialDecay(gamma WeightT) Schedule {
+	if gamma <= 0 {
+		panic(fmt.Sprintf("Expected a positive decay but got %g.", gamma))
+	}
+	return exponentialDecay{gamma}
+}
+
+func (exponentialDecay) StateSize() int {
+	return 0
+}
+
+func (s exponentialDecay) Value(state []float64, base WeightT, t int64) WeightT {
+	return base * WeightT(math.Pow(float64(s.gamma), float64(t)))
+}
+
+func (exponentialDecay) Observe(state []float64, score float64) {
+}
+
+func (s exponentialDecay) String() string {
+	return fmt.Sprintf("ExponentialDecay(gamma=%g)", s.gamma)
+}
+
+// inverseTimeDecay decays the rate in inverse proportion to the time:
+//	rate = base / (1 + k * t)
+type inverseTimeDecay struct {
+	k WeightT
+}
+
+// NewInverseTimeDecay returns the schedule that decays the rate in inverse
+// proportion to the time, at the given speed k.
+func NewInverseTimeDecay(k WeightT) Schedule {
+	if k < 0 {
+		panic(fmt.Sprintf("Expected a non-negative decay speed but got %g.", k))
+	}
+	return inverseTimeDecay{k}
+}
+
+func (inverseTimeDecay) StateSize() int {
+	return 0
+}
+
+func (s inverseTimeDecay) Value(state []float64, base WeightT, t int64) WeightT {
+	return base / (1 + s.k*WeightT(t))
+}
+
+func (inverseTimeDecay) Observe(state []float64, score float64) {
+}
+
+func (s inverseTimeDecay) String() string {
+	return fmt.Sprintf("InverseTimeDecay(k=%g)", s.k)
+}
+
+// cosineAnnealing anneals the rate from its base to min_rate over period
+// units of time along half a cosine [14], and keeps it at min_rate after:
+//	rate = min_rate + (base - min_rate) * (1 + cos(pi * min(t, period) / period)) / 2
+type cosineAnnealing struct {
+	period   int64
+	min_rate WeightT
+}
+
+// NewCosineAnnealing returns the schedule that anneals the rate from its base
+// to min_rate over period units of time.
+func NewCosineAnnealing(period int64, min_rate WeightT) Schedule {
+	if period < 1 || min_rate < 0 {
+		panic(fmt.Sprintf("Invalid cosine annealing parameters: period %d, minimum rate %g.", period, min_rate))
+	}
+	return cosineAnnealing{period, min_rate}
+}
+
+func (cosineAnnealing) StateSize() int {
+	return 0
+}
+
+func (s cosineAnnealing) Value(state []float64, base WeightT, t int64) WeightT {
+	if t > s.period {
+		t = s.period
+	}
+	return s.min_rate + (base-s.min_rate)*WeightT(1+math.Cos(math.Pi*float64(t)/float64(s.period)))/2
+}
+
+func (cosineAnnealing) Observe(state []float64, score float64) {
+}
+
+func (s cosineAnnealing) String() string {
+	return fmt.Sprintf("CosineAnnealing(period=%d, min_rate=%g)", s.period, s.min_rate)
+}
+
+// linearWarmup raises the rate linearly from start to its base over steps
+// units of time [15], then follows the schedule after, if any, shifted by
+// steps:
+//	rate = start + (base - start) * t / steps, for t < steps
+type linearWarmup struct {
+	start WeightT
+	steps int64
+	after Schedule
+}
+
+// NewLinearWarmup returns the schedule that raises the rate linearly from
+// start to its base over steps units of time, then follows the schedule
+// after, or keeps the base if it is nil.
+func NewLinearWarmup(start WeightT, steps int64, after Schedule) Schedule {
+	if steps < 1 {
+		panic(fmt.Sprintf("Expected a positive number of warmup steps but got %d.", steps))
+	}
+	return linearWarmup{start, steps, after}
+}
+
+func (s linearWarmup) StateSize() int {
+	if s.after == nil {
+		return 0
+	}
+	return s.after.StateSize()
+}
+
+func (s linearWarmup) Value(state []float64, base WeightT, t int64) WeightT {
+	switch {
+	case t < s.steps:
+		return s.start + (base-s.start)*WeightT(t)/WeightT(s.steps)
+	case s.after == nil:
+		return base
+	}
+	return s.after.Value(state, base, t-s.steps)
+}
+
+func (s linearWarmup) Observe(state []float64, score float64) {
+	if s.after != nil {
+		s.after.Observe(state, score)
+	}
+}
+
+func (s linearWarmup) String() string {
+	return fmt.Sprintf("LinearWarmup(start=%g, steps=%d, after=%v)", s.start, s.steps, s.after)
+}
+
+// reduceOnPlateau multiplies the rate by factor whenever the validation score
+// has not improved by more than threshold for patience epochs, down to
+// min_rate:
+//	rate = max(base * factor^reductions, min_rate)
+// Its state is the number of reductions, the best score, the number of
+// epochs without improvement and whether a score has been observed. NaN
+// scores, such as those of an empty validation set, are ignored.
+type reduceOnPlateau struct {
+	factor    WeightT
+	patience  int
+	threshold float64
+	min_rate  WeightT
+}
+
+// NewReduceOnPlateau returns the schedule that multiplies the rate by factor
+// whenever the validation score has not improved by more than threshold for
+// patience epochs, keeping it above min_rate.
+func NewReduceOnPlateau(factor WeightT, patience int, threshold float64, min_rate WeightT) Schedule {
+	if factor <= 0 || factor >= 1 || patience < 1 || threshold < 0 || min_rate < 0 {
+		panic(fmt.Sprintf("Invalid reduce on plateau parameters: factor %g, patience %d, threshold %g, minimum rate %g.",
+			factor, patience, threshold, min_rate))
+	}
+	return reduceOnPlateau{factor, patience, threshold, min_rate}
+}
+
+func (reduceOnPlateau) StateSize() int {
+	return 4
+}
+
+func (s reduceOnPlateau) Value(state []float64, base WeightT, t int64) WeightT {
+	rate := base * WeightT(math.Pow(float64(s.factor), state[0]))
+	if rate < s.min_rate && state[0] > 0 {
+		return s.min_rate
+	}
+	return rate
+}
+
+func (s reduceOnPlateau) Observe(state []float64, score float64) {
+	if math.IsNaN(score) {
+		return
+	}
+	if state[3] == 0 || score > state[1]+s.threshold {
+		state[1], state[2], state[3] = score, 0, 1
+		return
+	}
+	state[2]++
+	if state[2] >= float64(s.patience) {
+		state[0]++
+		state[2] = 0
+	}
+}
+
+func (s reduceOnPlateau) String() string {
+	return fmt.Sprintf("ReduceOnPlateau(factor=%g, patience=%d, threshold=%g, min_rate=%g)",
+		s.factor, s.patience, s.threshold, s.min_rate)
+}
+
+// scheduleT is a schedule of a training rate, nil for a constant rate, with
+// its unit of time and its state.
+type scheduleT struct {
+	schedule Schedule
+	unit     ScheduleUnit
+	state    []float64
+}
+
+func newSchedule(schedule Schedule, unit ScheduleUnit) scheduleT {
+	if unit != KPerEpoch && unit != KPerUpdate {
+		panic(fmt.Sprintf("Invalid schedule unit %d.", unit))
+	}
+	s := scheduleT{schedule: schedule, unit: unit}
+	if schedule != nil {
+		s.state = make([]float64, schedule.StateSize())
+	}
+	return s
+}
+
+// value returns the rate at the given number of completed epochs and of
+// model updates, given its base value.
+func (s *scheduleT) value(base WeightT, epoch int, updates int64) WeightT {
+	if s.schedule == nil {
+		return base
+	}
+	t := int64(epoch)
+	if s.unit == KPerUpdate {
+		t = updates
+	}
+	return s.schedule.Value(s.state, base, t)
+}
+
+// name returns the description of the schedule, "" for a constant rate.
+func (s *scheduleT) name() string {
+	if s.schedule == nil {
+		return ""
+	}
+	return s.schedule.String()
+}
+
+// schedulesT holds the schedules of the learning rate and of the momentum of
+// a trainer, which the workers of parallel training share.
+type schedulesT struct {
+	learning_rate scheduleT
+	momentum_rate scheduleT
+	updates       int64 //number of model updates so far, counted atomically
+}
+
+// SetLearningRateSchedule makes the learning rate follow the given schedule
+// from the base learning rate, its time counting epochs or model updates as
+// specified by unit. A nil schedule keeps the learning rate constant, the
+// default.
+func (trainer *RBMTrainer) SetLearningRateSchedule(schedule Schedule, unit ScheduleUnit) {
+	trainer.schedules.learning_rate = newSchedule(schedule, unit)
+	trainer.updateRates()
+}
+
+// SetMomentumSchedule makes the momentum follow the given schedule from the
+// base momentum, see SetLearningRateSchedule.
+func (trainer *RBMTrainer) SetMomentumSchedule(schedule Schedule, unit ScheduleUnit) {
+	trainer.schedules.momentum_rate = newSchedule(schedule, unit)
+	trainer.updateRates()
+}
+
+// LearningRate returns the learning rate of the next model update.
+func (trainer *RBMTrainer) LearningRate() WeightT {
+	return trainer.learning_rate
+}
+
+// MomentumRate returns the momentum of the next model update.
+func (trainer *RBMTrainer) MomentumRate() WeightT {
+	return trainer.momentum_rate
+}
+
+// updateRates sets the learning rate and the momentum of the next model
+// update from their schedules.
+func (trainer *RBMTrainer) updateRates() {
+	schedules := trainer.schedules
+	updates := atomic.LoadInt64(&schedules.updates)
+	trainer.learning_rate = schedules.learning_rate.value(trainer.parameters.learning_rate, trainer.epoch, updates)
+	trainer.momentum_rate = schedules.momentum_rate.value(trainer.parameters.momentum_rate, trainer.epoch, updates)
+}
+
+// observe passes the validation score of the epoch that just ended to the
+// schedules.
+func (schedules *schedulesT) observe(score float64) {
+	for _, s := range []*scheduleT{&schedules.learning_rate, &schedules.momentum_rate} {
+		if s.schedule != nil {
+			s.schedule.Observe(s.state, score)
+		}
+	}
+}
+
+// writeSchedule writes the description of the schedule, "" for a constant
+// rate, its unit and its state.
+func (mw *modelWriter) writeSchedule(s *scheduleT) {
+	mw.writeUint32(len(s.name()))
+	mw.writeBytes([]byte(s.name()))
+	mw.writeUint32(int(s.unit))
+	for _, v := range s.state {
+		mw.writeUint64(math.Float64bits(v))
+	}
+}
+
+// readSchedule reads the state of the given schedule, written by
+// writeSchedule, checking that the same schedule was written.
+func (mr *modelReader) readSchedule(s *scheduleT, rate string) []float64 {
+	name := make([]byte, mr.readDimension("length of the schedule name", 0))
+	mr.readBytes(name)
+	unit := ScheduleUnit(mr.readUint32())
+	if mr.err == nil && (string(name) != s.name() || unit != s.unit) {
+		mr.err = fmt.Errorf("Invalid %s schedule %q per unit %d, expected %q per unit %d.", rate, name, unit,
+			s.name(), s.unit)
+	}
+	state := make([]float64, len(s.state))
+	for i := range state {
+		state[i] = math.Float64frombits(mr.readUint64())
+	}
+	return state
+}
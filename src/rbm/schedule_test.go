@@ -0,0 +1,133 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_ScheduleValue(t *testing.T) {
+	const base WeightT = 0.5
+	tests := []struct {
+		schedule Schedule
+		times    []int64
+		expected []WeightT
+	}{
+		{NewStepDecay(2, 0.1), []int64{0, 1, 2, 5}, []WeightT{0.5, 0.5, 0.05, 0.005}},
+		{NewExponentialDecay(0.5), []int64{0, 1, 3}, []WeightT{0.5, 0.25, 0.0625}},
+		{NewInverseTimeDecay(0.5), []int64{0, 2, 6}, []WeightT{0.5, 0.25, 0.125}},
+		{NewCosineAnnealing(4, 0.1), []int64{0, 2, 4, 10}, []WeightT{0.5, 0.3, 0.1, 0.1}},
+		{NewLinearWarmup(0.1, 4, nil), []int64{0, 1, 4, 10}, []WeightT{0.1, 0.2, 0.5, 0.5}},
+		{NewLinearWarmup(0.1, 4, NewExponentialDecay(0.5)), []int64{2, 4, 5}, []WeightT{0.3, 0.5, 0.25}},
+	}
+	for _, test := range tests {
+		state := make([]float64, test.schedule.StateSize())
+		for i, time := range test.times {
+			value := test.schedule.Value(state, base, time)
+			if math.Abs(float64(value-test.expected[i])) > 1e-9 {
+				t.Errorf("Expected %s to be %f at %d but got %f.", test.schedule, test.expected[i], time, value)
+			}
+		}
+	}
+}
+
+func Test_ReduceOnPlateau(t *testing.T) {
+	schedule := NewReduceOnPlateau(0.5, 2, 0.01, 0.2)
+	state := make([]float64, schedule.StateSize())
+	scores := []float64{0.6, 0.7, 0.705, 0.7, 0.8, 0.8, 0.79, 0.8, 0.8}
+	expected := []WeightT{1, 1, 1, 0.5, 0.5, 0.5, 0.25, 0.25, 0.2}
+	for i, score := range scores {
+		schedule.Observe(state, score)
+		if value := schedule.Value(state, 1, 0); value != expected[i] {
+			t.Errorf("Expected rate %f after score %d but got %f.", expected[i], i, value)
+		}
+	}
+
+	//NaN scores are ignored, and the best score keeps its precision.
+	schedule = NewReduceOnPlateau(0.5, 1, 0, 0)
+	state = make([]float64, schedule.StateSize())
+	scores = []float64{math.NaN(), 0.1 + 1e-12, math.NaN(), 0.1 + 2e-12, 0.1 + 2e-12}
+	expected = []WeightT{1, 1, 1, 1, 0.5}
+	for i, score := range scores {
+		schedule.Observe(state, score)
+		if value := schedule.Value(state, 1, 0); value != expected[i] {
+			t.Errorf("Expected rate %f after score %d but got %f.", expected[i], i, value)
+		}
+	}
+	if state[1] != 0.1+2e-12 {
+		t.Errorf("Expected best score %v but got %v.", 0.1+2e-12, state[1])
+	}
+}
+
+func Test_TrainerSchedules(t *testing.T) {
+	trainer := newBatchTestTrainer(getBatchTestData())
+	trainer.SetLearningRateSchedule(NewStepDecay(2, 0.5), KPerUpdate)
+	trainer.SetMomentumSchedule(NewLinearWarmup(0.1, 2, nil), KPerEpoch)
+	if trainer.LearningRate() != 0.1 || trainer.MomentumRate() != 0.1 {
+		t.Errorf("Expected initial rates 0.1 and 0.1 but got %f and %f.",
+			trainer.LearningRate(), trainer.MomentumRate())
+	}
+	trainer.Train()
+	if trainer.schedules.updates != 4 {
+		t.Errorf("Expected 4 updates but got %d.", trainer.schedules.updates)
+	}
+	if math.Abs(float64(trainer.LearningRate()-0.025)) > 1e-9 || math.Abs(float64(trainer.MomentumRate()-0.3)) > 1e-9 {
+		t.Errorf("Expected rates 0.025 and 0.3 after an epoch but got %f and %f.",
+			trainer.LearningRate(), trainer.MomentumRate())
+	}
+}
+
+func Test_CheckpointSchedules(t *testing.T) {
+	train_file := "./schedule_checkpoint.txt"
+	data := getBatchTestData()
+	saveDataToFile(train_file, data)
+	defer os.Remove(train_file)
+	var loaders []*SequentialDataLoader
+	defer func() {
+		for _, loader := range loaders {
+			loader.Close()
+		}
+	}()
+	newTrainer := func() *RBMTrainer {
+		loader := NewInstanceLoader(train_file, 3)
+		loaders = append(loaders, loader)
+		trainer := newBatchTestTrainer(data)
+		trainer.training_data_accessor = loader
+		trainer.SetMaxEpochs(3)
+		return trainer
+	}
+	trainer := newTrainer()
+	trainer.SetLearningRateSchedule(NewReduceOnPlateau(0.5, 1, 0, 0), KPerEpoch)
+	trainer.SetMomentumSchedule(NewExponentialDecay(0.9), KPerUpdate)
+	trainer.Train()
+	var buf bytes.Buffer
+	if err := trainer.SaveCheckpoint(&buf); err != nil {
+		t.Fatalf("Failed to save checkpoint: %s.", err)
+	}
+
+	resumed := newTrainer()
+	resumed.SetLearningRateSchedule(NewReduceOnPlateau(0.5, 1, 0, 0), KPerEpoch)
+	resumed.SetMomentumSchedule(NewExponentialDecay(0.9), KPerUpdate)
+	if err := resumed.LoadCheckpoint(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to load checkpoint: %s.", err)
+	}
+	if !reflect.DeepEqual(resumed.schedules, trainer.schedules) {
+		t.Errorf("Expected schedules\n%v\nbut got\n%v.", trainer.schedules, resumed.schedules)
+	}
+	if resumed.LearningRate() != trainer.LearningRate() || resumed.MomentumRate() != trainer.MomentumRate() {
+		t.Errorf("Expected rates %f and %f but got %f and %f.", trainer.LearningRate(), trainer.MomentumRate(),
+			resumed.LearningRate(), resumed.MomentumRate())
+	}
+
+	mismatched := newTrainer()
+	mismatched.SetMomentumSchedule(NewExponentialDecay(0.9), KPerEpoch)
+	if err := mismatched.LoadCheckpoint(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Errorf("Expected loading a checkpoint with different schedules to fail.")
+	}
+}
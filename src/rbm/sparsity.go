@@ -0,0 +1,103 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Sparsity target of the hidden units.
+//
+// Following section 11 of [1], the trainer keeps an exponentially decaying
+// average q_j of the activation of every hidden unit j in the positive phase,
+//	q_j = decay * q_j + (1 - decay) * P(h_j = 1 | X, y)
+// updated at every training instance, and penalizes the cross entropy
+// between the target t and q_j with the given cost, which adds
+//	-cost * (q_j - t)
+// to the gradient of c[j] and, times the activity of the visible unit, to
+// that of W[c][j][k] for the active values k of X_c.
+
+package rbm
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	KDefaultSparsityDecay = 0.95 //default decay of the average activations of the hidden units
+)
+
+// activityT holds the decaying average activations of the hidden units,
+// which the workers of parallel training share.
+type activityT struct {
+	mutex sync.Mutex
+	q     []WeightT
+}
+
+// SetSparsityTarget makes the trainer penalize hidden units whose average
+// activation q_j, decaying by decay at every training instance, departs from
+// target, with the given cost. A cost of 0, the default, disables the
+// penalty. The averages start at the target.
+func (trainer *RBMTrainer) SetSparsityTarget(target, cost, decay WeightT) {
+	if target <= 0 || target >= 1 || cost < 0 || decay < 0 || decay >= 1 {
+		panic(fmt.Sprintf("Invalid sparsity parameters: target %g, cost %g, decay %g.", target, cost, decay))
+	}
+	param := &trainer.parameters
+	param.sparsity_target = target
+	param.sparsity_cost = cost
+	param.sparsity_decay = decay
+	trainer.activity = nil
+	if cost > 0 {
+		trainer.activity = &activityT{q: make([]WeightT, trainer.rbm.SizeOfHiddenLayer())}
+		for j := range trainer.activity.q {
+			trainer.activity.q[j] = target
+		}
+	}
+}
+
+// HiddenActivity returns the average activations of the hidden units, nil
+// without sparsity target.
+func (trainer *RBMTrainer) HiddenActivity() []WeightT {
+	if trainer.activity == nil {
+		return nil
+	}
+	trainer.activity.mutex.Lock()
+	defer trainer.activity.mutex.Unlock()
+	return append([]WeightT(nil), trainer.activity.q...)
+}
+
+// sparsityPenalties updates the average activations of the hidden units with
+// their activations p_h in the positive phase of an instance, and returns the
+// gradients of the sparsity penalty with respect to their total inputs, all 0
+// without sparsity target.
+func (trainer *RBMTrainer) sparsityPenalties(p_h []WeightT) []WeightT {
+	penalties := make([]WeightT, len(p_h))
+	activity := trainer.activity
+	if activity == nil {
+		return penalties
+	}
+	param := &trainer.parameters
+	activity.mutex.Lock()
+	defer activity.mutex.Unlock()
+	for j, p_hj := range p_h {
+		q_j := param.sparsity_decay*activity.q[j] + (1-param.sparsity_decay)*p_hj
+		activity.q[j] = q_j
+		penalties[j] = -param.sparsity_cost * (q_j - param.sparsity_target)
+	}
+	return penalties
+}
+
+// printHiddenActivity prints the average activation of every hidden unit, if
+// there is a sparsity target.
+func (trainer *RBMTrainer) printHiddenActivity() {
+	q := trainer.HiddenActivity()
+	if q == nil {
+		return
+	}
+	mean := WeightT(0)
+	for _, q_j := range q {
+		mean += q_j
+	}
+	fmt.Printf("Hidden activity (target %f): mean %f,", trainer.parameters.sparsity_target, mean/WeightT(len(q)))
+	for _, q_j := range q {
+		fmt.Printf(" %.3f", q_j)
+	}
+	fmt.Printf("\n")
+}
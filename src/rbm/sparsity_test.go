@@ -0,0 +1,125 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_sparsityPenalties(t *testing.T) {
+	trainer := newBatchTestTrainer(getBatchTestData())
+	if penalties := trainer.sparsityPenalties([]WeightT{0.5, 0.1, 0, 1}); !reflect.DeepEqual(penalties, make([]WeightT, 4)) {
+		t.Errorf("Expected no penalty without sparsity target but got %v.", penalties)
+	}
+	trainer.SetSparsityTarget(0.1, 2, 0.5)
+	penalties := trainer.sparsityPenalties([]WeightT{0.5, 0.1, 0, 1})
+	expected_q := []WeightT{0.3, 0.1, 0.05, 0.55}
+	for j, q_j := range trainer.HiddenActivity() {
+		expected_penalty := -2 * (expected_q[j] - 0.1)
+		if math.Abs(float64(q_j-expected_q[j])) > 1e-9 || math.Abs(float64(penalties[j]-expected_penalty)) > 1e-9 {
+			t.Errorf("Expected activity %f and penalty %f of unit %d but got %f and %f.",
+				expected_q[j], expected_penalty, j, q_j, penalties[j])
+		}
+	}
+}
+
+func Test_SparsityGradient(t *testing.T) {
+	data := getBatchTestData()
+	v, y := &data[0], 1
+	plain := newBatchTestTrainer(data)
+	plain_delta := plain.rbm.NewDeltaT()
+	plain.doInstanceGradient(v, y, plain_delta)
+
+	sparse := newBatchTestTrainer(data)
+	sparse.SetSparsityTarget(0.2, 3, 0)
+	sparse_delta := sparse.rbm.NewDeltaT()
+	sparse.doInstanceGradient(v, y, sparse_delta)
+
+	p_h := make([]WeightT, sparse.rbm.SizeOfHiddenLayer())
+	sparse.rbm.probDistOfHGivenInstance(p_h, v, y)
+	for j, p_hj := range p_h {
+		penalty := -3 * (p_hj - 0.2)
+		if d := sparse_delta.delta_c[j] - plain_delta.delta_c[j]; math.Abs(float64(d-penalty)) > 1e-9 {
+			t.Errorf("Expected penalty %f in delta c[%d] but got %f.", penalty, j, d)
+		}
+	}
+	for i, w := range sparse_delta.delta_w {
+		penalty := -3 * (p_h[w.h_index] - 0.2)
+		if v.x[w.c_index] != w.c_value {
+			penalty = 0
+		}
+		if d := w.delta_v - plain_delta.delta_w[i].delta_v; math.Abs(float64(d-penalty)) > 1e-9 {
+			t.Errorf("Expected penalty %f in delta %v but got %f.", penalty, w, d)
+		}
+	}
+	if !reflect.DeepEqual(sparse_delta.delta_u, plain_delta.delta_u) || sparse_delta.delta_d != plain_delta.delta_d {
+		t.Errorf("Expected the sparsity penalty to leave U and d alone.")
+	}
+}
+
+func Test_SparsityTraining(t *testing.T) {
+	data := getBatchTestData()
+	mean := func(trainer *RBMTrainer) WeightT {
+		sum := WeightT(0)
+		for i := range data {
+			for _, h_j := range trainer.rbm.HiddenFeatures(&data[i]) {
+				sum += h_j
+			}
+		}
+		return sum / WeightT(len(data)*trainer.rbm.SizeOfHiddenLayer())
+	}
+	plain := newBatchTestTrainer(data)
+	plain.SetMaxEpochs(20)
+	plain.Train()
+	sparse := newBatchTestTrainer(data)
+	sparse.SetMaxEpochs(20)
+	sparse.SetSparsityTarget(0.05, 1, KDefaultSparsityDecay)
+	sparse.Train()
+	if mean(sparse) >= mean(plain) {
+		t.Errorf("Expected a sparser hidden layer with the sparsity target but got mean activation %f, %f without.",
+			mean(sparse), mean(plain))
+	}
+}
+
+func Test_CheckpointSparsity(t *testing.T) {
+	train_file := "./sparsity_checkpoint.txt"
+	data := getBatchTestData()
+	saveDataToFile(train_file, data)
+	defer os.Remove(train_file)
+	var loaders []*SequentialDataLoader
+	defer func() {
+		for _, loader := range loaders {
+			loader.Close()
+		}
+	}()
+	newTrainer := func() *RBMTrainer {
+		loader := NewInstanceLoader(train_file, 3)
+		loaders = append(loaders, loader)
+		trainer := newBatchTestTrainer(data)
+		trainer.training_data_accessor = loader
+		return trainer
+	}
+	trainer := newTrainer()
+	trainer.SetSparsityTarget(0.05, 1, 0.9)
+	trainer.Train()
+	var buf bytes.Buffer
+	if err := trainer.SaveCheckpoint(&buf); err != nil {
+		t.Fatalf("Failed to save checkpoint: %s.", err)
+	}
+	resumed := newTrainer()
+	if err := resumed.LoadCheckpoint(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to load checkpoint: %s.", err)
+	}
+	if !reflect.DeepEqual(resumed.parameters, trainer.parameters) {
+		t.Errorf("Expected parameters %v but got %v.", trainer.parameters, resumed.parameters)
+	}
+	if !reflect.DeepEqual(resumed.HiddenActivity(), trainer.HiddenActivity()) {
+		t.Errorf("Expected hidden activity %v but got %v.", trainer.HiddenActivity(), resumed.HiddenActivity())
+	}
+}
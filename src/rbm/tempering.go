@@ -0,0 +1,138 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Parallel tempering.
+//
+// With PT [5], every persistent chain has replicas at a ladder of inverse
+// temperatures 1 = beta_0 > beta_1 > ... > beta_M-1 > 0, the replica at
+// beta_m sampling from the model with its energy multiplied by beta_m, which
+// flattens its modes. After the Gibbs steps of all the replicas, the states
+// of the replicas at beta_m and beta_m+1 are swapped with probability
+//	min(1, exp((beta_m - beta_m+1) * (E(X_m, y_m, h_m) - E(X_m+1, y_m+1, h_m+1))))
+// so that the replica at beta_0, which is the fantasy particle of the
+// negative phase, can jump between the modes the hotter replicas visit.
+// The ladder should be tuned so that the swaps between neighbouring
+// temperatures are accepted often enough, see SwapAcceptanceRates.
+//
+// Reference:
+//  [5]. Desjardins, Courville, Bengio, Vincent, Delalleau, 2010, Tempered
+//  Markov Chain Monte Carlo for training of Restricted Boltzmann Machines
+
+package rbm
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	kDefaultNumTemperatures = 5   //number of inverse temperatures of the default ladder
+	kDefaultMinBeta         = 0.2 //lowest inverse temperature of the default ladder
+)
+
+// LinearTemperatures returns n inverse temperatures evenly spaced between 1
+// and min_beta.
+func LinearTemperatures(n int, min_beta WeightT) []WeightT {
+	if n < 1 || min_beta <= 0 || min_beta > 1 {
+		panic(fmt.Sprintf("Invalid ladder of %d temperatures down to %f.", n, min_beta))
+	}
+	betas := make([]WeightT, n)
+	for m := range betas {
+		betas[m] = 1
+		if m > 0 {
+			betas[m] -= (1 - min_beta) * WeightT(m) / WeightT(n-1)
+		}
+	}
+	return betas
+}
+
+// SetTemperatures sets the inverse temperatures of the replicas of PT, which
+// must decrease from 1 and be positive. By default, there are 5 of them,
+// evenly spaced between 1 and 0.2. Changing the temperatures discards the
+// chains.
+func (trainer *RBMTrainer) SetTemperatures(betas []WeightT) {
+	if len(betas) == 0 || betas[0] != 1 {
+		panic(fmt.Sprintf("Expected inverse temperatures starting from 1 but got %v.", betas))
+	}
+	for m := 1; m < len(betas); m++ {
+		if betas[m] <= 0 || betas[m] >= betas[m-1] {
+			panic(fmt.Sprintf("Expected positive decreasing inverse temperatures but got %v.", betas))
+		}
+	}
+	trainer.parameters.betas = append([]WeightT(nil), betas...)
+	trainer.chains = nil
+}
+
+// temperatures returns the inverse temperatures of the replicas of PT.
+func (param *trainParameters) temperatures() []WeightT {
+	if param.betas == nil {
+		return LinearTemperatures(kDefaultNumTemperatures, kDefaultMinBeta)
+	}
+	return param.betas
+}
+
+// temperingStep advances every replica of particle i by gibbs_chain_length
+// Gibbs steps at its temperature, then proposes to swap the states of the
+// replicas at neighbouring temperatures, from the hottest pair down so that
+// a state can reach beta_0 in one step. h receives the h sampled for the
+// replica at beta_0.
+func (trainer *RBMTrainer) temperingStep(i int, h []WeightT) {
+	rbm := trainer.rbm
+	chains := trainer.chains
+	betas := trainer.parameters.temperatures()
+	replicas := append([]*particleT{chains.particles[i]}, chains.ladders[i]...)
+	hs := make([][]WeightT, len(replicas))
+	energies := make([]WeightT, len(replicas))
+	for m, p := range replicas {
+		hs[m] = make([]WeightT, rbm.SizeOfHiddenLayer())
+		for t := 0; t < trainer.parameters.gibbs_chain_length; t++ {
+			trainer.gibbsStep(p, hs[m], betas[m])
+		}
+		energies[m] = rbm.samplingEnergy(p.v, p.y, p.target, hs[m])
+	}
+	for m := len(replicas) - 2; m >= 0; m-- {
+		chains.swap_attempts[m]++
+		log_r := (betas[m] - betas[m+1]) * (energies[m] - energies[m+1])
+		if log_r >= 0 || randomWeight(trainer.rng) < Exp(log_r) {
+			*replicas[m], *replicas[m+1] = *replicas[m+1], *replicas[m]
+			energies[m], energies[m+1] = energies[m+1], energies[m]
+			hs[m], hs[m+1] = hs[m+1], hs[m]
+			chains.swap_accepts[m]++
+		}
+	}
+	copy(h, hs[0])
+}
+
+// SwapAcceptanceRates returns, for every pair of neighbouring temperatures m
+// and m+1 of PT, the fraction of the proposed swaps between their replicas
+// that have been accepted since the chains started, nil if there is none.
+// Rates close to 0 call for more temperatures, or closer ones, between m and
+// m+1.
+func (trainer *RBMTrainer) SwapAcceptanceRates() []float64 {
+	chains := trainer.chains
+	if chains == nil || len(chains.swap_attempts) == 0 {
+		return nil
+	}
+	rates := make([]float64, len(chains.swap_attempts))
+	for m, attempts := range chains.swap_attempts {
+		if attempts > 0 {
+			rates[m] = float64(chains.swap_accepts[m]) / float64(attempts)
+		}
+	}
+	return rates
+}
+
+// printSwapStats prints the swap acceptance rates of PT, if any.
+func (trainer *RBMTrainer) printSwapStats() {
+	rates := trainer.SwapAcceptanceRates()
+	if rates == nil {
+		return
+	}
+	betas := trainer.parameters.temperatures()
+	fields := make([]string, len(rates))
+	for m, rate := range rates {
+		fields[m] = fmt.Sprintf("%.2f-%.2f: %.3f", betas[m], betas[m+1], rate)
+	}
+	fmt.Printf("Swap acceptance rates: %s\n", strings.Join(fields, ", "))
+}
@@ -0,0 +1,93 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"math"
+	"testing"
+)
+
+func Test_LinearTemperatures(t *testing.T) {
+	expected := []WeightT{1, 0.8, 0.6, 0.4, 0.2}
+	betas := LinearTemperatures(5, 0.2)
+	for m, beta := range betas {
+		if !EqualWithinPrecision(beta, expected[m], kPrecision) {
+			t.Errorf("Expected %v but got %v.", expected, betas)
+			break
+		}
+	}
+	if betas := LinearTemperatures(1, 0.5); len(betas) != 1 || betas[0] != 1 {
+		t.Errorf("Expected [1] but got %v.", betas)
+	}
+}
+
+// Test_samplingEnergy checks that the energy differences match the log odds
+// of the conditional distributions the Gibbs steps sample from.
+func Test_samplingEnergy(t *testing.T) {
+	for _, rbm := range []*SparseClassRBM{getSampleRBMForProbabilityTest(), getSampleMultiClassRBM()} {
+		v := &DataInstance{x: []int{0, 1, 2}}
+		h := []WeightT{1, 0, 1, 0}
+		energy := func(v *DataInstance, y int, h []WeightT) float64 {
+			return float64(rbm.samplingEnergy(v, y, 0, h))
+		}
+
+		p_y := rbm.probDistOfYGivenH(h)
+		if expected, got := math.Log(float64(p_y[1]/p_y[0])), energy(v, 0, h)-energy(v, 1, h); !EqualWithinPrecesionF64(got, expected, kPrecision) {
+			t.Errorf("Expected log odds of y %f but got %f.", expected, got)
+		}
+
+		p_h := rbm.probOfHGivenInstance(1, v, 1)
+		h_1 := []WeightT{1, 1, 1, 0}
+		if expected, got := math.Log(float64(p_h/(1-p_h))), energy(v, 1, h)-energy(v, 1, h_1); !EqualWithinPrecesionF64(got, expected, kPrecision) {
+			t.Errorf("Expected log odds of h_1 %f but got %f.", expected, got)
+		}
+
+		p_x := rbm.probOfXInClassCGivenH(2, h)
+		v_0 := &DataInstance{x: []int{0, 1, 0}}
+		if expected, got := math.Log(float64(p_x[2]/p_x[0])), energy(v_0, 1, h)-energy(v, 1, h); !EqualWithinPrecesionF64(got, expected, kPrecision) {
+			t.Errorf("Expected log odds of X_2 %f but got %f.", expected, got)
+		}
+	}
+}
+
+func Test_ParallelTempering(t *testing.T) {
+	data := getBatchTestData()
+	trainer := newBatchTestTrainer(data)
+	trainer.SetSamplingMethod(KParallelTempering, 2)
+	trainer.SetTemperatures([]WeightT{1, 0.5, 0.25})
+	if trainer.SwapAcceptanceRates() != nil {
+		t.Errorf("Expected no swap before the chains are started.")
+	}
+	deltas := trainer.rbm.newLabelDeltas()
+	for labels := trainer.doGradient(deltas); labels != nil; labels = trainer.doGradient(deltas) {
+	}
+	chains := trainer.chains
+	if len(chains.particles) != 2 || len(chains.ladders) != 2 || len(chains.ladders[0]) != 2 {
+		t.Fatalf("Expected 2 particles with 2 replicas each but got %v.", chains)
+	}
+	for m, attempts := range chains.swap_attempts {
+		if attempts != int64(len(data)) || chains.swap_accepts[m] > attempts {
+			t.Errorf("Expected %d swap proposals between %d and %d but got %d, %d accepted.", len(data),
+				m, m+1, attempts, chains.swap_accepts[m])
+		}
+	}
+	rates := trainer.SwapAcceptanceRates()
+	if len(rates) != 2 || rates[0] < 0 || rates[0] > 1 || rates[1] < 0 || rates[1] > 1 {
+		t.Errorf("Invalid swap acceptance rates %v.", rates)
+	}
+
+	// Swaps between almost equal temperatures are almost always accepted.
+	near := newBatchTestTrainer(data)
+	near.SetSamplingMethod(KParallelTempering, 1)
+	near.SetTemperatures([]WeightT{1, 1 - 1e-9})
+	for i := 0; i < 10; i++ {
+		for labels := near.doGradient(deltas); labels != nil; labels = near.doGradient(deltas) {
+		}
+		near.training_data_accessor.Reset()
+	}
+	if rates := near.SwapAcceptanceRates(); len(rates) != 1 || rates[0] < 0.99 {
+		t.Errorf("Expected swaps to be accepted but got rates %v.", rates)
+	}
+}
@@ -6,6 +6,10 @@ package rbm
 
 import (
 	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
 )
 
 const (
@@ -19,66 +23,259 @@ func (trainer *RBMTrainer) Initialize(rbm *SparseClassRBM,
 	learning_rate WeightT, regularization_rate WeightT,
 	momentum_rate WeightT, gen_learn_importance WeightT, gibbs_chain_length int) {
 	trainer.parameters = trainParameters{
-		learning_rate,
-		regularization_rate,
-		momentum_rate,
-		gen_learn_importance,
-		gibbs_chain_length,
+		learning_rate:        learning_rate,
+		regularization_rate:  regularization_rate,
+		momentum_rate:        momentum_rate,
+		gen_learn_importance: gen_learn_importance,
+		gibbs_chain_length:   gibbs_chain_length,
+		num_particles:        1,
+		fast_learning_rate:   learning_rate,
+		fast_weight_decay:    kDefaultFastWeightDecay,
 	}
 	trainer.rbm = rbm
-	trainer.prev_delta = rbm.CloneEmpty()
+	trainer.SetOptimizer(NewMomentumSGD())
 	trainer.training_data_accessor = train_data_accessor
 	trainer.validation_data_accessor = validation_data_accessor
+	trainer.rng_source = newCountingSource(time.Now().UnixNano())
+	trainer.rng = rand.New(trainer.rng_source)
+	trainer.epoch = 0
+	trainer.instances = 0
+	trainer.prev_auc = 0
+	trainer.best_auc = 0
+	trainer.chains = nil
+	trainer.activity = nil
+	trainer.schedules = &schedulesT{}
+	trainer.updateRates()
 }
 
-// Train an RBM.
+// SetSeed seeds the random number generator used for sampling during
+// training, making training runs reproducible.
+func (trainer *RBMTrainer) SetSeed(seed int64) {
+	trainer.rng_source.Seed(seed)
+}
+
+// SetMaxEpochs limits training to the given number of epochs, 0 means that
+// training only stops on the validation criterion.
+func (trainer *RBMTrainer) SetMaxEpochs(max_epochs int) {
+	trainer.max_epochs = max_epochs
+}
+
+// SetUnsupervisedImportance makes the trainer learn from the unlabeled
+// training instances, whose gradient is that of the generative term
+//	beta * log P(X)
+// y being summed out, see doUnlabeledGradient. Unlabeled instances are
+// skipped with a beta of 0, the default. Regression models have no
+// unlabeled instances.
+func (trainer *RBMTrainer) SetUnsupervisedImportance(beta WeightT) {
+	if beta < 0 {
+		panic(fmt.Sprintf("Expected a non-negative importance but got %f.", beta))
+	}
+	trainer.parameters.unsup_importance = beta
+}
+
+// SetCheckpoint makes the trainer save a checkpoint to the given file every
+// interval training instances and at the end of every epoch. An interval of
+// 0 disables the intra-epoch checkpoints.
+func (trainer *RBMTrainer) SetCheckpoint(filename string, interval int) {
+	trainer.checkpoint_file = filename
+	trainer.checkpoint_interval = interval
+}
+
+// SetLearnVariance makes the trainer learn the standard deviations of the
+// Gaussian classes, which are kept fixed otherwise.
+func (trainer *RBMTrainer) SetLearnVariance(learn_variance bool) {
+	trainer.learn_variance = learn_variance
+}
+
+// SetBatchSize makes the trainer update the model once every batch_size
+// training instances, with the mean of their gradients; the gradient of an
+// instance still being the sum of those of its labels scaled by their counts.
+// As the learning rate applies to the mean gradient, the size of the updates
+// does not grow with the batch size but there are batch_size times fewer of
+// them per epoch; the regularization and the momentum are applied once per
+// update. The last batch of an epoch may be smaller. A batch size of 1, the
+// default, updates the model with the gradient of each label of every
+// instance in turn.
+func (trainer *RBMTrainer) SetBatchSize(batch_size int) {
+	if batch_size < 1 {
+		panic(fmt.Sprintf("Expected a positive batch size but got %d.", batch_size))
+	}
+	trainer.batch_size = batch_size
+}
+
+// BatchSize returns the number of training instances per model update.
+func (trainer *RBMTrainer) BatchSize() int {
+	if trainer.batch_size < 1 {
+		return 1
+	}
+	return trainer.batch_size
+}
+
+// Train an RBM. With more than one worker (see SetNumWorkers), the epochs
+// are run by workers in parallel.
 func (trainer *RBMTrainer) Train() {
-	pos_delta := trainer.rbm.NewDeltaT()
-	neg_delta := trainer.rbm.NewDeltaT()
-	prev_auc := float64(0)
-	epoch := 0
-	use_validation_auc_stop := false
-	for {
-		has_pos, has_neg := trainer.doGradient(pos_delta, neg_delta)
-		if has_pos {
-			trainer.updateModel(pos_delta)
+	if trainer.num_workers > 1 {
+		if shards := trainer.trainingShards(); shards != nil {
+			trainer.trainParallel(shards)
+			return
 		}
-		if has_neg {
-			trainer.updateModel(neg_delta)
-		}
-		if !has_pos && !has_neg {
-			auc := ROCAuc(trainer.rbm, trainer.validation_data_accessor)
-			log_likelihood := LogLikelihood(trainer.rbm, trainer.training_data_accessor)
-			//TODO(weidoliang): output various model statistics.
-			fmt.Printf("Epoch: %d\n", epoch)
-			fmt.Printf("Training LogLikelihood: %f\n", log_likelihood)
-			fmt.Printf("Validation AUC: %f\n", auc)
-			trainer.ModelStats()
-			if use_validation_auc_stop && auc-prev_auc < KMinDeltaAUC {
+	}
+	deltas := trainer.rbm.newLabelDeltas()
+	batch := trainer.rbm.newBatchDelta()
+	epoch_start, epoch_instances := time.Now(), int64(0)
+	for trainer.max_epochs <= 0 || trainer.epoch < trainer.max_epochs {
+		labels := trainer.doGradient(deltas)
+		if len(labels) > 0 {
+			trainer.addInstance(batch, deltas, labels)
+			trainer.instances++
+			epoch_instances++
+			if batch.instances >= trainer.BatchSize() {
+				trainer.applyBatch(batch)
+			}
+		} else {
+			trainer.applyBatch(batch)
+			if !trainer.endEpoch(epoch_instances, time.Since(epoch_start), trainer.training_data_accessor.Reset) {
 				break
-			} else {
-				trainer.training_data_accessor.Reset()
 			}
-			epoch++
-			prev_auc = auc
+			epoch_start, epoch_instances = time.Now(), 0
 		}
 	}
 }
 
+// endEpoch evaluates and reports the epoch that just ended, in which the given
+// number of training instances have been processed, then resets the training
+// data with reset and saves a checkpoint. It returns false if training should
+// stop.
+func (trainer *RBMTrainer) endEpoch(instances int64, elapsed time.Duration, reset func()) bool {
+	use_validation_auc_stop := false
+	auc := trainer.validationScore()
+	if trainer.epoch == 0 || auc > trainer.best_auc {
+		trainer.best_auc = auc
+	}
+	//TODO(weidoliang): output various model statistics.
+	fmt.Printf("Epoch: %d\n", trainer.epoch)
+	trainer.printEpochMetrics(auc)
+	fmt.Printf("Throughput: %d instances in %.3fs, %.1f instances/s, %d workers\n", instances,
+		elapsed.Seconds(), float64(instances)/math.Max(elapsed.Seconds(), 1e-9), trainer.NumWorkers())
+	fmt.Printf("Learning rate: %f, momentum: %f\n", trainer.learning_rate, trainer.momentum_rate)
+	trainer.printSwapStats()
+	trainer.ModelStats()
+	trainer.schedules.observe(auc)
+	if use_validation_auc_stop && auc-trainer.prev_auc < KMinDeltaAUC {
+		return false
+	}
+	reset()
+	trainer.epoch++
+	trainer.prev_auc = auc
+	trainer.updateRates()
+	trainer.saveCheckpoint()
+	return true
+}
+
+// validationScore returns the score of the model on the validation data used
+// for model selection: the AUC for binary models, the macro AUC for
+// multi-class models and the negative RMSE for regression models.
+func (trainer *RBMTrainer) validationScore() float64 {
+	switch {
+	case trainer.rbm.IsRegression():
+		return -RegressionRMSE(trainer.rbm, trainer.validation_data_accessor)
+	case trainer.rbm.IsMultiClass():
+		return MacroAUC(trainer.rbm, trainer.validation_data_accessor)
+	}
+	return ROCAuc(trainer.rbm, trainer.validation_data_accessor)
+}
+
+// printEpochMetrics prints the training metric and the validation score of
+// the current epoch, along with the pseudo log-likelihood and the
+// reconstruction error of the training data if the generative term is
+// learned.
+func (trainer *RBMTrainer) printEpochMetrics(score float64) {
+	switch {
+	case trainer.rbm.IsRegression():
+		rmse := RegressionRMSE(trainer.rbm, trainer.training_data_accessor)
+		fmt.Printf("Training RMSE: %f\n", rmse)
+		fmt.Printf("Validation RMSE: %f (best %f)\n", -score, -trainer.best_auc)
+	case trainer.rbm.IsMultiClass():
+		log_likelihood := MultiClassLogLikelihood(trainer.rbm, trainer.training_data_accessor)
+		fmt.Printf("Training LogLikelihood: %f\n", log_likelihood)
+		fmt.Printf("Validation Macro AUC: %f (best %f)\n", score, trainer.best_auc)
+	default:
+		log_likelihood := LogLikelihood(trainer.rbm, trainer.training_data_accessor)
+		fmt.Printf("Training LogLikelihood: %f\n", log_likelihood)
+		fmt.Printf("Validation AUC: %f (best %f)\n", score, trainer.best_auc)
+	}
+	if trainer.parameters.gen_learn_importance > 0 {
+		pseudo_loglikelihood := PseudoLogLikelihood(trainer.rbm, trainer.training_data_accessor)
+		fmt.Printf("Training PseudoLogLikelihood: %f\n", pseudo_loglikelihood)
+		reconstruction_error := ReconstructionError(trainer.rbm, trainer.training_data_accessor)
+		fmt.Printf("Training Reconstruction Error: %f\n", reconstruction_error)
+	}
+}
+
+// saveCheckpoint writes a checkpoint if checkpointing has been enabled.
+// Failures are logged but do not interrupt training.
+func (trainer *RBMTrainer) saveCheckpoint() {
+	if trainer.checkpoint_file == "" {
+		return
+	}
+	if err := trainer.SaveCheckpointToFile(trainer.checkpoint_file); err != nil {
+		log.Printf("Failed to save checkpoint: %s.", err)
+	}
+}
+
 func (trainer *RBMTrainer) ModelStats() {
 	w_sparsity := trainer.rbm.SparsityOfW()
 	u_sparsity := trainer.rbm.SparsityOfU()
 	fmt.Printf("Sparsity: \nW: %f\nU: %f\n", w_sparsity, u_sparsity)
+	fmt.Printf("Visible biases: %s, %d parameters\n", trainer.rbm.BiasParameterization(),
+		trainer.rbm.NumOfVisibleBiases())
+	trainer.printHiddenActivity()
 }
 
+// Method IsValidInput determines whether the instance can be used with the
+// model. Unlabeled instances of classification models are valid, see
+// isUnlabeled.
 func (rbm *SparseClassRBM) IsValidInput(instance DataInstance) bool {
-	if (instance.pos_y < 0 || instance.neg_y < 0) ||
-		(instance.pos_y == 0 && instance.neg_y == 0) {
+	if rbm.IsRegression() {
+		if math.IsNaN(float64(instance.target)) || math.IsInf(float64(instance.target), 0) {
+			return false
+		}
+	} else if rbm.IsMultiClass() {
+		if len(instance.y_counts) != rbm.NumOfLabels() {
+			return false
+		}
+		for _, n := range instance.y_counts {
+			if n < 0 {
+				return false
+			}
+		}
+	} else if instance.pos_y < 0 || instance.neg_y < 0 {
+		return false
+	}
+	if len(instance.x) != rbm.NumOfVisibleClasses() {
 		return false
 	}
 	for i := 0; i < rbm.NumOfVisibleClasses(); i++ {
-		if instance.x[i] >= rbm.ClassSize(i) {
-			return false
+		if instance.x[i] == KMissingValue {
+			continue
+		}
+		if rbm.isGaussian(i) {
+			if len(instance.x_real) != rbm.NumOfVisibleClasses() ||
+				math.IsNaN(float64(instance.x_real[i])) || math.IsInf(float64(instance.x_real[i]), 0) {
+				return false
+			}
+			continue
+		}
+		if !rbm.isMultiValued(i) {
+			if instance.x[i] < 0 || instance.x[i] >= rbm.ClassSize(i) {
+				return false
+			}
+			continue
+		}
+		for _, k := range instance.bag(i) {
+			if k < 0 || k >= rbm.ClassSize(i) {
+				return false
+			}
 		}
 	}
 	return true
@@ -43,21 +43,21 @@ func Test_Training(t *testing.T) {
 	// functions and generates Y based on conjunctive-disjunction of the values of Xs.
 	train_data := []DataInstance{
 		{
-			[]int{0, 1, 1, 1},
-			2,
-			1,
+			x:     []int{0, 1, 1, 1},
+			pos_y: 2,
+			neg_y: 1,
 		}, {
-			[]int{1, 2, 1, 0},
-			0,
-			1,
+			x:     []int{1, 2, 1, 0},
+			pos_y: 0,
+			neg_y: 1,
 		}, {
-			[]int{1, 0, 3, 4},
-			1,
-			0,
+			x:     []int{1, 0, 3, 4},
+			pos_y: 1,
+			neg_y: 0,
 		}, {
-			[]int{1, 2, 3, 2},
-			10,
-			2,
+			x:     []int{1, 2, 3, 2},
+			pos_y: 10,
+			neg_y: 2,
 		},
 	}
 
@@ -79,6 +79,7 @@ func Test_Training(t *testing.T) {
 	var trainer RBMTrainer
 	trainer.Initialize(&rbm, train_data_accessor, test_data_accessor,
 		0.01, 0.2, 0.9, 0.3, 1)
+	trainer.SetMaxEpochs(1)
 
 	trainer.Train()
 
@@ -0,0 +1,297 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Vocabulary of raw feature values.
+
+package rbm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	KOutOfVocabulary = 0 //value index of unknown and rare feature values
+
+	kVocabularyHeader  = "#SCRBMVOCAB"
+	kVocabularyVersion = 1
+)
+
+// FeatureEncoder maps the raw string values of each feature class to the
+// integer values used by a SparseClassRBM.
+type FeatureEncoder interface {
+	// NumOfClasses returns the number of feature classes.
+	NumOfClasses() int
+	// ClassSizes returns the number of distinct encoded values of each class.
+	ClassSizes() []int
+	// Encode maps the raw value of the given class to [0, ClassSizes()[class_id]).
+	Encode(class_id int, value string) int
+}
+
+// Vocabulary implements FeatureEncoder by assigning a dense index to every
+// value of a feature class that occurred at least min_count times in the
+// data it was built from. Index KOutOfVocabulary of every class is reserved
+// for values outside of the vocabulary; absent classes are KMissingValue.
+type Vocabulary struct {
+	min_count int
+	classes   []vocabularyClass
+}
+
+type vocabularyClass struct {
+	indices map[string]int //value to index
+	values  []string       //index to value, values[KOutOfVocabulary] is ""
+	counts  []int          //number of occurrences of each value in the source data
+}
+
+// BuildVocabulary scans the given data file and builds a vocabulary with all
+// the values that occur at least min_count times. The number of feature
+// classes is one more than the largest class id found. Lines that cannot be
+// parsed are skipped.
+func BuildVocabulary(filename string, min_count int) (*Vocabulary, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var counts []map[string]int
+	reader := bufio.NewReader(file)
+	for line_no := 1; ; line_no++ {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %s.", filename, err)
+		}
+		_, features, err := parseInstanceLine(line)
+		if err != nil {
+			log.Printf("Skipping line %d of %s: %s", line_no, filename, err)
+			continue
+		}
+		for _, f := range features {
+			for f.class_id >= len(counts) {
+				counts = append(counts, make(map[string]int))
+			}
+			counts[f.class_id][f.value]++
+		}
+	}
+	return newVocabulary(counts, min_count), nil
+}
+
+// newVocabulary creates a vocabulary from the value counts of each class.
+// Values are indexed in the order of decreasing count, ties are broken by
+// the values themselves so that the result is deterministic.
+func newVocabulary(counts []map[string]int, min_count int) *Vocabulary {
+	vocabulary := &Vocabulary{min_count, make([]vocabularyClass, len(counts))}
+	for c, class_counts := range counts {
+		oov_count := 0
+		var values []string
+		for v, n := range class_counts {
+			if n >= min_count {
+				values = append(values, v)
+			} else {
+				oov_count += n
+			}
+		}
+		sort.Sort(valuesByCount{values, class_counts})
+		class := newVocabularyClass(len(values) + 1)
+		class.counts[KOutOfVocabulary] = oov_count
+		for _, v := range values {
+			class.add(v, class_counts[v])
+		}
+		vocabulary.classes[c] = class
+	}
+	return vocabulary
+}
+
+// valuesByCount sorts values in the order of decreasing count and then
+// increasing value.
+type valuesByCount struct {
+	values []string
+	counts map[string]int
+}
+
+func (v valuesByCount) Len() int {
+	return len(v.values)
+}
+
+func (v valuesByCount) Swap(i, j int) {
+	v.values[i], v.values[j] = v.values[j], v.values[i]
+}
+
+func (v valuesByCount) Less(i, j int) bool {
+	n_i, n_j := v.counts[v.values[i]], v.counts[v.values[j]]
+	if n_i != n_j {
+		return n_i > n_j
+	}
+	return v.values[i] < v.values[j]
+}
+
+func newVocabularyClass(capacity int) vocabularyClass {
+	return vocabularyClass{
+		make(map[string]int, capacity),
+		append(make([]string, 0, capacity), ""),
+		append(make([]int, 0, capacity), 0),
+	}
+}
+
+func (class *vocabularyClass) add(value string, count int) {
+	class.indices[value] = len(class.values)
+	class.values = append(class.values, value)
+	class.counts = append(class.counts, count)
+}
+
+// NumOfClasses returns the number of feature classes.
+func (vocabulary *Vocabulary) NumOfClasses() int {
+	return len(vocabulary.classes)
+}
+
+// ClassSizes returns the number of values of each class, including the
+// out-of-vocabulary value; it can be used as the feature_classes argument of
+// SparseClassRBM.Initialize.
+func (vocabulary *Vocabulary) ClassSizes() []int {
+	sizes := make([]int, len(vocabulary.classes))
+	for c, class := range vocabulary.classes {
+		sizes[c] = len(class.values)
+	}
+	return sizes
+}
+
+// Encode returns the index of the given value, or KOutOfVocabulary if the
+// value is not in the vocabulary.
+func (vocabulary *Vocabulary) Encode(class_id int, value string) int {
+	if class_id < 0 || class_id >= len(vocabulary.classes) {
+		return KOutOfVocabulary
+	}
+	if index, ok := vocabulary.classes[class_id].indices[value]; ok {
+		return index
+	}
+	return KOutOfVocabulary
+}
+
+// Decode returns the raw value of the given index, "" for KOutOfVocabulary.
+func (vocabulary *Vocabulary) Decode(class_id, index int) string {
+	return vocabulary.classes[class_id].values[index]
+}
+
+// Count returns the number of occurrences of the value of the given index in
+// the data the vocabulary was built from. For KOutOfVocabulary, it is the
+// number of occurrences of the values that have been cut off.
+func (vocabulary *Vocabulary) Count(class_id, index int) int {
+	return vocabulary.classes[class_id].counts[index]
+}
+
+// Save writes the vocabulary in a tab separated text format:
+//  #SCRBMVOCAB \t version \t num_classes \t min_count
+//  class_id \t index \t count \t value
+//  ...
+// Feature values never contain tabs or newlines as those separate the fields
+// of the data files.
+func (vocabulary *Vocabulary) Save(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	fmt.Fprintf(writer, "%s\t%d\t%d\t%d\n", kVocabularyHeader, kVocabularyVersion,
+		len(vocabulary.classes), vocabulary.min_count)
+	for c, class := range vocabulary.classes {
+		for i, v := range class.values {
+			fmt.Fprintf(writer, "%d\t%d\t%d\t%s\n", c, i, class.counts[i], v)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("Failed to save vocabulary: %s.", err)
+	}
+	return nil
+}
+
+// LoadVocabulary reads a vocabulary written by Vocabulary.Save.
+func LoadVocabulary(r io.Reader) (*Vocabulary, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("Failed to load vocabulary: missing header.")
+	}
+	header := strings.Split(scanner.Text(), "\t")
+	if len(header) != 4 || header[0] != kVocabularyHeader {
+		return nil, fmt.Errorf("Failed to load vocabulary: invalid header %q.", scanner.Text())
+	}
+	version, err_v := strconv.Atoi(header[1])
+	num_classes, err_n := strconv.Atoi(header[2])
+	min_count, err_m := strconv.Atoi(header[3])
+	if err_v != nil || err_n != nil || err_m != nil || num_classes < 0 {
+		return nil, fmt.Errorf("Failed to load vocabulary: invalid header %q.", scanner.Text())
+	}
+	if version != kVocabularyVersion {
+		return nil, fmt.Errorf("Failed to load vocabulary: unsupported version %d, expected %d.",
+			version, kVocabularyVersion)
+	}
+
+	vocabulary := &Vocabulary{min_count, make([]vocabularyClass, num_classes)}
+	for c := range vocabulary.classes {
+		vocabulary.classes[c] = newVocabularyClass(1)
+	}
+	for line_no := 2; scanner.Scan(); line_no++ {
+		fields := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Failed to load vocabulary: invalid line %d.", line_no)
+		}
+		c, err_c := strconv.Atoi(fields[0])
+		index, err_i := strconv.Atoi(fields[1])
+		count, err_n := strconv.Atoi(fields[2])
+		if err_c != nil || err_i != nil || err_n != nil || c < 0 || c >= num_classes {
+			return nil, fmt.Errorf("Failed to load vocabulary: invalid line %d.", line_no)
+		}
+		class := &vocabulary.classes[c]
+		if index == KOutOfVocabulary {
+			class.counts[KOutOfVocabulary] = count
+			continue
+		}
+		if index != len(class.values) {
+			return nil, fmt.Errorf("Failed to load vocabulary: line %d, expected index %d of class %d but got %d.",
+				line_no, len(class.values), c, index)
+		}
+		if _, ok := class.indices[fields[3]]; ok {
+			return nil, fmt.Errorf("Failed to load vocabulary: line %d, duplicated value %q.",
+				line_no, fields[3])
+		}
+		class.add(fields[3], count)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to load vocabulary: %s.", err)
+	}
+	return vocabulary, nil
+}
+
+// VocabularyFilename returns the name of the vocabulary file that goes with
+// the given model file.
+func VocabularyFilename(model_file string) string {
+	return model_file + ".vocab"
+}
+
+// SaveToFile saves the vocabulary to the file of the given name.
+func (vocabulary *Vocabulary) SaveToFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := vocabulary.Save(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadVocabularyFromFile loads a vocabulary from the file of the given name.
+func LoadVocabularyFromFile(filename string) (*Vocabulary, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadVocabulary(file)
+}
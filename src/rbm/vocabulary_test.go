@@ -0,0 +1,118 @@
+// Copyright 2013 Weidong Liang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rbm
+
+import (
+	"bufio"
+	"bytes"
+	"common/util"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func saveLinesToFile(filename string, lines []string) error {
+	return util.WithNewOpenFileAsBufioWriter(filename,
+		func(w *bufio.Writer) error {
+			for _, l := range lines {
+				fmt.Fprintln(w, l)
+			}
+			return nil
+		})
+}
+
+func Test_Vocabulary(t *testing.T) {
+	data_file := "test_vocabulary.dat"
+	lines := []string{
+		"1\t0\t0:a\t1:55741475-2\t3:246_237_165",
+		"0\t1\t0:b\t1:55741475-2\t3:41-149660412063915533",
+		"0\t2\t0:a\t1:20157108-1\t3:246_237_165",
+		"invalid line",
+		"1\t1\t0:a\t1:20157108-1",
+	}
+	if err := saveLinesToFile(data_file, lines); err != nil {
+		t.Fatalf("Failed to create test file: %s.", err)
+	}
+	defer os.Remove(data_file)
+
+	vocabulary, err := BuildVocabulary(data_file, 2)
+	if err != nil {
+		t.Fatalf("Failed to build vocabulary: %s.", err)
+	}
+	expected_sizes := []int{2, 3, 1, 2}
+	if sizes := vocabulary.ClassSizes(); !reflect.DeepEqual(sizes, expected_sizes) {
+		t.Errorf("Expected class sizes %v but got %v.", expected_sizes, sizes)
+	}
+
+	test_cases := []struct {
+		class_id int
+		value    string
+		index    int
+		count    int
+	}{
+		{0, "a", 1, 3},
+		{0, "b", KOutOfVocabulary, 1},
+		{1, "20157108-1", 1, 2},
+		{1, "55741475-2", 2, 2},
+		{3, "246_237_165", 1, 2},
+		{3, "41-149660412063915533", KOutOfVocabulary, 1},
+		{2, "never seen", KOutOfVocabulary, 0},
+		{7, "unknown class", KOutOfVocabulary, 0},
+	}
+	for i, t_case := range test_cases {
+		index := vocabulary.Encode(t_case.class_id, t_case.value)
+		if index != t_case.index {
+			t.Errorf("TestCase #%d: expected index %d but got %d.", i, t_case.index, index)
+		}
+		if t_case.class_id < vocabulary.NumOfClasses() &&
+			vocabulary.Count(t_case.class_id, index) != t_case.count {
+			t.Errorf("TestCase #%d: expected count %d but got %d.", i, t_case.count,
+				vocabulary.Count(t_case.class_id, index))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := vocabulary.Save(&buf); err != nil {
+		t.Fatalf("Failed to save vocabulary: %s.", err)
+	}
+	loaded, err := LoadVocabulary(&buf)
+	if err != nil {
+		t.Fatalf("Failed to load vocabulary: %s.", err)
+	}
+	if !reflect.DeepEqual(vocabulary, loaded) {
+		t.Errorf("Expected loaded vocabulary\n%v\nto be equal to\n%v.", loaded, vocabulary)
+	}
+
+	loader := NewEncodedInstanceLoader(data_file, vocabulary)
+	defer loader.Close()
+	expected := []DataInstance{
+		{x: []int{1, 2, KMissingValue, 1}, pos_y: 1, neg_y: 0},
+		{x: []int{0, 2, KMissingValue, 0}, pos_y: 0, neg_y: 1},
+		{x: []int{1, 1, KMissingValue, 1}, pos_y: 0, neg_y: 2},
+	}
+	for i, e := range expected {
+		instance, err := loader.NextInstance()
+		if err != nil || !instance.Equal(&e) {
+			t.Errorf("Instance #%d: expected %v but got %v, %v.", i, e, instance, err)
+		}
+	}
+}
+
+func Test_LoadVocabularyRejectsInvalidInput(t *testing.T) {
+	test_cases := []string{
+		"",
+		"#SOMETHING\t1\t1\t1\n",
+		"#SCRBMVOCAB\t2\t1\t1\n",
+		"#SCRBMVOCAB\t1\t1\t1\n0\t2\t5\tb\n",
+		"#SCRBMVOCAB\t1\t1\t1\n1\t1\t5\tb\n",
+		"#SCRBMVOCAB\t1\t1\t1\n0\t1\t5\tb\n0\t2\t5\tb\n",
+	}
+	for i, t_case := range test_cases {
+		if _, err := LoadVocabulary(bytes.NewBufferString(t_case)); err == nil {
+			t.Errorf("TestCase #%d: expected error.", i)
+		}
+	}
+}